@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/D8-X/d8x-broker-server/src/env"
+	"github.com/D8-X/d8x-broker-server/src/utils"
+	"github.com/redis/rueidis"
+)
+
+func usage() {
+	fmt.Println("Usage (REDIS_ADDR and REDIS_PW from environment):")
+	fmt.Println("apikey issue -label <label> -scopes <scope,...>")
+	fmt.Println("apikey revoke <id>")
+	fmt.Println("apikey list")
+	fmt.Println("Scopes: " + strings.Join(utils.ApiKeyScopes, ","))
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		return
+	}
+	client, err := rueidis.NewClient(rueidis.ClientOption{
+		InitAddress: []string{os.Getenv(env.REDIS_ADDR)},
+		Password:    os.Getenv(env.REDIS_PW),
+	})
+	if err != nil {
+		fmt.Println("Error connecting to redis:", err)
+		os.Exit(1)
+	}
+	defer client.Close()
+	r := &utils.RueidisClient{Client: &client, Ctx: context.Background()}
+
+	switch os.Args[1] {
+	case "issue":
+		fs := flag.NewFlagSet("issue", flag.ExitOnError)
+		label := fs.String("label", "", "description of the key owner")
+		scopes := fs.String("scopes", "", "comma separated scopes")
+		fs.Parse(os.Args[2:])
+		key, err := r.IssueApiKey(*label, strings.Split(*scopes, ","))
+		if err != nil {
+			fmt.Println("Error issuing key:", err)
+			os.Exit(1)
+		}
+		fmt.Println("id:     " + key.Id)
+		fmt.Println("secret: " + key.Secret)
+		fmt.Println("scopes: " + strings.Join(key.Scopes, ","))
+		fmt.Println("Store the secret now, it is not shown again")
+	case "revoke":
+		if len(os.Args) != 3 {
+			usage()
+			os.Exit(1)
+		}
+		err := r.RevokeApiKey(os.Args[2])
+		if err != nil {
+			fmt.Println("Error revoking key:", err)
+			os.Exit(1)
+		}
+		fmt.Println("revoked " + os.Args[2])
+	case "list":
+		keys, err := r.ListApiKeys()
+		if err != nil {
+			fmt.Println("Error listing keys:", err)
+			os.Exit(1)
+		}
+		for _, k := range keys {
+			fmt.Printf("%s\t%s\t%s\t%s\n", k.Id, time.Unix(k.Created, 0).UTC().Format(time.RFC3339),
+				strings.Join(k.Scopes, ","), k.Label)
+		}
+	default:
+		usage()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"github.com/D8-X/d8x-broker-server/src/utils"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// mocksigner serves the remote signer and the JSON-RPC signer protocol
+// with an in-memory key, for testing SIGNER_TYPE=remote|jsonrpc offline
+func main() {
+	addr := flag.String("addr", "127.0.0.1:8555", "listen address")
+	token := flag.String("token", "", "bearer token required from clients (optional)")
+	flag.Parse()
+
+	pk := os.Getenv("PK")
+	if pk == "" {
+		slog.Error("Private key not set in environment (export PK)")
+		return
+	}
+	key, err := crypto.HexToECDSA(pk)
+	if err != nil {
+		slog.Error("invalid private key: " + err.Error())
+		return
+	}
+	slog.Info("mock signer listening on "+*addr, "signer", crypto.PubkeyToAddress(key.PublicKey).Hex())
+	err = http.ListenAndServe(*addr, utils.NewMockSigner(key, *token))
+	if err != nil {
+		slog.Error("mock signer: " + err.Error())
+	}
+}
@@ -0,0 +1,212 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/D8-X/d8x-broker-server/src/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/go-chi/chi/v5"
+)
+
+// adminAuth requires the admin api key as bearer token
+func (a *App) adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), []byte(a.AdminApiKey)) != 1 {
+			http.Error(w, string(formatError("unauthorized")), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SeedExecutors initializes the live executor whitelist in Redis with the
+// executors from the config file (first start only)
+func (a *App) SeedExecutors() error {
+	var errs []error
+	for _, conf := range a.Pen.GetChainConfigs() {
+		seeded, err := a.RedisClient.SeedExecutors(conf.ChainId, conf.AllowedExecutors)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("seeding executors for chain %d: %s", conf.ChainId, err.Error()))
+			continue
+		}
+		if seeded {
+			slog.Info("executor whitelist seeded from config", "chainId", conf.ChainId, "executors", len(conf.AllowedExecutors))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SyncExecutors applies executors added to or removed from the config file
+// to the live whitelist
+func (a *App) SyncExecutors(old []utils.ChainConfig, new map[int64]utils.ChainConfig) {
+	oldMap := make(map[int64]utils.ChainConfig)
+	for _, conf := range old {
+		oldMap[conf.ChainId] = conf
+	}
+	for chainId, conf := range new {
+		prev, exists := oldMap[chainId]
+		if !exists {
+			_, err := a.RedisClient.SeedExecutors(chainId, conf.AllowedExecutors)
+			if err != nil {
+				slog.Error(fmt.Sprintf("seeding executors for chain %d: %s", chainId, err.Error()))
+			}
+			continue
+		}
+		var added, removed []common.Address
+		for _, e := range conf.AllowedExecutors {
+			if !slices.Contains(prev.AllowedExecutors, e) {
+				added = append(added, e)
+			}
+		}
+		for _, e := range prev.AllowedExecutors {
+			if !slices.Contains(conf.AllowedExecutors, e) {
+				removed = append(removed, e)
+			}
+		}
+		err := a.RedisClient.AddExecutors(chainId, added)
+		if err == nil {
+			err = a.RedisClient.RemoveExecutors(chainId, removed)
+		}
+		if err != nil {
+			slog.Error(fmt.Sprintf("syncing executors for chain %d: %s", chainId, err.Error()))
+		}
+	}
+}
+
+// isExecutorAllowed checks the live whitelist. Executors are not allowed if
+// Redis is not available, the config file may list removed executors
+func (a *App) isExecutorAllowed(chainId int64, executor common.Address) bool {
+	if _, exists := a.Pen.GetChainConfig(chainId); !exists {
+		return false
+	}
+	allowed, err := a.RedisClient.IsExecutorAllowed(chainId, executor)
+	if err != nil {
+		slog.Error("checking executor whitelist: " + err.Error())
+		return false
+	}
+	return allowed
+}
+
+// parseExecutorPath reads chainId and (optional) executor address from
+// the url path
+func (a *App) parseExecutorPath(r *http.Request, withAddr bool) (int64, common.Address, error) {
+	chainId, err := strconv.ParseInt(chi.URLParam(r, "chainId"), 10, 64)
+	if err != nil {
+		return 0, common.Address{}, fmt.Errorf("invalid chainId")
+	}
+	if _, exists := a.Pen.GetChainConfig(chainId); !exists {
+		return 0, common.Address{}, fmt.Errorf("chain %d not configured", chainId)
+	}
+	if !withAddr {
+		return chainId, common.Address{}, nil
+	}
+	addr := chi.URLParam(r, "address")
+	if !common.IsHexAddress(addr) {
+		return 0, common.Address{}, fmt.Errorf("invalid executor address")
+	}
+	return chainId, common.HexToAddress(addr), nil
+}
+
+func (a *App) AdminGetExecutors(w http.ResponseWriter, r *http.Request) {
+	chainId, _, err := a.parseExecutorPath(r, false)
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusBadRequest)
+		return
+	}
+	executors, err := a.RedisClient.GetExecutors(chainId)
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusInternalServerError)
+		return
+	}
+	jsonResponse, err := json.Marshal(executors)
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonResponse)
+}
+
+func (a *App) AdminAddExecutor(w http.ResponseWriter, r *http.Request) {
+	chainId, addr, err := a.parseExecutorPath(r, true)
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusBadRequest)
+		return
+	}
+	err = a.RedisClient.AddExecutors(chainId, []common.Address{addr})
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("admin: executor added", "chainId", chainId, "executor", addr.Hex())
+	fmt.Fprint(w, `{"executor": "added"}`)
+}
+
+func (a *App) AdminRemoveExecutor(w http.ResponseWriter, r *http.Request) {
+	chainId, addr, err := a.parseExecutorPath(r, true)
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusBadRequest)
+		return
+	}
+	err = a.RedisClient.RemoveExecutors(chainId, []common.Address{addr})
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("admin: executor removed", "chainId", chainId, "executor", addr.Hex())
+	fmt.Fprint(w, `{"executor": "removed"}`)
+}
+
+func (a *App) AdminSuspendExecutor(w http.ResponseWriter, r *http.Request) {
+	chainId, addr, err := a.parseExecutorPath(r, true)
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusBadRequest)
+		return
+	}
+	var jsonData []byte
+	if r.Body != nil {
+		defer r.Body.Close()
+		jsonData, _ = io.ReadAll(r.Body)
+	}
+	var req struct {
+		DurationSec int64 `json:"durationSec"`
+	}
+	err = json.Unmarshal(jsonData, &req)
+	if err != nil || req.DurationSec <= 0 {
+		http.Error(w, string(formatError(`Wrong argument types. Usage: {"durationSec": 3600}`)), http.StatusBadRequest)
+		return
+	}
+	err = a.RedisClient.SuspendExecutor(chainId, addr, time.Duration(req.DurationSec)*time.Second)
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusBadRequest)
+		return
+	}
+	slog.Info("admin: executor suspended", "chainId", chainId, "executor", addr.Hex(), "durationSec", req.DurationSec)
+	fmt.Fprint(w, `{"executor": "suspended"}`)
+}
+
+func (a *App) AdminResumeExecutor(w http.ResponseWriter, r *http.Request) {
+	chainId, addr, err := a.parseExecutorPath(r, true)
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusBadRequest)
+		return
+	}
+	err = a.RedisClient.ResumeExecutor(chainId, addr)
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("admin: executor resumed", "chainId", chainId, "executor", addr.Hex())
+	fmt.Fprint(w, `{"executor": "resumed"}`)
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/D8-X/d8x-broker-server/src/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/go-chi/chi/v5"
+)
+
+func TestAdminExecutors(t *testing.T) {
+	a := newTestApp(t)
+	redis, mr := newTestRedis(t)
+	a.RedisClient = redis
+	a.AdminApiKey = "secret"
+	router := chi.NewRouter()
+	a.RegisterRoutes(router)
+	executor := common.HexToAddress("0x3ef256282e578c5D97a7231C3C046F19b1E50855")
+	do := func(method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	list := func() []utils.ExecutorStatus {
+		w := do(http.MethodGet, "/admin/executors/42161", "secret")
+		var executors []utils.ExecutorStatus
+		if err := json.Unmarshal(w.Body.Bytes(), &executors); err != nil {
+			t.Fatalf("%d %s: %v", w.Code, w.Body.String(), err)
+		}
+		return executors
+	}
+	path := "/admin/executors/42161/" + executor.Hex()
+
+	if w := do(http.MethodPut, path, "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong admin key accepted: %d", w.Code)
+	}
+	if w := do(http.MethodPut, "/admin/executors/1/"+executor.Hex(), "secret"); w.Code != http.StatusBadRequest {
+		t.Errorf("executor added on unconfigured chain: %d", w.Code)
+	}
+	if w := do(http.MethodPut, path, "secret"); w.Code != http.StatusOK {
+		t.Fatalf("adding executor: %d %s", w.Code, w.Body.String())
+	}
+	if executors := list(); len(executors) != 1 || executors[0].Address != executor {
+		t.Errorf("unexpected executors %+v", executors)
+	}
+	if !a.isExecutorAllowed(42161, executor) {
+		t.Errorf("added executor not allowed")
+	}
+	if w := do(http.MethodDelete, path, "secret"); w.Code != http.StatusOK {
+		t.Fatalf("removing executor: %d %s", w.Code, w.Body.String())
+	}
+	if executors := list(); len(executors) != 0 {
+		t.Errorf("removed executor listed %+v", executors)
+	}
+
+	// without Redis, executors are not allowed even if the config file
+	// lists them, and seeding fails
+	conf, _ := a.Pen.GetChainConfig(42161)
+	conf.AllowedExecutors = []common.Address{executor}
+	_, err := a.Pen.UpdateConfig(map[int64]utils.ChainConfig{42161: conf}, []utils.RpcConfig{{ChainId: 42161, Rpc: []string{"http://localhost:8545"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr.SetError("ERR unavailable")
+	if a.isExecutorAllowed(42161, executor) {
+		t.Errorf("executor allowed without Redis")
+	}
+	if err := a.SeedExecutors(); err == nil {
+		t.Errorf("seeding without Redis succeeded")
+	}
+}
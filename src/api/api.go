@@ -6,90 +6,164 @@ import (
 	"log/slog"
 	"math/big"
 	"net"
-	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/D8-X/d8x-broker-server/src/contracts"
+	"github.com/D8-X/d8x-broker-server/src/fees"
+	"github.com/D8-X/d8x-broker-server/src/metrics"
 	"github.com/D8-X/d8x-broker-server/src/utils"
+	"github.com/D8-X/d8x-broker-server/src/vip3"
 	"github.com/D8-X/d8x-futures-go-sdk/pkg/d8x_futures"
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/go-chi/chi/v5"
 	"github.com/redis/rueidis"
+	"golang.org/x/sync/singleflight"
 )
 
 const APPROVAL_EXPIRY_SEC int64 = 86400 * 7
 
+// maximal time to send a token approval and wait until it is mined
+const APPROVAL_TIMEOUT = 60 * time.Second
+
+// maximal time to look up the data the broker fee depends on (VIP3 level,
+// volume, token balances)
+const FEE_LOOKUP_TIMEOUT = 5 * time.Second
+
 // App is dependency container for API server
 type App struct {
-	Port              string
-	BindAddr          string
-	Pen               utils.SignaturePen
-	BrokerFeeTbps     uint16
-	BrokerFeeLvlsTbps map[int][]uint16
-	RedisClient       *utils.RueidisClient
-	TokenApprovalTs   map[string]int64
+	Port          string
+	BindAddr      string
+	Pen           *utils.SignaturePen
+	BrokerFeeTbps uint16
+	// fee discounts, the base fee applies to all traders if nil
+	Fees        *fees.Engine
+	Vip3        *vip3.Client
+	RedisClient *utils.RueidisClient
+	// rpc clients shared by on-chain lookups
+	RpcClients *utils.RpcClients
+	// mark prices the notional of submitted orders is valued at, volume
+	// is not counted if nil
+	MarkPrices      utils.MarkPriceSource
+	TokenApprovalTs map[string]int64
+	// bearer token for the admin endpoints, admin endpoints disabled if empty
+	AdminApiKey string
+	// require HMAC-signed requests with API keys for signing endpoints
+	ApiAuthEnabled   bool
+	ApiAuthWindowSec int64
+	// validity of fee quotes, defaults to DEFAULT_FEE_QUOTE_TTL_SEC
+	FeeQuoteTtlSec int64
+	// age of submitted orders kept in the order stream for executorws
+	// replicas, defaults to utils.DEFAULT_ORDER_STREAM_MAX_AGE
+	OrderStreamMaxAgeSec int64
+	// maximal time from now to the deadline of signed orders, defaults to
+	// utils.DEFAULT_ORDER_MAX_DEADLINE
+	OrderMaxDeadlineSec int64
+	// perpetuals orders are validated against, not checked if nil
+	Perpetuals *utils.PerpetualCache
+	// token bucket limits for order signature requests
+	RateLimits RateLimits
+	// http server timeouts and shutdown grace period
+	Timeouts utils.HttpTimeouts
+	// guards TokenApprovalTs
+	approvalMu sync.Mutex
+	// deduplicates concurrent approvals of the same token
+	approvals singleflight.Group
+	// last result of the /readyz checks
+	readiness readinessCache
+	// promotions of the fee lookups
+	promotions promotionCache
 }
 
-func NewApp(pk, port, bindAddr, REDIS_ADDR, REDIS_PW, FeeRed string, chainConf map[int64]utils.ChainConfig, rpcConf []utils.RpcConfig, feeTbps uint16) (*App, error) {
-	pen, err := utils.NewSignaturePen(pk, chainConf, rpcConf)
-	if err != nil {
-		return nil, errors.New("Unable to create signature pen:" + err.Error())
-	}
-	feeRed := vip3ToFeeMap(FeeRed, feeTbps)
-	if len(feeRed) > 0 {
-		slog.Info("VIP3 reduction enabled")
-	}
+func NewApp(pen *utils.SignaturePen, port, bindAddr, REDIS_ADDR, REDIS_PW, FeeRed string, feeTbps uint16, vip3Conf vip3.Config) (*App, error) {
 	a := App{
-		Port:              port,
-		BindAddr:          bindAddr,
-		Pen:               pen,
-		BrokerFeeTbps:     feeTbps,
-		BrokerFeeLvlsTbps: feeRed,
-		TokenApprovalTs:   make(map[string]int64),
+		Port:            port,
+		BindAddr:        bindAddr,
+		Pen:             pen,
+		BrokerFeeTbps:   feeTbps,
+		TokenApprovalTs: make(map[string]int64),
+		RpcClients:      utils.NewRpcClients(pen.GetRpcUrls),
 	}
 	client, err := rueidis.NewClient(
 		rueidis.ClientOption{InitAddress: []string{REDIS_ADDR}, Password: REDIS_PW})
 	if err != nil {
 		return nil, err
 	}
-	a.RedisClient = &utils.RueidisClient{
-		Client: &client,
-		Ctx:    context.Background(),
+	a.RedisClient = utils.NewRueidisClient(client)
+	a.MarkPrices = utils.NewMarkPriceCache(utils.OraclePrices{Client: a.RpcClients.Client})
+	a.Vip3 = vip3.NewClient(vip3Conf, a.RedisClient)
+	feeConf := vip3ToFeeConfig(FeeRed)
+	if len(feeConf) > 0 {
+		a.Fees, err = fees.NewEngine(feeConf, a.feeDeps())
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("VIP3 reduction enabled")
 	}
 	return &a, nil
 }
 
 // StartApiServer initializes and starts the api server. This func is blocking
-func (a *App) StartApiServer() error {
+// until ctx is cancelled and in-flight requests are completed
+func (a *App) StartApiServer(ctx context.Context) error {
 	router := chi.NewRouter()
 	a.RegisterRoutes(router)
+	go a.expireOrders(ctx)
+	go a.refreshPerpetuals(ctx)
 
 	addr := net.JoinHostPort(
 		a.BindAddr,
 		a.Port,
 	)
 	slog.Info("starting api server host_port " + addr)
-	err := http.ListenAndServe(
-		addr,
-		router,
-	)
-	return errors.New("api server is shutting down" + err.Error())
+	srv := utils.NewHttpServer(addr, router, a.Timeouts)
+	err := utils.ServeHttp(ctx, srv, a.Timeouts)
+	if err != nil {
+		return errors.New("api server is shutting down: " + err.Error())
+	}
+	return nil
 }
 
-func (a *App) ApproveToken(chainId int64, tokenAddr common.Address) error {
+// ApproveToken approves the multipay contract to spend the token, unless
+// it was approved within APPROVAL_EXPIRY_SEC. Concurrent calls for the same
+// token share one approval transaction
+func (a *App) ApproveToken(ctx context.Context, chainId int64, tokenAddr common.Address) error {
 	chainIdBI := new(big.Int).SetInt64(chainId)
 	key := chainIdBI.String() + "." + tokenAddr.Hex()
 	now := time.Now().Unix()
-	if now-a.TokenApprovalTs[key] < APPROVAL_EXPIRY_SEC {
+	a.approvalMu.Lock()
+	approvedTs := a.TokenApprovalTs[key]
+	a.approvalMu.Unlock()
+	if now-approvedTs < APPROVAL_EXPIRY_SEC {
 		// already approved
 		slog.Info("token already approved for chain.tkn=" + key)
 		return nil
 	}
-	config := a.Pen.ChainConfig[chainId]
-	rpcUrls := a.Pen.RpcUrl[chainId]
+	_, err, _ := a.approvals.Do(key, func() (any, error) {
+		err := a.approveToken(ctx, chainId, tokenAddr)
+		if err != nil {
+			metrics.TokenApprovals.WithLabelValues(metrics.Label(chainId), metrics.RESULT_ERROR).Inc()
+			return nil, err
+		}
+		metrics.TokenApprovals.WithLabelValues(metrics.Label(chainId), metrics.RESULT_OK).Inc()
+		a.approvalMu.Lock()
+		a.TokenApprovalTs[key] = time.Now().Unix()
+		a.approvalMu.Unlock()
+		return nil, nil
+	})
+	return err
+}
+
+// approveToken sends the approval transaction for the multipay contract
+func (a *App) approveToken(ctx context.Context, chainId int64, tokenAddr common.Address) error {
+	chainIdBI := new(big.Int).SetInt64(chainId)
+	key := chainIdBI.String() + "." + tokenAddr.Hex()
+	config, _ := a.Pen.GetChainConfig(chainId)
+	rpcUrls := a.Pen.GetRpcUrls(chainId)
 	if len(rpcUrls) == 0 {
 		return errors.New("no rpc url defined for chain " + strconv.Itoa(int(chainId)))
 	}
@@ -104,11 +178,11 @@ func (a *App) ApproveToken(chainId int64, tokenAddr common.Address) error {
 		return errors.New("creating token instance " + tokenAddr.String() + " for chain " + strconv.Itoa(int(chainId)) + ": " + err.Error())
 	}
 
-	auth, err := bind.NewKeyedTransactorWithChainID(a.Pen.Wallets[chainId].PrivateKey, chainIdBI)
+	auth, err := newTransactor(ctx, a.Pen.Signers[chainId], chainIdBI)
 	if err != nil {
-		return errors.New("creating NewKeyedTransactorWithChainID for chain " + strconv.Itoa(int(chainId)) + ": " + err.Error())
+		return errors.New("creating transactor for chain " + strconv.Itoa(int(chainId)) + ": " + err.Error())
 	}
-	nonce, err := getNonce(client, a.Pen.Wallets[chainId].Address)
+	nonce, err := getNonce(ctx, client, auth.From)
 	if err != nil {
 		return errors.New("getting nonce for chain " + strconv.Itoa(int(chainId)) + ": " + err.Error())
 	}
@@ -128,18 +202,40 @@ func (a *App) ApproveToken(chainId int64, tokenAddr common.Address) error {
 		return errors.New("approving token for chain " + strconv.Itoa(int(chainId)) + ": " + err.Error())
 	}
 	// Wait for the transaction to be mined
-	receipt, err := bind.WaitMined(context.Background(), client, approvalTx)
+	receipt, err := bind.WaitMined(ctx, client, approvalTx)
 	if err != nil {
 		return err
 	}
 	slog.Info("Approved 'chain.token':" + key)
 	slog.Info("Approval transaction hash: " + receipt.TxHash.Hex())
-	a.TokenApprovalTs[key] = time.Now().Unix()
 	return nil
 }
 
-func getNonce(rpc *ethclient.Client, a common.Address) (uint64, error) {
-	nonce, err := rpc.PendingNonceAt(context.Background(), a)
+// newTransactor creates transact options that sign transactions with the
+// broker signer
+func newTransactor(ctx context.Context, signer utils.Signer, chainId *big.Int) (*bind.TransactOpts, error) {
+	if signer == nil {
+		return nil, errors.New("no broker key defined")
+	}
+	txSigner, ok := signer.(utils.TxSigner)
+	if !ok {
+		return nil, errors.New("broker signer does not support signing transactions")
+	}
+	from := signer.Address()
+	return &bind.TransactOpts{
+		From: from,
+		Signer: func(address common.Address, tx *types.Transaction) (*types.Transaction, error) {
+			if address != from {
+				return nil, bind.ErrNotAuthorized
+			}
+			return txSigner.SignTx(tx, chainId)
+		},
+		Context: ctx,
+	}, nil
+}
+
+func getNonce(ctx context.Context, rpc *ethclient.Client, a common.Address) (uint64, error) {
+	nonce, err := rpc.PendingNonceAt(ctx, a)
 	if err != nil {
 		return 0, err
 	}
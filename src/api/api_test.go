@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"log/slog"
@@ -46,7 +47,7 @@ func TestApproveTokenAmount(t *testing.T) {
 		t.Fail()
 	}
 	mockTkn := common.HexToAddress("0x37D97d1FFc09587EA9BDF88Ea77ec4aFAA911260")
-	err = app.ApproveToken(1442, mockTkn)
+	err = app.ApproveToken(context.Background(), 1442, mockTkn)
 	if err != nil {
 		t.Fail()
 	}
@@ -0,0 +1,139 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/D8-X/d8x-broker-server/src/utils"
+)
+
+// Request headers of HMAC-signed requests
+const (
+	HEADER_API_KEY       = "X-Api-Key"
+	HEADER_API_TIMESTAMP = "X-Api-Timestamp"
+	HEADER_API_SIGNATURE = "X-Api-Signature"
+)
+
+const DEFAULT_API_AUTH_WINDOW_SEC = 30
+
+// maximal body size of signed requests
+const MAX_SIGNED_BODY_SIZE = 1 << 20
+
+type ctxKey string
+
+const ctxKeyApiKey ctxKey = "apiKey"
+
+// apiKeyFromContext returns the id of the API key that authenticated the
+// request, or an empty string
+func apiKeyFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(ctxKeyApiKey).(string)
+	return id
+}
+
+// apiKeyAuth requires requests to be signed with an API key that has the
+// given scope. Requests pass unchecked if API authentication is disabled
+func (a *App) apiKeyAuth(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !a.ApiAuthEnabled {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if r, ok := a.verifyApiKey(w, r, scope); ok {
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+// backendAuth requires the admin bearer token or a request signed with an
+// API key that has the given scope, also if API authentication is disabled
+func (a *App) backendAuth(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if found && a.AdminApiKey != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.AdminApiKey)) == 1 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if r, ok := a.verifyApiKey(w, r, scope); ok {
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+// verifyApiKey checks the API key signature of the request and returns the
+// request with the key id in the context. Writes the error response and
+// returns false if the request is not authorized
+func (a *App) verifyApiKey(w http.ResponseWriter, r *http.Request, scope string) (*http.Request, bool) {
+	keyId := r.Header.Get(HEADER_API_KEY)
+	ts, err := strconv.ParseInt(r.Header.Get(HEADER_API_TIMESTAMP), 10, 64)
+	sig := r.Header.Get(HEADER_API_SIGNATURE)
+	if keyId == "" || err != nil || sig == "" {
+		http.Error(w, string(formatError("request must be signed: "+HEADER_API_KEY+", "+
+			HEADER_API_TIMESTAMP+", "+HEADER_API_SIGNATURE+" required")), http.StatusUnauthorized)
+		return r, false
+	}
+	window := a.apiAuthWindow()
+	if d := time.Since(time.Unix(ts, 0)); d > window || d < -window {
+		http.Error(w, string(formatError("request timestamp outside of allowed window")), http.StatusUnauthorized)
+		return r, false
+	}
+	key, err := a.RedisClient.GetApiKey(keyId)
+	if err != nil {
+		http.Error(w, string(formatError("invalid api key")), http.StatusUnauthorized)
+		return r, false
+	}
+	var body []byte
+	if r.Body != nil {
+		body, err = io.ReadAll(http.MaxBytesReader(w, r.Body, MAX_SIGNED_BODY_SIZE))
+		r.Body.Close()
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, string(formatError("request body too large")), http.StatusRequestEntityTooLarge)
+			return r, false
+		} else if err != nil {
+			http.Error(w, string(formatError("reading request body")), http.StatusBadRequest)
+			return r, false
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	expected := utils.SignApiRequest(key.Secret, ts, r.Method, r.URL.Path, r.URL.RawQuery, body)
+	if !hmac.Equal([]byte(expected), []byte(sig)) {
+		http.Error(w, string(formatError("invalid signature")), http.StatusUnauthorized)
+		return r, false
+	}
+	if !key.HasScope(scope) {
+		http.Error(w, string(formatError("api key not allowed to access "+scope)), http.StatusForbidden)
+		return r, false
+	}
+	// the window is covered twice to account for clock skew in both directions
+	fresh, err := a.RedisClient.ClaimRequestSignature(sig, 2*window)
+	if err != nil {
+		slog.Error("checking request replay: " + err.Error())
+		http.Error(w, string(formatError("internal error")), http.StatusInternalServerError)
+		return r, false
+	}
+	if !fresh {
+		http.Error(w, string(formatError("request replayed")), http.StatusUnauthorized)
+		return r, false
+	}
+	return r.WithContext(context.WithValue(r.Context(), ctxKeyApiKey, key.Id)), true
+}
+
+func (a *App) apiAuthWindow() time.Duration {
+	if a.ApiAuthWindowSec <= 0 {
+		return DEFAULT_API_AUTH_WINDOW_SEC * time.Second
+	}
+	return time.Duration(a.ApiAuthWindowSec) * time.Second
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/D8-X/d8x-broker-server/src/testutil"
+	"github.com/D8-X/d8x-broker-server/src/utils"
+	"github.com/alicebob/miniredis/v2"
+)
+
+func newTestRedis(t *testing.T) (*utils.RueidisClient, *miniredis.Miniredis) {
+	client, s := testutil.NewRedis(t)
+	return utils.NewRueidisClient(client), s
+}
+
+func signedRequest(key utils.ApiKey, ts int64, target string, body []byte) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	req.Header.Set(HEADER_API_KEY, key.Id)
+	req.Header.Set(HEADER_API_TIMESTAMP, strconv.FormatInt(ts, 10))
+	req.Header.Set(HEADER_API_SIGNATURE, utils.SignApiRequest(key.Secret, ts, http.MethodPost, req.URL.Path, req.URL.RawQuery, body))
+	return req
+}
+
+func TestApiKeyAuth(t *testing.T) {
+	redis, _ := newTestRedis(t)
+	a := &App{RedisClient: redis, ApiAuthEnabled: true}
+	var gotBody, gotKey string
+	handler := a.apiKeyAuth(utils.SCOPE_SIGN_ORDER)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(r.Body)
+		gotBody = buf.String()
+		gotKey = apiKeyFromContext(r.Context())
+	}))
+	key, err := redis.IssueApiKey("frontend", []string{utils.SCOPE_SIGN_ORDER})
+	if err != nil {
+		t.Fatal(err)
+	}
+	paymentKey, _ := redis.IssueApiKey("executor", []string{utils.SCOPE_SIGN_PAYMENT})
+	body := []byte(`{"chainId": 42161}`)
+	now := time.Now().Unix()
+
+	check := func(name string, req *http.Request, status int) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != status {
+			t.Errorf("%s: status %d, expected %d: %s", name, rec.Code, status, rec.Body.String())
+		}
+	}
+	check("unsigned", httptest.NewRequest(http.MethodPost, "/sign-order", bytes.NewReader(body)), http.StatusUnauthorized)
+	check("valid", signedRequest(key, now, "/sign-order", body), http.StatusOK)
+	if gotBody != string(body) || gotKey != key.Id {
+		t.Errorf("body or key not passed to handler: %s %s", gotBody, gotKey)
+	}
+	check("replay", signedRequest(key, now, "/sign-order", body), http.StatusUnauthorized)
+	check("stale", signedRequest(key, now-DEFAULT_API_AUTH_WINDOW_SEC-5, "/sign-order", body), http.StatusUnauthorized)
+
+	tampered := signedRequest(key, now+1, "/sign-order", body)
+	tampered.Body = http.NoBody
+	check("tampered body", tampered, http.StatusUnauthorized)
+	check("wrong scope", signedRequest(paymentKey, now, "/sign-order", body), http.StatusForbidden)
+
+	// the query is signed in canonical form
+	query := signedRequest(key, now+3, "/fee-quote?perpetualId=100001&chain=42161", nil)
+	query.URL.RawQuery = "chain=42161&perpetualId=100001"
+	check("reordered query", query, http.StatusOK)
+	query = signedRequest(key, now+4, "/fee-quote?chain=42161&perpetualId=100001", nil)
+	query.URL.RawQuery = "chain=42161&perpetualId=100002"
+	check("tampered query", query, http.StatusUnauthorized)
+	check("body too large", signedRequest(key, now+5, "/sign-order", bytes.Repeat([]byte(" "), MAX_SIGNED_BODY_SIZE+1)),
+		http.StatusRequestEntityTooLarge)
+
+	redis.RevokeApiKey(key.Id)
+	check("revoked", signedRequest(key, now+2, "/sign-order", body), http.StatusUnauthorized)
+
+	a.ApiAuthEnabled = false
+	check("auth disabled", httptest.NewRequest(http.MethodPost, "/sign-order", bytes.NewReader(body)), http.StatusOK)
+}
+
+func TestBackendAuth(t *testing.T) {
+	redis, _ := newTestRedis(t)
+	a := &App{RedisClient: redis, AdminApiKey: "secret"}
+	handler := a.backendAuth(utils.SCOPE_ORDER_STATUS)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	key, err := redis.IssueApiKey("backend", []string{utils.SCOPE_ORDER_STATUS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte(`{"orderIds": ["0x01"], "status": "executed"}`)
+	now := time.Now().Unix()
+	check := func(name string, req *http.Request, status int) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != status {
+			t.Errorf("%s: status %d, expected %d: %s", name, rec.Code, status, rec.Body.String())
+		}
+	}
+	// API authentication is disabled, the endpoint still requires a key
+	check("unsigned", httptest.NewRequest(http.MethodPost, "/order-status", bytes.NewReader(body)), http.StatusUnauthorized)
+	check("signed", signedRequest(key, now, "/order-status", body), http.StatusOK)
+	admin := httptest.NewRequest(http.MethodPost, "/order-status", bytes.NewReader(body))
+	admin.Header.Set("Authorization", "Bearer secret")
+	check("admin token", admin, http.StatusOK)
+	wrong := httptest.NewRequest(http.MethodPost, "/order-status", bytes.NewReader(body))
+	wrong.Header.Set("Authorization", "Bearer wrong")
+	check("wrong admin token", wrong, http.StatusUnauthorized)
+
+	a.AdminApiKey = ""
+	empty := httptest.NewRequest(http.MethodPost, "/order-status", bytes.NewReader(body))
+	empty.Header.Set("Authorization", "Bearer ")
+	check("empty admin token", empty, http.StatusUnauthorized)
+}
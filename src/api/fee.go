@@ -2,122 +2,145 @@ package api
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
-	"fmt"
-	"io"
 	"log/slog"
-	"net/http"
+	"math"
 	"strconv"
 	"strings"
-)
 
-const API_URL = "https://dappapi.vip3.io/api/v1/sbt/info"
-const VIP3_REDIS = "VIP"
-const VIP3_INFO_EXPIRY_SEC int64 = 7 * 86_400
+	"github.com/D8-X/d8x-broker-server/src/fees"
+	"github.com/D8-X/d8x-broker-server/src/utils"
+	"github.com/D8-X/d8x-broker-server/src/vip3"
+	"github.com/ethereum/go-ethereum/common"
+)
 
 // Reduction of broker fees for VIP3 per level (4 levels) is set in the .env-file as
-// VIP3_REDUCTION_PERC="50,75,90,100"
-
-type Vip3Response struct {
-	Code int    `json:"code"`
-	Msg  string `json:"msg"`
-	Data struct {
-		Level int `json:"level"`
-	} `json:"data"`
+// VIP3_REDUCTION_PERC="1101:0,50,75,90,100" unless a fee config file
+// (FEE_CONFIG_PATH) is used
+
+// getBrokerFeeTbps returns the broker fee for any perpetual of the chain.
+// traderAddr can be an empty string and chainId can be -1
+func (a *App) getBrokerFeeTbps(ctx context.Context, traderAddr string, chainId int) uint16 {
+	fee, _ := a.getBrokerFee(ctx, traderAddr, chainId, -1)
+	return fee
 }
 
-// getBrokerFeeTbps returns the broker fee. traderAddr can be an empty string
-// and chainId can be -1
-func (a *App) getBrokerFeeTbps(traderAddr string, chainId int) uint16 {
-	if a.BrokerFeeLvlsTbps == nil {
-		return a.BrokerFeeTbps
-	}
-	return a.getReducedBrokerFeeTbps(traderAddr, chainId)
+// getBrokerFee returns the broker fee for the perpetual and how it was
+// determined. This is the fee that is signed
+func (a *App) getBrokerFee(ctx context.Context, traderAddr string, chainId, perpetualId int) (uint16, utils.FeeInfo) {
+	return a.feeWithReferral(ctx, traderAddr, chainId, perpetualId, a.traderReferral(traderAddr))
 }
 
-func (a *App) getReducedBrokerFeeTbps(traderAddr string, chainId int) uint16 {
-	traderAddr = strings.ToLower(traderAddr)
-	l := a.GetVip3Level(traderAddr)
-	if l == 0 {
-		return a.BrokerFeeTbps
+// feeWithReferral is getBrokerFee with the given referral code of the
+// trader, nil if none
+func (a *App) feeWithReferral(ctx context.Context, traderAddr string, chainId, perpetualId int, ref *utils.ReferralCode) (uint16, utils.FeeInfo) {
+	fee, info := a.referralFee(ctx, traderAddr, chainId, perpetualId, ref)
+	return withPromotion(fee, info, a.bestPromotion(traderAddr, int64(chainId), int64(perpetualId), fee))
+}
+
+// orderFee is feeWithReferral for an order that is signed. The order is
+// counted towards the usage limit of the promotion applied, release it
+// with releasePromotion if the order is not signed
+func (a *App) orderFee(ctx context.Context, traderAddr string, chainId, perpetualId int, ref *utils.ReferralCode) (uint16, utils.FeeInfo) {
+	fee, info := a.referralFee(ctx, traderAddr, chainId, perpetualId, ref)
+	return withPromotion(fee, info, a.reserveBestPromotion(traderAddr, int64(chainId), int64(perpetualId), fee))
+}
+
+// referralFee returns the fee with the referral discount, before
+// promotions. The fee providers are queried for at most FEE_LOOKUP_TIMEOUT
+func (a *App) referralFee(ctx context.Context, traderAddr string, chainId, perpetualId int, ref *utils.ReferralCode) (uint16, utils.FeeInfo) {
+	ctx, cancel := context.WithTimeout(ctx, FEE_LOOKUP_TIMEOUT)
+	defer cancel()
+	q := a.Fees.Fee(ctx, traderAddr, int64(chainId), int64(perpetualId), a.BrokerFeeTbps)
+	fee, info := q.FeeTbps, utils.FeeInfo{Tier: q.Tier(), Vip3Level: q.Level(fees.PROVIDER_VIP3)}
+	if ref != nil {
+		// the referral discount applies on top of the fee tier
+		fee = uint16(math.Floor(float64(fee)*(100-ref.DiscountPerc)/100 + 1e-9))
+		info.Tier = addFeeTier(info.Tier, utils.FEE_TIER_REFERRAL+ref.Code)
+		info.Referral = ref
 	}
-	if chainId == -1 {
-		for key := range a.BrokerFeeLvlsTbps {
-			chainId = key
-			break
-		}
-		fmt.Printf("getReducedBrokerFeeTbps: chainId not specified, defaulting to %d", chainId)
+	return fee, info
+}
+
+// withPromotion applies the promotion to the fee, if not nil
+func withPromotion(fee uint16, info utils.FeeInfo, promo *utils.Promotion) (uint16, utils.FeeInfo) {
+	if promo == nil {
+		return fee, info
 	}
-	if _, exits := a.BrokerFeeLvlsTbps[chainId]; !exits {
-		fmt.Printf("getReducedBrokerFeeTbps: chainId %d queried but not specified", chainId)
-		return a.BrokerFeeTbps
+	info.Tier = addFeeTier(info.Tier, utils.FEE_TIER_PROMOTION+promo.Id)
+	info.Promotion = promo
+	return promo.Fee(fee), info
+}
+
+// addFeeTier appends the tier to the tiers applied
+func addFeeTier(tiers, tier string) string {
+	if tiers == fees.TIER_BASE {
+		return tier
 	}
-	if l > len(a.BrokerFeeLvlsTbps[chainId]) {
-		l = len(a.BrokerFeeLvlsTbps[chainId])
+	return tiers + "+" + tier
+}
+
+// feeDeps are the data sources of the fee providers
+func (a *App) feeDeps() fees.Deps {
+	return fees.Deps{
+		Vip3:     vip3Source{a},
+		Volume:   volumeSource{a},
+		Balances: fees.RpcBalances{Client: a.RpcClients.Client},
 	}
-	return a.BrokerFeeLvlsTbps[chainId][l-1]
 }
 
-// GetVip3Level checks whether for the given address we already have
-// vip3 level stored. if not, it will get it from the REST API and store
-func (a *App) GetVip3Level(traderAddr string) int {
-	c := *a.RedisClient.Client
-	traderAddr = strings.ToLower(traderAddr)
-	redisKey := VIP3_REDIS + ":" + traderAddr
-	var lvl int
-	lvlRedis, err := c.Do(context.Background(), c.B().Get().Key(redisKey).Build()).ToString()
+// LoadFeeConfig loads the fee config file and replaces the fee engine config.
+// The current config is kept on error
+func (a *App) LoadFeeConfig(path string) error {
+	conf, err := fees.LoadConfig(path)
 	if err != nil {
-		//query from rest
-		lvl, err = RestGetVip3Level(traderAddr)
-		if err != nil {
-			slog.Error("Error in getting Vip3Level for trader addr " + traderAddr + ":" + err.Error())
-			return 0
-		}
-		// store
-		err = c.Do(context.Background(), c.B().Set().Key(redisKey).Value(strconv.Itoa(lvl)).Build()).Error()
-		if err != nil {
-			slog.Error("Error in stroring Vip3Level for trader addr " + traderAddr + ":" + err.Error())
-
-		}
-		// expire
-		c.Do(context.Background(), c.B().Expire().Key(redisKey).Seconds(VIP3_INFO_EXPIRY_SEC).Build())
-		return lvl
+		return err
 	}
-	lvl, err = strconv.Atoi(lvlRedis)
+	if a.Fees == nil {
+		a.Fees, err = fees.NewEngine(conf, a.feeDeps())
+		return err
+	}
+	return a.Fees.Update(conf)
+}
+
+// vip3Source provides cached VIP3 levels to the fee engine
+type vip3Source struct {
+	a *App
+}
+
+func (s vip3Source) Vip3Level(ctx context.Context, trader common.Address) (int, error) {
+	return s.a.Vip3.Level(ctx, trader.Hex())
+}
+
+// GetVip3Level returns the VIP3 level of the trader, cached or from the
+// VIP3 API. Level 0 if the lookup fails
+func (a *App) GetVip3Level(ctx context.Context, traderAddr string) int {
+	lvl, err := a.Vip3.Level(ctx, traderAddr)
 	if err != nil {
 		slog.Error("Error in getting Vip3Level for trader addr " + traderAddr + ":" + err.Error())
+		return 0
 	}
 	return lvl
 }
 
 // RestGetVip3Level queries the Vip3 level from the Vip3 API
 func RestGetVip3Level(traderAddr string) (int, error) {
-	query := API_URL + "?addr=" + traderAddr
-	response, err := http.Get(query)
-	if err != nil {
-		return 0, errors.New("Error in GetVIP3Level:" + err.Error())
-	}
-	defer response.Body.Close()
-	body, err := io.ReadAll(response.Body)
+	lvl, err := vip3.NewClient(vip3.DefaultConfig(), nil).Fetch(context.Background(), traderAddr)
 	if err != nil {
 		return 0, errors.New("Error in GetVIP3Level:" + err.Error())
 	}
-	var v Vip3Response
-	err = json.Unmarshal(body, &v)
-	if err != nil {
-		return 0, errors.New("Error in GetVIP3Level:" + err.Error())
-	}
-	return v.Data.Level, nil
+	return lvl, nil
 }
 
-func vip3ToFeeMap(feeReduc string, brokerFeeTbps uint16) map[int][]uint16 {
+// vip3ToFeeConfig converts the legacy VIP3_REDUCTION_PERC setting into a fee
+// config with a VIP3 provider per chain
+func vip3ToFeeConfig(feeReduc string) map[int64]fees.ChainFeeConfig {
 	// parse string of the form "1101:70,70,70,70;196:70,70,70,70"
 	if feeReduc == "" {
 		return nil
 	}
 	chains := strings.Split(feeReduc, ";")
-	reducedFees := make(map[int][]uint16)
+	conf := make(map[int64]fees.ChainFeeConfig)
 	for _, c := range chains {
 		v := strings.Split(c, ":")
 		if len(v) == 1 {
@@ -129,7 +152,7 @@ func vip3ToFeeMap(feeReduc string, brokerFeeTbps uint16) map[int][]uint16 {
 			slog.Error("Error parsing VIP3 chainId to integer:" + err.Error())
 			return nil
 		}
-		var fees []uint16
+		var percs []float64
 
 		feesStr := strings.Split(strings.TrimSuffix(v[1], ";"), ",")
 		for k := 1; k < len(feesStr); k++ {
@@ -138,9 +161,12 @@ func vip3ToFeeMap(feeReduc string, brokerFeeTbps uint16) map[int][]uint16 {
 				slog.Error("Error converting VIP3 fee to integer:" + err.Error())
 				return nil
 			}
-			fees = append(fees, uint16((100-valuePerc)*int(brokerFeeTbps)/100))
+			percs = append(percs, float64(valuePerc))
+		}
+		if len(percs) == 0 {
+			continue
 		}
-		reducedFees[chainId] = fees
+		conf[int64(chainId)] = fees.ChainFeeConfig{ChainId: int64(chainId), Vip3: percs}
 	}
-	return reducedFees
+	return conf
 }
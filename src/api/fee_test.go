@@ -1,12 +1,19 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"log/slog"
+	"net/http/httptest"
+	"slices"
 	"testing"
 	"time"
 
+	"github.com/D8-X/d8x-broker-server/src/fees"
 	"github.com/D8-X/d8x-broker-server/src/utils"
+	"github.com/D8-X/d8x-broker-server/src/vip3"
+	"github.com/ethereum/go-ethereum/common"
 )
 
 func TestRestGetVip3Level(t *testing.T) {
@@ -35,30 +42,35 @@ func TestGetVip3Level(t *testing.T) {
 		slog.Error("loading rpc config: " + err.Error())
 		return
 	}
+	pen, err := utils.NewSignaturePen("c3aadd4417f0f918fe7a53d7c6c75fa65352a1ef5c29097f0ce5ba8dbf05e08c", chConf, rpcConf)
+	if err != nil {
+		slog.Error("signature pen creation failed: " + err.Error())
+		t.FailNow()
+	}
 	a, err := NewApp(
-		"c3aadd4417f0f918fe7a53d7c6c75fa65352a1ef5c29097f0ce5ba8dbf05e08c",
+		pen,
 		"8001",
 		"127.0.0.1",
 		"localhost:6379",
 		"23_*PAejOanJma",
 		"",
-		chConf,
-		rpcConf,
 		400,
+
+		vip3.DefaultConfig(),
 	)
 	if err != nil {
 		slog.Error("new app creation failed: " + err.Error())
 		t.FailNow()
 	}
-	l := a.GetVip3Level("0x0aB6527027EcFF1144dEc3d78154fce309ac838c")
+	l := a.GetVip3Level(context.Background(), "0x0aB6527027EcFF1144dEc3d78154fce309ac838c")
 
 	fmt.Print(l)
 	t0 := time.Now()
-	l = a.GetVip3Level("0xabe292b291A18699b09608de86888D77aD6BAf23")
+	l = a.GetVip3Level(context.Background(), "0xabe292b291A18699b09608de86888D77aD6BAf23")
 
 	t1 := time.Now()
 	fmt.Print("Found level ", l, " in ", t1.Sub(t0))
-	l = a.GetVip3Level("0xabe292b291A18699b09608de86888D77aD6BAf23")
+	l = a.GetVip3Level(context.Background(), "0xabe292b291A18699b09608de86888D77aD6BAf23")
 
 	t0 = time.Now()
 	fmt.Print("Found level ", l, " in ", t0.Sub(t1))
@@ -69,30 +81,119 @@ func TestGetBrokerFeeTbps(t *testing.T) {
 	rpcConf, _ := utils.LoadRpcConfig("../../config/rpc.json")
 	conf := "1101:50,75,90"
 	//conf := ""
+	pen, err := utils.NewSignaturePen("c3aadd4417f0f918fe7a53d7c6c75fa65352a1ef5c29097f0ce5ba8dbf05e08c", chConf, rpcConf)
+	if err != nil {
+		slog.Error(err.Error())
+		t.FailNow()
+	}
 	a, err := NewApp(
-		"c3aadd4417f0f918fe7a53d7c6c75fa65352a1ef5c29097f0ce5ba8dbf05e08c",
+		pen,
 		"8001",
 		"127.0.0.1",
 		"localhost:6379",
 		"23_*PAejOanJma",
 		conf,
-		chConf,
-		rpcConf,
 		400,
+
+		vip3.DefaultConfig(),
 	)
 	if err != nil {
 		slog.Error(err.Error())
 		t.FailNow()
 	}
-	fee1 := a.getBrokerFeeTbps("0xB8aAEC178f5b30B6Bcd75740fB64F0369010faDF", 196)
-	fee2 := a.getBrokerFeeTbps("0xdA5b972BdA66112E0D9035425AbAda4DaC933C30", 1101)
+	fee1 := a.getBrokerFeeTbps(context.Background(), "0xB8aAEC178f5b30B6Bcd75740fB64F0369010faDF", 196)
+	fee2 := a.getBrokerFeeTbps(context.Background(), "0xdA5b972BdA66112E0D9035425AbAda4DaC933C30", 1101)
 	fmt.Println("Fee ", fee1)
 	fmt.Println("Fee ", fee2)
 }
 
 func TestStrToFeeArray(t *testing.T) {
-	v := vip3ToFeeMap("50,75,90,100", 60)
-	fmt.Println(v)
-	v = vip3ToFeeMap("", 60)
-	fmt.Println(v)
+	for _, s := range []string{"", "50,75,90,100", "x:50,75", "1101:50,x"} {
+		if v := vip3ToFeeConfig(s); v != nil {
+			t.Errorf("%q: expected no config, got %v", s, v)
+		}
+	}
+	// the first value is the reduction of level 0
+	v := vip3ToFeeConfig("1101:48,72,70,70;196:10,20")
+	if len(v) != 2 || v[1101].ChainId != 1101 || !slices.Equal(v[1101].Vip3, []float64{72, 70, 70}) ||
+		!slices.Equal(v[196].Vip3, []float64{20}) {
+		t.Errorf("unexpected config %v", v)
+	}
+}
+
+func TestGetBrokerFee(t *testing.T) {
+	trader := common.HexToAddress("0x9d5aaB428e98678d0E645ea4AeBd25f744341a05")
+	base := uint16(40)
+	engine, err := fees.NewEngine(map[int64]fees.ChainFeeConfig{
+		42161: {
+			BaseFeeTbps:      &base,
+			PerpetualFeeTbps: map[int64]uint16{100001: 20},
+			Allowlist:        []fees.AllowlistEntry{{Addr: trader, Perc: 50}},
+		},
+	}, fees.Deps{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	redis, _ := newTestRedis(t)
+	a := &App{BrokerFeeTbps: 60, Fees: engine, RedisClient: redis}
+	for _, tc := range []struct {
+		query string
+		fee   uint16
+	}{
+		// without chain, the lowest configured chain applies
+		{"", 40},
+		{"?chain=42161", 40},
+		{"?chain=42161&perpetualId=100001", 20},
+		{"?chain=42161&perpetualId=100001&addr=" + trader.Hex(), 10},
+		{"?chain=1101&perpetualId=100001&addr=" + trader.Hex(), 60},
+	} {
+		w := httptest.NewRecorder()
+		a.GetBrokerFee(w, httptest.NewRequest("GET", "/broker-fee"+tc.query, nil))
+		var res utils.APIBrokerFeeRes
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if res.BrokerFeeTbps != tc.fee {
+			t.Errorf("%s: got fee %d, expected %d", tc.query, res.BrokerFeeTbps, tc.fee)
+		}
+	}
+	w := httptest.NewRecorder()
+	a.GetBrokerFee(w, httptest.NewRequest("GET", "/broker-fee?perpetualId=abc", nil))
+	if w.Code != 400 {
+		t.Errorf("expected bad request for invalid perpetualId, got %d", w.Code)
+	}
+}
+
+// hungVip3 blocks VIP3 lookups until the context is done
+type hungVip3 struct{}
+
+func (hungVip3) Vip3Level(ctx context.Context, trader common.Address) (int, error) {
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+func TestFeeLookupCancelled(t *testing.T) {
+	engine, err := fees.NewEngine(map[int64]fees.ChainFeeConfig{
+		42161: {ChainId: 42161, Vip3: []float64{50}},
+	}, fees.Deps{Vip3: hungVip3{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	redis, _ := newTestRedis(t)
+	a := &App{BrokerFeeTbps: 60, Fees: engine, RedisClient: redis}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan uint16)
+	go func() {
+		fee, _ := a.getBrokerFee(ctx, "0x9d5aaB428e98678d0E645ea4AeBd25f744341a05", 42161, 100001)
+		done <- fee
+	}()
+	select {
+	case fee := <-done:
+		if fee != 60 {
+			t.Errorf("expected the base fee without VIP3 level, got %d", fee)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("fee lookup not cancelled with the request")
+	}
 }
@@ -1,26 +1,35 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"log/slog"
 
+	"github.com/D8-X/d8x-broker-server/src/ledger"
+	"github.com/D8-X/d8x-broker-server/src/metrics"
 	"github.com/D8-X/d8x-broker-server/src/utils"
 	"github.com/D8-X/d8x-futures-go-sdk/pkg/d8x_futures"
 	"github.com/ethereum/go-ethereum/common"
 )
 
 func (a *App) GetChainConfig(w http.ResponseWriter, r *http.Request) {
-	config := make([]utils.ChainConfig, len(a.Pen.ChainConfig))
-	var k int
-	for _, conf := range a.Pen.ChainConfig {
-		config[k] = conf
-		k++
+	config := a.Pen.GetChainConfigs()
+	// executors from the live whitelist
+	for k := range config {
+		executors, err := a.RedisClient.GetActiveExecutors(config[k].ChainId)
+		if err != nil {
+			slog.Error("getting executors, using config file: " + err.Error())
+			continue
+		}
+		config[k].AllowedExecutors = executors
 	}
 	// Marshal the struct into JSON
 	jsonResponse, err := json.Marshal(config)
@@ -36,16 +45,32 @@ func (a *App) GetChainConfig(w http.ResponseWriter, r *http.Request) {
 	w.Write(jsonResponse)
 }
 
-func (a *App) BrokerAddress() string {
-	// same address for all chains
-	for _, wallet := range a.Pen.Wallets {
-		return wallet.Address.Hex()
+// BrokerAddress returns the broker address for the given chain, or the
+// address shared by all chains if chainId is -1
+func (a *App) BrokerAddress(chainId int64) (string, error) {
+	addr, err := a.Pen.BrokerAddress(chainId)
+	if err != nil {
+		return "", err
 	}
-	return ""
+	return addr.Hex(), nil
 }
 
 func (a *App) GetBrokerAddress(w http.ResponseWriter, r *http.Request) {
-	brokerAddr := a.BrokerAddress()
+	chainId := int64(-1)
+	chainIdStr := r.URL.Query().Get("chain")
+	if chainIdStr != "" {
+		var err error
+		chainId, err = strconv.ParseInt(chainIdStr, 10, 64)
+		if err != nil {
+			http.Error(w, string(formatError("invalid chain")), http.StatusBadRequest)
+			return
+		}
+	}
+	brokerAddr, err := a.BrokerAddress(chainId)
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusBadRequest)
+		return
+	}
 	response := struct {
 		BrokerAddr string `json:"brokerAddr"`
 	}{
@@ -79,10 +104,30 @@ func (a *App) GetBrokerFee(w http.ResponseWriter, r *http.Request) {
 			chainId = -1
 		}
 	}
-	fee := a.getBrokerFeeTbps(addr, chainId)
+	perpetualId := -1
+	if perpIdStr := r.URL.Query().Get("perpetualId"); perpIdStr != "" {
+		var err error
+		perpetualId, err = strconv.Atoi(perpIdStr)
+		if err != nil {
+			http.Error(w, string(formatError("invalid perpetualId")), http.StatusBadRequest)
+			return
+		}
+	}
+	fee, _ := a.getBrokerFee(r.Context(), addr, chainId, perpetualId)
 	res := utils.APIBrokerFeeRes{
 		BrokerFeeTbps: fee,
 	}
+	vol, exists, err := a.Fees.VolumeStatus(r.Context(), addr, int64(chainId))
+	if err != nil {
+		slog.Error("trader volume: " + err.Error())
+	}
+	if exists {
+		res.Volume = &vol.Volume
+		if vol.NextTier != nil {
+			res.NextTierVolume = &vol.NextTier.MinVolume
+			res.NextTierDiscountPerc = &vol.NextTier.Perc
+		}
+	}
 	// Marshal the struct into JSON
 	jsonResponse, err := json.Marshal(res)
 	if err != nil {
@@ -120,11 +165,19 @@ func (a *App) SignOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if req.Order.BrokerAddr == (common.Address{}).String() || len(req.Order.BrokerAddr) != len((common.Address{})) {
-		req.Order.BrokerAddr = a.BrokerAddress()
+		req.Order.BrokerAddr, err = a.BrokerAddress(req.ChainId)
+		if err != nil {
+			http.Error(w, string(formatError(err.Error())), http.StatusBadRequest)
+			return
+		}
 	}
-	err = req.CheckData()
-	if err != nil {
-		http.Error(w, string(formatError(err.Error())), http.StatusBadRequest)
+	var verr *utils.ValidationError
+	if err = a.validateOrder(r.Context(), &req); errors.As(err, &verr) {
+		slog.Info("Order signature request rejected: " + err.Error())
+		http.Error(w, string(formatValidationError(verr)), http.StatusBadRequest)
+		return
+	} else if errors.Is(err, errNoPerpetuals) {
+		http.Error(w, string(formatError(err.Error())), http.StatusServiceUnavailable)
 		return
 	}
 	slog.Info(fmt.Sprintf("Order signature request: trader %s... Perpetual %d Chain %d broker %s... deadline %d fee Tbps %d",
@@ -134,15 +187,49 @@ func (a *App) SignOrder(w http.ResponseWriter, r *http.Request) {
 		string(req.Order.BrokerAddr[0:8]),
 		int(req.Order.Deadline),
 		int(req.Order.BrokerFeeTbps)))
-	req.Order.BrokerFeeTbps = a.getBrokerFeeTbps(req.Order.TraderAddr, int(req.ChainId))
+	var quote *utils.FeeQuote
+	if req.FeeQuote != "" {
+		q, err := a.checkFeeQuote(req.FeeQuote, req)
+		if err != nil {
+			http.Error(w, string(formatError(err.Error())), http.StatusBadRequest)
+			return
+		}
+		quote = &q
+	}
+	var ref *utils.ReferralCode
+	if req.ReferralCode != "" {
+		ref, err = a.orderReferral(req)
+		if err != nil {
+			http.Error(w, string(formatError("referral code: "+err.Error())), http.StatusBadRequest)
+			return
+		}
+	} else {
+		ref = a.traderReferral(req.Order.TraderAddr)
+	}
+	var feeInfo utils.FeeInfo
+	if quote != nil {
+		// sign the quoted fee
+		req.Order.BrokerFeeTbps, feeInfo, err = a.quotedFee(*quote)
+		if err != nil {
+			http.Error(w, string(formatError(err.Error())), http.StatusBadRequest)
+			return
+		}
+	} else {
+		req.Order.BrokerFeeTbps, feeInfo = a.orderFee(r.Context(), req.Order.TraderAddr, int(req.ChainId), int(req.Order.PerpetualId), ref)
+	}
 
-	jsonResponse, err := pen.GetBrokerOrderSignatureResponse(req.Order, int64(req.ChainId), redis)
+	jsonResponse, err := pen.GetBrokerOrderSignatureResponse(req.Order, int64(req.ChainId), redis, feeInfo)
 	if err != nil {
+		a.releasePromotion(feeInfo.Promotion, req.Order.TraderAddr)
 		slog.Error("Error in signature request: " + err.Error())
 		response := string(formatError(err.Error()))
 		fmt.Fprint(w, response)
 		return
 	}
+	if req.ReferralCode != "" {
+		a.bindReferral(req.Order.TraderAddr, ref)
+	}
+	metrics.OrderSignatures.WithLabelValues(metrics.Label(int64(req.ChainId)), metrics.Label(int64(req.Order.PerpetualId))).Inc()
 	// Set the Content-Type header to application/json
 	w.Header().Set("Content-Type", "application/json")
 	// Write the JSON response
@@ -172,13 +259,21 @@ func (a *App) OrdersSubmitted(w http.ResponseWriter, r *http.Request) {
 	for k := range req.OrderIds {
 		req.OrderIds[k] = strings.TrimPrefix(req.OrderIds[k], "0x")
 	}
-	err = a.RedisClient.OrderSubmission(req.OrderIds)
+	orders, err := a.RedisClient.OrderSubmission(req.OrderIds, time.Duration(a.OrderStreamMaxAgeSec)*time.Second)
+	a.recordVolume(r.Context(), orders)
 	if err != nil {
+		metrics.OrderSubmissionFailures.Inc()
 		slog.Error(err.Error())
 		response := string(formatError(err.Error()))
 		fmt.Fprint(w, response)
 		return
 	}
+	if a.Pen.Ledger != nil {
+		err = a.Pen.Ledger.RecordSubmission(r.Context(), req.OrderIds, time.Now().Unix())
+		if err != nil {
+			slog.Error("ledger: recording order submission: " + err.Error())
+		}
+	}
 	fmt.Fprint(w, `{"orders-submitted": "success"}`)
 }
 
@@ -228,15 +323,52 @@ func (a *App) SignPayment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// signature correct, check if this is a registered payment executor
-	if !findExecutor(pen, req.Payment.ChainId, addr) {
+	if !a.isExecutorAllowed(req.Payment.ChainId, addr) {
 		slog.Error("SignPayment: executor not whitelisted")
 		response := string(formatError("executor not allowed"))
 		fmt.Fprint(w, response)
 		return
 	}
+	// reject stale, replayed and capped payments
+	conf, _ := pen.GetChainConfig(req.Payment.ChainId)
+	now := time.Now()
+	err = checkPayment(conf, &req.Payment, now)
+	if err != nil {
+		slog.Error("SignPayment: " + err.Error())
+		response := string(formatError(err.Error()))
+		fmt.Fprint(w, response)
+		return
+	}
+	fresh, err := a.claimPayment(r.Context(), conf, &req.Payment)
+	if err != nil {
+		slog.Error("SignPayment: claiming payment id: " + err.Error())
+		response := string(formatError("internal error"))
+		fmt.Fprint(w, response)
+		return
+	}
+	if !fresh {
+		slog.Error("SignPayment: duplicate payment id", "chainId", req.Payment.ChainId, "executor", addr.Hex(), "id", req.Payment.Id)
+		response := string(formatError(ledger.ErrDuplicatePayment.Error()))
+		fmt.Fprint(w, response)
+		return
+	}
+	withinCap, err := a.reservePayment(conf, &req.Payment, now)
+	if err != nil || !withinCap {
+		a.releasePayment(conf, &req.Payment, now)
+		msg := fmt.Sprintf("daily payment cap of executor for token %s exceeded", req.Payment.Token.Hex())
+		if err != nil {
+			slog.Error("SignPayment: reserving payment amount: " + err.Error())
+			msg = "internal error"
+		}
+		fmt.Fprint(w, string(formatError(msg)))
+		return
+	}
 	// ensure token is approved to be spent
-	err = a.ApproveToken(req.Payment.ChainId, req.Payment.Token)
+	ctx, cancel := context.WithTimeout(r.Context(), APPROVAL_TIMEOUT)
+	err = a.ApproveToken(ctx, req.Payment.ChainId, req.Payment.Token)
+	cancel()
 	if err != nil {
+		a.releasePayment(conf, &req.Payment, now)
 		msg := fmt.Sprintf("error approving token for chain %d %s", req.Payment.ChainId, err.Error())
 		slog.Error(msg)
 		response := string(formatError("error approving token spending"))
@@ -244,7 +376,32 @@ func (a *App) SignPayment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// allowed executor, token approved, we can sign
-	jsonResponse, err := pen.GetBrokerPaymentSignatureResponse(req)
+	start := time.Now()
+	sig, err := pen.SignPayment(&req.Payment)
+	if err != nil {
+		a.releasePayment(conf, &req.Payment, now)
+		response := string(formatError(err.Error()))
+		fmt.Fprint(w, response)
+		return
+	}
+	metrics.ObserveSince(metrics.SignatureLatency.WithLabelValues("payment"), start)
+	// the signature is only handed out once it is recorded
+	err = a.recordPayment(r.Context(), &req.Payment, sig)
+	if err != nil {
+		slog.Error("SignPayment: ledger: " + err.Error())
+		// a duplicate id stays taken in the ledger
+		a.releasePayment(conf, &req.Payment, now)
+		msg := "internal error"
+		if errors.Is(err, ledger.ErrDuplicatePayment) {
+			msg = err.Error()
+		}
+		fmt.Fprint(w, string(formatError(msg)))
+		return
+	}
+	metrics.PaymentSignatures.WithLabelValues(metrics.Label(req.Payment.ChainId)).Inc()
+	jsonResponse, err := json.Marshal(struct {
+		BrokerSignature string `json:"brokerSignature"`
+	}{BrokerSignature: sig})
 	if err != nil {
 		response := string(formatError(err.Error()))
 		fmt.Fprint(w, response)
@@ -257,16 +414,6 @@ func (a *App) SignPayment(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func findExecutor(pen utils.SignaturePen, chainId int64, executor common.Address) bool {
-	config := pen.ChainConfig[chainId]
-	for _, addr := range config.AllowedExecutors {
-		if addr == executor {
-			return true
-		}
-	}
-	return false
-}
-
 func formatError(errorMsg string) []byte {
 	response := struct {
 		Error string `json:"error"`
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/D8-X/d8x-broker-server/src/utils"
+)
+
+// Healthz reports that the process is alive
+func (a *App) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"status": "ok"}`)
+}
+
+// READINESS_CACHE_TTL is how long the result of the readiness checks is
+// reused, the checks dial the rpcs of all chains
+const READINESS_CACHE_TTL = 10 * time.Second
+
+const (
+	CHECK_OK   = "ok"
+	CHECK_FAIL = "fail"
+)
+
+type readinessRes struct {
+	Ready  bool              `json:"ready"`
+	Redis  string            `json:"redis"`
+	Chains map[string]string `json:"chains"`
+}
+
+// readinessCache keeps the last readiness result. Checks run one at a time
+type readinessCache struct {
+	mu      sync.Mutex
+	res     readinessRes
+	checked time.Time
+}
+
+// checkReadiness checks Redis connectivity and rpc reachability of all
+// configured chains. Errors are logged, they may contain rpc urls with keys
+func (a *App) checkReadiness() readinessRes {
+	ctx, cancel := context.WithTimeout(context.Background(), utils.HEALTH_CHECK_TIMEOUT)
+	defer cancel()
+	res := readinessRes{Ready: true, Redis: CHECK_OK, Chains: make(map[string]string)}
+	if err := a.RedisClient.Ping(ctx); err != nil {
+		slog.Error("readiness: redis: " + err.Error())
+		res.Ready = false
+		res.Redis = CHECK_FAIL
+	}
+	rpcUrls := make(map[int64][]string)
+	for _, conf := range a.Pen.GetChainConfigs() {
+		rpcUrls[conf.ChainId] = a.Pen.GetRpcUrls(conf.ChainId)
+	}
+	for chainId, err := range utils.CheckRpcs(ctx, rpcUrls) {
+		res.Chains[chainId] = CHECK_OK
+		if err != nil {
+			slog.Error("readiness: chain " + chainId + ": " + err.Error())
+			res.Ready = false
+			res.Chains[chainId] = CHECK_FAIL
+		}
+	}
+	return res
+}
+
+// Readyz reports the readiness checks, at most READINESS_CACHE_TTL old.
+// Responds with 503 if any check fails
+func (a *App) Readyz(w http.ResponseWriter, r *http.Request) {
+	a.readiness.mu.Lock()
+	if time.Since(a.readiness.checked) >= READINESS_CACHE_TTL {
+		a.readiness.res = a.checkReadiness()
+		a.readiness.checked = time.Now()
+	}
+	res := a.readiness.res
+	a.readiness.mu.Unlock()
+
+	jsonResponse, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !res.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(jsonResponse)
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/D8-X/d8x-broker-server/src/ledger"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// parseInt64Param parses an optional integer query parameter
+func parseInt64Param(r *http.Request, name string) (int64, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, errors.New("invalid query parameter " + name)
+	}
+	return n, nil
+}
+
+// AdminGetLedgerOrders queries the signed orders.
+// Query parameters (all optional): trader, chainId, perpetualId, from, to
+// (unix timestamps), limit, offset
+func (a *App) AdminGetLedgerOrders(w http.ResponseWriter, r *http.Request) {
+	if a.Pen.Ledger == nil {
+		http.Error(w, string(formatError("ledger not configured")), http.StatusNotFound)
+		return
+	}
+	var f ledger.OrderFilter
+	f.TraderAddr = r.URL.Query().Get("trader")
+	if f.TraderAddr != "" && !common.IsHexAddress(f.TraderAddr) {
+		http.Error(w, string(formatError("invalid trader address")), http.StatusBadRequest)
+		return
+	}
+	var nums [6]int64
+	for k, name := range []string{"chainId", "perpetualId", "from", "to", "limit", "offset"} {
+		n, err := parseInt64Param(r, name)
+		if err != nil {
+			http.Error(w, string(formatError(err.Error())), http.StatusBadRequest)
+			return
+		}
+		nums[k] = n
+	}
+	f.ChainId, f.PerpetualId, f.From, f.To = nums[0], int32(nums[1]), nums[2], nums[3]
+	f.Limit, f.Offset = int(nums[4]), int(nums[5])
+
+	orders, err := a.Pen.Ledger.QueryOrders(r.Context(), f)
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusInternalServerError)
+		return
+	}
+	jsonResponse, err := json.Marshal(orders)
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonResponse)
+}
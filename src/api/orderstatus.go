@@ -0,0 +1,147 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/D8-X/d8x-broker-server/src/ledger"
+	"github.com/D8-X/d8x-broker-server/src/utils"
+)
+
+const (
+	// interval of the check for submitted orders past their deadline
+	orderExpiryInterval = 10 * time.Second
+	// expired orders closed per check
+	orderExpiryBatch = 100
+)
+
+// APIOrderStatusRes is the response of POST /order-status
+type APIOrderStatusRes struct {
+	Statuses []utils.OrderStatus `json:"statuses"`
+	// error per order id
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// closeOrder sets the final status of the order, publishes the status to
+// the executors if the order was submitted and records it in the ledger
+func (a *App) closeOrder(orderId, status string, now time.Time) (utils.OrderStatus, error) {
+	st, err := a.RedisClient.CloseOrder(orderId, status, now, time.Duration(a.OrderStreamMaxAgeSec)*time.Second)
+	if err != nil {
+		return st, err
+	}
+	slog.Info("order " + orderId + " " + status)
+	if a.Pen.Ledger != nil {
+		err = a.Pen.Ledger.RecordStatus(context.Background(), orderId, status, now.Unix())
+		if err != nil {
+			slog.Error("ledger: recording status of order " + orderId + ": " + err.Error())
+		}
+	}
+	return st, nil
+}
+
+// expireOrders closes submitted orders past their deadline until ctx is
+// cancelled
+func (a *App) expireOrders(ctx context.Context) {
+	ticker := time.NewTicker(orderExpiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.closeExpiredOrders(time.Now())
+		}
+	}
+}
+
+// closeExpiredOrders closes submitted orders with a deadline before now.
+// Several broker instances may run the check, each order is closed once
+func (a *App) closeExpiredOrders(now time.Time) {
+	orderIds, err := a.RedisClient.ExpiredOrders(now, orderExpiryBatch)
+	if err != nil {
+		slog.Error("expired orders: " + err.Error())
+		return
+	}
+	for _, orderId := range orderIds {
+		_, err = a.closeOrder(orderId, ledger.STATUS_EXPIRED, now)
+		if errors.Is(err, utils.ErrOrderNotFound) || errors.Is(err, utils.ErrOrderStatus) {
+			// closed by another instance or status expired
+			err = a.RedisClient.RemoveOrderDeadline(orderId)
+		}
+		if err != nil {
+			slog.Error("expiring order " + orderId + ": " + err.Error())
+		}
+	}
+}
+
+// PostOrderStatus reports the execution or cancellation of orders
+func (a *App) PostOrderStatus(w http.ResponseWriter, r *http.Request) {
+	var jsonData []byte
+	if r.Body != nil {
+		defer r.Body.Close()
+		jsonData, _ = io.ReadAll(r.Body)
+	}
+	var req struct {
+		OrderIds []string `json:"orderIds"`
+		Status   string   `json:"status"`
+	}
+	err := json.Unmarshal(jsonData, &req)
+	if err != nil || len(req.OrderIds) == 0 ||
+		(req.Status != ledger.STATUS_EXECUTED && req.Status != ledger.STATUS_CANCELLED) {
+		errMsg := `Wrong argument types. Usage: { "orderIds": ["0xABCE...",...], "status": "executed" | "cancelled" }`
+		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+		return
+	}
+	res := APIOrderStatusRes{Statuses: make([]utils.OrderStatus, 0, len(req.OrderIds))}
+	now := time.Now()
+	for _, orderId := range req.OrderIds {
+		orderId = strings.TrimPrefix(orderId, "0x")
+		st, err := a.closeOrder(orderId, req.Status, now)
+		if err != nil {
+			if res.Errors == nil {
+				res.Errors = make(map[string]string)
+			}
+			res.Errors[orderId] = err.Error()
+			continue
+		}
+		res.Statuses = append(res.Statuses, st)
+	}
+	jsonResponse, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonResponse)
+}
+
+// GetOrderStatus returns the status of an order
+func (a *App) GetOrderStatus(w http.ResponseWriter, r *http.Request) {
+	orderId := strings.TrimPrefix(r.URL.Query().Get("orderId"), "0x")
+	if orderId == "" {
+		http.Error(w, string(formatError("orderId required")), http.StatusBadRequest)
+		return
+	}
+	st, err := a.RedisClient.GetOrderStatus(orderId)
+	if errors.Is(err, utils.ErrOrderNotFound) {
+		http.Error(w, string(formatError(err.Error())), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusInternalServerError)
+		return
+	}
+	jsonResponse, err := json.Marshal(st)
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonResponse)
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/D8-X/d8x-broker-server/src/ledger"
+	"github.com/D8-X/d8x-broker-server/src/utils"
+)
+
+func TestOrderStatusLifecycle(t *testing.T) {
+	a := newTestApp(t)
+	trader := "0x9d5aaB428e98678d0E645ea4AeBd25f744341a05"
+	var orderIds []string
+	for _, amount := range []float64{1, 2} {
+		w := httptest.NewRecorder()
+		a.SignOrder(w, httptest.NewRequest("POST", "/sign-order", bytes.NewReader(signOrderBody(trader, 100001, amount, 1000, ""))))
+		var res utils.APIBrokerSignatureRes
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%s: %v", w.Body.String(), err)
+		}
+		orderIds = append(orderIds, res.OrderId)
+	}
+	body, _ := json.Marshal(map[string][]string{"orderIds": orderIds})
+	w := httptest.NewRecorder()
+	a.OrdersSubmitted(w, httptest.NewRequest("POST", "/orders-submitted", bytes.NewReader(body)))
+	if w.Code != 200 {
+		t.Fatalf("submission failed: %s", w.Body.String())
+	}
+
+	postStatus := func(status string, ids ...string) (int, APIOrderStatusRes) {
+		body, _ := json.Marshal(map[string]any{"orderIds": ids, "status": status})
+		w := httptest.NewRecorder()
+		a.PostOrderStatus(w, httptest.NewRequest("POST", "/order-status", bytes.NewReader(body)))
+		var res APIOrderStatusRes
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return w.Code, res
+	}
+	if code, _ := postStatus(ledger.STATUS_EXPIRED, orderIds[0]); code != 400 {
+		t.Errorf("expired status accepted from the back-end: %d", code)
+	}
+	code, res := postStatus(ledger.STATUS_CANCELLED, "0x"+orderIds[0], "unknown")
+	if code != 200 || len(res.Statuses) != 1 || res.Statuses[0].Status != ledger.STATUS_CANCELLED || res.Errors["unknown"] == "" {
+		t.Fatalf("unexpected response %d %+v", code, res)
+	}
+	if _, res = postStatus(ledger.STATUS_EXECUTED, orderIds[0]); res.Errors[orderIds[0]] == "" {
+		t.Errorf("cancelled order executed %+v", res)
+	}
+
+	// the second order expires at its deadline
+	a.closeExpiredOrders(time.Unix(1_900_000_001, 0))
+	// orders without status are removed from the deadline index
+	client := *a.RedisClient.Client
+	client.Do(context.Background(), client.B().Zadd().Key(utils.ORDER_DEADLINES_REDIS).ScoreMember().ScoreMember(1, "gone").Build())
+	a.closeExpiredOrders(time.Unix(1_900_000_001, 0))
+	if ids, _ := a.RedisClient.ExpiredOrders(time.Unix(1_900_000_001, 0), 10); len(ids) != 0 {
+		t.Errorf("orders left in the deadline index: %v", ids)
+	}
+	w = httptest.NewRecorder()
+	a.GetOrderStatus(w, httptest.NewRequest("GET", "/order-status?orderId="+orderIds[1], nil))
+	var st utils.OrderStatus
+	json.Unmarshal(w.Body.Bytes(), &st)
+	if st.Status != ledger.STATUS_EXPIRED || st.Topic != "100001:42161" {
+		t.Errorf("unexpected status %s", w.Body.String())
+	}
+
+	// executors receive the status changes
+	entries, err := a.RedisClient.OrderStreamRange("-", "+", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var statuses []string
+	for _, e := range entries {
+		if e.Status != nil {
+			statuses = append(statuses, e.Status.OrderId+":"+e.Status.Status)
+		}
+	}
+	if len(statuses) != 2 || statuses[0] != orderIds[0]+":cancelled" || statuses[1] != orderIds[1]+":expired" {
+		t.Errorf("unexpected status events %v", statuses)
+	}
+	recs, _ := a.Pen.Ledger.QueryOrders(context.Background(), ledger.OrderFilter{TraderAddr: trader})
+	for _, rec := range recs {
+		if rec.Status != map[string]string{orderIds[0]: "cancelled", orderIds[1]: "expired"}[rec.OrderId] {
+			t.Errorf("ledger status of %s: %s", rec.OrderId, rec.Status)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/D8-X/d8x-broker-server/src/ledger"
+	"github.com/D8-X/d8x-broker-server/src/utils"
+	"github.com/D8-X/d8x-futures-go-sdk/pkg/d8x_futures"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// allowed clock difference for payment timestamps in the future
+const PAYMENT_MAX_FUTURE_SEC = 60
+
+// checkPayment rejects stale payments and payments without amount
+func checkPayment(conf utils.ChainConfig, pay *d8x_futures.PaySummary, now time.Time) error {
+	ts := int64(pay.Timestamp)
+	if ts < now.Unix()-conf.PaymentMaxAgeSec {
+		return fmt.Errorf("payment timestamp older than %d seconds", conf.PaymentMaxAgeSec)
+	}
+	if ts > now.Unix()+PAYMENT_MAX_FUTURE_SEC {
+		return errors.New("payment timestamp in the future")
+	}
+	if pay.TotalAmount == nil || pay.TotalAmount.Sign() <= 0 {
+		return errors.New("invalid payment amount")
+	}
+	return nil
+}
+
+// claimPayment reserves the payment id of the executor. Returns false if
+// the id was used before. With ledger, the signed ids are kept there and the
+// claim only lasts for the accepted timestamp range, without ledger the
+// claim does not expire
+func (a *App) claimPayment(ctx context.Context, conf utils.ChainConfig, pay *d8x_futures.PaySummary) (bool, error) {
+	var ttl time.Duration
+	if a.Pen.Ledger != nil {
+		used, err := a.Pen.Ledger.HasPayment(ctx, pay.ChainId, pay.Executor.Hex(), pay.Id)
+		if err != nil || used {
+			return false, err
+		}
+		ttl = time.Duration(conf.PaymentMaxAgeSec+PAYMENT_MAX_FUTURE_SEC) * time.Second
+	}
+	return a.RedisClient.ClaimPayment(pay.ChainId, pay.Executor, pay.Id, ttl)
+}
+
+// reservePayment counts the payment towards the daily cap of the executor
+// for the token. Returns false if the cap would be exceeded. The spending
+// is tracked in Redis, so the cap holds across broker replicas
+func (a *App) reservePayment(conf utils.ChainConfig, pay *d8x_futures.PaySummary, now time.Time) (bool, error) {
+	cap, exists := conf.PaymentDailyCaps[pay.Token]
+	if !exists {
+		return true, nil
+	}
+	return a.RedisClient.ReservePaymentAmount(pay.ChainId, pay.Executor, pay.Token, pay.Id, pay.TotalAmount, cap, now)
+}
+
+// releasePayment releases the payment id and the reserved amount of a
+// payment that was not signed
+func (a *App) releasePayment(conf utils.ChainConfig, pay *d8x_futures.PaySummary, now time.Time) {
+	err := a.RedisClient.ReleasePayment(pay.ChainId, pay.Executor, pay.Id)
+	if _, exists := conf.PaymentDailyCaps[pay.Token]; exists {
+		err = errors.Join(err, a.RedisClient.ReleasePaymentAmount(pay.ChainId, pay.Executor, pay.Token, pay.Id, now))
+	}
+	if err != nil {
+		slog.Error("releasing payment: "+err.Error(), "chainId", pay.ChainId, "executor", pay.Executor.Hex(), "id", pay.Id)
+	}
+}
+
+// recordPayment stores the signed payment in the ledger
+func (a *App) recordPayment(ctx context.Context, pay *d8x_futures.PaySummary, sig string) error {
+	if a.Pen.Ledger == nil {
+		return nil
+	}
+	return a.Pen.Ledger.RecordPayment(ctx, ledger.PaymentRecord{
+		ChainId:       pay.ChainId,
+		PaymentId:     pay.Id,
+		Executor:      pay.Executor.Hex(),
+		Payer:         pay.Payer.Hex(),
+		Token:         pay.Token.Hex(),
+		TotalAmount:   pay.TotalAmount.String(),
+		Timestamp:     pay.Timestamp,
+		MultiPayCtrct: pay.MultiPayCtrct.Hex(),
+		Signature:     sig,
+		SignedAt:      time.Now().Unix(),
+	})
+}
+
+// AdminGetLedgerPayments queries the signed payments.
+// Query parameters (all optional): chainId, executor, payer, token, from, to
+// (unix timestamps), limit, offset
+func (a *App) AdminGetLedgerPayments(w http.ResponseWriter, r *http.Request) {
+	if a.Pen.Ledger == nil {
+		http.Error(w, string(formatError("ledger not configured")), http.StatusNotFound)
+		return
+	}
+	var f ledger.PaymentFilter
+	for _, p := range []struct {
+		name string
+		val  *string
+	}{{"executor", &f.Executor}, {"payer", &f.Payer}, {"token", &f.Token}} {
+		*p.val = r.URL.Query().Get(p.name)
+		if *p.val != "" && !common.IsHexAddress(*p.val) {
+			http.Error(w, string(formatError("invalid "+p.name+" address")), http.StatusBadRequest)
+			return
+		}
+	}
+	var nums [5]int64
+	for k, name := range []string{"chainId", "from", "to", "limit", "offset"} {
+		n, err := parseInt64Param(r, name)
+		if err != nil {
+			http.Error(w, string(formatError(err.Error())), http.StatusBadRequest)
+			return
+		}
+		nums[k] = n
+	}
+	f.ChainId, f.From, f.To, f.Limit, f.Offset = nums[0], nums[1], nums[2], int(nums[3]), int(nums[4])
+
+	payments, err := a.Pen.Ledger.QueryPayments(r.Context(), f)
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusInternalServerError)
+		return
+	}
+	jsonResponse, err := json.Marshal(payments)
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonResponse)
+}
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"context"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/D8-X/d8x-broker-server/src/ledger"
+	"github.com/D8-X/d8x-broker-server/src/utils"
+	"github.com/D8-X/d8x-futures-go-sdk/pkg/d8x_futures"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestCheckPayment(t *testing.T) {
+	token := common.HexToAddress("0x2d10075E54356E16Ebd5C6BB5194290709B69C1e")
+	executor := common.HexToAddress("0xDa47a0CAc77D50114F2725D06a2Ce887cF9f4D98")
+	conf := utils.ChainConfig{
+		ChainId:          42161,
+		PaymentMaxAgeSec: 600,
+		PaymentDailyCaps: map[common.Address]*big.Int{token: big.NewInt(1000)},
+	}
+	now := time.Now()
+	pay := func(id uint32, ts time.Time, amount int64) *d8x_futures.PaySummary {
+		return &d8x_futures.PaySummary{
+			ChainId:     42161,
+			Executor:    executor,
+			Token:       token,
+			Id:          id,
+			Timestamp:   uint32(ts.Unix()),
+			TotalAmount: big.NewInt(amount),
+		}
+	}
+	for _, tc := range []struct {
+		name string
+		pay  *d8x_futures.PaySummary
+		err  string
+	}{
+		{"stale", pay(1, now.Add(-time.Hour), 1), "older than"},
+		{"future", pay(1, now.Add(time.Hour), 1), "future"},
+		{"zero amount", pay(1, now, 0), "amount"},
+	} {
+		err := checkPayment(conf, tc.pay, now)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		}
+	}
+
+	redis, _ := newTestRedis(t)
+	a := &App{RedisClient: redis}
+	reserve := func(p *d8x_futures.PaySummary) bool {
+		ok, err := a.reservePayment(conf, p, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+	if !reserve(pay(1, now, 900)) || !reserve(pay(2, now, 100)) {
+		t.Errorf("payment within cap rejected")
+	}
+	if reserve(pay(3, now, 1)) {
+		t.Errorf("payment exceeding cap accepted")
+	}
+	// released payments do not count towards the cap
+	a.releasePayment(conf, pay(2, now, 100), now)
+	if !reserve(pay(3, now, 100)) {
+		t.Errorf("payment rejected after release")
+	}
+	// other tokens are not capped
+	other := pay(4, now, 1_000_000)
+	other.Token = common.HexToAddress("0x1")
+	if !reserve(other) {
+		t.Errorf("uncapped token rejected")
+	}
+}
+
+func TestClaimPayment(t *testing.T) {
+	conf := utils.ChainConfig{ChainId: 42161, PaymentMaxAgeSec: 600}
+	executor := common.HexToAddress("0xDa47a0CAc77D50114F2725D06a2Ce887cF9f4D98")
+	pay := func(id uint32) *d8x_futures.PaySummary {
+		return &d8x_futures.PaySummary{ChainId: 42161, Executor: executor, Id: id}
+	}
+	claim := func(a *App, p *d8x_futures.PaySummary) bool {
+		fresh, err := a.claimPayment(context.Background(), conf, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fresh
+	}
+
+	// ids in the ledger stay used after the claim expired
+	a := newTestApp(t)
+	err := a.Pen.Ledger.RecordPayment(context.Background(), ledger.PaymentRecord{
+		ChainId: 42161, PaymentId: 1, Executor: executor.Hex(), TotalAmount: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claim(a, pay(1)) {
+		t.Errorf("payment id of the ledger claimed")
+	}
+	if !claim(a, pay(2)) || claim(a, pay(2)) {
+		t.Errorf("payment id not claimed once")
+	}
+
+	// without ledger the claim does not expire
+	redis, s := newTestRedis(t)
+	a = &App{Pen: &utils.SignaturePen{}, RedisClient: redis}
+	if !claim(a, pay(1)) {
+		t.Fatalf("payment id not claimed")
+	}
+	s.FastForward(365 * 24 * time.Hour)
+	if claim(a, pay(1)) {
+		t.Errorf("payment id claimed twice")
+	}
+}
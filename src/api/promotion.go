@@ -0,0 +1,196 @@
+package api
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/D8-X/d8x-broker-server/src/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/go-chi/chi/v5"
+)
+
+// PROMOTIONS_CACHE_TTL is how long the promotions are cached. Promotions
+// created or deleted on other replicas apply after at most this time
+const PROMOTIONS_CACHE_TTL = 10 * time.Second
+
+type promotionCache struct {
+	mu     sync.Mutex
+	promos []utils.Promotion
+	loaded time.Time
+}
+
+// activePromotions returns the cached promotions. Reloading prunes
+// expired promotions from Redis
+func (a *App) activePromotions(now time.Time) ([]utils.Promotion, error) {
+	c := &a.promotions
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.loaded.IsZero() || now.Sub(c.loaded) >= PROMOTIONS_CACHE_TTL {
+		promos, err := a.RedisClient.PruneExpiredPromotions(now)
+		if err != nil {
+			return nil, err
+		}
+		c.promos, c.loaded = promos, now
+	}
+	return c.promos, nil
+}
+
+// invalidatePromotions reloads the promotions on the next lookup
+func (a *App) invalidatePromotions() {
+	a.promotions.mu.Lock()
+	defer a.promotions.mu.Unlock()
+	a.promotions.loaded = time.Time{}
+}
+
+// applicablePromotions returns the active promotions of the chain and
+// perpetual ordered by the resulting fee, lowest first. Promotions with a
+// usage limit require a trader address
+func (a *App) applicablePromotions(traderAddr string, chainId, perpetualId int64, fee uint16) []utils.Promotion {
+	now := time.Now()
+	promos, err := a.activePromotions(now)
+	if err != nil {
+		slog.Error("promotions: " + err.Error())
+		return nil
+	}
+	var applicable []utils.Promotion
+	for _, p := range promos {
+		if !p.Applies(chainId, perpetualId, now) {
+			continue
+		}
+		if p.MaxUsesPerTrader > 0 && !common.IsHexAddress(traderAddr) {
+			continue
+		}
+		applicable = append(applicable, p)
+	}
+	slices.SortStableFunc(applicable, func(p, q utils.Promotion) int {
+		return cmp.Compare(p.Fee(fee), q.Fee(fee))
+	})
+	return applicable
+}
+
+// bestPromotion returns the active promotion with the lowest fee for the
+// trader, nil if none applies. Promotions the trader used up are skipped
+func (a *App) bestPromotion(traderAddr string, chainId, perpetualId int64, fee uint16) *utils.Promotion {
+	for _, p := range a.applicablePromotions(traderAddr, chainId, perpetualId, fee) {
+		if p.MaxUsesPerTrader == 0 {
+			return &p
+		}
+		n, err := a.RedisClient.PromotionUsage(p.Id, traderAddr)
+		if err != nil {
+			slog.Error("promotion " + p.Id + " usage: " + err.Error())
+			continue
+		}
+		if n < p.MaxUsesPerTrader {
+			return &p
+		}
+	}
+	return nil
+}
+
+// reserveBestPromotion is bestPromotion for an order that is signed: the
+// order is counted towards the usage limit of the promotion
+func (a *App) reserveBestPromotion(traderAddr string, chainId, perpetualId int64, fee uint16) *utils.Promotion {
+	for _, p := range a.applicablePromotions(traderAddr, chainId, perpetualId, fee) {
+		if p.MaxUsesPerTrader == 0 {
+			return &p
+		}
+		if a.reservePromotion(p, traderAddr) {
+			return &p
+		}
+	}
+	return nil
+}
+
+// reservePromotion counts the order towards the trader's usage limit of
+// the promotion. Returns false if the trader used up the promotion or the
+// usage cannot be counted
+func (a *App) reservePromotion(p utils.Promotion, traderAddr string) bool {
+	if p.MaxUsesPerTrader == 0 {
+		return true
+	}
+	ok, err := a.RedisClient.ReservePromotion(p, traderAddr)
+	if err != nil {
+		slog.Error("promotion " + p.Id + " usage of " + traderAddr + ": " + err.Error())
+		return false
+	}
+	return ok
+}
+
+// releasePromotion takes back the order counted with reservePromotion if
+// it was not signed
+func (a *App) releasePromotion(p *utils.Promotion, traderAddr string) {
+	if p == nil || p.MaxUsesPerTrader == 0 {
+		return
+	}
+	err := a.RedisClient.ReleasePromotion(*p, traderAddr)
+	if err != nil {
+		slog.Error("promotion " + p.Id + " release of " + traderAddr + ": " + err.Error())
+	}
+}
+
+func (a *App) AdminGetPromotions(w http.ResponseWriter, r *http.Request) {
+	promos, err := a.RedisClient.ListPromotions()
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusInternalServerError)
+		return
+	}
+	jsonResponse, err := json.Marshal(promos)
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonResponse)
+}
+
+func (a *App) AdminCreatePromotion(w http.ResponseWriter, r *http.Request) {
+	var jsonData []byte
+	if r.Body != nil {
+		defer r.Body.Close()
+		jsonData, _ = io.ReadAll(r.Body)
+	}
+	var req utils.Promotion
+	err := json.Unmarshal(jsonData, &req)
+	if err != nil {
+		errMsg := `Wrong argument types. Usage: {"id": "weekend", "start": 1718000000, "end": 1718200000, "chainId": 42161, "perpetualIds": [100001], "feeTbps": 0, "discountPerc": 50, "maxUsesPerTrader": 10}`
+		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+		return
+	}
+	promo, err := a.RedisClient.CreatePromotion(req)
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusBadRequest)
+		return
+	}
+	a.invalidatePromotions()
+	slog.Info("admin: promotion created", "id", promo.Id, "start", promo.Start, "end", promo.End)
+	jsonResponse, err := json.Marshal(promo)
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonResponse)
+}
+
+func (a *App) AdminDeletePromotion(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	err := a.RedisClient.DeletePromotion(id)
+	if err == utils.ErrPromotionNotFound {
+		http.Error(w, string(formatError(err.Error())), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusInternalServerError)
+		return
+	}
+	a.invalidatePromotions()
+	slog.Info("admin: promotion deleted", "id", id)
+	fmt.Fprint(w, `{"promotion": "deleted"}`)
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/D8-X/d8x-broker-server/src/utils"
+)
+
+func TestPromotions(t *testing.T) {
+	a := newTestApp(t)
+	trader := "0x9d5aaB428e98678d0E645ea4AeBd25f744341a05"
+	now := time.Now().Unix()
+	feeCap := uint16(20)
+	for _, p := range []utils.Promotion{
+		{Id: "cap", Start: now - 10, End: now + 3600, ChainId: 42161, FeeTbps: &feeCap},
+		{Id: "launch", Start: now - 10, End: now + 3600, ChainId: 42161, PerpetualIds: []int64{100002},
+			DiscountPerc: 100, MaxUsesPerTrader: 1},
+		{Id: "future", Start: now + 3600, End: now + 7200, DiscountPerc: 100},
+	} {
+		if _, err := a.RedisClient.CreatePromotion(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		perpetualId int
+		fee         uint16
+		tier        string
+	}{
+		{100001, 20, "promo-cap"},
+		{100002, 0, "promo-launch"},
+		{-1, 20, "promo-cap"},
+	} {
+		fee, info := a.getBrokerFee(context.Background(), trader, 42161, tc.perpetualId)
+		if fee != tc.fee || info.Tier != tc.tier {
+			t.Errorf("perpetual %d: fee %d tier %s", tc.perpetualId, fee, info.Tier)
+		}
+	}
+	if fee, info := a.getBrokerFee(context.Background(), trader, 1, 100002); fee != 60 || info.Promotion != nil {
+		t.Errorf("promotion of other chain applied: %d", fee)
+	}
+
+	// the launch promotion applies to one order of the trader
+	sign := func() uint16 {
+		w := httptest.NewRecorder()
+		a.SignOrder(w, httptest.NewRequest("POST", "/sign-order", bytes.NewReader(signOrderBody(trader, 100002, 1, 1000, ""))))
+		var res utils.APIBrokerSignatureRes
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%s: %v", w.Body.String(), err)
+		}
+		return res.Order.BrokerFeeTbps
+	}
+	if fee := sign(); fee != 0 {
+		t.Errorf("unexpected fee of first order %d", fee)
+	}
+	if fee := sign(); fee != 20 {
+		t.Errorf("unexpected fee of second order %d", fee)
+	}
+
+	// a quoted promotion is counted and rejected once used up
+	other := "0x0000000000000000000000000000000000000001"
+	w := httptest.NewRecorder()
+	a.GetFeeQuote(w, httptest.NewRequest("GET", "/fee-quote?chain=42161&perpetualId=100002&addr="+other, nil))
+	var quote utils.APIFeeQuoteRes
+	if err := json.Unmarshal(w.Body.Bytes(), &quote); err != nil || quote.Promotion != "launch" {
+		t.Fatalf("unexpected quote %s: %v", w.Body.String(), err)
+	}
+	signWithQuote := func() int {
+		var req utils.APIBrokerOrderSignatureReq
+		json.Unmarshal(signOrderBody(other, 100002, 1, 1000, ""), &req)
+		req.FeeQuote = quote.QuoteToken
+		body, _ := json.Marshal(req)
+		w := httptest.NewRecorder()
+		a.SignOrder(w, httptest.NewRequest("POST", "/sign-order", bytes.NewReader(body)))
+		return w.Code
+	}
+	if code := signWithQuote(); code != 200 {
+		t.Errorf("quoted promotion rejected: %d", code)
+	}
+	if code := signWithQuote(); code != 400 {
+		t.Errorf("used up promotion signed: %d", code)
+	}
+
+	// promotions are cached until changed by the admin
+	future, err := a.RedisClient.GetPromotion("future")
+	if err != nil {
+		t.Fatal(err)
+	}
+	future.Id, future.Start = "now", now-10
+	if _, err := a.RedisClient.CreatePromotion(future); err != nil {
+		t.Fatal(err)
+	}
+	if fee, _ := a.getBrokerFee(context.Background(), trader, 42161, 100001); fee != 20 {
+		t.Errorf("promotions not cached: %d", fee)
+	}
+	a.invalidatePromotions()
+	if fee, _ := a.getBrokerFee(context.Background(), trader, 42161, 100001); fee != 0 {
+		t.Errorf("new promotion not applied: %d", fee)
+	}
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/D8-X/d8x-broker-server/src/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const DEFAULT_FEE_QUOTE_TTL_SEC = 60
+
+func (a *App) feeQuoteTtl() time.Duration {
+	if a.FeeQuoteTtlSec <= 0 {
+		return DEFAULT_FEE_QUOTE_TTL_SEC * time.Second
+	}
+	return time.Duration(a.FeeQuoteTtlSec) * time.Second
+}
+
+// GetFeeQuote returns the broker fee with a signed quote token that
+// /sign-order accepts until the quote expires.
+// Query parameters: chain, perpetualId, addr (all required)
+func (a *App) GetFeeQuote(w http.ResponseWriter, r *http.Request) {
+	addr := r.URL.Query().Get("addr")
+	if !common.IsHexAddress(addr) {
+		http.Error(w, string(formatError("invalid addr")), http.StatusBadRequest)
+		return
+	}
+	var nums [2]int64
+	for k, name := range []string{"chain", "perpetualId"} {
+		n, err := parseInt64Param(r, name)
+		if err != nil || n <= 0 {
+			http.Error(w, string(formatError("invalid "+name)), http.StatusBadRequest)
+			return
+		}
+		nums[k] = n
+	}
+	chainId, perpetualId := nums[0], nums[1]
+	fee, info := a.getBrokerFee(r.Context(), addr, int(chainId), int(perpetualId))
+	q := utils.FeeQuote{
+		TraderAddr:    strings.ToLower(addr),
+		ChainId:       chainId,
+		PerpetualId:   perpetualId,
+		BrokerFeeTbps: fee,
+		FeeTier:       info.Tier,
+		Vip3Level:     info.Vip3Level,
+		Expiry:        time.Now().Add(a.feeQuoteTtl()).Unix(),
+	}
+	if info.Promotion != nil {
+		q.Promotion = info.Promotion.Id
+	}
+	token, err := a.Pen.SignFeeQuote(q)
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusBadRequest)
+		return
+	}
+	jsonResponse, err := json.Marshal(utils.APIFeeQuoteRes{FeeQuote: q, QuoteToken: token})
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonResponse)
+}
+
+// checkFeeQuote verifies the quote token and that it is valid for the order
+func (a *App) checkFeeQuote(token string, req utils.APIBrokerOrderSignatureReq) (utils.FeeQuote, error) {
+	q, err := a.Pen.VerifyFeeQuote(token, time.Now().Unix())
+	if err != nil {
+		return q, err
+	}
+	if !strings.EqualFold(q.TraderAddr, req.Order.TraderAddr) || q.ChainId != req.ChainId ||
+		q.PerpetualId != int64(req.Order.PerpetualId) {
+		return q, fmt.Errorf("fee quote is for trader %s, chain %d, perpetual %d",
+			q.TraderAddr, q.ChainId, q.PerpetualId)
+	}
+	return q, nil
+}
+
+// quotedFee returns the fee of the quote and how it was determined. The
+// order is counted towards the usage limit of the quoted promotion, the
+// quote is rejected if the promotion was deleted or used up
+func (a *App) quotedFee(q utils.FeeQuote) (uint16, utils.FeeInfo, error) {
+	info := utils.FeeInfo{Tier: q.FeeTier, Vip3Level: q.Vip3Level}
+	// referrer rebates only if the quoted fee includes the referral discount
+	if ref := a.traderReferral(q.TraderAddr); ref != nil {
+		tier := utils.FEE_TIER_REFERRAL + ref.Code
+		if q.FeeTier == tier || strings.HasSuffix(q.FeeTier, "+"+tier) {
+			info.Referral = ref
+		}
+	}
+	if q.Promotion != "" {
+		p, err := a.RedisClient.GetPromotion(q.Promotion)
+		if err != nil {
+			return 0, info, errors.New("promotion " + q.Promotion + " of the fee quote: " + err.Error())
+		}
+		if !a.reservePromotion(p, q.TraderAddr) {
+			return 0, info, errors.New("promotion " + q.Promotion + " of the fee quote used up")
+		}
+		info.Promotion = &p
+	}
+	return q.BrokerFeeTbps, info, nil
+}
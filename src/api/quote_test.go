@@ -0,0 +1,81 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/D8-X/d8x-broker-server/src/utils"
+)
+
+func TestFeeQuote(t *testing.T) {
+	a := newTestApp(t)
+	trader := "0x9d5aaB428e98678d0E645ea4AeBd25f744341a05"
+
+	w := httptest.NewRecorder()
+	a.GetFeeQuote(w, httptest.NewRequest("GET", "/fee-quote?chain=42161&addr="+trader, nil))
+	if w.Code != 400 {
+		t.Errorf("quote without perpetual: %d %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	a.GetFeeQuote(w, httptest.NewRequest("GET", "/fee-quote?chain=42161&perpetualId=100001&addr="+trader, nil))
+	var quote utils.APIFeeQuoteRes
+	if err := json.Unmarshal(w.Body.Bytes(), &quote); err != nil {
+		t.Fatalf("%s: %v", w.Body.String(), err)
+	}
+	if quote.BrokerFeeTbps != 60 || quote.Expiry < time.Now().Unix()+DEFAULT_FEE_QUOTE_TTL_SEC-5 {
+		t.Fatalf("unexpected quote %+v", quote)
+	}
+
+	// the fee changes after the quote
+	a.BrokerFeeTbps = 80
+	signWithQuote := func(perpetualId int32, token string) (int, uint16) {
+		var req utils.APIBrokerOrderSignatureReq
+		json.Unmarshal(signOrderBody(trader, perpetualId, 2, 1000, ""), &req)
+		req.FeeQuote = token
+		body, _ := json.Marshal(req)
+		w := httptest.NewRecorder()
+		a.SignOrder(w, httptest.NewRequest("POST", "/sign-order", bytes.NewReader(body)))
+		var res utils.APIBrokerSignatureRes
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return w.Code, res.Order.BrokerFeeTbps
+	}
+	if code, fee := signWithQuote(100001, quote.QuoteToken); code != 200 || fee != 60 {
+		t.Errorf("quoted fee not signed: %d %d", code, fee)
+	}
+	if code, fee := signWithQuote(100001, ""); code != 200 || fee != 80 {
+		t.Errorf("unexpected fee without quote: %d %d", code, fee)
+	}
+	if code, _ := signWithQuote(100002, quote.QuoteToken); code != 400 {
+		t.Errorf("quote for other perpetual accepted: %d", code)
+	}
+
+	// tampered fee
+	payload, sig, _ := strings.Cut(quote.QuoteToken, ".")
+	q := quote.FeeQuote
+	q.BrokerFeeTbps = 0
+	tampered, _ := a.Pen.SignFeeQuote(q)
+	tamperedPayload, _, _ := strings.Cut(tampered, ".")
+	if code, _ := signWithQuote(100001, tamperedPayload+"."+sig); code != 400 {
+		t.Errorf("tampered quote accepted: %d", code)
+	}
+	if code, _ := signWithQuote(100001, payload+".00"); code != 400 {
+		t.Errorf("invalid signature accepted: %d", code)
+	}
+
+	q = quote.FeeQuote
+	q.Expiry = time.Now().Unix() - 1
+	expired, err := a.Pen.SignFeeQuote(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.Pen.VerifyFeeQuote(expired, time.Now().Unix()); err != utils.ErrFeeQuoteExpired {
+		t.Errorf("expected expired quote, got %v", err)
+	}
+	if code, _ := signWithQuote(100001, expired); code != 400 {
+		t.Errorf("expired quote accepted: %d", code)
+	}
+}
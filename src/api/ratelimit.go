@@ -0,0 +1,136 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/D8-X/d8x-broker-server/src/utils"
+)
+
+// RateLimits configures the token buckets for order signature requests
+type RateLimits struct {
+	Trader utils.RateLimit
+	Ip     utils.RateLimit
+	ApiKey utils.RateLimit
+	// number of reverse proxies in front of the broker that append to
+	// X-Forwarded-For, 0 to ignore the proxy headers
+	TrustedProxies int
+}
+
+func (l RateLimits) Enabled() bool {
+	return l.Trader.Enabled() || l.Ip.Enabled() || l.ApiKey.Enabled()
+}
+
+// orderRateLimit limits order signature and fee quote requests per client
+// ip, API key and trader address (the order's trader or the addr query
+// parameter). Rate limiting is skipped if Redis is not available
+func (a *App) orderRateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.RateLimits.Enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		type bucket struct {
+			kind  string
+			id    string
+			limit utils.RateLimit
+		}
+		buckets := []bucket{{utils.RATELIMIT_IP, a.clientIp(r), a.RateLimits.Ip}}
+		if keyId := apiKeyFromContext(r.Context()); keyId != "" {
+			buckets = append(buckets, bucket{utils.RATELIMIT_APIKEY, keyId, a.RateLimits.ApiKey})
+		}
+		if a.RateLimits.Trader.Enabled() {
+			trader := r.URL.Query().Get("addr")
+			if r.Method == http.MethodPost && r.Body != nil {
+				body, _ := io.ReadAll(r.Body)
+				r.Body.Close()
+				r.Body = io.NopCloser(bytes.NewReader(body))
+				var req utils.APIBrokerOrderSignatureReq
+				if json.Unmarshal(body, &req) == nil {
+					trader = req.Order.TraderAddr
+				}
+			}
+			if trader != "" {
+				buckets = append(buckets, bucket{utils.RATELIMIT_TRADER, trader, a.RateLimits.Trader})
+			}
+		}
+		now := time.Now()
+		for k, b := range buckets {
+			allowed, wait, err := a.RedisClient.TakeRateLimitToken(b.kind, b.id, b.limit, now)
+			if err != nil {
+				slog.Error("rate limit " + b.kind + ": " + err.Error())
+				continue
+			}
+			if !allowed {
+				// rejected requests do not count towards the other limits
+				for _, taken := range buckets[:k] {
+					err = a.RedisClient.RefundRateLimitToken(taken.kind, taken.id, taken.limit)
+					if err != nil {
+						slog.Error("rate limit refund " + taken.kind + ": " + err.Error())
+					}
+				}
+				slog.Info("rate limit exceeded", "kind", b.kind, "id", b.id)
+				w.Header().Set("Retry-After", strconv.FormatInt(utils.RetryAfterSec(wait), 10))
+				http.Error(w, string(formatError("rate limit exceeded ("+b.kind+")")), http.StatusTooManyRequests)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIp returns the ip of the client. Behind TrustedProxies proxies,
+// it is the entry of X-Forwarded-For appended by the outermost proxy, the
+// entries left of it are set by the client
+func (a *App) clientIp(r *http.Request) string {
+	if n := a.RateLimits.TrustedProxies; n > 0 {
+		var fwd []string
+		for _, h := range r.Header.Values("X-Forwarded-For") {
+			fwd = append(fwd, strings.Split(h, ",")...)
+		}
+		if len(fwd) > 0 {
+			return strings.TrimSpace(fwd[max(len(fwd)-n, 0)])
+		}
+		if ip := r.Header.Get("X-Real-Ip"); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (a *App) AdminGetRateLimits(w http.ResponseWriter, r *http.Request) {
+	stats, err := a.RedisClient.GetRateLimitStats()
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusInternalServerError)
+		return
+	}
+	res := struct {
+		Limits map[string]string           `json:"limits"`
+		Counts map[string]map[string]int64 `json:"counts"`
+	}{
+		Limits: map[string]string{
+			utils.RATELIMIT_TRADER: a.RateLimits.Trader.String(),
+			utils.RATELIMIT_IP:     a.RateLimits.Ip.String(),
+			utils.RATELIMIT_APIKEY: a.RateLimits.ApiKey.String(),
+		},
+		Counts: stats,
+	}
+	jsonResponse, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonResponse)
+}
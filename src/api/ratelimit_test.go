@@ -0,0 +1,81 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/D8-X/d8x-broker-server/src/utils"
+)
+
+func TestOrderRateLimit(t *testing.T) {
+	redis, _ := newTestRedis(t)
+	a := &App{RedisClient: redis, RateLimits: RateLimits{
+		Trader: utils.RateLimit{Burst: 2, Period: time.Minute},
+		Ip:     utils.RateLimit{Burst: 3, Period: time.Minute},
+	}}
+	handler := a.orderRateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	send := func(trader, ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/sign-order",
+			strings.NewReader(`{"order": {"traderAddr": "`+trader+`"}, "chainId": 42161}`))
+		req.RemoteAddr = ip + ":5555"
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	trader := "0x9d5aaB428e98678d0E645ea4AeBd25f744341a05"
+	for i := 0; i < 2; i++ {
+		if rec := send(trader, "10.0.0.1"); rec.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d", i, rec.Code)
+		}
+	}
+	rec := send(trader, "10.0.0.1")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "30" {
+		t.Errorf("trader limit: status %d retry-after %s", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	// the rejected request did not use the last token of the ip bucket
+	if rec = send("0x0000000000000000000000000000000000000001", "10.0.0.1"); rec.Code != http.StatusOK {
+		t.Errorf("ip token of a rejected request used: status %d", rec.Code)
+	}
+	rec = send("0x0000000000000000000000000000000000000001", "10.0.0.1")
+	if rec.Code != http.StatusTooManyRequests || !strings.Contains(rec.Body.String(), "ip") {
+		t.Errorf("ip limit: status %d %s", rec.Code, rec.Body.String())
+	}
+	if rec = send("0x0000000000000000000000000000000000000001", "10.0.0.2"); rec.Code != http.StatusOK {
+		t.Errorf("other client: status %d", rec.Code)
+	}
+	// fee quotes share the trader bucket, taken from the addr parameter
+	req := httptest.NewRequest(http.MethodGet, "/fee-quote?chain=42161&perpetualId=100001&addr="+trader, nil)
+	req.RemoteAddr = "10.0.0.3:5555"
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusTooManyRequests || !strings.Contains(rec.Body.String(), "trader") {
+		t.Errorf("fee quote trader limit: status %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestClientIp(t *testing.T) {
+	for _, tc := range []struct {
+		proxies int
+		fwd     []string
+		want    string
+	}{
+		{0, []string{"1.1.1.1"}, "10.0.0.1"},
+		{1, nil, "10.0.0.1"},
+		{1, []string{"6.6.6.6, 1.1.1.1"}, "1.1.1.1"},
+		{2, []string{"6.6.6.6, 1.1.1.1", "2.2.2.2"}, "1.1.1.1"},
+		{3, []string{"1.1.1.1, 2.2.2.2"}, "1.1.1.1"},
+	} {
+		a := &App{RateLimits: RateLimits{TrustedProxies: tc.proxies}}
+		req := httptest.NewRequest(http.MethodGet, "/fee-quote", nil)
+		req.RemoteAddr = "10.0.0.1:5555"
+		for _, h := range tc.fwd {
+			req.Header.Add("X-Forwarded-For", h)
+		}
+		if ip := a.clientIp(req); ip != tc.want {
+			t.Errorf("%d proxies, %v: expected %s, got %s", tc.proxies, tc.fwd, tc.want, ip)
+		}
+	}
+}
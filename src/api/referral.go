@@ -0,0 +1,154 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/D8-X/d8x-broker-server/src/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/go-chi/chi/v5"
+)
+
+// traderReferral returns the referral code the trader is bound to, nil if
+// none
+func (a *App) traderReferral(traderAddr string) *utils.ReferralCode {
+	if !common.IsHexAddress(traderAddr) {
+		return nil
+	}
+	ref, exists, err := a.RedisClient.TraderReferral(traderAddr)
+	if err != nil {
+		slog.Error("referral code of trader " + traderAddr + ": " + err.Error())
+		return nil
+	}
+	if !exists {
+		return nil
+	}
+	return &ref
+}
+
+// orderReferral verifies the referral code and signature of a signature
+// request and returns the code that applies to the order: the code the
+// trader is bound to, else the requested one. The trader is bound with
+// bindReferral once the order is signed
+func (a *App) orderReferral(req utils.APIBrokerOrderSignatureReq) (*utils.ReferralCode, error) {
+	err := utils.VerifyReferralSignature(req.Order.TraderAddr, req.ReferralCode, req.ReferralSignature)
+	if err != nil {
+		return nil, err
+	}
+	c, err := a.RedisClient.CheckTraderReferral(req.Order.TraderAddr, req.ReferralCode)
+	if err != nil {
+		return nil, err
+	}
+	if bound := a.traderReferral(req.Order.TraderAddr); bound != nil {
+		return bound, nil
+	}
+	return &c, nil
+}
+
+// bindReferral binds the trader of a signed order to the referral code
+func (a *App) bindReferral(trader string, ref *utils.ReferralCode) {
+	code, err := a.RedisClient.BindTraderReferral(trader, ref.Code)
+	if err != nil {
+		slog.Error("binding referral code: "+err.Error(), "trader", trader, "code", ref.Code)
+		return
+	}
+	if code != ref.Code {
+		slog.Info("trader already bound to referral code", "trader", trader, "code", code)
+	}
+}
+
+// GetReferralEarnings returns the rebates of the referrer for submitted orders.
+// Query parameters: referrer (required), from, to (unix timestamps)
+func (a *App) GetReferralEarnings(w http.ResponseWriter, r *http.Request) {
+	if a.Pen.Ledger == nil {
+		http.Error(w, string(formatError("ledger not configured")), http.StatusNotFound)
+		return
+	}
+	referrer := r.URL.Query().Get("referrer")
+	if !common.IsHexAddress(referrer) {
+		http.Error(w, string(formatError("invalid referrer address")), http.StatusBadRequest)
+		return
+	}
+	var nums [2]int64
+	for k, name := range []string{"from", "to"} {
+		n, err := parseInt64Param(r, name)
+		if err != nil {
+			http.Error(w, string(formatError(err.Error())), http.StatusBadRequest)
+			return
+		}
+		nums[k] = n
+	}
+	earnings, err := a.Pen.Ledger.ReferrerEarnings(r.Context(), referrer, nums[0], nums[1])
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusInternalServerError)
+		return
+	}
+	jsonResponse, err := json.Marshal(earnings)
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonResponse)
+}
+
+func (a *App) AdminGetReferralCodes(w http.ResponseWriter, r *http.Request) {
+	codes, err := a.RedisClient.ListReferralCodes()
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusInternalServerError)
+		return
+	}
+	jsonResponse, err := json.Marshal(codes)
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonResponse)
+}
+
+func (a *App) AdminCreateReferralCode(w http.ResponseWriter, r *http.Request) {
+	var jsonData []byte
+	if r.Body != nil {
+		defer r.Body.Close()
+		jsonData, _ = io.ReadAll(r.Body)
+	}
+	var req utils.ReferralCode
+	err := json.Unmarshal(jsonData, &req)
+	if err != nil {
+		errMsg := `Wrong argument types. Usage: {"code": "ALICE", "referrer": "0x...", "discountPerc": 10, "referrerSharePerc": 20}`
+		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+		return
+	}
+	code, err := a.RedisClient.CreateReferralCode(req)
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusBadRequest)
+		return
+	}
+	slog.Info("admin: referral code created", "code", code.Code, "referrer", code.Referrer.Hex())
+	jsonResponse, err := json.Marshal(code)
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonResponse)
+}
+
+func (a *App) AdminDeleteReferralCode(w http.ResponseWriter, r *http.Request) {
+	code := chi.URLParam(r, "code")
+	err := a.RedisClient.DeleteReferralCode(code)
+	if err == utils.ErrReferralCodeNotFound {
+		http.Error(w, string(formatError(err.Error())), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("admin: referral code deleted", "code", code)
+	fmt.Fprint(w, `{"referralCode": "deleted"}`)
+}
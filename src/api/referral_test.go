@@ -0,0 +1,167 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/D8-X/d8x-broker-server/src/ledger"
+	"github.com/D8-X/d8x-broker-server/src/utils"
+	d8xUtils "github.com/D8-X/d8x-futures-go-sdk/utils"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// newTestApp creates an app with a random broker key for chain 42161, Redis
+// and a ledger
+func newTestApp(t *testing.T) *App {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := utils.NewLocalSigner(common.Bytes2Hex(crypto.FromECDSA(key)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chConf := map[int64]utils.ChainConfig{42161: {
+		ChainId:   42161,
+		ProxyAddr: common.HexToAddress("0x8f8BccE4c180B699F81499005281fA89440D1e95"),
+	}}
+	pen, err := utils.NewSignaturePenWithSigner(signer, chConf, []utils.RpcConfig{{ChainId: 42161, Rpc: []string{"http://localhost:8545"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pen.Ledger, err = ledger.Open("sqlite3://" + filepath.Join(t.TempDir(), "ledger.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pen.Ledger.Close() })
+	redis, _ := newTestRedis(t)
+	return &App{Pen: pen, BrokerFeeTbps: 60, RedisClient: redis}
+}
+
+// signOrderBody creates a /sign-order request body
+func signOrderBody(trader string, perpetualId int32, amount, limitPrice float64, referralCode string) []byte {
+	req := utils.APIBrokerOrderSignatureReq{
+		ChainId: 42161,
+		Order: utils.APIOrderSig{
+			PerpetualId:   perpetualId,
+			TraderAddr:    trader,
+			Deadline:      uint32(time.Now().Add(24 * time.Hour).Unix()),
+			FAmount:       d8xUtils.Float64ToABDK(amount).String(),
+			FLimitPrice:   d8xUtils.Float64ToABDK(limitPrice).String(),
+			FTriggerPrice: "0",
+		},
+		ReferralCode: referralCode,
+	}
+	body, _ := json.Marshal(req)
+	return body
+}
+
+// withReferralSignature adds the trader's signature of the referral code to
+// a /sign-order request body
+func withReferralSignature(t *testing.T, body []byte, key *ecdsa.PrivateKey) []byte {
+	var req utils.APIBrokerOrderSignatureReq
+	json.Unmarshal(body, &req)
+	msg := utils.REFERRAL_MESSAGE_PREFIX + utils.NormalizeReferralCode(req.ReferralCode)
+	sig, err := crypto.Sign(accounts.TextHash([]byte(msg)), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ReferralSignature = hexutil.Encode(sig)
+	body, _ = json.Marshal(req)
+	return body
+}
+
+func TestReferralRebates(t *testing.T) {
+	a := newTestApp(t)
+	a.Pen.MarkPrices = staticPrices{100001: 1000}
+	referrer := common.HexToAddress("0x3ef256282e578c5D97a7231C3C046F19b1E50855")
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	trader := crypto.PubkeyToAddress(key.PublicKey).Hex()
+	_, err = a.RedisClient.CreateReferralCode(utils.ReferralCode{Code: "ALICE", Referrer: referrer, DiscountPerc: 25, SharePerc: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signOrder := func(body []byte) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		a.SignOrder(w, httptest.NewRequest("POST", "/sign-order", bytes.NewReader(body)))
+		return w
+	}
+	bound := func() bool {
+		_, exists, _ := a.RedisClient.TraderReferral(trader)
+		return exists
+	}
+
+	if w := signOrder(withReferralSignature(t, signOrderBody(trader, 100001, 2, 1000, "nope"), key)); w.Code != 400 || !strings.Contains(w.Body.String(), "referral code") {
+		t.Errorf("unknown code accepted: %d %s", w.Code, w.Body.String())
+	}
+	// the trader has to sign the code
+	other, _ := crypto.GenerateKey()
+	for _, body := range [][]byte{
+		signOrderBody(trader, 100001, 2, 1000, "alice"),
+		withReferralSignature(t, signOrderBody(trader, 100001, 2, 1000, "alice"), other),
+	} {
+		if w := signOrder(body); w.Code != 400 || !strings.Contains(w.Body.String(), "referral signature") || bound() {
+			t.Errorf("referral without trader signature accepted: %d %s", w.Code, w.Body.String())
+		}
+	}
+	// the trader is bound only if the order is signed
+	conf, _ := a.Pen.GetChainConfig(42161)
+	proxy := conf.ProxyAddr
+	conf.ProxyAddr = common.Address{}
+	rpcs := []utils.RpcConfig{{ChainId: 42161, Rpc: []string{"http://localhost:8545"}}}
+	a.Pen.UpdateConfig(map[int64]utils.ChainConfig{42161: conf}, rpcs)
+	signOrder(withReferralSignature(t, signOrderBody(trader, 100001, 2, 1000, "alice"), key))
+	if bound() {
+		t.Errorf("trader bound without signed order")
+	}
+	conf.ProxyAddr = proxy
+	a.Pen.UpdateConfig(map[int64]utils.ChainConfig{42161: conf}, rpcs)
+
+	w := signOrder(withReferralSignature(t, signOrderBody(trader, 100001, 2, 1e9, "alice"), key))
+	var res utils.APIBrokerSignatureRes
+	if err = json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("%s: %v", w.Body.String(), err)
+	}
+	if res.Order.BrokerFeeTbps != 45 || !bound() {
+		t.Errorf("unexpected fee with referral discount %d", res.Order.BrokerFeeTbps)
+	}
+	// the binding applies to later orders without code
+	if fee, info := a.getBrokerFee(context.Background(), trader, 42161, 100001); fee != 45 || info.Tier != "ref-ALICE" {
+		t.Errorf("unexpected fee %d tier %s", fee, info.Tier)
+	}
+
+	earnings := func() []ledger.ReferralEarnings {
+		w := httptest.NewRecorder()
+		a.GetReferralEarnings(w, httptest.NewRequest("GET", "/referral/earnings?referrer="+referrer.Hex(), nil))
+		var e []ledger.ReferralEarnings
+		if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil {
+			t.Fatalf("%s: %v", w.Body.String(), err)
+		}
+		return e
+	}
+	if e := earnings(); len(e) != 0 {
+		t.Errorf("unsubmitted order earns rebate %v", e)
+	}
+	err = a.Pen.Ledger.RecordSubmission(context.Background(), []string{res.OrderId}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// notional 2 x mark price 1000 (not the limit price) x 45 tbps x 50% share
+	e := earnings()
+	if len(e) != 1 || e[0].Code != "ALICE" || e[0].Orders != 1 || e[0].Notional != 2000 || e[0].Rebate != 2000*45e-5*0.5 {
+		t.Errorf("unexpected earnings %+v", e)
+	}
+}
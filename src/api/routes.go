@@ -3,12 +3,13 @@ package api
 import (
 	"net/http"
 
+	"github.com/D8-X/d8x-broker-server/src/utils"
 	"github.com/go-chi/chi/v5"
 )
 
 // RegisterRoutes registers all API routes for D8X-Backend application
 func (a *App) RegisterRoutes(router chi.Router) {
-	// Endpoint: /broker-address?id={id}
+	// Endpoint: /broker-address?chain={chainId}
 	router.Get("/broker-address", func(w http.ResponseWriter, r *http.Request) {
 		a.GetBrokerAddress(w, r)
 	})
@@ -17,23 +18,71 @@ func (a *App) RegisterRoutes(router chi.Router) {
 		a.GetChainConfig(w, r)
 	})
 
-	// Endpoint: /broker-fee?perpetualId={perpetualId}
+	// Endpoint: /broker-fee?chain={chainId}&perpetualId={perpetualId}&addr={traderAddr}
 	router.Get("/broker-fee", func(w http.ResponseWriter, r *http.Request) {
 		a.GetBrokerFee(w, r)
 	})
 
+	// Endpoint: /fee-quote?chain={chainId}&perpetualId={perpetualId}&addr={traderAddr}
+	router.With(a.apiKeyAuth(utils.SCOPE_SIGN_ORDER), a.orderRateLimit).Get("/fee-quote", a.GetFeeQuote)
+
 	// Endpoint: /sign-order
-	router.Post("/sign-order", func(w http.ResponseWriter, r *http.Request) {
+	router.With(a.apiKeyAuth(utils.SCOPE_SIGN_ORDER), a.orderRateLimit).Post("/sign-order", func(w http.ResponseWriter, r *http.Request) {
 		a.SignOrder(w, r)
 	})
 
 	// Endpoint: /order-submitted
-	router.Post("/orders-submitted", func(w http.ResponseWriter, r *http.Request) {
+	router.With(a.apiKeyAuth(utils.SCOPE_ORDERS_SUBMITTED)).Post("/orders-submitted", func(w http.ResponseWriter, r *http.Request) {
 		a.OrdersSubmitted(w, r)
 	})
 
+	// Endpoint: /order-status?orderId={orderId} (GET), /order-status (POST,
+	// executions and cancellations reported by the trader back-end)
+	router.Get("/order-status", a.GetOrderStatus)
+	router.With(a.backendAuth(utils.SCOPE_ORDER_STATUS)).Post("/order-status", a.PostOrderStatus)
+
 	// Endpoint: /payment-signature
-	router.Post("/sign-payment", func(w http.ResponseWriter, r *http.Request) {
+	router.With(a.apiKeyAuth(utils.SCOPE_SIGN_PAYMENT)).Post("/sign-payment", func(w http.ResponseWriter, r *http.Request) {
 		a.SignPayment(w, r)
 	})
+
+	// Endpoint: /referral/earnings?referrer={addr}&from={ts}&to={ts}
+	router.Get("/referral/earnings", a.GetReferralEarnings)
+
+	// Endpoint: /healthz (liveness), /readyz (Redis and rpc reachability)
+	router.Get("/healthz", a.Healthz)
+	router.Get("/readyz", a.Readyz)
+
+	// Admin endpoints, only available if an admin api key is configured
+	if a.AdminApiKey == "" {
+		return
+	}
+	router.Route("/admin", func(r chi.Router) {
+		r.Use(a.adminAuth)
+
+		// Endpoint: /admin/executors/{chainId}
+		r.Get("/executors/{chainId}", a.AdminGetExecutors)
+		// Endpoint: /admin/executors/{chainId}/{address}
+		r.Put("/executors/{chainId}/{address}", a.AdminAddExecutor)
+		r.Delete("/executors/{chainId}/{address}", a.AdminRemoveExecutor)
+		// Endpoint: /admin/executors/{chainId}/{address}/suspend
+		r.Post("/executors/{chainId}/{address}/suspend", a.AdminSuspendExecutor)
+		r.Delete("/executors/{chainId}/{address}/suspend", a.AdminResumeExecutor)
+		// Endpoint: /admin/rate-limits
+		r.Get("/rate-limits", a.AdminGetRateLimits)
+		// Endpoint: /admin/ledger/orders?trader={addr}&chainId={id}&perpetualId={id}&from={ts}&to={ts}&limit={n}&offset={n}
+		r.Get("/ledger/orders", a.AdminGetLedgerOrders)
+		// Endpoint: /admin/ledger/payments?chainId={id}&executor={addr}&payer={addr}&token={addr}&from={ts}&to={ts}&limit={n}&offset={n}
+		r.Get("/ledger/payments", a.AdminGetLedgerPayments)
+		// Endpoint: /admin/referral-codes
+		r.Get("/referral-codes", a.AdminGetReferralCodes)
+		r.Post("/referral-codes", a.AdminCreateReferralCode)
+		// Endpoint: /admin/referral-codes/{code}
+		r.Delete("/referral-codes/{code}", a.AdminDeleteReferralCode)
+		// Endpoint: /admin/promotions
+		r.Get("/promotions", a.AdminGetPromotions)
+		r.Post("/promotions", a.AdminCreatePromotion)
+		// Endpoint: /admin/promotions/{id}
+		r.Delete("/promotions/{id}", a.AdminDeletePromotion)
+	})
 }
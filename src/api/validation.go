@@ -0,0 +1,104 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/D8-X/d8x-broker-server/src/utils"
+)
+
+func (a *App) orderMaxDeadline() time.Duration {
+	if a.OrderMaxDeadlineSec <= 0 {
+		return utils.DEFAULT_ORDER_MAX_DEADLINE
+	}
+	return time.Duration(a.OrderMaxDeadlineSec) * time.Second
+}
+
+const (
+	// interval of the reload of the perpetuals of the configured chains
+	perpetualsRefreshInterval = utils.PERPETUALS_CACHE_TTL / 2
+	// time to load the perpetuals of a chain
+	perpetualsLoadTimeout = 30 * time.Second
+)
+
+// errNoPerpetuals is returned by validateOrder if the perpetuals of the chain
+// cannot be loaded
+var errNoPerpetuals = errors.New("perpetuals of the chain not available, try again later")
+
+// validateOrder checks the order of a signature request against the
+// deadline horizon and the perpetuals of the chain. Returns errNoPerpetuals
+// if the perpetuals were never loaded, and a *utils.ValidationError for
+// invalid orders
+func (a *App) validateOrder(ctx context.Context, req *utils.APIBrokerOrderSignatureReq) error {
+	v := utils.OrderValidation{Now: time.Now(), MaxDeadline: a.orderMaxDeadline()}
+	if a.Perpetuals != nil && req.ChainId > 0 {
+		perps, err := a.Perpetuals.Perpetuals(ctx, req.ChainId, req.Order.PerpetualId)
+		if err != nil {
+			slog.Warn("loading perpetuals of chain " + strconv.FormatInt(req.ChainId, 10) + ": " + err.Error())
+		}
+		if perps == nil {
+			if err := req.Validate(v); err != nil {
+				return err
+			}
+			return errNoPerpetuals
+		}
+		v.Perpetuals = perps
+	}
+	return req.Validate(v)
+}
+
+// LoadPerpetuals loads the perpetuals of the configured chains into the
+// cache orders are validated against
+func (a *App) LoadPerpetuals(ctx context.Context) error {
+	if a.Perpetuals == nil {
+		return nil
+	}
+	var errs []error
+	for _, conf := range a.Pen.GetChainConfigs() {
+		loadCtx, cancel := context.WithTimeout(ctx, perpetualsLoadTimeout)
+		err := a.Perpetuals.Refresh(loadCtx, conf.ChainId)
+		cancel()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("perpetuals of chain %d: %w", conf.ChainId, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// refreshPerpetuals reloads the perpetuals before they expire until ctx is
+// cancelled, so that order validation does not query them
+func (a *App) refreshPerpetuals(ctx context.Context) {
+	ticker := time.NewTicker(perpetualsRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := a.LoadPerpetuals(ctx); err != nil {
+				slog.Error("reloading perpetuals: " + err.Error())
+			}
+		}
+	}
+}
+
+// formatValidationError is formatError with the invalid fields
+func formatValidationError(verr *utils.ValidationError) []byte {
+	response := struct {
+		Error  string             `json:"error"`
+		Fields []utils.FieldError `json:"fields"`
+	}{
+		Error:  "invalid order",
+		Fields: verr.Fields,
+	}
+	jsonResponse, err := json.Marshal(response)
+	if err != nil {
+		return []byte(err.Error())
+	}
+	return jsonResponse
+}
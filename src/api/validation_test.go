@@ -0,0 +1,66 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/D8-X/d8x-broker-server/src/utils"
+)
+
+type staticPerpetuals map[int32]utils.PerpetualInfo
+
+func (s staticPerpetuals) Perpetuals(ctx context.Context, chainId int64) (map[int32]utils.PerpetualInfo, error) {
+	return s, nil
+}
+
+type failingPerpetuals struct{}
+
+func (failingPerpetuals) Perpetuals(ctx context.Context, chainId int64) (map[int32]utils.PerpetualInfo, error) {
+	return nil, errors.New("rpc down")
+}
+
+func TestSignOrderWithoutPerpetuals(t *testing.T) {
+	a := newTestApp(t)
+	a.Perpetuals = utils.NewPerpetualCache(failingPerpetuals{})
+	body := signOrderBody("0x9d5aaB428e98678d0E645ea4AeBd25f744341a05", 100001, 2, 1000, "")
+	w := httptest.NewRecorder()
+	a.SignOrder(w, httptest.NewRequest("POST", "/sign-order", bytes.NewReader(body)))
+	if w.Code != 503 {
+		t.Errorf("expected 503 without perpetuals, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestSignOrderValidation(t *testing.T) {
+	a := newTestApp(t)
+	a.Perpetuals = utils.NewPerpetualCache(staticPerpetuals{100001: {Id: 100001, MaxLeverage: 10, State: "NORMAL"}})
+	trader := "0x9d5aaB428e98678d0E645ea4AeBd25f744341a05"
+	signOrder := func(body []byte) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		a.SignOrder(w, httptest.NewRequest("POST", "/sign-order", bytes.NewReader(body)))
+		return w
+	}
+	if w := signOrder(signOrderBody(trader, 100001, 2, 1000, "")); w.Code != 200 {
+		t.Fatalf("valid order rejected: %d %s", w.Code, w.Body.String())
+	}
+
+	var req utils.APIBrokerOrderSignatureReq
+	json.Unmarshal(signOrderBody(trader, 100002, 2, 1000, ""), &req)
+	req.Order.Deadline = 1000
+	req.Order.FAmount = "abc"
+	body, _ := json.Marshal(req)
+	w := signOrder(body)
+	var res struct {
+		Error  string             `json:"error"`
+		Fields []utils.FieldError `json:"fields"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &res)
+	if w.Code != 400 || res.Error != "invalid order" || len(res.Fields) != 3 ||
+		res.Fields[0].Field != "order.iDeadline" || res.Fields[1].Field != "order.fAmount" ||
+		res.Fields[2].Field != "order.iPerpetualId" {
+		t.Errorf("unexpected response %d %s", w.Code, w.Body.String())
+	}
+}
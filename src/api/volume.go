@@ -0,0 +1,48 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/D8-X/d8x-broker-server/src/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// recordVolume adds the notional of submitted orders at the mark price to
+// the trader volume used for volume fee tiers
+func (a *App) recordVolume(ctx context.Context, orders []utils.SubmittedOrder) {
+	if a.MarkPrices == nil {
+		return
+	}
+	now := time.Now()
+	for _, o := range orders {
+		px, err := a.MarkPrices.MarkPrice(ctx, o.ChainId, int32(o.PerpetualId))
+		if err != nil {
+			slog.Error("mark price, volume not counted: "+err.Error(), "orderId", o.OrderId)
+			continue
+		}
+		notional, ok := o.Notional(px)
+		if !ok {
+			slog.Info("order without amount, volume not counted", "orderId", o.OrderId)
+			continue
+		}
+		err = a.RedisClient.AddTraderVolume(o, notional, now)
+		if err != nil {
+			slog.Error("recording trader volume: "+err.Error(), "orderId", o.OrderId)
+		}
+	}
+}
+
+// volumeSource provides the trailing trader volume to the fee engine
+type volumeSource struct {
+	a *App
+}
+
+func (s volumeSource) TraderVolume(ctx context.Context, trader common.Address, chainId int64) (float64, error) {
+	if chainId <= 0 {
+		// volume is tracked per chain
+		return 0, nil
+	}
+	return s.a.RedisClient.TraderVolume(chainId, trader.Hex(), time.Now())
+}
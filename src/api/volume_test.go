@@ -0,0 +1,74 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/D8-X/d8x-broker-server/src/fees"
+	"github.com/D8-X/d8x-broker-server/src/utils"
+	d8xUtils "github.com/D8-X/d8x-futures-go-sdk/utils"
+)
+
+type staticPrices map[int32]float64
+
+func (s staticPrices) MarkPrice(ctx context.Context, chainId int64, perpetualId int32) (float64, error) {
+	if px, exists := s[perpetualId]; exists {
+		return px, nil
+	}
+	return 0, errors.New("no price")
+}
+
+func TestVolumeTiers(t *testing.T) {
+	redis, _ := newTestRedis(t)
+	a := &App{BrokerFeeTbps: 60, RedisClient: redis, MarkPrices: staticPrices{100001: 3000}}
+	var err error
+	a.Fees, err = fees.NewEngine(map[int64]fees.ChainFeeConfig{
+		42161: {Volume: []fees.VolumeTier{{MinVolume: 10_000, Perc: 10}, {MinVolume: 100_000, Perc: 50}}},
+	}, fees.Deps{Volume: volumeSource{a}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trader := "0x9d5aaB428e98678d0E645ea4AeBd25f744341a05"
+	getFee := func() utils.APIBrokerFeeRes {
+		w := httptest.NewRecorder()
+		a.GetBrokerFee(w, httptest.NewRequest("GET", "/broker-fee?chain=42161&addr="+trader, nil))
+		var res utils.APIBrokerFeeRes
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	res := getFee()
+	if res.BrokerFeeTbps != 60 || res.Volume == nil || *res.Volume != 0 || *res.NextTierVolume != 10_000 {
+		t.Errorf("unexpected fee without volume %+v", res)
+	}
+
+	// valued at the mark price, not the limit price
+	a.recordVolume(context.Background(), []utils.SubmittedOrder{{
+		OrderId:     "a1",
+		ChainId:     42161,
+		PerpetualId: 100001,
+		TraderAddr:  trader,
+		FAmount:     d8xUtils.Float64ToABDK(-5).String(),
+		FLimitPrice: d8xUtils.Float64ToABDK(1e6).String(),
+	}, {
+		OrderId:     "a2",
+		ChainId:     42161,
+		PerpetualId: 100002,
+		TraderAddr:  trader,
+		FAmount:     d8xUtils.Float64ToABDK(-5).String(),
+	}})
+	res = getFee()
+	if res.BrokerFeeTbps != 54 || *res.Volume != 15_000 || *res.NextTierVolume != 100_000 || *res.NextTierDiscountPerc != 50 {
+		t.Errorf("unexpected fee in first tier %+v", res)
+	}
+	// volume is not reported without trader
+	w := httptest.NewRecorder()
+	a.GetBrokerFee(w, httptest.NewRequest("GET", "/broker-fee?chain=42161", nil))
+	if w.Body.String() != `{"BrokerFeeTbps":60}` {
+		t.Errorf("unexpected response without trader %s", w.Body.String())
+	}
+}
@@ -21,4 +21,63 @@ const (
 	// Broker key
 	BROKER_KEY          = "BROKER_KEY"
 	VIP3_REDUCTION_PERC = "VIP3_REDUCTION_PERC"
+	// Broker signer backend: local (keyfile), remote (HTTP signer) or
+	// jsonrpc (eth_sign compatible signer). Defaults to local
+	SIGNER_TYPE = "SIGNER_TYPE"
+	// url of the remote/jsonrpc signer
+	SIGNER_URL = "SIGNER_URL"
+	// broker address of the jsonrpc signer (optional, defaults to first account)
+	SIGNER_ADDR = "SIGNER_ADDR"
+	// bearer token sent to the remote signer (optional)
+	SIGNER_AUTH_TOKEN = "SIGNER_AUTH_TOKEN"
+	// bearer token for the admin endpoints (admin endpoints disabled if not set)
+	ADMIN_API_KEY = "ADMIN_API_KEY"
+	// require API keys with HMAC-signed requests for signing endpoints
+	API_AUTH_ENABLED = "API_AUTH_ENABLED"
+	// allowed age of signed requests in seconds, defaults to 30
+	API_AUTH_WINDOW_SEC = "API_AUTH_WINDOW_SEC"
+	// rate limits for /sign-order as <requests>/<seconds>, disabled if empty
+	RATE_LIMIT_TRADER = "RATE_LIMIT_TRADER"
+	RATE_LIMIT_IP     = "RATE_LIMIT_IP"
+	RATE_LIMIT_APIKEY = "RATE_LIMIT_APIKEY"
+	// number of reverse proxies appending to X-Forwarded-For, the client ip
+	// for rate limiting is taken from the headers if set
+	RATE_LIMIT_TRUSTED_PROXIES = "RATE_LIMIT_TRUSTED_PROXIES"
+	// http server timeouts in seconds. The write timeout must cover token
+	// approvals that wait for the transaction to be mined
+	HTTP_READ_TIMEOUT_SEC  = "HTTP_READ_TIMEOUT_SEC"
+	HTTP_WRITE_TIMEOUT_SEC = "HTTP_WRITE_TIMEOUT_SEC"
+	HTTP_IDLE_TIMEOUT_SEC  = "HTTP_IDLE_TIMEOUT_SEC"
+	// time in-flight requests get to complete on SIGTERM
+	SHUTDOWN_TIMEOUT_SEC = "SHUTDOWN_TIMEOUT_SEC"
+	// ledger database, sqlite3://<file> or postgres://..., disabled if empty
+	LEDGER_DSN = "LEDGER_DSN"
+	// fee discount config file (providers and policy per chain), replaces
+	// VIP3_REDUCTION_PERC if set
+	FEE_CONFIG_PATH = "FEE_CONFIG_PATH"
+	// validity of /fee-quote quotes in seconds, defaults to 60
+	FEE_QUOTE_TTL_SEC = "FEE_QUOTE_TTL_SEC"
+	// address of the Prometheus /metrics endpoint (e.g. 0.0.0.0:9100), kept
+	// off the public API and websocket ports. Metrics are not served if empty
+	METRICS_ADDR = "METRICS_ADDR"
+	// maximal time in seconds from now to the deadline of orders signed via
+	// /sign-order, defaults to a year
+	ORDER_MAX_DEADLINE_SEC = "ORDER_MAX_DEADLINE_SEC"
+	// executor websocket: messages queued per client and policy if the queue
+	// of a slow client is full (drop-oldest or disconnect)
+	WS_SEND_BUFFER        = "WS_SEND_BUFFER"
+	WS_SLOW_CLIENT_POLICY = "WS_SLOW_CLIENT_POLICY"
+	// age in seconds of submitted orders kept in the order stream, and the
+	// executorws replica name under which the stream offset is stored
+	// (defaults to the hostname, must be unique per replica)
+	ORDER_STREAM_MAX_AGE_SEC = "ORDER_STREAM_MAX_AGE_SEC"
+	WS_INSTANCE_ID           = "WS_INSTANCE_ID"
+	// VIP3 API url, request timeout in seconds and retries of failed requests
+	VIP3_API_URL     = "VIP3_API_URL"
+	VIP3_TIMEOUT_SEC = "VIP3_TIMEOUT_SEC"
+	VIP3_RETRIES     = "VIP3_RETRIES"
+	// failed VIP3 lookups in a row after which the API is not queried for
+	// VIP3_BREAKER_COOLDOWN_SEC seconds
+	VIP3_BREAKER_THRESHOLD    = "VIP3_BREAKER_THRESHOLD"
+	VIP3_BREAKER_COOLDOWN_SEC = "VIP3_BREAKER_COOLDOWN_SEC"
 )
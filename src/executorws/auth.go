@@ -0,0 +1,200 @@
+package executorws
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/D8-X/d8x-futures-go-sdk/pkg/d8x_futures"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gorilla/websocket"
+)
+
+// Executors authenticate after connecting by signing the challenge message
+// (EIP-191 personal_sign) and sending
+// {"type": "auth", "address": "0x...", "signature": "0x..."}
+const AUTH_MESSAGE_PREFIX = "D8X broker websocket authentication, nonce: "
+
+// time to authenticate after connecting
+const authWait = 30 * time.Second
+
+// EXECUTOR_RECHECK_INTERVAL is how often the executors of subscribed clients
+// are checked against the whitelist
+const EXECUTOR_RECHECK_INTERVAL = 10 * time.Second
+
+// session is the authentication state of a client
+type session struct {
+	message  string
+	executor common.Address
+	authed   bool
+}
+
+func newSession() (*session, error) {
+	nonce := make([]byte, 32)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return &session{message: AUTH_MESSAGE_PREFIX + hex.EncodeToString(nonce)}, nil
+}
+
+// challenge returns the challenge message sent to the client on connect
+func (c *Client) challenge() []byte {
+	c.mu.Lock()
+	message := c.sess.message
+	c.mu.Unlock()
+	r := ServerResponse{Type: "challenge", Data: struct {
+		Message string `json:"message"`
+	}{message}}
+	jsonData, err := json.Marshal(r)
+	if err != nil {
+		slog.Error("forming challenge")
+		return []byte{}
+	}
+	return jsonData
+}
+
+// Authenticate verifies the signature of the challenge message by the
+// executor address
+func (c *Client) Authenticate(addr, signature string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sess.authed {
+		return errors.New("already authenticated")
+	}
+	if !common.IsHexAddress(addr) {
+		return errors.New("invalid address")
+	}
+	sig, err := d8x_futures.BytesFromHexString(signature)
+	if err != nil || len(sig) != 65 {
+		return errors.New("invalid signature")
+	}
+	if sig[64] < 27 {
+		sig[64] += 27
+	}
+	rec, err := d8x_futures.RecoverEvmAddress([]byte(c.sess.message), sig)
+	if err != nil || rec != common.HexToAddress(addr) {
+		return errors.New("invalid signature")
+	}
+	c.sess.executor = rec
+	c.sess.authed = true
+	return nil
+}
+
+// Executor returns the executor address of the client, false if the client
+// did not authenticate
+func (c *Client) Executor() (common.Address, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sess.executor, c.sess.authed
+}
+
+// closeUnauthenticated disconnects the client if it did not authenticate
+func (c *Client) closeUnauthenticated() {
+	if _, authed := c.Executor(); authed {
+		return
+	}
+	slog.Info("client " + c.Id + " did not authenticate, disconnecting")
+	c.Close(websocket.ClosePolicyViolation, "authentication required")
+}
+
+// isExecutorAllowed checks the executor against the live whitelist in
+// Redis. Executors are not allowed while Redis is not available, the config
+// file may list removed executors
+func (s *Server) isExecutorAllowed(chainId int64, executor common.Address) bool {
+	if s.RedisClient == nil {
+		return false
+	}
+	allowed, err := s.RedisClient.IsExecutorAllowed(chainId, executor)
+	if err != nil {
+		slog.Error("checking executor whitelist: " + err.Error())
+		return false
+	}
+	return allowed
+}
+
+// watchExecutors rechecks the executors of subscribed clients every
+// interval until ctx is cancelled
+func (s *Server) watchExecutors(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.recheckExecutors()
+		}
+	}
+}
+
+// recheckExecutors unsubscribes clients from the topics of chains their
+// executor is no longer whitelisted on (removed or suspended). Subscriptions
+// are kept while the whitelist cannot be read
+func (s *Server) recheckExecutors() {
+	type subscription struct {
+		c     *Client
+		topic string
+	}
+	var subs []subscription
+	s.mu.RLock()
+	for topic, clients := range s.subscriptions {
+		for _, c := range clients {
+			subs = append(subs, subscription{c, topic})
+		}
+	}
+	s.mu.RUnlock()
+	type executorKey struct {
+		chainId  int64
+		executor common.Address
+	}
+	allowed := make(map[executorKey]bool)
+	for _, sub := range subs {
+		_, chainIdStr, _ := strings.Cut(sub.topic, ":")
+		chainId, err := strconv.ParseInt(chainIdStr, 10, 64)
+		if err != nil {
+			continue
+		}
+		executor, _ := sub.c.Executor()
+		key := executorKey{chainId, executor}
+		ok, checked := allowed[key]
+		if !checked {
+			ok, err = s.RedisClient.IsExecutorAllowed(chainId, executor)
+			if err != nil {
+				slog.Error("rechecking executor whitelist: " + err.Error())
+				return
+			}
+			allowed[key] = ok
+		}
+		if ok {
+			continue
+		}
+		s.mu.Lock()
+		if s.subscriptions[sub.topic][sub.c.Id] == sub.c {
+			s.unsubscribe(sub.c.Id, sub.topic)
+			sub.c.Send(errorResponse("unsubscribe", sub.topic, "executor not whitelisted on chain "+chainIdStr))
+			slog.Info("client " + sub.c.Id + " unsubscribed from " + sub.topic + ", executor " + executor.Hex() + " not whitelisted")
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *Server) handleAuth(c *Client, data ClientMessage) {
+	err := c.Authenticate(strings.TrimSpace(data.Address), strings.TrimSpace(data.Signature))
+	if err != nil {
+		slog.Info("client " + c.Id + " authentication failed: " + err.Error())
+		c.Send(errorResponse("auth", "", err.Error()))
+		return
+	}
+	executor, _ := c.Executor()
+	slog.Info("client " + c.Id + " authenticated as executor " + executor.Hex())
+	r := ServerResponse{Type: "auth", Data: "ack"}
+	jsonData, _ := json.Marshal(r)
+	c.Send(jsonData)
+}
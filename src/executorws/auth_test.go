@@ -0,0 +1,122 @@
+package executorws
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/D8-X/d8x-broker-server/src/testutil"
+	"github.com/D8-X/d8x-broker-server/src/utils"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gorilla/websocket"
+)
+
+func newTestRedis(t *testing.T) (*utils.RueidisClient, *miniredis.Miniredis) {
+	client, s := testutil.NewRedis(t)
+	return utils.NewRueidisClient(client), s
+}
+
+// newTestWs starts the websocket handler with chains 42161 and 1101
+func newTestWs(t *testing.T) (*httptest.Server, *utils.RueidisClient) {
+	redis, _ := newTestRedis(t)
+	server = NewServer()
+	server.RedisClient = redis
+	UpdateConfig(map[int64]utils.ChainConfig{42161: {ChainId: 42161}, 1101: {ChainId: 1101}})
+	srv := httptest.NewServer(http.HandlerFunc(HandleWs))
+	t.Cleanup(srv.Close)
+	return srv, redis
+}
+
+func dialWs(t *testing.T, srv *httptest.Server) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readResponse(t *testing.T, conn *websocket.Conn) ServerResponse {
+	var r ServerResponse
+	if err := conn.ReadJSON(&r); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestWsAuthentication(t *testing.T) {
+	srv, redis := newTestWs(t)
+	key, _ := crypto.GenerateKey()
+	executor := crypto.PubkeyToAddress(key.PublicKey)
+	redis.SeedExecutors(42161, []common.Address{executor})
+
+	conn := dialWs(t, srv)
+	challenge := readResponse(t, conn)
+	message := challenge.Data.(map[string]any)["message"].(string)
+	if challenge.Type != "challenge" || !strings.HasPrefix(message, AUTH_MESSAGE_PREFIX) {
+		t.Fatalf("unexpected challenge %+v", challenge)
+	}
+	expectError := func(msg ClientMessage, errMsg string) {
+		conn.WriteJSON(msg)
+		r := readResponse(t, conn)
+		data, _ := json.Marshal(r.Data)
+		if !strings.Contains(string(data), errMsg) {
+			t.Errorf("%s: expected error %s, got %s", msg.Type, errMsg, data)
+		}
+	}
+	expectError(ClientMessage{Type: "subscribe", Topic: "100001:42161"}, "authentication required")
+
+	// signature of another message
+	sig, _ := crypto.Sign(accounts.TextHash([]byte(AUTH_MESSAGE_PREFIX+"00")), key)
+	expectError(ClientMessage{Type: "auth", Address: executor.Hex(), Signature: hexutil.Encode(sig)}, "invalid signature")
+
+	sig, _ = crypto.Sign(accounts.TextHash([]byte(message)), key)
+	conn.WriteJSON(ClientMessage{Type: "auth", Address: executor.Hex(), Signature: hexutil.Encode(sig)})
+	if r := readResponse(t, conn); r.Type != "auth" || r.Data != "ack" {
+		t.Fatalf("authentication failed %+v", r)
+	}
+	expectError(ClientMessage{Type: "subscribe", Topic: "100001:1101"}, "not whitelisted")
+	conn.WriteJSON(ClientMessage{Type: "subscribe", Topic: "100001:42161"})
+	if r := readResponse(t, conn); r.Type != "subscribe" || r.Data != "ack" {
+		t.Fatalf("subscription failed %+v", r)
+	}
+
+	// removed executors lose their subscriptions
+	server.recheckExecutors()
+	if n := server.Subscribers("100001:42161"); n != 1 {
+		t.Fatalf("whitelisted executor unsubscribed: %d", n)
+	}
+	redis.RemoveExecutors(42161, []common.Address{executor})
+	server.recheckExecutors()
+	r := readResponse(t, conn)
+	data, _ := json.Marshal(r.Data)
+	if r.Type != "unsubscribe" || r.Topic != "100001:42161" || !strings.Contains(string(data), "not whitelisted") {
+		t.Errorf("unexpected response %+v", r)
+	}
+	if n := server.Subscribers("100001:42161"); n != 0 {
+		t.Errorf("removed executor still subscribed")
+	}
+}
+
+func TestExecutorAllowedWithoutRedis(t *testing.T) {
+	redis, mr := newTestRedis(t)
+	s := NewServer()
+	s.RedisClient = redis
+	executor := common.HexToAddress("0x3ef256282e578c5D97a7231C3C046F19b1E50855")
+	UpdateConfig(map[int64]utils.ChainConfig{42161: {ChainId: 42161, AllowedExecutors: []common.Address{executor}}})
+	redis.SeedExecutors(42161, []common.Address{executor})
+	if !s.isExecutorAllowed(42161, executor) {
+		t.Fatal("whitelisted executor not allowed")
+	}
+	// the config file is not used as fallback
+	mr.SetError("ERR unavailable")
+	if s.isExecutorAllowed(42161, executor) {
+		t.Error("executor allowed without Redis")
+	}
+}
@@ -0,0 +1,187 @@
+package executorws
+
+import (
+	"errors"
+	"log/slog"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/D8-X/d8x-broker-server/src/metrics"
+	"github.com/gorilla/websocket"
+)
+
+// Policies for slow clients, applied when the send buffer of a client is full
+const (
+	// drop the oldest queued message
+	POLICY_DROP_OLDEST = "drop-oldest"
+	// disconnect the client
+	POLICY_DISCONNECT = "disconnect"
+)
+
+// DEFAULT_SEND_BUFFER is the default size of the outbound queue per client
+const DEFAULT_SEND_BUFFER = 64
+
+// ClientOptions configure the outbound queues of the clients
+type ClientOptions struct {
+	// messages queued per client, DEFAULT_SEND_BUFFER if 0
+	SendBuffer int
+	// POLICY_DROP_OLDEST (default) or POLICY_DISCONNECT
+	SlowClientPolicy string
+}
+
+// Validate checks the options and sets the defaults
+func (o *ClientOptions) Validate() error {
+	if o.SendBuffer < 0 {
+		return errors.New("send buffer must not be negative")
+	}
+	if o.SendBuffer == 0 {
+		o.SendBuffer = DEFAULT_SEND_BUFFER
+	}
+	switch o.SlowClientPolicy {
+	case "":
+		o.SlowClientPolicy = POLICY_DROP_OLDEST
+	case POLICY_DROP_OLDEST, POLICY_DISCONNECT:
+	default:
+		return errors.New("unknown slow client policy " + o.SlowClientPolicy)
+	}
+	return nil
+}
+
+// Client is a connected websocket client. Messages to the client are queued
+// and written by a single writer goroutine (writePump)
+type Client struct {
+	Id   string
+	conn *websocket.Conn
+	// outbound messages
+	send   chan []byte
+	policy string
+	// messages dropped because the client was too slow
+	dropped atomic.Int64
+	// closed when the client is disconnected
+	done      chan struct{}
+	closeOnce sync.Once
+	// authentication state
+	mu   sync.Mutex
+	sess *session
+}
+
+func newClient(id string, conn *websocket.Conn, opts ClientOptions) (*Client, error) {
+	sess, err := newSession()
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		Id:     id,
+		conn:   conn,
+		send:   make(chan []byte, opts.SendBuffer),
+		policy: opts.SlowClientPolicy,
+		done:   make(chan struct{}),
+		sess:   sess,
+	}, nil
+}
+
+// Send queues the message for the client. If the queue is full, the oldest
+// message is dropped or the client is disconnected, depending on the policy.
+// Returns false if the message is not queued
+func (c *Client) Send(message []byte) bool {
+	for {
+		select {
+		case <-c.done:
+			return false
+		default:
+		}
+		select {
+		case c.send <- message:
+			return true
+		default:
+		}
+		if c.policy == POLICY_DISCONNECT {
+			c.drop()
+			metrics.SlowClientDisconnects.Inc()
+			slog.Warn("client " + c.Id + " is too slow, disconnecting")
+			// do not block the sender on the close frame
+			go c.Close(websocket.CloseTryAgainLater, "too slow")
+			return false
+		}
+		// make room
+		select {
+		case <-c.send:
+			c.drop()
+		default:
+		}
+	}
+}
+
+// free returns the number of messages that can be queued without applying
+// the slow client policy
+func (c *Client) free() int {
+	return cap(c.send) - len(c.send)
+}
+
+// drop counts a dropped message
+func (c *Client) drop() {
+	metrics.DroppedSends.Inc()
+	if c.dropped.Add(1) == 1 {
+		slog.Warn("client " + c.Id + " is too slow, dropping messages")
+	}
+}
+
+// Close sends a close frame and disconnects the client
+func (c *Client) Close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		if n := c.dropped.Load(); n > 0 {
+			slog.Info("client " + c.Id + " disconnected, " + strconv.FormatInt(n, 10) + " messages dropped")
+		}
+		msg := websocket.FormatCloseMessage(code, reason)
+		c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+		c.conn.Close()
+	})
+}
+
+// writePump writes queued messages and pings to the client until the client
+// is disconnected
+func (c *Client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			err := c.conn.WriteMessage(websocket.TextMessage, msg)
+			if err != nil {
+				metrics.DroppedSends.Inc()
+				slog.Info("client " + c.Id + " write failed, disconnecting: " + err.Error())
+				c.Close(websocket.CloseGoingAway, "write failed")
+				return
+			}
+		case <-ticker.C:
+			err := c.conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(writeWait))
+			if err != nil {
+				c.Close(websocket.CloseGoingAway, "ping failed")
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// readPump processes incoming messages until the connection fails
+func (c *Client) readPump(s *Server) {
+	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+	for {
+		_, msg, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		s.HandleRequest(c, msg)
+	}
+}
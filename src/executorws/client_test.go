@@ -0,0 +1,71 @@
+package executorws
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestConn returns the client side of a websocket connection
+func newTestConn(t *testing.T) *websocket.Conn {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestSlowClientPolicies(t *testing.T) {
+	opts := ClientOptions{SlowClientPolicy: "block"}
+	if err := opts.Validate(); err == nil {
+		t.Error("unknown policy accepted")
+	}
+	opts = ClientOptions{}
+	if err := opts.Validate(); err != nil || opts.SendBuffer != DEFAULT_SEND_BUFFER || opts.SlowClientPolicy != POLICY_DROP_OLDEST {
+		t.Errorf("unexpected defaults %+v, %v", opts, err)
+	}
+
+	// the writer is not started, the queue fills up
+	c, _ := newClient("drop", newTestConn(t), ClientOptions{SendBuffer: 2, SlowClientPolicy: POLICY_DROP_OLDEST})
+	for _, msg := range []string{"1", "2", "3"} {
+		if !c.Send([]byte(msg)) {
+			t.Errorf("message %s not queued", msg)
+		}
+	}
+	if first := string(<-c.send); first != "2" || c.dropped.Load() != 1 {
+		t.Errorf("expected oldest message dropped, got %s, %d dropped", first, c.dropped.Load())
+	}
+
+	c, _ = newClient("disconnect", newTestConn(t), ClientOptions{SendBuffer: 2, SlowClientPolicy: POLICY_DISCONNECT})
+	c.Send([]byte("1"))
+	c.Send([]byte("2"))
+	if c.Send([]byte("3")) {
+		t.Error("message queued for slow client")
+	}
+	select {
+	case <-c.done:
+	case <-time.After(time.Second):
+		t.Fatal("slow client not disconnected")
+	}
+	if c.Send([]byte("4")) {
+		t.Error("message queued for disconnected client")
+	}
+}
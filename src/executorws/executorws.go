@@ -2,8 +2,10 @@ package executorws
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/D8-X/d8x-broker-server/src/utils"
@@ -12,11 +14,16 @@ import (
 	"github.com/redis/rueidis"
 )
 
-var upgrader = websocket.Upgrader{}
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
 
 // Initialize server with empty subscription
 var server = NewServer()
+
+// chain config, swapped on reload
 var config map[int64]utils.ChainConfig
+var configMu sync.RWMutex
 
 const (
 	// time to read the next client's pong message
@@ -25,136 +32,134 @@ const (
 	pingPeriod = (pongWait * 9) / 10
 	// time allowed to write a message to client
 	writeWait = 10 * time.Second
-	// max message size allowed
-	maxMessageSize = 512
+	// max message size allowed, larger messages close the connection
+	// (close code 1009). Fits MAX_TOPICS_PER_REQUEST topics
+	maxMessageSize = 4096
+	// MAX_TOPICS_PER_REQUEST is the number of topics a subscribe or
+	// unsubscribe request may contain, the acknowledgements fit the default
+	// send buffer
+	MAX_TOPICS_PER_REQUEST = 50
 )
 
-func StartWSServer(config_ map[int64]utils.ChainConfig, WS_ADDR string, REDIS_ADDR string, REDIS_PWD string) error {
+// getConfig returns the current chain config
+func getConfig() map[int64]utils.ChainConfig {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return config
+}
+
+// UpdateConfig atomically swaps the chain config and returns the changes
+func UpdateConfig(config_ map[int64]utils.ChainConfig) []string {
+	configMu.Lock()
+	defer configMu.Unlock()
+	diff := utils.DiffChainConfig(config, config_)
 	config = config_
+	return diff
+}
+
+// StartWSServer runs the websocket server until ctx is cancelled. Orders are
+// read from the order stream, with the offset stored under the instanceId.
+// On shutdown the stream reader stops and clients receive a close frame
+func StartWSServer(ctx context.Context, config_ map[int64]utils.ChainConfig, WS_ADDR string, REDIS_ADDR string, REDIS_PWD string, instanceId string, timeouts utils.HttpTimeouts, opts ClientOptions) error {
+	UpdateConfig(config_)
+	err := server.SetClientOptions(opts)
+	if err != nil {
+		return err
+	}
 	client, err := rueidis.NewClient(
 		rueidis.ClientOption{InitAddress: []string{REDIS_ADDR}, Password: REDIS_PWD})
 	if err != nil {
 		return err
 	}
-	server.RedisClient = &utils.RueidisClient{
-		Client: &client,
-		Ctx:    context.Background(),
-	}
-	errChanRedis := make(chan error)
+	defer client.Close()
+	server.RedisClient = utils.NewRueidisClient(client)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errChanRedis := make(chan error, 1)
+	var streamWg sync.WaitGroup
+	streamWg.Add(1)
 	go func() {
-		err = server.RedisClient.Subscribe(utils.CHANNEL_NEW_ORDER, server.handleNewOrder)
-		if err != nil {
-			errChanRedis <- err
-		}
+		defer streamWg.Done()
+		errChanRedis <- server.streamOrders(ctx, instanceId)
 	}()
-	http.HandleFunc("/ws", HandleWs)
+	go server.watchExecutors(ctx, EXECUTOR_RECHECK_INTERVAL)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", HandleWs)
+	mux.HandleFunc("/healthz", Healthz)
+	mux.HandleFunc("/readyz", Readyz)
 	slog.Info("Listening on " + WS_ADDR + "/ws")
 
-	errChanWS := make(chan error)
+	errChanWS := make(chan error, 1)
 	go func() {
-		err = http.ListenAndServe(WS_ADDR, nil)
-		if err != nil {
-			errChanWS <- err
-		}
+		errChanWS <- utils.ServeHttp(ctx, utils.NewHttpServer(WS_ADDR, mux, timeouts), timeouts)
 	}()
 
 	select {
-	case err := <-errChanWS:
+	case err = <-errChanWS:
 		if err != nil {
-			// Handle the error here.
-			// You can also choose to return it or take appropriate action.
-			// For example, log the error and exit the program.
 			slog.Error("WS terminated:" + err.Error())
-		} else {
-			// The blocking function completed without an error.
-			// You can continue with your program logic here.
-			slog.Info("WS terminated")
 		}
-	case err := <-errChanRedis:
+	case err = <-errChanRedis:
 		if err != nil {
-			// Handle the error here.
-			// You can also choose to return it or take appropriate action.
-			// For example, log the error and exit the program.
 			slog.Error("REDIS terminated:" + err.Error())
-		} else {
-			// The blocking function completed without an error.
-			// You can continue with your program logic here.
-			slog.Info("REDIS terminated")
 		}
+		cancel()
+		<-errChanWS
+	case <-ctx.Done():
+		// http server is shutting down
+		err = <-errChanWS
 	}
-	return nil
+	// stop reading orders and disconnect the clients
+	cancel()
+	streamWg.Wait()
+	server.CloseClients()
+	slog.Info("WS terminated")
+	return err
+}
+
+// Healthz reports that the process is alive
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"status": "ok"}`)
+}
+
+// Readyz checks the Redis connection
+func Readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), utils.HEALTH_CHECK_TIMEOUT)
+	defer cancel()
+	w.Header().Set("Content-Type", "application/json")
+	if err := server.RedisClient.Ping(ctx); err != nil {
+		slog.Error("readiness: redis: " + err.Error())
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, `{"ready": false, "redis": "fail"}`)
+		return
+	}
+	fmt.Fprint(w, `{"ready": true, "redis": "ok"}`)
 }
 
 func HandleWs(w http.ResponseWriter, r *http.Request) {
-	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
-	c, err := upgrader.Upgrade(w, r, nil)
+	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		slog.Info("upgrade:" + err.Error())
 		return
 	}
-	defer c.Close()
 	// create new client id
-	clientID := uuid.New().String()
-
-	//log new client
-	slog.Info("Server: new client connected, ID is " + clientID)
-
-	// create channel to signal client health
-	done := make(chan struct{})
-
-	go writePump(c, clientID, done)
-	readPump(c, clientID, done)
-}
-
-// readPump process incoming messages and set the settings
-func readPump(conn *websocket.Conn, clientID string, done chan<- struct{}) {
-	// set limit, deadline to read & pong handler
-	conn.SetReadLimit(maxMessageSize)
-	conn.SetReadDeadline(time.Now().Add(pongWait))
-	conn.SetPongHandler(func(string) error {
-		conn.SetReadDeadline(time.Now().Add(pongWait))
-		return nil
-	})
-
-	// message handling
-	for {
-		// read incoming message
-		_, msg, err := conn.ReadMessage()
-		// if error occured
-		if err != nil {
-			// remove from the client
-			server.RemoveClient(clientID)
-			// set health status to unhealthy by closing channel
-			close(done)
-			// stop process
-			break
-		}
-
-		// if no error, process incoming message
-		server.HandleRequest(conn, clientID, msg)
+	c, err := newClient(uuid.New().String(), conn, server.clientOptions())
+	if err != nil {
+		slog.Error("adding client: " + err.Error())
+		conn.Close()
+		return
 	}
-}
+	server.AddClient(c)
+	defer server.RemoveClient(c.Id)
 
-// writePump sends ping to the client
-func writePump(conn *websocket.Conn, clientID string, done <-chan struct{}) {
-	// create ping ticker
-	ticker := time.NewTicker(pingPeriod)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ticker.C:
-			// send ping message
-			err := conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(writeWait))
-			if err != nil {
-				// if error sending ping, remove this client from the server
-				server.RemoveClient(clientID)
-				// stop sending ping
-				return
-			}
-		case <-done:
-			// if process is done, stop sending ping
-			return
-		}
-	}
+	//log new client
+	slog.Info("Server: new client connected, ID is " + c.Id)
+	// clients authenticate before subscribing
+	c.Send(c.challenge())
+	authTimer := time.AfterFunc(authWait, c.closeUnauthenticated)
+	defer authTimer.Stop()
+
+	go c.writePump()
+	c.readPump(server)
 }
@@ -0,0 +1,131 @@
+package executorws
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/D8-X/d8x-broker-server/src/utils"
+)
+
+const (
+	// stream entries read at once for a replay
+	replayPageSize = 1000
+	// stream entries read at most for a replay
+	replayMaxEntries = 10000
+	// reads of the entries broadcast while a client subscribes
+	replayAttempts = 3
+)
+
+var errReplayTooLarge = errors.New("too many orders to replay")
+
+// Replay selects the recent orders sent to a new subscriber before live
+// updates: orders submitted since the unix timestamp Since, or after the
+// order LastOrderId, and status changes. Orders older than
+// utils.EXPIRY_HDATA_SEC, orders with a past deadline and orders closed later
+// are not replayed
+type Replay struct {
+	Since       int64
+	LastOrderId string
+}
+
+func (r Replay) enabled() bool {
+	return r.Since > 0 || r.LastOrderId != ""
+}
+
+// start returns the first stream entry id to replay
+func (r Replay) start(now time.Time) string {
+	from := now.Add(-utils.EXPIRY_HDATA_SEC * time.Second).UnixMilli()
+	if r.Since > 0 {
+		from = max(from, r.Since*1000)
+	}
+	return strconv.FormatInt(from, 10)
+}
+
+// recentOrders reads the stream entries a subscriber could replay from the
+// first entry to replay. Called without s.mu held, subscribe completes the
+// entries
+func (s *Server) recentOrders(from string) ([]utils.OrderStreamEntry, error) {
+	return s.readReplay(nil, from, "+")
+}
+
+// readReplay appends the stream entries from start to end (XRANGE syntax)
+// to entries, reading replayPageSize entries at a time. Fails if more than
+// replayMaxEntries entries would be replayed
+func (s *Server) readReplay(entries []utils.OrderStreamEntry, start, end string) ([]utils.OrderStreamEntry, error) {
+	for {
+		page, err := s.RedisClient.OrderStreamRange(start, end, replayPageSize)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, page...)
+		if len(entries) > replayMaxEntries {
+			return nil, errReplayTooLarge
+		}
+		if len(page) < replayPageSize {
+			return entries, nil
+		}
+		start = "(" + page[len(page)-1].Id
+	}
+}
+
+// replayGap returns the start of the stream entries missing in entries,
+// read from the first entry to replay from, up to the stream position pos.
+// Returns false if no entries are missing
+func replayGap(entries []utils.OrderStreamEntry, from, pos string) (string, bool) {
+	if pos == "" {
+		// nothing broadcast yet
+		return "", false
+	}
+	if len(entries) == 0 {
+		return from, utils.CompareStreamIds(pos, from) >= 0
+	}
+	last := entries[len(entries)-1].Id
+	return "(" + last, utils.CompareStreamIds(pos, last) > 0
+}
+
+// replayOrders returns the order updates matching the topic to replay, in
+// stream order. Entries up to the stream position pos were broadcast before
+// the client subscribed, later entries are sent live. entries must cover
+// the stream up to pos, see replayGap
+func replayOrders(entries []utils.OrderStreamEntry, topic string, r Replay, pos string, now time.Time) [][]byte {
+	if pos == "" {
+		return nil
+	}
+	var orders []utils.OrderStreamEntry
+	closed := make(map[string]bool)
+	for _, e := range entries {
+		if utils.CompareStreamIds(e.Id, pos) > 0 {
+			break
+		}
+		if e.Status == nil && e.Order.OrderId == r.LastOrderId {
+			// replay the orders after the last order seen
+			orders = orders[:0]
+			continue
+		}
+		if !topicMatches(topic, e.Topic) {
+			continue
+		}
+		if e.Status != nil {
+			closed[e.Status.OrderId] = true
+		} else if e.Order.Deadline != 0 && int64(e.Order.Deadline) < now.Unix() {
+			continue
+		}
+		orders = append(orders, e)
+	}
+	msgs := make([][]byte, 0, len(orders))
+	for _, e := range orders {
+		if e.Status == nil && closed[e.Order.OrderId] {
+			continue
+		}
+		jsonData, err := json.Marshal(entryResponse(e))
+		if err != nil {
+			slog.Error("forming order update")
+			continue
+		}
+		msgs = append(msgs, jsonData)
+	}
+	return msgs
+}
@@ -0,0 +1,183 @@
+package executorws
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/D8-X/d8x-broker-server/src/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gorilla/websocket"
+)
+
+// orderIds reads n messages and returns the order ids of the updates,
+// skipping the status of the closed order
+func orderIds(t *testing.T, conn *websocket.Conn, n int) []string {
+	var ids []string
+	for k := 0; k < n; k++ {
+		r := readResponse(t, conn)
+		if r.Type == "status" && r.Data.(map[string]any)["orderId"] != "closed" {
+			t.Errorf("unexpected status %+v", r)
+		}
+		if r.Type == "update" {
+			ids = append(ids, r.Data.(map[string]any)["orderId"].(string))
+		}
+	}
+	return ids
+}
+
+func TestSubscribeReplay(t *testing.T) {
+	srv, redis := newTestWs(t)
+	key, _ := crypto.GenerateKey()
+	redis.SeedExecutors(42161, []common.Address{crypto.PubkeyToAddress(key.PublicKey)})
+	topic := "100001:42161"
+	deadline := uint32(time.Now().Add(time.Hour).Unix())
+	for _, o := range []struct{ id, topic string }{{"a", topic}, {"b", "100002:42161"}, {"c", topic}} {
+		redis.AddOrderToStream(o.topic, utils.WSOrderResp{OrderId: o.id, Deadline: deadline}, 0)
+	}
+	redis.AddOrderToStream(topic, utils.WSOrderResp{OrderId: "expired", Deadline: 1000}, 0)
+	// closed orders are not replayed, their status is
+	redis.AddOrderToStream(topic, utils.WSOrderResp{OrderId: "closed", Deadline: deadline}, 0)
+	redis.AddStatusToStream(utils.OrderStatus{OrderId: "closed", Status: "executed", Topic: topic}, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		server.streamOrders(ctx, "ws")
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	// wait until the orders are broadcast
+	for k := 0; ; k++ {
+		if offset, _ := redis.OrderStreamOffset("ws"); offset != "" {
+			break
+		}
+		if k == 500 {
+			t.Fatal("orders not broadcast")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	subscribe := func(msg ClientMessage, n int) (*websocket.Conn, []string) {
+		conn := dialWs(t, srv)
+		if err := authenticate(conn, key); err != nil {
+			t.Fatal(err)
+		}
+		conn.WriteJSON(msg)
+		if r := readResponse(t, conn); r.Type != "subscribe" || r.Data != "ack" {
+			t.Fatalf("subscription failed %+v", r)
+		}
+		return conn, orderIds(t, conn, n)
+	}
+	_, ids := subscribe(ClientMessage{Type: "subscribe", Topic: topic, LastOrderId: "0xa"}, 2)
+	if len(ids) != 1 || ids[0] != "c" {
+		t.Errorf("expected order c after a, got %v", ids)
+	}
+	conn, ids := subscribe(ClientMessage{Type: "subscribe", Topic: topic, Since: time.Now().Add(-time.Minute).Unix()}, 3)
+	if len(ids) != 2 || ids[0] != "a" || ids[1] != "c" {
+		t.Errorf("expected orders a and c since a minute, got %v", ids)
+	}
+	// live updates follow the replay
+	redis.AddOrderToStream(topic, utils.WSOrderResp{OrderId: "d", Deadline: deadline}, 0)
+	if ids = orderIds(t, conn, 1); len(ids) != 1 || ids[0] != "d" {
+		t.Errorf("expected live order d, got %v", ids)
+	}
+	// no replay without since or last order
+	conn, _ = subscribe(ClientMessage{Type: "subscribe", Topic: topic}, 0)
+	redis.AddOrderToStream(topic, utils.WSOrderResp{OrderId: "e", Deadline: deadline}, 0)
+	if ids = orderIds(t, conn, 1); len(ids) != 1 || ids[0] != "e" {
+		t.Errorf("expected live order e, got %v", ids)
+	}
+}
+
+func TestReplayGap(t *testing.T) {
+	redis, _ := newTestRedis(t)
+	s := NewServer()
+	s.RedisClient = redis
+	UpdateConfig(map[int64]utils.ChainConfig{42161: {ChainId: 42161}})
+	topic := "100001:42161"
+	deadline := uint32(time.Now().Add(time.Hour).Unix())
+	redis.AddOrderToStream(topic, utils.WSOrderResp{OrderId: "a", Deadline: deadline}, 0)
+	replay := Replay{Since: time.Now().Add(-time.Minute).Unix()}
+	from := replay.start(time.Now())
+	recent, err := s.recentOrders(from)
+	if err != nil || len(recent) != 1 {
+		t.Fatalf("unexpected entries %+v, %v", recent, err)
+	}
+	// order b is broadcast after the entries were read
+	redis.AddOrderToStream(topic, utils.WSOrderResp{OrderId: "b", Deadline: deadline}, 0)
+	pos, _ := redis.OrderStreamTail()
+	s.streamPos = pos
+	c, _ := newClient("c", newTestConn(t), ClientOptions{SendBuffer: 8})
+	s.AddClient(c)
+	start, gapEnd, done := s.subscribe(c, topic, replay, recent, from)
+	if done || start != "("+recent[0].Id || gapEnd != pos || s.Subscribers(topic) != 0 {
+		t.Fatalf("missing entries not detected: %s %s %v", start, gapEnd, done)
+	}
+	recent, err = s.readReplay(recent, start, gapEnd)
+	if err != nil || len(recent) != 2 {
+		t.Fatalf("unexpected entries %+v, %v", recent, err)
+	}
+	if _, _, done = s.subscribe(c, topic, replay, recent, from); !done || s.Subscribers(topic) != 1 {
+		t.Fatal("client not subscribed")
+	}
+	<-c.send // ack
+	if id := nextOrder(t, c); id != "a" {
+		t.Errorf("expected order a, got %s", id)
+	}
+	if id := nextOrder(t, c); id != "b" {
+		t.Errorf("expected order b, got %s", id)
+	}
+}
+
+func TestReplayExceedingSendBuffer(t *testing.T) {
+	redis, _ := newTestRedis(t)
+	s := NewServer()
+	s.RedisClient = redis
+	topic := "100001:42161"
+	deadline := uint32(time.Now().Add(time.Hour).Unix())
+	for k := 0; k < 10; k++ {
+		redis.AddOrderToStream(topic, utils.WSOrderResp{OrderId: strconv.Itoa(k), Deadline: deadline}, 0)
+	}
+	s.streamPos, _ = redis.OrderStreamTail()
+	replay := Replay{Since: time.Now().Add(-time.Minute).Unix()}
+	from := replay.start(time.Now())
+	recent, err := s.recentOrders(from)
+	if err != nil || len(recent) != 10 {
+		t.Fatalf("unexpected entries %+v, %v", recent, err)
+	}
+
+	// the replay fails rather than dropping orders
+	c, _ := newClient("c", newTestConn(t), ClientOptions{SendBuffer: 8, SlowClientPolicy: POLICY_DROP_OLDEST})
+	s.AddClient(c)
+	if _, _, done := s.subscribe(c, topic, replay, recent, from); !done || s.Subscribers(topic) != 0 {
+		t.Fatal("client subscribed with a replay exceeding the send buffer")
+	}
+	var res ServerResponse
+	json.Unmarshal(<-c.send, &res)
+	if e, _ := res.Data.(map[string]any); res.Type != "subscribe" || !strings.HasPrefix(e["error"].(string), errReplayTooLarge.Error()) {
+		t.Errorf("unexpected response %+v", res)
+	}
+	if c.dropped.Load() != 0 || len(c.send) != 0 {
+		t.Errorf("messages dropped or queued: %d, %d", c.dropped.Load(), len(c.send))
+	}
+
+	c, _ = newClient("d", newTestConn(t), ClientOptions{SendBuffer: 11, SlowClientPolicy: POLICY_DISCONNECT})
+	s.AddClient(c)
+	if _, _, done := s.subscribe(c, topic, replay, recent, from); !done || s.Subscribers(topic) != 1 {
+		t.Fatal("client not subscribed")
+	}
+	<-c.send // ack
+	for k := 0; k < 10; k++ {
+		if id := nextOrder(t, c); id != strconv.Itoa(k) {
+			t.Errorf("expected order %d, got %s", k, id)
+		}
+	}
+}
@@ -2,33 +2,55 @@ package executorws
 
 import (
 	"encoding/json"
-	"regexp"
+	"errors"
+	"fmt"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"log/slog"
 
+	"github.com/D8-X/d8x-broker-server/src/metrics"
 	"github.com/D8-X/d8x-broker-server/src/utils"
 	"github.com/gorilla/websocket"
-	"github.com/redis/rueidis"
 )
 
-// Subscriptions is a type for each string of topic and the clients that subscribe to it
+// Subscriptions maps topics to the subscribed clients
 type Subscriptions map[string]Clients
 
-// Clients is a type that describe the clients' ID and their connection
-type Clients map[string]*websocket.Conn
+// Clients maps client ids to clients
+type Clients map[string]*Client
 
-// Server is the struct to handle the Server functions & manage the Subscriptions
+// Server manages the connected clients and their subscriptions. Clients and
+// subscriptions are guarded by mu, messages are sent via the client queues
 type Server struct {
-	Subscriptions Subscriptions
-	RedisClient   *utils.RueidisClient
+	RedisClient *utils.RueidisClient
+	mu          sync.RWMutex
+	// subscribed clients per topic
+	subscriptions Subscriptions
+	// all connected clients, closed on shutdown
+	clients Clients
+	// send buffer and slow client policy of new clients
+	opts ClientOptions
+	// id of the last order stream entry broadcast, set by the stream reader
+	// with mu held for reading, read by subscribers holding mu
+	streamPos string
 }
 
 type ClientMessage struct {
 	Type  string `json:"type"`
 	Topic string `json:"topic"`
+	// several topics for types subscribe and unsubscribe
+	Topics []string `json:"topics,omitempty"`
+	// executor address and signature of the challenge for type auth
+	Address   string `json:"address,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	// replay orders submitted since the unix timestamp or after the order id
+	// for type subscribe
+	Since       int64  `json:"since,omitempty"`
+	LastOrderId string `json:"lastOrderId,omitempty"`
 }
 
 type ServerResponse struct {
@@ -44,39 +66,124 @@ type ErrorResponse struct {
 const NEW_ORDER_TOPIC = "orders"
 
 func NewServer() *Server {
-	var s Server
-	s.Subscriptions = make(Subscriptions)
-	s.Subscriptions[NEW_ORDER_TOPIC] = make(Clients)
-	return &s
+	return &Server{
+		subscriptions: make(Subscriptions),
+		clients:       make(Clients),
+		opts:          ClientOptions{SendBuffer: DEFAULT_SEND_BUFFER, SlowClientPolicy: POLICY_DROP_OLDEST},
+	}
 }
 
-// Send simply sends message to the websocket client
-func (s *Server) Send(conn *websocket.Conn, message []byte) {
-	// send simple message
-	conn.WriteMessage(websocket.TextMessage, message)
+// SetClientOptions sets the send buffer and slow client policy of clients
+// connecting later
+func (s *Server) SetClientOptions(opts ClientOptions) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.opts = opts
+	return nil
 }
 
-// SendWithWait sends message to the websocket client using wait group, allowing usage with goroutines
-func (s *Server) SendWithWait(conn *websocket.Conn, message []byte, wg *sync.WaitGroup) {
-	// send simple message
-	conn.WriteMessage(websocket.TextMessage, message)
+// clientOptions returns the options for new clients
+func (s *Server) clientOptions() ClientOptions {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.opts
+}
 
-	// set the task as done
-	wg.Done()
+// AddClient registers a connected client
+func (s *Server) AddClient(c *Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients[c.Id] = c
 }
 
-// RemoveClient removes the clients from the server subscription map
+// RemoveClient removes the client from all subscriptions and disconnects it
 func (s *Server) RemoveClient(clientID string) {
-	// loop all topics
-	for _, client := range s.Subscriptions {
-		// delete the client from all the topic's client map
-		delete(client, clientID)
+	s.mu.Lock()
+	c := s.clients[clientID]
+	delete(s.clients, clientID)
+	for topic, clients := range s.subscriptions {
+		if _, subbed := clients[clientID]; subbed {
+			s.unsubscribe(clientID, topic)
+		}
+	}
+	s.mu.Unlock()
+	if c != nil {
+		c.Close(websocket.CloseNormalClosure, "")
+	}
+}
+
+// CloseClients sends a close frame to all connected clients
+func (s *Server) CloseClients() {
+	s.mu.Lock()
+	clients := s.clients
+	s.clients = make(Clients)
+	for topic := range s.subscriptions {
+		metrics.WsClients.WithLabelValues(topic).Set(0)
+	}
+	s.subscriptions = make(Subscriptions)
+	s.mu.Unlock()
+	for _, c := range clients {
+		c.Close(websocket.CloseGoingAway, "server shutting down")
+	}
+	slog.Info("closed all websocket clients")
+}
+
+// Broadcast queues the message for all clients subscribed to the order topic
+// perpetualId:chainId or to a topic matching it, and returns the number of
+// clients. Clients with several matching subscriptions receive the message
+// once
+func (s *Server) Broadcast(topic string, message []byte) int {
+	return s.broadcast(topic, message, "")
+}
+
+// broadcast queues the message for the subscribers of the topic. If the
+// message is the order stream entry streamId, the stream position is set
+// for replays of later subscribers
+func (s *Server) broadcast(topic string, message []byte, streamId string) int {
+	s.mu.RLock()
+	matched := make(Clients)
+	for _, t := range matchingTopics(topic) {
+		for id, c := range s.subscriptions[t] {
+			matched[id] = c
+		}
+	}
+	if streamId != "" {
+		s.streamPos = streamId
+	}
+	s.mu.RUnlock()
+	for _, c := range matched {
+		c.Send(message)
+	}
+	return len(matched)
+}
+
+// Subscribers returns the number of clients subscribed to the topic
+func (s *Server) Subscribers(topic string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.subscriptions[topic])
+}
+
+// ClientTopics returns the sorted topics the client is subscribed to
+func (s *Server) ClientTopics(clientID string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	topics := make([]string, 0)
+	for topic, clients := range s.subscriptions {
+		if _, subbed := clients[clientID]; subbed {
+			topics = append(topics, topic)
+		}
 	}
+	slices.Sort(topics)
+	return topics
 }
 
 // Process incoming websocket message
 // https://github.com/madeindra/golang-websocket/
-func (s *Server) HandleRequest(conn *websocket.Conn, clientID string, message []byte) {
+func (s *Server) HandleRequest(c *Client, message []byte) {
 
 	var data ClientMessage
 	err := json.Unmarshal(message, &data)
@@ -85,17 +192,49 @@ func (s *Server) HandleRequest(conn *websocket.Conn, clientID string, message []
 		return
 	}
 	slog.Info("recv: Topic " + data.Topic + " Type " + data.Type)
-	reqTopic := strings.TrimSpace(strings.ToLower(data.Topic))
+	reqTopics := make([]string, 0, len(data.Topics)+1)
+	for _, t := range append([]string{data.Topic}, data.Topics...) {
+		t = strings.TrimSpace(strings.ToLower(t))
+		if t != "" && !slices.Contains(reqTopics, t) {
+			reqTopics = append(reqTopics, t)
+		}
+	}
+	if len(reqTopics) == 0 {
+		// usage error on subscribe
+		reqTopics = append(reqTopics, "")
+	}
 	reqType := strings.TrimSpace(strings.ToLower(data.Type))
-	if reqType == "subscribe" {
-		msg := s.SubscribeOrders(conn, clientID, reqTopic)
-		server.Send(conn, msg)
+	if (reqType == "subscribe" || reqType == "unsubscribe") && len(reqTopics) > MAX_TOPICS_PER_REQUEST {
+		c.Send(errorResponse(reqType, "", "at most "+strconv.Itoa(MAX_TOPICS_PER_REQUEST)+" topics per request"))
+		return
+	}
+	if reqType == "auth" {
+		s.handleAuth(c, data)
+	} else if reqType == "subscribe" {
+		replay := Replay{Since: data.Since, LastOrderId: strings.TrimPrefix(strings.TrimSpace(data.LastOrderId), "0x")}
+		for _, topic := range reqTopics {
+			s.SubscribeOrders(c, topic, replay)
+		}
 	} else if reqType == "unsubscribe" {
-		// unsubscribe
-		s.UnsubscribeOrders(clientID, reqTopic)
+		for _, topic := range reqTopics {
+			s.UnsubscribeOrders(c.Id, topic)
+		}
+	} else if reqType == "list" {
+		c.Send(s.listResponse(c.Id))
 	} //else: ignore
 }
 
+// listResponse returns the subscriptions of the client
+func (s *Server) listResponse(clientID string) []byte {
+	r := ServerResponse{Type: "list", Data: s.ClientTopics(clientID)}
+	jsonData, err := json.Marshal(r)
+	if err != nil {
+		slog.Error("forming response")
+		return []byte{}
+	}
+	return jsonData
+}
+
 func (s *Server) AckSub(topic string) []byte {
 	r := ServerResponse{Type: "subscribe", Topic: topic, Data: "ack"}
 	jsonData, err := json.Marshal(r)
@@ -106,130 +245,137 @@ func (s *Server) AckSub(topic string) []byte {
 	return jsonData
 }
 
-// Subscribe the client to new orders
-func (s *Server) SubscribeOrders(conn *websocket.Conn, clientID string, topic string) []byte {
-	if !isValidOrderTopic(topic) {
-		return errorResponse("subscribe", topic, "usage: perpetualId:chainId")
+// SubscribeOrders subscribes the client to new orders of the topic. The
+// acknowledgement and replayed orders are queued before live updates
+func (s *Server) SubscribeOrders(c *Client, topic string, replay Replay) {
+	chainId, valid := parseTopic(topic)
+	if !valid {
+		c.Send(errorResponse("subscribe", topic, "usage: perpetualId:chainId, *:chainId or pool-poolId:chainId"))
+		return
 	}
-	if _, exist := s.Subscriptions[topic]; exist {
-		clients := s.Subscriptions[topic]
-		// if client already subscribed, stop the process
-		if _, subbed := clients[clientID]; subbed {
-			return errorResponse("subscribe", topic, "client already subscribed")
+	executor, authed := c.Executor()
+	if !authed {
+		c.Send(errorResponse("subscribe", topic, "authentication required"))
+		return
+	}
+	chainIdStr := strconv.FormatInt(chainId, 10)
+	if !s.isExecutorAllowed(chainId, executor) {
+		c.Send(errorResponse("subscribe", topic, "executor not whitelisted on chain "+chainIdStr))
+		return
+	}
+	var recent []utils.OrderStreamEntry
+	var from string
+	if replay.enabled() {
+		from = replay.start(time.Now())
+		var err error
+		recent, err = s.recentOrders(from)
+		if err != nil {
+			s.replayFailed(c, topic, err)
+			return
+		}
+	}
+	for attempt := 1; ; attempt++ {
+		start, pos, done := s.subscribe(c, topic, replay, recent, from)
+		if done {
+			return
+		}
+		if attempt == replayAttempts {
+			s.replayFailed(c, topic, errors.New("stream position moved during "+strconv.Itoa(attempt)+" reads"))
+			return
+		}
+		// read the entries broadcast meanwhile without holding s.mu
+		var err error
+		recent, err = s.readReplay(recent, start, pos)
+		if err != nil {
+			s.replayFailed(c, topic, err)
+			return
 		}
-		// not subscribed
-		clients[clientID] = conn
-		return s.AckSub(topic)
 	}
-	// if topic does not exist, create a new topic
-	newClients := make(Clients)
-	s.Subscriptions[topic] = newClients
-
-	// add the client to the topic
-	s.Subscriptions[topic][clientID] = conn
-	return s.AckSub(topic)
 }
 
-// Unsubscribe the client from a candle-topic (e.g. btc-usd:15m)
-func (s *Server) UnsubscribeOrders(clientID string, topic string) {
-	// if topic exists, check the client map
-	if _, exist := s.Subscriptions[topic]; exist {
-		client := s.Subscriptions[topic]
-		// remove the client from the topic's client map
-		delete(client, clientID)
-	}
-}
-
-func isValidOrderTopic(topic string) bool {
-	pattern := "^[0-9]+:[0-9]+$" // Regular expression for order topics
-	regex, _ := regexp.Compile(pattern)
-	if !regex.MatchString(topic) {
-		return false
-	}
-	perpId, chainId, _ := strings.Cut(topic, ":")
-	id, _ := strconv.Atoi(perpId)
-	if id < 100000 {
-		return false
-	}
-	// supported chainId?
-	id, _ = strconv.Atoi(chainId)
-	for _, el := range config {
-		if el.ChainId == int64(id) {
-			return true
+// subscribe adds the client to the topic and queues the acknowledgement and
+// the replayed orders. If entries broadcast after recent are missing for
+// the replay, the client is not subscribed and the start of the missing
+// entries and the stream position are returned with done false
+func (s *Server) subscribe(c *Client, topic string, replay Replay, recent []utils.OrderStreamEntry, from string) (string, string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, connected := s.clients[c.Id]; !connected {
+		c.Send(errorResponse("subscribe", topic, "client disconnected"))
+		return "", "", true
+	}
+	clients, exist := s.subscriptions[topic]
+	// if client already subscribed, stop the process
+	if _, subbed := clients[c.Id]; subbed {
+		c.Send(errorResponse("subscribe", topic, "client already subscribed"))
+		return "", "", true
+	}
+	var updates [][]byte
+	if replay.enabled() {
+		if start, missing := replayGap(recent, from, s.streamPos); missing {
+			return start, s.streamPos, false
+		}
+		updates = replayOrders(recent, topic, replay, s.streamPos, time.Now())
+		// the replay must not trigger the slow client policy
+		if free := c.free() - 1; len(updates) > free {
+			s.replayFailed(c, topic, fmt.Errorf("%w: %d orders, send buffer has room for %d", errReplayTooLarge, len(updates), max(free, 0)))
+			return "", "", true
 		}
 	}
-	return false
+	if !exist {
+		clients = make(Clients)
+		s.subscriptions[topic] = clients
+	}
+	clients[c.Id] = c
+	metrics.WsClients.WithLabelValues(topic).Set(float64(len(clients)))
+	c.Send(s.AckSub(topic))
+	for _, msg := range updates {
+		c.Send(msg)
+	}
+	if len(updates) > 0 {
+		slog.Info("replayed " + strconv.Itoa(len(updates)) + " orders of " + topic + " to client " + c.Id)
+	}
+	return "", "", true
 }
 
-func errorResponse(reqType string, reqTopic string, msg string) []byte {
-
-	e := ErrorResponse{Error: msg}
-	res := ServerResponse{Type: reqType, Topic: reqTopic, Data: e}
-	jsonData, err := json.Marshal(res)
-	if err != nil {
-		slog.Error("forming error response")
+// replayFailed reports a failed replay to the client, which is not
+// subscribed
+func (s *Server) replayFailed(c *Client, topic string, err error) {
+	slog.Error("replay of " + topic + ": " + err.Error())
+	msg := "replay failed"
+	if errors.Is(err, errReplayTooLarge) {
+		msg = err.Error() + ", use a later since or lastOrderId"
 	}
-	return jsonData
+	c.Send(errorResponse("subscribe", topic, msg))
 }
 
-// handle Redis message from CHANNEL_NEW_ORDER
-func (s *Server) handleNewOrder(msg rueidis.PubSubMessage) {
-	slog.Info("Received CHANNEL_NEW_ORDER message:" + msg.Message)
-	topic := msg.Message
-	// get the order-id
-	client := *s.RedisClient.Client
-	for {
-		oId, err := client.Do(s.RedisClient.Ctx, client.B().Lpop().Key(topic).Build()).ToString()
-		if err != nil {
-			// done (no more elements on stack)
-			break
-		}
-		slog.Info("New order id =" + oId)
-		s.handleOrderId(oId, topic)
-	}
+// Unsubscribe the client from the topic
+func (s *Server) UnsubscribeOrders(clientID string, topic string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unsubscribe(clientID, topic)
 }
 
-func (s *Server) handleOrderId(oId string, topic string) {
-	client := *s.RedisClient.Client
-	orderStr, err := client.Do(s.RedisClient.Ctx, client.B().Hgetall().Key(oId).Build()).AsStrMap()
-	if err != nil {
-		slog.Error("Error handleNewOrder:" + err.Error())
+// unsubscribe removes the client from the topic, s.mu must be held
+func (s *Server) unsubscribe(clientID string, topic string) {
+	clients, exist := s.subscriptions[topic]
+	if !exist {
 		return
 	}
-	if len(orderStr) == 0 {
-		// expired order Id
-		slog.Info(" -- order id expired")
-		return
+	delete(clients, clientID)
+	metrics.WsClients.WithLabelValues(topic).Set(float64(len(clients)))
+	if len(clients) == 0 {
+		delete(s.subscriptions, topic)
 	}
-	vd, _ := strconv.Atoi(orderStr["Deadline"])
-	vf, _ := strconv.Atoi(orderStr["Flags"])
-	ve, _ := strconv.Atoi(orderStr["ExecutionTimestamp"])
-	var o = utils.WSOrderResp{
-		OrderId:            oId,
-		TraderAddr:         orderStr["TraderAddr"],
-		Deadline:           uint32(vd),
-		Flags:              uint32(vf),
-		FAmount:            orderStr["FAmount"],
-		FLimitPrice:        orderStr["FLimitPrice"],
-		FTriggerPrice:      orderStr["FTriggerPrice"],
-		ExecutionTimestamp: uint32(ve),
-	}
-	r := ServerResponse{Type: "update", Topic: topic, Data: o}
-	jsonData, err := json.Marshal(r)
+}
+
+func errorResponse(reqType string, reqTopic string, msg string) []byte {
+
+	e := ErrorResponse{Error: msg}
+	res := ServerResponse{Type: reqType, Topic: reqTopic, Data: e}
+	jsonData, err := json.Marshal(res)
 	if err != nil {
-		slog.Error("forming order update")
-		return
-	}
-	// update subscribers
-	clients := server.Subscriptions[topic]
-	var wg sync.WaitGroup
-	slog.Info("Sending update to " + strconv.Itoa(len(clients)) + " subscribers")
-	for k, conn := range clients {
-		wg.Add(1)
-		slog.Info("Sending update to client " + k)
-		go server.SendWithWait(conn, jsonData, &wg)
+		slog.Error("forming error response")
 	}
-	// wait until all goroutines jobs done
-	wg.Wait()
-
+	return jsonData
 }
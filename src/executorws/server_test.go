@@ -0,0 +1,136 @@
+package executorws
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gorilla/websocket"
+)
+
+// readUntil reads messages until a message of the given type, skipping
+// order updates
+func readUntil(conn *websocket.Conn, msgType string) (ServerResponse, error) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var r ServerResponse
+		if err := conn.ReadJSON(&r); err != nil {
+			return r, err
+		}
+		if r.Type == msgType {
+			return r, nil
+		}
+	}
+}
+
+// authenticate answers the challenge of a new connection
+func authenticate(conn *websocket.Conn, key *ecdsa.PrivateKey) error {
+	challenge, err := readUntil(conn, "challenge")
+	if err != nil {
+		return err
+	}
+	message := challenge.Data.(map[string]any)["message"].(string)
+	sig, _ := crypto.Sign(accounts.TextHash([]byte(message)), key)
+	err = conn.WriteJSON(ClientMessage{Type: "auth", Address: crypto.PubkeyToAddress(key.PublicKey).Hex(),
+		Signature: hexutil.Encode(sig)})
+	if err != nil {
+		return err
+	}
+	r, err := readUntil(conn, "auth")
+	if err == nil && r.Data != "ack" {
+		err = fmt.Errorf("authentication failed: %v", r.Data)
+	}
+	return err
+}
+
+func TestConcurrentClients(t *testing.T) {
+	srv, redis := newTestWs(t)
+	key, _ := crypto.GenerateKey()
+	redis.SeedExecutors(42161, []common.Address{crypto.PubkeyToAddress(key.PublicKey)})
+	const numClients = 50
+	topic := "100001:42161"
+
+	// broadcast while clients connect, subscribe and unsubscribe
+	stop := make(chan struct{})
+	var bg sync.WaitGroup
+	bg.Add(1)
+	go func() {
+		defer bg.Done()
+		msg, _ := json.Marshal(ServerResponse{Type: "update", Topic: topic, Data: "order"})
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				server.Broadcast(topic, msg)
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+
+	conns := make([]*websocket.Conn, numClients)
+	var ready sync.WaitGroup
+	for k := range conns {
+		conns[k] = dialWs(t, srv)
+		ready.Add(1)
+		go func(conn *websocket.Conn) {
+			defer ready.Done()
+			if err := authenticate(conn, key); err != nil {
+				t.Error(err)
+				return
+			}
+			for j := 0; j < 5; j++ {
+				conn.WriteJSON(ClientMessage{Type: "subscribe", Topic: topic})
+				if r, err := readUntil(conn, "subscribe"); err != nil || r.Data != "ack" {
+					t.Errorf("subscription failed: %v %v", r.Data, err)
+					return
+				}
+				if j < 4 {
+					conn.WriteJSON(ClientMessage{Type: "unsubscribe", Topic: topic})
+				}
+			}
+		}(conns[k])
+	}
+	ready.Wait()
+	close(stop)
+	bg.Wait()
+	if n := server.Subscribers(topic); n != numClients {
+		t.Fatalf("expected %d subscribers, got %d", numClients, n)
+	}
+
+	// every subscriber receives the broadcast
+	marker, _ := json.Marshal(ServerResponse{Type: "marker", Topic: topic})
+	if n := server.Broadcast(topic, marker); n != numClients {
+		t.Fatalf("broadcast to %d clients", n)
+	}
+	var received sync.WaitGroup
+	for _, conn := range conns {
+		received.Add(1)
+		go func(conn *websocket.Conn) {
+			defer received.Done()
+			if _, err := readUntil(conn, "marker"); err != nil {
+				t.Error(err)
+			}
+		}(conn)
+	}
+	received.Wait()
+
+	// disconnected clients are removed
+	for _, conn := range conns {
+		conn.Close()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for server.Subscribers(topic) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d subscribers left", server.Subscribers(topic))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
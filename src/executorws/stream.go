@@ -0,0 +1,123 @@
+package executorws
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/D8-X/d8x-broker-server/src/metrics"
+	"github.com/D8-X/d8x-broker-server/src/utils"
+)
+
+const (
+	// orders read from the stream at once
+	streamReadCount = 100
+	// time to wait for new orders before checking for shutdown
+	streamBlock = 2 * time.Second
+	// pause after a failed read
+	streamRetryWait = time.Second
+)
+
+// streamOrders sends the orders of the order stream to the subscribers until
+// ctx is cancelled. With an instanceId, reading starts after the offset
+// stored for the instance, so orders submitted while the instance was down
+// are sent after a restart. The offset is stored after the orders are
+// queued, hence orders are sent at least once and executors may receive an
+// order twice after a restart. Without instanceId or stored offset, reading
+// starts at the end of the stream, earlier orders are available to
+// subscribers as replay
+func (s *Server) streamOrders(ctx context.Context, instanceId string) error {
+	var lastId string
+	var err error
+	if instanceId != "" {
+		lastId, err = s.RedisClient.OrderStreamOffset(instanceId)
+		if err != nil {
+			return err
+		}
+	}
+	if lastId == "" {
+		lastId, err = s.RedisClient.OrderStreamTail()
+		if err != nil {
+			return err
+		}
+	}
+	// orders up to the offset were sent before, or are older than this
+	// instance, and are replayed to subscribers
+	s.mu.Lock()
+	s.streamPos = lastId
+	s.mu.Unlock()
+	if instanceId == "" {
+		slog.Info("reading order stream after entry " + lastId + ", no instance id to store the offset")
+	} else {
+		slog.Info("reading order stream as " + instanceId + " after entry " + lastId)
+	}
+	var stored time.Time
+	for ctx.Err() == nil {
+		entries, err := s.RedisClient.ReadOrderStream(ctx, lastId, streamReadCount, streamBlock)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			slog.Error("reading order stream: " + err.Error())
+			select {
+			case <-ctx.Done():
+			case <-time.After(streamRetryWait):
+			}
+			continue
+		}
+		now := time.Now()
+		for _, e := range entries {
+			s.handleOrder(e, now.Unix())
+		}
+		if len(entries) > 0 {
+			lastId = entries[len(entries)-1].Id
+		} else if now.Sub(stored) < utils.ORDER_STREAM_OFFSET_REFRESH {
+			continue
+		}
+		if instanceId == "" {
+			continue
+		}
+		// idle instances refresh the offset before it expires
+		err = s.RedisClient.SetOrderStreamOffset(instanceId, lastId)
+		if err != nil {
+			slog.Error("storing order stream offset: " + err.Error())
+			continue
+		}
+		stored = now
+	}
+	return nil
+}
+
+// handleOrder sends the order or status change to the subscribers of its
+// topic. Orders are not sent if their deadline passed
+func (s *Server) handleOrder(e utils.OrderStreamEntry, now int64) {
+	if e.Status == nil && e.Order.Deadline != 0 && int64(e.Order.Deadline) < now {
+		slog.Info("order " + e.Order.OrderId + " expired, not sent")
+		return
+	}
+	jsonData, err := json.Marshal(entryResponse(e))
+	if err != nil {
+		slog.Error("forming order update")
+		return
+	}
+	// update subscribers
+	start := time.Now()
+	n := s.broadcast(e.Topic, jsonData, e.Id)
+	if e.Status != nil {
+		slog.Info("Sent status " + e.Status.Status + " of order " + e.Status.OrderId + " to " + strconv.Itoa(n) + " subscribers")
+	} else {
+		slog.Info("Sent order " + e.Order.OrderId + " to " + strconv.Itoa(n) + " subscribers")
+	}
+	metrics.ObserveSince(metrics.BroadcastLatency, start)
+}
+
+// entryResponse returns the update message of a new order or the status
+// message of a status change
+func entryResponse(e utils.OrderStreamEntry) ServerResponse {
+	if e.Status != nil {
+		return ServerResponse{Type: "status", Topic: e.Topic, Data: e.Status}
+	}
+	return ServerResponse{Type: "update", Topic: e.Topic, Data: e.Order}
+}
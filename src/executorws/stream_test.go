@@ -0,0 +1,125 @@
+package executorws
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/D8-X/d8x-broker-server/src/utils"
+)
+
+// startReplica runs the stream reader of a new server with one client
+// subscribed to the topic. The reader stops when the returned func is called
+func startReplica(t *testing.T, redis *utils.RueidisClient, instanceId, topic string) (*Client, func()) {
+	s := NewServer()
+	s.RedisClient = redis
+	c, _ := newClient(instanceId, newTestConn(t), ClientOptions{SendBuffer: 8})
+	s.AddClient(c)
+	s.subscriptions[topic] = Clients{c.Id: c}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.streamOrders(ctx, instanceId)
+	}()
+	// wait until the reader found its start position
+	position := func() string {
+		// streamPos is written with mu held for reading
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.streamPos
+	}
+	for start := time.Now(); position() == ""; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("replica %s did not start", instanceId)
+		}
+	}
+	return c, func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// nextOrder returns the id of the next order queued for the client
+func nextOrder(t *testing.T, c *Client) string {
+	select {
+	case msg := <-c.send:
+		var r struct {
+			Data utils.WSOrderResp `json:"data"`
+		}
+		json.Unmarshal(msg, &r)
+		return r.Data.OrderId
+	case <-time.After(5 * time.Second):
+		t.Fatalf("client %s: no order received", c.Id)
+		return ""
+	}
+}
+
+func TestOrderStreamReplicas(t *testing.T) {
+	redis, _ := newTestRedis(t)
+	topic := "100001:42161"
+	deadline := uint32(time.Now().Add(time.Hour).Unix())
+	// replicas without offset start at the end of the stream
+	redis.AddOrderToStream(topic, utils.WSOrderResp{OrderId: "0", Deadline: deadline}, 0)
+
+	// every replica sends every order, expired orders are skipped
+	a, stopA := startReplica(t, redis, "ws-a", topic)
+	b, stopB := startReplica(t, redis, "ws-b", topic)
+	defer stopB()
+	redis.AddOrderToStream(topic, utils.WSOrderResp{OrderId: "expired", Deadline: 1000}, 0)
+	redis.AddOrderToStream(topic, utils.WSOrderResp{OrderId: "1", Deadline: deadline}, 0)
+	if id := nextOrder(t, a); id != "1" {
+		t.Errorf("replica a sent %s", id)
+	}
+	if id := nextOrder(t, b); id != "1" {
+		t.Errorf("replica b sent %s", id)
+	}
+	stopA()
+
+	// orders submitted while a replica is down are sent after the restart
+	redis.AddOrderToStream(topic, utils.WSOrderResp{OrderId: "2", Deadline: deadline}, 0)
+	if id := nextOrder(t, b); id != "2" {
+		t.Errorf("replica b sent %s", id)
+	}
+	a, stopA = startReplica(t, redis, "ws-a", topic)
+	defer stopA()
+	if id := nextOrder(t, a); id != "2" {
+		t.Errorf("restarted replica a sent %s, expected order 2 only", id)
+	}
+
+	// without instance id, no offset is stored
+	c, stopC := startReplica(t, redis, "", topic)
+	defer stopC()
+	redis.AddOrderToStream(topic, utils.WSOrderResp{OrderId: "3", Deadline: deadline}, 0)
+	if id := nextOrder(t, c); id != "3" {
+		t.Errorf("replica without instance id sent %s", id)
+	}
+	if offset, err := redis.OrderStreamOffset(""); err != nil || offset != "" {
+		t.Errorf("offset stored without instance id: %s, %v", offset, err)
+	}
+}
+
+func TestStatusEvents(t *testing.T) {
+	redis, _ := newTestRedis(t)
+	topic := "100001:42161"
+	deadline := uint32(time.Now().Add(time.Hour).Unix())
+	c, stop := startReplica(t, redis, "ws", topic)
+	defer stop()
+	redis.AddOrderToStream(topic, utils.WSOrderResp{OrderId: "1", Deadline: deadline}, 0)
+	redis.AddStatusToStream(utils.OrderStatus{OrderId: "1", Status: "cancelled", Topic: topic}, 0)
+	if id := nextOrder(t, c); id != "1" {
+		t.Fatalf("expected order 1, got %s", id)
+	}
+	var r ServerResponse
+	select {
+	case msg := <-c.send:
+		json.Unmarshal(msg, &r)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no status received")
+	}
+	if st, _ := r.Data.(map[string]any); r.Type != "status" || st["orderId"] != "1" || st["status"] != "cancelled" {
+		t.Errorf("unexpected status event %+v", r)
+	}
+}
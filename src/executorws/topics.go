@@ -0,0 +1,73 @@
+package executorws
+
+import (
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Subscription topics are <selector>:<chainId>. The selector is a perpetual
+// id, TOPIC_ALL_PERPETUALS for all perpetuals of the chain, or
+// TOPIC_POOL_PREFIX followed by a pool id for the perpetuals of a pool.
+// Order updates are sent with the topic perpetualId:chainId
+const (
+	TOPIC_ALL_PERPETUALS = "*"
+	TOPIC_POOL_PREFIX    = "pool-"
+	// perpetual ids are poolId * PERPETUALS_PER_POOL + index
+	PERPETUALS_PER_POOL = 100000
+)
+
+// ids without leading zeros, so that topics match the order topics
+var topicRegex = regexp.MustCompile(`^(\*|pool-[1-9][0-9]*|[1-9][0-9]*):([1-9][0-9]*)$`)
+
+// parseTopic validates the subscription topic and returns its chain id
+func parseTopic(topic string) (int64, bool) {
+	if !topicRegex.MatchString(topic) {
+		return 0, false
+	}
+	selector, chainIdStr, _ := strings.Cut(topic, ":")
+	if poolId, isPool := strings.CutPrefix(selector, TOPIC_POOL_PREFIX); isPool {
+		id, err := strconv.ParseInt(poolId, 10, 64)
+		if err != nil || id < 1 {
+			return 0, false
+		}
+	} else if selector != TOPIC_ALL_PERPETUALS {
+		id, err := strconv.ParseInt(selector, 10, 64)
+		if err != nil || id < PERPETUALS_PER_POOL {
+			return 0, false
+		}
+	}
+	// supported chainId?
+	chainId, err := strconv.ParseInt(chainIdStr, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	for _, el := range getConfig() {
+		if el.ChainId == chainId {
+			return chainId, true
+		}
+	}
+	return 0, false
+}
+
+// matchingTopics returns the subscription topics that receive orders of the
+// order topic perpetualId:chainId
+func matchingTopics(orderTopic string) []string {
+	perpId, chainId, found := strings.Cut(orderTopic, ":")
+	if !found {
+		return []string{orderTopic}
+	}
+	topics := []string{orderTopic, TOPIC_ALL_PERPETUALS + ":" + chainId}
+	if id, err := strconv.ParseInt(perpId, 10, 64); err == nil {
+		poolId := strconv.FormatInt(id/PERPETUALS_PER_POOL, 10)
+		topics = append(topics, TOPIC_POOL_PREFIX+poolId+":"+chainId)
+	}
+	return topics
+}
+
+// topicMatches reports whether the subscription topic receives orders of
+// the order topic
+func topicMatches(topic, orderTopic string) bool {
+	return slices.Contains(matchingTopics(orderTopic), topic)
+}
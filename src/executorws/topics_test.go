@@ -0,0 +1,127 @@
+package executorws
+
+import (
+	"encoding/json"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/D8-X/d8x-broker-server/src/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestTopicMatching(t *testing.T) {
+	UpdateConfig(map[int64]utils.ChainConfig{42161: {ChainId: 42161}})
+	for topic, valid := range map[string]bool{
+		"100001:42161":  true,
+		"*:42161":       true,
+		"pool-2:42161":  true,
+		"100001:1101":   false,
+		"1001:42161":    false,
+		"pool-0:42161":  false,
+		"pool-:42161":   false,
+		"*1:42161":      false,
+		"*":             false,
+		"100001:":       false,
+		"0100001:42161": false,
+		"100001:042161": false,
+		"pool-02:42161": false,
+	} {
+		if _, ok := parseTopic(topic); ok != valid {
+			t.Errorf("topic %s: valid %v, expected %v", topic, ok, valid)
+		}
+	}
+	for _, tc := range []struct {
+		topic, orderTopic string
+		match             bool
+	}{
+		{"100001:42161", "100001:42161", true},
+		{"100001:42161", "100002:42161", false},
+		{"*:42161", "200003:42161", true},
+		{"*:42161", "200003:1101", false},
+		{"pool-2:42161", "200003:42161", true},
+		{"pool-2:42161", "100003:42161", false},
+		{"pool-2:42161", "200003:1101", false},
+	} {
+		if m := topicMatches(tc.topic, tc.orderTopic); m != tc.match {
+			t.Errorf("%s matches %s: %v, expected %v", tc.topic, tc.orderTopic, m, tc.match)
+		}
+	}
+}
+
+func TestMultiTopicSubscriptions(t *testing.T) {
+	srv, redis := newTestWs(t)
+	key, _ := crypto.GenerateKey()
+	redis.SeedExecutors(42161, []common.Address{crypto.PubkeyToAddress(key.PublicKey)})
+	conn := dialWs(t, srv)
+	if err := authenticate(conn, key); err != nil {
+		t.Fatal(err)
+	}
+	list := func() []string {
+		conn.WriteJSON(ClientMessage{Type: "list"})
+		r, err := readUntil(conn, "list")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var topics []string
+		for _, topic := range r.Data.([]any) {
+			topics = append(topics, topic.(string))
+		}
+		return topics
+	}
+	if topics := list(); len(topics) != 0 {
+		t.Fatalf("expected no subscriptions, got %v", topics)
+	}
+
+	conn.WriteJSON(ClientMessage{Type: "subscribe", Topics: []string{"*:42161", "100001:42161", "pool-1:42161", "pool-1:1101"}})
+	for k := 0; k < 4; k++ {
+		r := readResponse(t, conn)
+		if (r.Topic == "pool-1:1101") == (r.Data == "ack") {
+			t.Errorf("unexpected response %+v", r)
+		}
+	}
+	if topics := list(); !slices.Equal(topics, []string{"*:42161", "100001:42161", "pool-1:42161"}) {
+		t.Fatalf("unexpected subscriptions %v", topics)
+	}
+
+	// the client receives each order once
+	for orderTopic, expected := range map[string]int{"100001:42161": 1, "200001:42161": 1, "100001:1101": 0} {
+		msg, _ := json.Marshal(ServerResponse{Type: "update", Topic: orderTopic})
+		if n := server.Broadcast(orderTopic, msg); n != expected {
+			t.Errorf("%s sent to %d clients, expected %d", orderTopic, n, expected)
+		}
+		if expected == 0 {
+			continue
+		}
+		if r := readResponse(t, conn); r.Type != "update" || r.Topic != orderTopic {
+			t.Errorf("expected update of %s, got %+v", orderTopic, r)
+		}
+	}
+
+	conn.WriteJSON(ClientMessage{Type: "unsubscribe", Topics: []string{"*:42161", "pool-1:42161"}})
+	if topics := list(); !slices.Equal(topics, []string{"100001:42161"}) {
+		t.Fatalf("unexpected subscriptions after unsubscribe %v", topics)
+	}
+
+	// the maximal number of topics fits a message, more are rejected
+	var topics []string
+	for k := 0; k <= MAX_TOPICS_PER_REQUEST; k++ {
+		topics = append(topics, "pool-"+strconv.Itoa(1000000000+k)+":42161")
+	}
+	conn.WriteJSON(ClientMessage{Type: "subscribe", Topics: topics})
+	r, err := readUntil(conn, "subscribe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := json.Marshal(r.Data); !strings.Contains(string(data), "at most") {
+		t.Errorf("too many topics accepted: %+v", r)
+	}
+	conn.WriteJSON(ClientMessage{Type: "subscribe", Topics: topics[1:]})
+	for k := 0; k < MAX_TOPICS_PER_REQUEST; k++ {
+		if r, err := readUntil(conn, "subscribe"); err != nil || r.Data != "ack" {
+			t.Fatalf("subscription %d failed: %+v, %v", k, r, err)
+		}
+	}
+}
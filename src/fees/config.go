@@ -0,0 +1,185 @@
+package fees
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"slices"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Provider names used in the fee config
+const (
+	PROVIDER_VIP3      = "vip3"
+	PROVIDER_ALLOWLIST = "allowlist"
+	PROVIDER_VOLUME    = "volume"
+	PROVIDER_HOLDINGS  = "holdings"
+)
+
+var providerOrder = []string{PROVIDER_VIP3, PROVIDER_ALLOWLIST, PROVIDER_VOLUME, PROVIDER_HOLDINGS}
+
+// ChainFeeConfig is the fee config of a chain in the fee config file.
+// ChainId 0 is the default for chains that are not listed
+type ChainFeeConfig struct {
+	ChainId int64 `json:"chainId"`
+	// base fee of the chain, defaults to the default chain's or BROKER_FEE_TBPS
+	BaseFeeTbps *uint16 `json:"baseFeeTbps"`
+	// base fee per perpetual id, defaults to BaseFeeTbps
+	PerpetualFeeTbps map[int64]uint16 `json:"perpetualFeeTbps"`
+	// min (default), first-match or stacked
+	Policy string `json:"policy"`
+	// providers in order of evaluation, defaults to all configured providers
+	Providers []string `json:"providers"`
+	// discount in percent per VIP3 level (index 0 is level 1)
+	Vip3      []float64        `json:"vip3"`
+	Allowlist []AllowlistEntry `json:"allowlist"`
+	Volume    []VolumeTier     `json:"volume"`
+	Holdings  []HoldingRule    `json:"holdings"`
+}
+
+type AllowlistEntry struct {
+	Addr common.Address `json:"addr"`
+	Perc float64        `json:"discountPerc"`
+	// optional tier name, defaults to "allowlist"
+	Tier string `json:"tier"`
+}
+
+// VolumeTier grants the discount to traders with at least MinVolume
+// trailing notional volume
+type VolumeTier struct {
+	MinVolume float64 `json:"minVolume"`
+	Perc      float64 `json:"discountPerc"`
+}
+
+// HoldingRule grants the discount to holders of at least MinBalance of the
+// ERC-20 token or ERC-721 collection (raw units)
+type HoldingRule struct {
+	Token      common.Address `json:"token"`
+	MinBalance string         `json:"minBalance"`
+	Perc       float64        `json:"discountPerc"`
+}
+
+// Deps are the data sources of the providers
+type Deps struct {
+	Vip3     Vip3Source
+	Volume   VolumeSource
+	Balances BalanceSource
+}
+
+// LoadConfig reads the fee config file, a list of ChainFeeConfig
+func LoadConfig(path string) (map[int64]ChainFeeConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.New("reading fee config: " + err.Error())
+	}
+	var list []ChainFeeConfig
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, errors.New("decoding fee config: " + err.Error())
+	}
+	conf := make(map[int64]ChainFeeConfig)
+	for _, c := range list {
+		if _, exists := conf[c.ChainId]; exists {
+			return nil, fmt.Errorf("fee config for chain %d defined twice", c.ChainId)
+		}
+		conf[c.ChainId] = c
+	}
+	return conf, nil
+}
+
+func (c *ChainFeeConfig) policy() string {
+	if c.Policy == "" {
+		return POLICY_MIN
+	}
+	return c.Policy
+}
+
+func (c *ChainFeeConfig) configured(name string) bool {
+	switch name {
+	case PROVIDER_VIP3:
+		return len(c.Vip3) > 0
+	case PROVIDER_ALLOWLIST:
+		return len(c.Allowlist) > 0
+	case PROVIDER_VOLUME:
+		return len(c.Volume) > 0
+	case PROVIDER_HOLDINGS:
+		return len(c.Holdings) > 0
+	}
+	return false
+}
+
+// providers validates the config and creates the providers
+func (c *ChainFeeConfig) providers(deps Deps) ([]FeeProvider, error) {
+	if !slices.Contains([]string{POLICY_MIN, POLICY_FIRST_MATCH, POLICY_STACKED}, c.policy()) {
+		return nil, errors.New("unknown policy " + c.Policy)
+	}
+	for perpId := range c.PerpetualFeeTbps {
+		if perpId <= 0 {
+			return nil, fmt.Errorf("invalid perpetual id %d", perpId)
+		}
+	}
+	names := c.Providers
+	if len(names) == 0 {
+		for _, name := range providerOrder {
+			if c.configured(name) {
+				names = append(names, name)
+			}
+		}
+	}
+	var percs []float64
+	percs = append(percs, c.Vip3...)
+	for _, e := range c.Allowlist {
+		percs = append(percs, e.Perc)
+	}
+	for _, t := range c.Volume {
+		percs = append(percs, t.Perc)
+	}
+	for _, h := range c.Holdings {
+		percs = append(percs, h.Perc)
+	}
+	for _, p := range percs {
+		if p < 0 || p > 100 {
+			return nil, fmt.Errorf("discount %v not in [0, 100]", p)
+		}
+	}
+
+	providers := make([]FeeProvider, 0, len(names))
+	for _, name := range names {
+		if !c.configured(name) {
+			return nil, errors.New("provider " + name + " listed but not configured")
+		}
+		var p FeeProvider
+		var err error
+		switch name {
+		case PROVIDER_VIP3:
+			p, err = NewVip3Provider(deps.Vip3, c.Vip3)
+		case PROVIDER_ALLOWLIST:
+			p = NewAllowlistProvider(c.Allowlist)
+		case PROVIDER_VOLUME:
+			p, err = NewVolumeProvider(deps.Volume, c.Volume)
+		case PROVIDER_HOLDINGS:
+			p, err = NewHoldingsProvider(deps.Balances, c.Holdings)
+		default:
+			err = errors.New("unknown provider " + name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, p)
+	}
+	return providers, nil
+}
+
+func parseBalance(s string) (*big.Int, error) {
+	if s == "" {
+		return big.NewInt(1), nil
+	}
+	b, ok := new(big.Int).SetString(s, 10)
+	if !ok || b.Sign() < 0 {
+		return nil, errors.New("invalid minBalance " + s)
+	}
+	return b, nil
+}
@@ -0,0 +1,261 @@
+package fees
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Policies combining the discounts of several providers
+const (
+	// the largest discount applies
+	POLICY_MIN = "min"
+	// the discount of the first matching provider (in configured order) applies
+	POLICY_FIRST_MATCH = "first-match"
+	// all discounts apply one after the other
+	POLICY_STACKED = "stacked"
+)
+
+const TIER_BASE = "base"
+
+// Discount is the fee reduction a provider grants a trader
+type Discount struct {
+	Provider string  `json:"provider"`
+	Tier     string  `json:"tier"`
+	Perc     float64 `json:"discountPerc"`
+	// provider specific level, e.g. the VIP3 level
+	Level int `json:"level,omitempty"`
+}
+
+// FeeProvider grants discounts on the broker fee
+type FeeProvider interface {
+	Name() string
+	// Discount returns the discount of the trader, false if the provider
+	// does not apply
+	Discount(ctx context.Context, trader common.Address, chainId int64) (Discount, bool, error)
+}
+
+// Quote is the broker fee for a trader and the discounts that were applied
+type Quote struct {
+	BaseFeeTbps uint16     `json:"baseFeeTbps"`
+	FeeTbps     uint16     `json:"brokerFeeTbps"`
+	Discounts   []Discount `json:"discounts,omitempty"`
+}
+
+// Tier describes the applied discounts, "base" if none
+func (q Quote) Tier() string {
+	if len(q.Discounts) == 0 {
+		return TIER_BASE
+	}
+	tiers := make([]string, len(q.Discounts))
+	for k, d := range q.Discounts {
+		tiers[k] = d.Tier
+	}
+	return strings.Join(tiers, "+")
+}
+
+// Level returns the level of the given provider's discount, 0 if not applied
+func (q Quote) Level(provider string) int {
+	for _, d := range q.Discounts {
+		if d.Provider == provider {
+			return d.Level
+		}
+	}
+	return 0
+}
+
+type chainFees struct {
+	baseFee   *uint16
+	perpFees  map[int64]uint16
+	policy    string
+	providers []FeeProvider
+}
+
+// Engine computes broker fees with the providers and policy configured
+// per chain. The config can be swapped at runtime
+type Engine struct {
+	mu     sync.RWMutex
+	deps   Deps
+	chains map[int64]chainFees
+}
+
+// NewEngine creates the fee engine from the per-chain config
+func NewEngine(conf map[int64]ChainFeeConfig, deps Deps) (*Engine, error) {
+	e := &Engine{deps: deps}
+	err := e.Update(conf)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Update validates the config and swaps it. The current config is kept on
+// error
+func (e *Engine) Update(conf map[int64]ChainFeeConfig) error {
+	chains := make(map[int64]chainFees)
+	for chainId, c := range conf {
+		providers, err := c.providers(e.deps)
+		if err != nil {
+			return fmt.Errorf("fee config chain %d: %s", chainId, err.Error())
+		}
+		chains[chainId] = chainFees{
+			baseFee:   c.BaseFeeTbps,
+			perpFees:  c.PerpetualFeeTbps,
+			policy:    c.policy(),
+			providers: providers,
+		}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.chains = chains
+	return nil
+}
+
+// resolve returns the id of the config that applies to the chain: the
+// chain's, else the default config (chainId 0). For chainId -1 the default
+// or else the lowest configured chain is used. Requires e.mu
+func (e *Engine) resolve(chainId int64) (int64, bool) {
+	if _, exists := e.chains[chainId]; exists && chainId > 0 {
+		return chainId, true
+	}
+	if _, exists := e.chains[0]; exists {
+		return 0, true
+	}
+	if chainId != -1 || len(e.chains) == 0 {
+		return 0, false
+	}
+	ids := make([]int64, 0, len(e.chains))
+	for id := range e.chains {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids[0], true
+}
+
+// chain returns the fee config that applies to the chain and the chain id
+// providers are queried with, see resolve
+func (e *Engine) chain(chainId int64) (chainFees, int64, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	id, exists := e.resolve(chainId)
+	if !exists {
+		return chainFees{}, chainId, false
+	}
+	if id > 0 {
+		chainId = id
+	}
+	return e.chains[id], chainId, true
+}
+
+// VolumeStatus returns the trailing volume of the trader and the next volume
+// tier. False if no volume tiers are configured for the chain
+func (e *Engine) VolumeStatus(ctx context.Context, trader string, chainId int64) (VolumeStatus, bool, error) {
+	if e == nil || !common.IsHexAddress(trader) {
+		return VolumeStatus{}, false, nil
+	}
+	c, chainId, exists := e.chain(chainId)
+	if !exists {
+		return VolumeStatus{}, false, nil
+	}
+	for _, p := range c.providers {
+		if vp, ok := p.(*VolumeProvider); ok {
+			status, err := vp.Status(ctx, common.HexToAddress(trader), chainId)
+			return status, err == nil, err
+		}
+	}
+	return VolumeStatus{}, false, nil
+}
+
+// BaseFee returns the scheduled fee of the perpetual before discounts. The
+// most specific entry applies: perpetual of the chain, chain, perpetual of the
+// default chain, default chain, defaultFeeTbps. chainId and perpetualId can
+// be -1, the chain is resolved as for the providers
+func (e *Engine) BaseFee(chainId, perpetualId int64, defaultFeeTbps uint16) uint16 {
+	if e == nil {
+		return defaultFeeTbps
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	id, _ := e.resolve(chainId)
+	return e.baseFee(id, perpetualId, defaultFeeTbps)
+}
+
+// baseFee is BaseFee for the resolved chain id. Requires e.mu
+func (e *Engine) baseFee(id, perpetualId int64, defaultFeeTbps uint16) uint16 {
+	for _, cid := range []int64{id, 0} {
+		c, exists := e.chains[cid]
+		if !exists {
+			continue
+		}
+		if fee, exists := c.perpFees[perpetualId]; exists {
+			return fee
+		}
+		if c.baseFee != nil {
+			return *c.baseFee
+		}
+	}
+	return defaultFeeTbps
+}
+
+// Fee returns the fee of the trader for the perpetual, starting from the
+// scheduled base fee. Providers that fail are skipped. trader can be empty,
+// chainId and perpetualId -1
+func (e *Engine) Fee(ctx context.Context, trader string, chainId, perpetualId int64, defaultFeeTbps uint16) Quote {
+	if e == nil {
+		return Quote{BaseFeeTbps: defaultFeeTbps, FeeTbps: defaultFeeTbps}
+	}
+	// base fee and providers of the same resolved chain
+	e.mu.RLock()
+	id, exists := e.resolve(chainId)
+	baseFeeTbps := e.baseFee(id, perpetualId, defaultFeeTbps)
+	c := e.chains[id]
+	e.mu.RUnlock()
+	if id > 0 {
+		chainId = id
+	}
+	q := Quote{BaseFeeTbps: baseFeeTbps, FeeTbps: baseFeeTbps}
+	if !exists || !common.IsHexAddress(trader) {
+		return q
+	}
+	traderAddr := common.HexToAddress(trader)
+	var discounts []Discount
+	for _, p := range c.providers {
+		d, ok, err := p.Discount(ctx, traderAddr, chainId)
+		if err != nil {
+			slog.Error("fee provider "+p.Name()+": "+err.Error(), "trader", trader, "chainId", chainId)
+			continue
+		}
+		if !ok || d.Perc <= 0 {
+			continue
+		}
+		discounts = append(discounts, d)
+		if c.policy == POLICY_FIRST_MATCH {
+			break
+		}
+	}
+	if len(discounts) == 0 {
+		return q
+	}
+	if c.policy == POLICY_MIN {
+		best := discounts[0]
+		for _, d := range discounts[1:] {
+			if d.Perc > best.Perc {
+				best = d
+			}
+		}
+		discounts = []Discount{best}
+	}
+	fee := float64(baseFeeTbps)
+	for _, d := range discounts {
+		fee = fee * (100 - math.Min(d.Perc, 100)) / 100
+	}
+	q.FeeTbps = uint16(math.Floor(fee + 1e-9))
+	q.Discounts = discounts
+	return q
+}
@@ -0,0 +1,209 @@
+package fees
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type testSources struct {
+	vip3     map[common.Address]int
+	volume   map[common.Address]float64
+	balances map[common.Address]int64
+	calls    int
+}
+
+func (s *testSources) Vip3Level(ctx context.Context, trader common.Address) (int, error) {
+	return s.vip3[trader], nil
+}
+
+func (s *testSources) TraderVolume(ctx context.Context, trader common.Address, chainId int64) (float64, error) {
+	return s.volume[trader], nil
+}
+
+func (s *testSources) BalanceOf(ctx context.Context, chainId int64, token, owner common.Address) (*big.Int, error) {
+	s.calls++
+	if chainId == 666 {
+		return nil, errors.New("rpc down")
+	}
+	return big.NewInt(s.balances[owner]), nil
+}
+
+var (
+	alice = common.HexToAddress("0x9d5aaB428e98678d0E645ea4AeBd25f744341a05")
+	bob   = common.HexToAddress("0x0aB6527027EcFF1144dEc3d78154fce309ac838c")
+	carol = common.HexToAddress("0xabe292b291A18699b09608de86888D77aD6BAf23")
+	token = common.HexToAddress("0x912CE59144191C1204E64559FE8253a0e49E6548")
+)
+
+func newTestEngine(t *testing.T, policy string) (*Engine, *testSources) {
+	src := &testSources{
+		vip3:     map[common.Address]int{alice: 2, bob: 9},
+		volume:   map[common.Address]float64{alice: 2_000_000, carol: 500},
+		balances: map[common.Address]int64{alice: 10, carol: 5},
+	}
+	conf := ChainFeeConfig{
+		Policy:    policy,
+		Providers: []string{PROVIDER_ALLOWLIST, PROVIDER_VIP3, PROVIDER_VOLUME, PROVIDER_HOLDINGS},
+		Vip3:      []float64{10, 50},
+		Allowlist: []AllowlistEntry{{Addr: carol, Perc: 25, Tier: "partner"}},
+		Volume:    []VolumeTier{{MinVolume: 1_000_000, Perc: 20}, {MinVolume: 100, Perc: 5}},
+		Holdings:  []HoldingRule{{Token: token, MinBalance: "10", Perc: 30}},
+	}
+	e, err := NewEngine(map[int64]ChainFeeConfig{42161: conf}, Deps{Vip3: src, Volume: src, Balances: src})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e, src
+}
+
+func TestEnginePolicies(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		policy string
+		trader common.Address
+		fee    uint16
+		tier   string
+	}{
+		// alice: vip3 level 2 (50%), volume tier 1 (20%), holder (30%)
+		{POLICY_MIN, alice, 50, "vip3-2"},
+		{POLICY_FIRST_MATCH, alice, 50, "vip3-2"},
+		{POLICY_STACKED, alice, 28, "vip3-2+volume-1+holder-" + token.Hex()},
+		// bob: vip3 level above configured levels
+		{POLICY_MIN, bob, 50, "vip3-2"},
+		// carol: allowlisted (25%), below volume tier 1 (5%), too few tokens
+		{POLICY_MIN, carol, 75, "partner"},
+		{POLICY_STACKED, carol, 71, "partner+volume-2"},
+	} {
+		e, _ := newTestEngine(t, tc.policy)
+		q := e.Fee(ctx, tc.trader.Hex(), 42161, -1, 100)
+		if q.FeeTbps != tc.fee || q.Tier() != tc.tier {
+			t.Errorf("%s %s: got fee %d tier %s, expected %d %s", tc.policy, tc.trader.Hex(), q.FeeTbps, q.Tier(), tc.fee, tc.tier)
+		}
+	}
+	e, _ := newTestEngine(t, POLICY_MIN)
+	if q := e.Fee(ctx, alice.Hex(), 42161, -1, 100); q.Level(PROVIDER_VIP3) != 2 {
+		t.Errorf("unexpected vip3 level %d", q.Level(PROVIDER_VIP3))
+	}
+}
+
+func TestEngineChains(t *testing.T) {
+	ctx := context.Background()
+	e, src := newTestEngine(t, POLICY_MIN)
+	// unknown chain without default config
+	if q := e.Fee(ctx, alice.Hex(), 1101, -1, 100); q.FeeTbps != 100 || q.Tier() != TIER_BASE {
+		t.Errorf("unexpected fee on unknown chain %v", q)
+	}
+	// unspecified chain uses the lowest configured chain
+	if q := e.Fee(ctx, alice.Hex(), -1, -1, 100); q.FeeTbps != 50 {
+		t.Errorf("unexpected fee without chain %v", q)
+	}
+	if q := e.Fee(ctx, "", 42161, -1, 100); q.FeeTbps != 100 {
+		t.Errorf("unexpected fee without trader %v", q)
+	}
+	// balances are cached
+	calls := src.calls
+	e.Fee(ctx, carol.Hex(), 42161, -1, 100)
+	e.Fee(ctx, carol.Hex(), 42161, -1, 100)
+	if src.calls != calls+1 {
+		t.Errorf("expected cached balance, got %d calls", src.calls-calls)
+	}
+
+	err := e.Update(map[int64]ChainFeeConfig{
+		0:   {Vip3: []float64{10}},
+		666: {Holdings: []HoldingRule{{Token: token, Perc: 90}}, Vip3: []float64{10}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := e.Fee(ctx, alice.Hex(), 1101, -1, 100); q.FeeTbps != 90 {
+		t.Errorf("default config not applied %v", q)
+	}
+	// failing providers are skipped
+	if q := e.Fee(ctx, alice.Hex(), 666, -1, 100); q.FeeTbps != 90 || q.Tier() != "vip3-1" {
+		t.Errorf("unexpected fee with failing provider %v", q)
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	src := &testSources{}
+	deps := Deps{Vip3: src, Balances: src}
+	for name, conf := range map[string]ChainFeeConfig{
+		"unknown policy":        {Policy: "max", Vip3: []float64{10}},
+		"unknown provider":      {Providers: []string{"nft"}},
+		"provider without conf": {Providers: []string{PROVIDER_ALLOWLIST}, Vip3: []float64{10}},
+		"discount above 100":    {Vip3: []float64{120}},
+		"invalid balance":       {Holdings: []HoldingRule{{Token: token, MinBalance: "1e18", Perc: 10}}},
+		"no volume source":      {Volume: []VolumeTier{{MinVolume: 1, Perc: 10}}},
+	} {
+		e, _ := NewEngine(nil, deps)
+		if err := e.Update(map[int64]ChainFeeConfig{1: conf}); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	conf, err := LoadConfig("../../config/feeConfig.example.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewEngine(conf, Deps{Vip3: src, Volume: src, Balances: src}); err != nil {
+		t.Errorf("example config: %v", err)
+	}
+}
+
+func TestBaseFeeSchedule(t *testing.T) {
+	fee := func(v uint16) *uint16 { return &v }
+	e, err := NewEngine(map[int64]ChainFeeConfig{
+		0:     {BaseFeeTbps: fee(50), PerpetualFeeTbps: map[int64]uint16{300001: 10}},
+		42161: {BaseFeeTbps: fee(40), PerpetualFeeTbps: map[int64]uint16{100001: 20}, Vip3: []float64{50}},
+		1101:  {PerpetualFeeTbps: map[int64]uint16{100001: 30}},
+	}, Deps{Vip3: &testSources{vip3: map[common.Address]int{alice: 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		chainId, perpetualId int64
+		fee                  uint16
+	}{
+		{42161, 100001, 20},
+		{42161, 100002, 40},
+		{42161, -1, 40},
+		{42161, 300001, 40},
+		{1101, 100001, 30},
+		{1101, 100002, 50},
+		{1101, 300001, 10},
+		{196, 100001, 50},
+		{-1, -1, 50},
+	} {
+		if fee := e.BaseFee(tc.chainId, tc.perpetualId, 60); fee != tc.fee {
+			t.Errorf("chain %d perpetual %d: got %d, expected %d", tc.chainId, tc.perpetualId, fee, tc.fee)
+		}
+	}
+	var none *Engine
+	if fee := none.BaseFee(42161, 100001, 60); fee != 60 {
+		t.Errorf("unexpected fee without engine %d", fee)
+	}
+	// discounts apply to the scheduled fee
+	q := e.Fee(context.Background(), alice.Hex(), 42161, 100001, 60)
+	if q.BaseFeeTbps != 20 || q.FeeTbps != 10 {
+		t.Errorf("unexpected quote %v", q)
+	}
+	// without default config, base fee and discounts of an unspecified
+	// chain are those of the lowest configured chain
+	err = e.Update(map[int64]ChainFeeConfig{
+		42161: {BaseFeeTbps: fee(40), Vip3: []float64{50}},
+		1101:  {BaseFeeTbps: fee(30), Vip3: []float64{10}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q = e.Fee(context.Background(), alice.Hex(), -1, -1, 60)
+	if q.BaseFeeTbps != 30 || q.FeeTbps != 27 || e.BaseFee(-1, -1, 60) != 30 {
+		t.Errorf("unexpected quote without chain %v", q)
+	}
+	if _, err = NewEngine(map[int64]ChainFeeConfig{1: {PerpetualFeeTbps: map[int64]uint16{-5: 1}}}, Deps{}); err == nil {
+		t.Errorf("expected error for invalid perpetual id")
+	}
+}
@@ -0,0 +1,251 @@
+package fees
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// HOLDINGS_CACHE_TTL is how long token balances are cached
+const HOLDINGS_CACHE_TTL = 10 * time.Minute
+
+// number of cached balances above which expired entries are pruned
+const HOLDINGS_CACHE_SIZE = 10_000
+
+// Vip3Source returns the VIP3 level of a trader, 0 if none
+type Vip3Source interface {
+	Vip3Level(ctx context.Context, trader common.Address) (int, error)
+}
+
+// VolumeSource returns the trailing notional volume of a trader on a chain
+type VolumeSource interface {
+	TraderVolume(ctx context.Context, trader common.Address, chainId int64) (float64, error)
+}
+
+// BalanceSource returns the balance of an ERC-20 token or ERC-721
+// collection on a chain
+type BalanceSource interface {
+	BalanceOf(ctx context.Context, chainId int64, token, owner common.Address) (*big.Int, error)
+}
+
+// Vip3Provider grants a discount per VIP3 level
+type Vip3Provider struct {
+	src   Vip3Source
+	percs []float64
+}
+
+func NewVip3Provider(src Vip3Source, percs []float64) (*Vip3Provider, error) {
+	if src == nil {
+		return nil, errors.New("vip3 provider requires a VIP3 source")
+	}
+	return &Vip3Provider{src: src, percs: percs}, nil
+}
+
+func (p *Vip3Provider) Name() string {
+	return PROVIDER_VIP3
+}
+
+func (p *Vip3Provider) Discount(ctx context.Context, trader common.Address, chainId int64) (Discount, bool, error) {
+	l, err := p.src.Vip3Level(ctx, trader)
+	if err != nil || l <= 0 {
+		return Discount{}, false, err
+	}
+	// levels above the configured ones get the highest configured discount
+	lvl := min(l, len(p.percs))
+	return Discount{
+		Provider: PROVIDER_VIP3,
+		Tier:     "vip3-" + strconv.Itoa(lvl),
+		Perc:     p.percs[lvl-1],
+		Level:    l,
+	}, true, nil
+}
+
+// AllowlistProvider grants fixed discounts to listed addresses
+type AllowlistProvider struct {
+	entries map[common.Address]AllowlistEntry
+}
+
+func NewAllowlistProvider(entries []AllowlistEntry) *AllowlistProvider {
+	p := &AllowlistProvider{entries: make(map[common.Address]AllowlistEntry)}
+	for _, e := range entries {
+		if e.Tier == "" {
+			e.Tier = PROVIDER_ALLOWLIST
+		}
+		p.entries[e.Addr] = e
+	}
+	return p
+}
+
+func (p *AllowlistProvider) Name() string {
+	return PROVIDER_ALLOWLIST
+}
+
+func (p *AllowlistProvider) Discount(ctx context.Context, trader common.Address, chainId int64) (Discount, bool, error) {
+	e, exists := p.entries[trader]
+	if !exists {
+		return Discount{}, false, nil
+	}
+	return Discount{Provider: PROVIDER_ALLOWLIST, Tier: e.Tier, Perc: e.Perc}, true, nil
+}
+
+// VolumeProvider grants the discount of the highest volume tier the trader
+// reached
+type VolumeProvider struct {
+	src   VolumeSource
+	tiers []VolumeTier
+}
+
+func NewVolumeProvider(src VolumeSource, tiers []VolumeTier) (*VolumeProvider, error) {
+	if src == nil {
+		return nil, errors.New("volume provider requires a volume source")
+	}
+	for _, t := range tiers {
+		if t.MinVolume < 0 {
+			return nil, fmt.Errorf("invalid minVolume %v", t.MinVolume)
+		}
+	}
+	return &VolumeProvider{src: src, tiers: tiers}, nil
+}
+
+func (p *VolumeProvider) Name() string {
+	return PROVIDER_VOLUME
+}
+
+func (p *VolumeProvider) Discount(ctx context.Context, trader common.Address, chainId int64) (Discount, bool, error) {
+	vol, err := p.src.TraderVolume(ctx, trader, chainId)
+	if err != nil {
+		return Discount{}, false, err
+	}
+	level := -1
+	for k, t := range p.tiers {
+		if vol >= t.MinVolume && (level == -1 || t.MinVolume > p.tiers[level].MinVolume) {
+			level = k
+		}
+	}
+	if level == -1 {
+		return Discount{}, false, nil
+	}
+	return Discount{
+		Provider: PROVIDER_VOLUME,
+		Tier:     "volume-" + strconv.Itoa(level+1),
+		Perc:     p.tiers[level].Perc,
+		Level:    level + 1,
+	}, true, nil
+}
+
+// VolumeStatus is the trailing volume of a trader and the next volume tier,
+// NextTier is nil if the highest tier is reached
+type VolumeStatus struct {
+	Volume   float64
+	NextTier *VolumeTier
+}
+
+// Status returns the volume of the trader and the next tier to reach
+func (p *VolumeProvider) Status(ctx context.Context, trader common.Address, chainId int64) (VolumeStatus, error) {
+	vol, err := p.src.TraderVolume(ctx, trader, chainId)
+	if err != nil {
+		return VolumeStatus{}, err
+	}
+	status := VolumeStatus{Volume: vol}
+	for k, t := range p.tiers {
+		if t.MinVolume > vol && (status.NextTier == nil || t.MinVolume < status.NextTier.MinVolume) {
+			status.NextTier = &p.tiers[k]
+		}
+	}
+	return status, nil
+}
+
+type holdingRule struct {
+	token      common.Address
+	minBalance *big.Int
+	perc       float64
+}
+
+type cachedBalance struct {
+	balance *big.Int
+	expiry  time.Time
+}
+
+// HoldingsProvider grants the largest discount of the token or NFT holding
+// rules the trader satisfies. Balances are cached for HOLDINGS_CACHE_TTL
+type HoldingsProvider struct {
+	src   BalanceSource
+	rules []holdingRule
+	mu    sync.Mutex
+	cache map[string]cachedBalance
+}
+
+func NewHoldingsProvider(src BalanceSource, rules []HoldingRule) (*HoldingsProvider, error) {
+	if src == nil {
+		return nil, errors.New("holdings provider requires a balance source")
+	}
+	p := &HoldingsProvider{src: src, cache: make(map[string]cachedBalance)}
+	for _, r := range rules {
+		b, err := parseBalance(r.MinBalance)
+		if err != nil {
+			return nil, err
+		}
+		p.rules = append(p.rules, holdingRule{token: r.Token, minBalance: b, perc: r.Perc})
+	}
+	return p, nil
+}
+
+func (p *HoldingsProvider) Name() string {
+	return PROVIDER_HOLDINGS
+}
+
+func (p *HoldingsProvider) balance(ctx context.Context, chainId int64, token, owner common.Address) (*big.Int, error) {
+	key := strconv.FormatInt(chainId, 10) + ":" + token.Hex() + ":" + owner.Hex()
+	now := time.Now()
+	p.mu.Lock()
+	c, exists := p.cache[key]
+	p.mu.Unlock()
+	if exists && now.Before(c.expiry) {
+		return c.balance, nil
+	}
+	b, err := p.src.BalanceOf(ctx, chainId, token, owner)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.cache) >= HOLDINGS_CACHE_SIZE {
+		for k, c := range p.cache {
+			if now.After(c.expiry) {
+				delete(p.cache, k)
+			}
+		}
+	}
+	p.cache[key] = cachedBalance{balance: b, expiry: now.Add(HOLDINGS_CACHE_TTL)}
+	return b, nil
+}
+
+func (p *HoldingsProvider) Discount(ctx context.Context, trader common.Address, chainId int64) (Discount, bool, error) {
+	if chainId <= 0 {
+		// holdings are chain specific
+		return Discount{}, false, nil
+	}
+	var best Discount
+	found := false
+	for _, r := range p.rules {
+		if found && r.perc <= best.Perc {
+			continue
+		}
+		b, err := p.balance(ctx, chainId, r.token, trader)
+		if err != nil {
+			return Discount{}, false, err
+		}
+		if b.Cmp(r.minBalance) < 0 {
+			continue
+		}
+		best = Discount{Provider: PROVIDER_HOLDINGS, Tier: "holder-" + r.token.Hex(), Perc: r.perc}
+		found = true
+	}
+	return best, found, nil
+}
@@ -0,0 +1,30 @@
+package fees
+
+import (
+	"context"
+	"math/big"
+
+	"github.com/D8-X/d8x-broker-server/src/contracts"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// RpcBalances reads balances on-chain via balanceOf, which ERC-20 tokens and
+// ERC-721 collections share
+type RpcBalances struct {
+	// Client returns the rpc client of a chain
+	Client func(ctx context.Context, chainId int64) (*ethclient.Client, error)
+}
+
+func (b RpcBalances) BalanceOf(ctx context.Context, chainId int64, token, owner common.Address) (*big.Int, error) {
+	client, err := b.Client(ctx, chainId)
+	if err != nil {
+		return nil, err
+	}
+	erc, err := contracts.NewErc20(token, client)
+	if err != nil {
+		return nil, err
+	}
+	return erc.BalanceOf(&bind.CallOpts{Context: ctx}, owner)
+}
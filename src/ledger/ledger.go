@@ -0,0 +1,121 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// Supported database drivers
+const (
+	DRIVER_SQLITE   = "sqlite3"
+	DRIVER_POSTGRES = "postgres"
+)
+
+const DEFAULT_QUERY_LIMIT = 100
+const MAX_QUERY_LIMIT = 1000
+
+// Order status: signed -> submitted -> executed, cancelled or expired
+const (
+	STATUS_SIGNED    = "signed"
+	STATUS_SUBMITTED = "submitted"
+	STATUS_EXECUTED  = "executed"
+	STATUS_CANCELLED = "cancelled"
+	STATUS_EXPIRED   = "expired"
+)
+
+// OrderRecord is an order signed by the broker
+type OrderRecord struct {
+	OrderId            string `json:"orderId"`
+	ChainId            int64  `json:"chainId"`
+	PerpetualId        int32  `json:"perpetualId"`
+	TraderAddr         string `json:"traderAddr"`
+	BrokerAddr         string `json:"brokerAddr"`
+	BrokerFeeTbps      uint16 `json:"brokerFeeTbps"`
+	FeeTier            string `json:"feeTier"`
+	Vip3Level          int    `json:"vip3Level"`
+	Flags              uint32 `json:"flags"`
+	Deadline           uint32 `json:"iDeadline"`
+	FAmount            string `json:"fAmount"`
+	FLimitPrice        string `json:"fLimitPrice"`
+	FTriggerPrice      string `json:"fTriggerPrice"`
+	LeverageTDR        uint16 `json:"leverageTDR"`
+	ExecutionTimestamp uint32 `json:"executionTimestamp"`
+	Digest             string `json:"orderDigest"`
+	Signature          string `json:"brokerSignature"`
+	SignedAt           int64  `json:"signedAt"`
+	// set from the submission and status records
+	Status      string `json:"status"`
+	SubmittedAt int64  `json:"submittedAt,omitempty"`
+	// time of the final status (executed, cancelled or expired)
+	ClosedAt int64 `json:"closedAt,omitempty"`
+}
+
+// OrderFilter selects orders in QueryOrders. Zero values are ignored,
+// From/To are unix timestamps of the signature (inclusive)
+type OrderFilter struct {
+	TraderAddr  string
+	ChainId     int64
+	PerpetualId int32
+	From        int64
+	To          int64
+	Limit       int
+	Offset      int
+}
+
+// Store is the append-only ledger of signed orders, payments and referral
+// rebates
+type Store interface {
+	// RecordOrder appends a signed order
+	RecordOrder(ctx context.Context, rec OrderRecord) error
+	// RecordSubmission appends the submission of orders
+	RecordSubmission(ctx context.Context, orderIds []string, ts int64) error
+	// RecordStatus appends the final status of an order
+	RecordStatus(ctx context.Context, orderId, status string, ts int64) error
+	// QueryOrders returns orders matching the filter, newest first
+	QueryOrders(ctx context.Context, f OrderFilter) ([]OrderRecord, error)
+	// RecordPayment appends a signed payment, ErrDuplicatePayment if the
+	// (chainId, executor, id) tuple exists
+	RecordPayment(ctx context.Context, rec PaymentRecord) error
+	// HasPayment checks whether the (chainId, executor, id) tuple exists
+	HasPayment(ctx context.Context, chainId int64, executor string, paymentId uint32) (bool, error)
+	// QueryPayments returns payments matching the filter, newest first
+	QueryPayments(ctx context.Context, f PaymentFilter) ([]PaymentRecord, error)
+	// RecordRebate appends the referrer rebate of a signed order
+	RecordRebate(ctx context.Context, rec RebateRecord) error
+	// ReferrerEarnings sums the rebates of submitted orders of the referrer
+	// signed between from and to (unix timestamps, 0 to ignore)
+	ReferrerEarnings(ctx context.Context, referrer string, from, to int64) ([]ReferralEarnings, error)
+	Close() error
+}
+
+// ParseDSN splits a ledger connection string into driver and data source,
+// for example sqlite3:///data/ledger.db or postgres://user:pw@host/db
+func ParseDSN(dsn string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(dsn, DRIVER_SQLITE+"://"):
+		return DRIVER_SQLITE, strings.TrimPrefix(dsn, DRIVER_SQLITE+"://"), nil
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		return DRIVER_POSTGRES, dsn, nil
+	}
+	return "", "", errors.New("unsupported ledger dsn, expected sqlite3://<file> or postgres://...")
+}
+
+// Open connects to the ledger database and creates the tables
+func Open(dsn string) (Store, error) {
+	driver, source, err := ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return newSqlStore(driver, source)
+}
+
+func queryLimit(limit int) int {
+	if limit <= 0 {
+		return DEFAULT_QUERY_LIMIT
+	}
+	if limit > MAX_QUERY_LIMIT {
+		return MAX_QUERY_LIMIT
+	}
+	return limit
+}
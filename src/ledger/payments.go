@@ -0,0 +1,141 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+var ErrDuplicatePayment = errors.New("payment already signed")
+
+// PaymentRecord is an executor payment signed by the broker
+type PaymentRecord struct {
+	ChainId       int64  `json:"chainId"`
+	PaymentId     uint32 `json:"id"`
+	Executor      string `json:"executor"`
+	Payer         string `json:"payer"`
+	Token         string `json:"token"`
+	TotalAmount   string `json:"totalAmount"`
+	Timestamp     uint32 `json:"timestamp"`
+	MultiPayCtrct string `json:"multiPayCtrct"`
+	Signature     string `json:"brokerSignature"`
+	SignedAt      int64  `json:"signedAt"`
+}
+
+// PaymentFilter selects payments in QueryPayments. Zero values are ignored,
+// From/To are unix timestamps of the signature (inclusive)
+type PaymentFilter struct {
+	ChainId  int64
+	Executor string
+	Payer    string
+	Token    string
+	From     int64
+	To       int64
+	Limit    int
+	Offset   int
+}
+
+var paymentSchema = []string{
+	`CREATE TABLE IF NOT EXISTS payments (
+		chain_id BIGINT NOT NULL,
+		payment_id BIGINT NOT NULL,
+		executor TEXT NOT NULL,
+		payer TEXT NOT NULL,
+		token TEXT NOT NULL,
+		total_amount TEXT NOT NULL,
+		timestamp BIGINT NOT NULL,
+		multipay_ctrct TEXT NOT NULL,
+		signature TEXT NOT NULL,
+		signed_at BIGINT NOT NULL,
+		UNIQUE (chain_id, executor, payment_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS payments_executor_idx ON payments (chain_id, executor, token, signed_at)`,
+	`CREATE INDEX IF NOT EXISTS payments_signed_idx ON payments (signed_at)`,
+}
+
+// RecordPayment appends a signed payment. Returns ErrDuplicatePayment if
+// the executor already used the payment id on the chain
+func (s *sqlStore) RecordPayment(ctx context.Context, rec PaymentRecord) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(`INSERT INTO payments (chain_id, payment_id, executor,
+		payer, token, total_amount, timestamp, multipay_ctrct, signature, signed_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		rec.ChainId, rec.PaymentId, strings.ToLower(rec.Executor), strings.ToLower(rec.Payer),
+		strings.ToLower(rec.Token), rec.TotalAmount, rec.Timestamp, rec.MultiPayCtrct, rec.Signature,
+		rec.SignedAt)
+	if isUniqueViolation(err) {
+		return ErrDuplicatePayment
+	}
+	return err
+}
+
+// HasPayment checks whether the executor already used the payment id
+func (s *sqlStore) HasPayment(ctx context.Context, chainId int64, executor string, paymentId uint32) (bool, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, s.rebind(`SELECT COUNT(*) FROM payments
+		WHERE chain_id = ? AND executor = ? AND payment_id = ?`),
+		chainId, strings.ToLower(executor), paymentId).Scan(&n)
+	return n > 0, err
+}
+
+func (s *sqlStore) QueryPayments(ctx context.Context, f PaymentFilter) ([]PaymentRecord, error) {
+	var where []string
+	var args []any
+	if f.ChainId != 0 {
+		where = append(where, "chain_id = ?")
+		args = append(args, f.ChainId)
+	}
+	for _, c := range []struct{ col, val string }{{"executor", f.Executor}, {"payer", f.Payer}, {"token", f.Token}} {
+		if c.val != "" {
+			where = append(where, c.col+" = ?")
+			args = append(args, strings.ToLower(c.val))
+		}
+	}
+	if f.From != 0 {
+		where = append(where, "signed_at >= ?")
+		args = append(args, f.From)
+	}
+	if f.To != 0 {
+		where = append(where, "signed_at <= ?")
+		args = append(args, f.To)
+	}
+	query := `SELECT chain_id, payment_id, executor, payer, token, total_amount, timestamp,
+		multipay_ctrct, signature, signed_at FROM payments`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += ` ORDER BY signed_at DESC, chain_id, executor, payment_id LIMIT ? OFFSET ?`
+	args = append(args, queryLimit(f.Limit), max(f.Offset, 0))
+
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make([]PaymentRecord, 0)
+	for rows.Next() {
+		var p PaymentRecord
+		err = rows.Scan(&p.ChainId, &p.PaymentId, &p.Executor, &p.Payer, &p.Token, &p.TotalAmount,
+			&p.Timestamp, &p.MultiPayCtrct, &p.Signature, &p.SignedAt)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, p)
+	}
+	return res, rows.Err()
+}
+
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique ||
+			sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505"
+	}
+	return false
+}
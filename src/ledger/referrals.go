@@ -0,0 +1,95 @@
+package ledger
+
+import (
+	"context"
+	"strings"
+)
+
+// RebateRecord is the referrer rebate accrued for an order signed with a
+// referral discount
+type RebateRecord struct {
+	OrderId       string  `json:"orderId"`
+	Code          string  `json:"code"`
+	Referrer      string  `json:"referrer"`
+	TraderAddr    string  `json:"traderAddr"`
+	ChainId       int64   `json:"chainId"`
+	PerpetualId   int32   `json:"perpetualId"`
+	BrokerFeeTbps uint16  `json:"brokerFeeTbps"`
+	DiscountPerc  float64 `json:"discountPerc"`
+	SharePerc     float64 `json:"referrerSharePerc"`
+	// order notional and rebate in quote currency of the perpetual
+	Notional float64 `json:"notional"`
+	Rebate   float64 `json:"rebate"`
+	SignedAt int64   `json:"signedAt"`
+}
+
+// ReferralEarnings are the rebates of a referrer per code and perpetual,
+// counting submitted orders only
+type ReferralEarnings struct {
+	Code        string  `json:"code"`
+	ChainId     int64   `json:"chainId"`
+	PerpetualId int32   `json:"perpetualId"`
+	Orders      int64   `json:"orders"`
+	Notional    float64 `json:"notional"`
+	Rebate      float64 `json:"rebate"`
+}
+
+var referralSchema = []string{
+	`CREATE TABLE IF NOT EXISTS referral_rebates (
+		order_id TEXT PRIMARY KEY,
+		code TEXT NOT NULL,
+		referrer TEXT NOT NULL,
+		trader_addr TEXT NOT NULL,
+		chain_id BIGINT NOT NULL,
+		perpetual_id INTEGER NOT NULL,
+		broker_fee_tbps INTEGER NOT NULL,
+		discount_perc DOUBLE PRECISION NOT NULL,
+		share_perc DOUBLE PRECISION NOT NULL,
+		notional DOUBLE PRECISION NOT NULL,
+		rebate DOUBLE PRECISION NOT NULL,
+		signed_at BIGINT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS referral_rebates_referrer_idx ON referral_rebates (referrer, signed_at)`,
+}
+
+func (s *sqlStore) RecordRebate(ctx context.Context, rec RebateRecord) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(`INSERT INTO referral_rebates (order_id, code, referrer,
+		trader_addr, chain_id, perpetual_id, broker_fee_tbps, discount_perc, share_perc, notional,
+		rebate, signed_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		rec.OrderId, rec.Code, strings.ToLower(rec.Referrer), strings.ToLower(rec.TraderAddr),
+		rec.ChainId, rec.PerpetualId, rec.BrokerFeeTbps, rec.DiscountPerc, rec.SharePerc,
+		rec.Notional, rec.Rebate, rec.SignedAt)
+	return err
+}
+
+func (s *sqlStore) ReferrerEarnings(ctx context.Context, referrer string, from, to int64) ([]ReferralEarnings, error) {
+	where := []string{"r.referrer = ?",
+		"EXISTS (SELECT 1 FROM order_submissions s WHERE s.order_id = r.order_id)"}
+	args := []any{strings.ToLower(referrer)}
+	if from != 0 {
+		where = append(where, "r.signed_at >= ?")
+		args = append(args, from)
+	}
+	if to != 0 {
+		where = append(where, "r.signed_at <= ?")
+		args = append(args, to)
+	}
+	query := `SELECT r.code, r.chain_id, r.perpetual_id, COUNT(*), SUM(r.notional), SUM(r.rebate)
+		FROM referral_rebates r WHERE ` + strings.Join(where, " AND ") + `
+		GROUP BY r.code, r.chain_id, r.perpetual_id ORDER BY r.code, r.chain_id, r.perpetual_id`
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make([]ReferralEarnings, 0)
+	for rows.Next() {
+		var e ReferralEarnings
+		err = rows.Scan(&e.Code, &e.ChainId, &e.PerpetualId, &e.Orders, &e.Notional, &e.Rebate)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, e)
+	}
+	return res, rows.Err()
+}
@@ -0,0 +1,199 @@
+package ledger
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS orders (
+		order_id TEXT PRIMARY KEY,
+		chain_id BIGINT NOT NULL,
+		perpetual_id INTEGER NOT NULL,
+		trader_addr TEXT NOT NULL,
+		broker_addr TEXT NOT NULL,
+		broker_fee_tbps INTEGER NOT NULL,
+		fee_tier TEXT NOT NULL,
+		vip3_level INTEGER NOT NULL,
+		flags BIGINT NOT NULL,
+		deadline BIGINT NOT NULL,
+		f_amount TEXT NOT NULL,
+		f_limit_price TEXT NOT NULL,
+		f_trigger_price TEXT NOT NULL,
+		leverage_tdr INTEGER NOT NULL,
+		execution_timestamp BIGINT NOT NULL,
+		digest TEXT NOT NULL,
+		signature TEXT NOT NULL,
+		signed_at BIGINT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS orders_trader_idx ON orders (trader_addr, signed_at)`,
+	`CREATE INDEX IF NOT EXISTS orders_perpetual_idx ON orders (chain_id, perpetual_id, signed_at)`,
+	`CREATE INDEX IF NOT EXISTS orders_signed_idx ON orders (signed_at)`,
+	`CREATE TABLE IF NOT EXISTS order_submissions (
+		order_id TEXT NOT NULL,
+		submitted_at BIGINT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS order_submissions_idx ON order_submissions (order_id)`,
+	`CREATE TABLE IF NOT EXISTS order_statuses (
+		order_id TEXT NOT NULL,
+		status TEXT NOT NULL,
+		updated_at BIGINT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS order_statuses_idx ON order_statuses (order_id, updated_at)`,
+}
+
+const orderColumns = `o.order_id, o.chain_id, o.perpetual_id, o.trader_addr, o.broker_addr,
+	o.broker_fee_tbps, o.fee_tier, o.vip3_level, o.flags, o.deadline, o.f_amount, o.f_limit_price,
+	o.f_trigger_price, o.leverage_tdr, o.execution_timestamp, o.digest, o.signature, o.signed_at`
+
+// sqlStore implements Store for SQLite and Postgres
+type sqlStore struct {
+	db     *sql.DB
+	driver string
+}
+
+func newSqlStore(driver, source string) (*sqlStore, error) {
+	db, err := sql.Open(driver, source)
+	if err != nil {
+		return nil, err
+	}
+	if driver == DRIVER_SQLITE {
+		// sqlite allows a single writer
+		db.SetMaxOpenConns(1)
+	}
+	s := &sqlStore{db: db, driver: driver}
+	stmts := append(append(schema, paymentSchema...), referralSchema...)
+	for _, stmt := range stmts {
+		_, err = db.Exec(stmt)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// rebind replaces ? placeholders by $n for postgres
+func (s *sqlStore) rebind(query string) string {
+	if s.driver != DRIVER_POSTGRES {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (s *sqlStore) RecordOrder(ctx context.Context, rec OrderRecord) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(`INSERT INTO orders (order_id, chain_id, perpetual_id,
+		trader_addr, broker_addr, broker_fee_tbps, fee_tier, vip3_level, flags, deadline, f_amount,
+		f_limit_price, f_trigger_price, leverage_tdr, execution_timestamp, digest, signature, signed_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		rec.OrderId, rec.ChainId, rec.PerpetualId, strings.ToLower(rec.TraderAddr), rec.BrokerAddr,
+		rec.BrokerFeeTbps, rec.FeeTier, rec.Vip3Level, rec.Flags, rec.Deadline, rec.FAmount,
+		rec.FLimitPrice, rec.FTriggerPrice, rec.LeverageTDR, rec.ExecutionTimestamp, rec.Digest,
+		rec.Signature, rec.SignedAt)
+	return err
+}
+
+func (s *sqlStore) RecordSubmission(ctx context.Context, orderIds []string, ts int64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, id := range orderIds {
+		_, err = tx.ExecContext(ctx, s.rebind(`INSERT INTO order_submissions (order_id, submitted_at) VALUES (?, ?)`), id, ts)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) RecordStatus(ctx context.Context, orderId, status string, ts int64) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(`INSERT INTO order_statuses (order_id, status, updated_at) VALUES (?, ?, ?)`),
+		orderId, status, ts)
+	return err
+}
+
+func (s *sqlStore) QueryOrders(ctx context.Context, f OrderFilter) ([]OrderRecord, error) {
+	var where []string
+	var args []any
+	if f.TraderAddr != "" {
+		where = append(where, "o.trader_addr = ?")
+		args = append(args, strings.ToLower(f.TraderAddr))
+	}
+	if f.ChainId != 0 {
+		where = append(where, "o.chain_id = ?")
+		args = append(args, f.ChainId)
+	}
+	if f.PerpetualId != 0 {
+		where = append(where, "o.perpetual_id = ?")
+		args = append(args, f.PerpetualId)
+	}
+	if f.From != 0 {
+		where = append(where, "o.signed_at >= ?")
+		args = append(args, f.From)
+	}
+	if f.To != 0 {
+		where = append(where, "o.signed_at <= ?")
+		args = append(args, f.To)
+	}
+	query := `SELECT ` + orderColumns + `,
+		(SELECT MIN(s.submitted_at) FROM order_submissions s WHERE s.order_id = o.order_id),
+		(SELECT st.status FROM order_statuses st WHERE st.order_id = o.order_id ORDER BY st.updated_at DESC LIMIT 1),
+		(SELECT MAX(st.updated_at) FROM order_statuses st WHERE st.order_id = o.order_id)
+		FROM orders o`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += ` ORDER BY o.signed_at DESC, o.order_id LIMIT ? OFFSET ?`
+	args = append(args, queryLimit(f.Limit), max(f.Offset, 0))
+
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make([]OrderRecord, 0)
+	for rows.Next() {
+		var r OrderRecord
+		var submittedAt, closedAt sql.NullInt64
+		var status sql.NullString
+		err = rows.Scan(&r.OrderId, &r.ChainId, &r.PerpetualId, &r.TraderAddr, &r.BrokerAddr,
+			&r.BrokerFeeTbps, &r.FeeTier, &r.Vip3Level, &r.Flags, &r.Deadline, &r.FAmount,
+			&r.FLimitPrice, &r.FTriggerPrice, &r.LeverageTDR, &r.ExecutionTimestamp, &r.Digest,
+			&r.Signature, &r.SignedAt, &submittedAt, &status, &closedAt)
+		if err != nil {
+			return nil, err
+		}
+		r.Status = STATUS_SIGNED
+		if submittedAt.Valid {
+			r.Status = STATUS_SUBMITTED
+			r.SubmittedAt = submittedAt.Int64
+		}
+		if status.Valid {
+			r.Status = status.String
+			r.ClosedAt = closedAt.Int64
+		}
+		res = append(res, r)
+	}
+	return res, rows.Err()
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,166 @@
+package ledger
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func newTestStore(t *testing.T) Store {
+	s, err := Open("sqlite3://" + filepath.Join(t.TempDir(), "ledger.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestParseDSN(t *testing.T) {
+	d, src, err := ParseDSN("sqlite3:///data/ledger.db")
+	if err != nil || d != DRIVER_SQLITE || src != "/data/ledger.db" {
+		t.Errorf("sqlite dsn: %s %s %v", d, src, err)
+	}
+	d, src, err = ParseDSN("postgres://u:p@db/ledger")
+	if err != nil || d != DRIVER_POSTGRES || src != "postgres://u:p@db/ledger" {
+		t.Errorf("postgres dsn: %s %s %v", d, src, err)
+	}
+	if _, _, err = ParseDSN("mysql://db"); err == nil {
+		t.Errorf("expected error for mysql")
+	}
+}
+
+func TestRebind(t *testing.T) {
+	s := &sqlStore{driver: DRIVER_POSTGRES}
+	if q := s.rebind("a = ? AND b = ?"); q != "a = $1 AND b = $2" {
+		t.Errorf("unexpected query %s", q)
+	}
+}
+
+func TestOrderLedger(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	trader := "0x9d5aaB428e98678d0E645ea4AeBd25f744341a05"
+	recs := []OrderRecord{
+		{OrderId: "a1", ChainId: 42161, PerpetualId: 100001, TraderAddr: trader, FeeTier: "base", SignedAt: 100},
+		{OrderId: "a2", ChainId: 42161, PerpetualId: 100002, TraderAddr: trader, FeeTier: "vip3-2", Vip3Level: 2, SignedAt: 200},
+		{OrderId: "b1", ChainId: 1101, PerpetualId: 100001, TraderAddr: "0x0000000000000000000000000000000000000001", SignedAt: 300},
+	}
+	for _, rec := range recs {
+		if err := s.RecordOrder(ctx, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// orders are append-only
+	if err := s.RecordOrder(ctx, recs[0]); err == nil {
+		t.Errorf("expected error recording an order twice")
+	}
+	if err := s.RecordSubmission(ctx, []string{"a2"}, 250); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RecordStatus(ctx, "a2", STATUS_EXECUTED, 260); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := s.QueryOrders(ctx, OrderFilter{TraderAddr: "0x9D5AAB428E98678D0E645EA4AEBD25F744341A05"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || res[0].OrderId != "a2" || res[1].OrderId != "a1" {
+		t.Fatalf("unexpected trader orders %v", res)
+	}
+	if res[0].Status != STATUS_EXECUTED || res[0].SubmittedAt != 250 || res[0].ClosedAt != 260 || res[0].Vip3Level != 2 {
+		t.Errorf("unexpected executed order %v", res[0])
+	}
+	if res[1].Status != STATUS_SIGNED {
+		t.Errorf("unexpected status %s", res[1].Status)
+	}
+
+	for _, tc := range []struct {
+		f   OrderFilter
+		ids []string
+	}{
+		{OrderFilter{ChainId: 42161, PerpetualId: 100001}, []string{"a1"}},
+		{OrderFilter{From: 150, To: 300}, []string{"b1", "a2"}},
+		{OrderFilter{Limit: 1, Offset: 1}, []string{"a2"}},
+	} {
+		res, err := s.QueryOrders(ctx, tc.f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != len(tc.ids) {
+			t.Errorf("filter %+v: got %d orders, expected %v", tc.f, len(res), tc.ids)
+			continue
+		}
+		for k := range res {
+			if res[k].OrderId != tc.ids[k] {
+				t.Errorf("filter %+v: got %s, expected %s", tc.f, res[k].OrderId, tc.ids[k])
+			}
+		}
+	}
+}
+
+func TestPaymentLedger(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	executor := "0xDa47a0CAc77D50114F2725D06a2Ce887cF9f4D98"
+	token := "0x2d10075E54356E16Ebd5C6BB5194290709B69C1e"
+	recs := []PaymentRecord{
+		{ChainId: 42161, PaymentId: 1, Executor: executor, Token: token, TotalAmount: "1000000000000000000000", SignedAt: 100},
+		{ChainId: 42161, PaymentId: 2, Executor: executor, Token: token, TotalAmount: "500", SignedAt: 200},
+		{ChainId: 1101, PaymentId: 1, Executor: executor, Token: token, TotalAmount: "7", SignedAt: 200},
+	}
+	for _, rec := range recs {
+		if err := s.RecordPayment(ctx, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dup := recs[0]
+	dup.Executor = "0xda47a0cac77d50114f2725d06a2ce887cf9f4d98"
+	if err := s.RecordPayment(ctx, dup); err != ErrDuplicatePayment {
+		t.Errorf("expected duplicate payment error, got %v", err)
+	}
+	if found, err := s.HasPayment(ctx, 42161, executor, 2); err != nil || !found {
+		t.Errorf("payment 2 not found: %v", err)
+	}
+	if found, _ := s.HasPayment(ctx, 42161, executor, 3); found {
+		t.Errorf("payment 3 should not exist")
+	}
+	res, err := s.QueryPayments(ctx, PaymentFilter{ChainId: 42161, Executor: executor})
+	if err != nil || len(res) != 2 || res[0].PaymentId != 2 {
+		t.Errorf("unexpected payments %v %v", res, err)
+	}
+}
+
+func TestReferralRebates(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	referrer := "0x3ef256282e578c5D97a7231C3C046F19b1E50855"
+	recs := []RebateRecord{
+		{OrderId: "a1", Code: "ALICE", Referrer: referrer, ChainId: 42161, PerpetualId: 100001, Notional: 1000, Rebate: 1, SignedAt: 100},
+		{OrderId: "a2", Code: "ALICE", Referrer: referrer, ChainId: 42161, PerpetualId: 100001, Notional: 3000, Rebate: 3, SignedAt: 200},
+		{OrderId: "a3", Code: "ALICE", Referrer: referrer, ChainId: 42161, PerpetualId: 100002, Notional: 500, Rebate: 0.5, SignedAt: 300},
+		{OrderId: "b1", Code: "BOB", Referrer: "0x0000000000000000000000000000000000000001", ChainId: 42161, PerpetualId: 100001, Notional: 10, Rebate: 7, SignedAt: 300},
+	}
+	for _, rec := range recs {
+		if err := s.RecordRebate(ctx, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.RecordRebate(ctx, recs[0]); err == nil {
+		t.Errorf("expected error recording a rebate twice")
+	}
+	// only submitted orders earn rebates
+	if err := s.RecordSubmission(ctx, []string{"a1", "a2", "b1"}, 400); err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.ReferrerEarnings(ctx, "0x3EF256282E578C5D97A7231C3C046F19B1E50855", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].Orders != 2 || res[0].Notional != 4000 || res[0].Rebate != 4 || res[0].PerpetualId != 100001 {
+		t.Errorf("unexpected earnings %+v", res)
+	}
+	if res, _ = s.ReferrerEarnings(ctx, referrer, 150, 0); len(res) != 1 || res[0].Orders != 1 {
+		t.Errorf("unexpected earnings since 150 %+v", res)
+	}
+}
@@ -0,0 +1,94 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "d8x_broker"
+
+// Results used as label values
+const (
+	RESULT_OK    = "ok"
+	RESULT_ERROR = "error"
+	RESULT_HIT   = "hit"
+	RESULT_MISS  = "miss"
+)
+
+var (
+	// brokerapi
+	OrderSignatures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "order_signatures_total",
+		Help:      "Order signatures issued per chain and perpetual",
+	}, []string{"chain", "perpetual"})
+	PaymentSignatures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "payment_signatures_total",
+		Help:      "Payment signatures issued per chain",
+	}, []string{"chain"})
+	SignatureLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "signature_duration_seconds",
+		Help:      "Time to create a broker signature (order or payment)",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"type"})
+	Vip3Lookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "vip3_lookups_total",
+		Help:      "VIP3 level lookups by result (hit, miss, error)",
+	}, []string{"result"})
+	TokenApprovals = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "token_approvals_total",
+		Help:      "ApproveToken transactions per chain and result",
+	}, []string{"chain", "result"})
+	OrderSubmissionFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "order_submission_failures_total",
+		Help:      "Failed order submissions (orders-submitted)",
+	})
+
+	// executorws
+	WsClients = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "ws_clients",
+		Help:      "Websocket clients subscribed per topic",
+	}, []string{"topic"})
+	BroadcastLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "ws_broadcast_duration_seconds",
+		Help:      "Time to fan out an order update to all subscribers of a topic",
+		Buckets:   prometheus.DefBuckets,
+	})
+	DroppedSends = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ws_dropped_sends_total",
+		Help:      "Websocket messages that could not be delivered to a client",
+	})
+	SlowClientDisconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ws_slow_client_disconnects_total",
+		Help:      "Websocket clients disconnected because their send buffer was full",
+	})
+)
+
+// Handler serves the metrics in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ObserveSince records the time elapsed since start in the histogram
+func ObserveSince(h prometheus.Observer, start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// Label formats an integer id as label value
+func Label(id int64) string {
+	return strconv.FormatInt(id, 10)
+}
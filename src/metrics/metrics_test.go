@@ -0,0 +1,25 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	OrderSignatures.WithLabelValues("42161", "100001").Inc()
+	WsClients.WithLabelValues("100001:42161").Set(2)
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	for _, line := range []string{
+		`d8x_broker_order_signatures_total{chain="42161",perpetual="100001"} 1`,
+		`d8x_broker_ws_clients{topic="100001:42161"} 2`,
+	} {
+		if !strings.Contains(string(body), line) {
+			t.Errorf("metric missing: %s", line)
+		}
+	}
+}
@@ -1,16 +1,24 @@
 package svc
 
 import (
+	"context"
 	"embed"
 	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/D8-X/d8x-broker-server/src/api"
 	"github.com/D8-X/d8x-broker-server/src/env"
 	"github.com/D8-X/d8x-broker-server/src/executorws"
+	"github.com/D8-X/d8x-broker-server/src/ledger"
+	"github.com/D8-X/d8x-broker-server/src/metrics"
 	"github.com/D8-X/d8x-broker-server/src/utils"
+	"github.com/D8-X/d8x-broker-server/src/vip3"
 	"github.com/spf13/viper"
 )
 
@@ -35,15 +43,38 @@ func RunExecutorWs() {
 		slog.Error("loading env: " + err.Error())
 		return
 	}
-	config, err := utils.LoadChainConfig(viper.GetString(env.CONFIG_PATH))
+	configPath := viper.GetString(env.CONFIG_PATH)
+	config, err := utils.LoadChainConfig(configPath)
 	if err != nil {
 		slog.Error("loading chain config: " + err.Error())
 		return
 	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	err = utils.WatchConfigFiles(ctx, []string{configPath}, func() {
+		newConf, err := utils.LoadChainConfig(configPath)
+		if err != nil {
+			slog.Error("reloading chain config, keeping current config: " + err.Error())
+			return
+		}
+		logConfigDiff(executorws.UpdateConfig(newConf))
+	})
+	if err != nil {
+		slog.Error("watching config files: " + err.Error())
+	}
 	wsAddr := viper.GetString(env.WS_ADDR)
 	redisAddr := viper.GetString(env.REDIS_ADDR)
 	redisPw := viper.GetString(env.REDIS_PW)
-	err = executorws.StartWSServer(config, wsAddr, redisAddr, redisPw)
+	opts := executorws.ClientOptions{
+		SendBuffer:       viper.GetInt(env.WS_SEND_BUFFER),
+		SlowClientPolicy: viper.GetString(env.WS_SLOW_CLIENT_POLICY),
+	}
+	instanceId := viper.GetString(env.WS_INSTANCE_ID)
+	if instanceId == "" {
+		slog.Warn("no " + env.WS_INSTANCE_ID + " configured, orders submitted while executorws is down are not sent after a restart")
+	}
+	serveMetrics(ctx)
+	err = executorws.StartWSServer(ctx, config, wsAddr, redisAddr, redisPw, instanceId, loadHttpTimeouts(), opts)
 	if err != nil {
 		slog.Error("Executor WS server: " + err.Error())
 	}
@@ -55,7 +86,6 @@ func RunBroker() {
 		env.CONFIG_PATH,
 		env.REDIS_ADDR,
 		env.REDIS_PW,
-		env.KEYFILE_PATH,
 		env.CONFIG_RPC_PATH,
 	}
 
@@ -65,38 +95,290 @@ func RunBroker() {
 		return
 	}
 
-	fmt.Println("Loading config file from " + viper.GetString(env.CONFIG_PATH))
-	chConf, err := utils.LoadChainConfig(viper.GetString(env.CONFIG_PATH))
+	configPath := viper.GetString(env.CONFIG_PATH)
+	rpcPath := viper.GetString(env.CONFIG_RPC_PATH)
+	fmt.Println("Loading config file from " + configPath)
+	chConf, err := utils.LoadChainConfig(configPath)
 	if err != nil {
 		slog.Error("loading chain config: " + err.Error())
 		return
 	}
-	fmt.Println("Loading rpc config file from " + viper.GetString(env.CONFIG_RPC_PATH))
-	rpcConf, err := utils.LoadRpcConfig(viper.GetString(env.CONFIG_RPC_PATH))
+	fmt.Println("Loading rpc config file from " + rpcPath)
+	rpcConf, err := utils.LoadRpcConfig(rpcPath)
 	if err != nil {
 		slog.Error("loading rpc config: " + err.Error())
 		return
 	}
-	pk := utils.LoadFromFile(viper.GetString(env.KEYFILE_PATH)+"keyfile.txt", abc)
+	signers, err := createSigners(chConf)
+	if err != nil {
+		slog.Error("creating broker signers: " + err.Error())
+		return
+	}
+	pen, err := utils.NewSignaturePenWithSigners(signers, chConf, rpcConf)
+	if err != nil {
+		slog.Error("Unable to create signature pen:" + err.Error())
+		return
+	}
 	fee := uint16(viper.GetInt32(env.BROKER_FEE_TBPS))
-	app, err := api.NewApp(pk,
+	app, err := api.NewApp(pen,
 		viper.GetString(env.API_PORT),
 		viper.GetString(env.API_BIND_ADDR),
 		viper.GetString(env.REDIS_ADDR),
 		viper.GetString(env.REDIS_PW),
 		viper.GetString(env.VIP3_REDUCTION_PERC),
-		chConf,
-		rpcConf,
-		fee)
+		fee,
+		loadVip3Config())
 	if err != nil {
 		slog.Error("API init: " + err.Error())
 		return
 	}
+	defer app.RpcClients.Close()
+	pen.MarkPrices = app.MarkPrices
+	app.AdminApiKey = viper.GetString(env.ADMIN_API_KEY)
+	app.ApiAuthEnabled = viper.GetBool(env.API_AUTH_ENABLED)
+	app.ApiAuthWindowSec = viper.GetInt64(env.API_AUTH_WINDOW_SEC)
+	app.FeeQuoteTtlSec = viper.GetInt64(env.FEE_QUOTE_TTL_SEC)
+	app.OrderStreamMaxAgeSec = viper.GetInt64(env.ORDER_STREAM_MAX_AGE_SEC)
+	app.OrderMaxDeadlineSec = viper.GetInt64(env.ORDER_MAX_DEADLINE_SEC)
+	app.Perpetuals = utils.NewPerpetualCache(utils.SdkPerpetuals{Client: app.RpcClients.Client})
+	if app.ApiAuthEnabled {
+		slog.Info("API key authentication enabled")
+	}
+	app.RateLimits, err = loadRateLimits()
+	if err != nil {
+		slog.Error("rate limits: " + err.Error())
+		return
+	}
+	if app.RateLimits.Enabled() {
+		slog.Info("rate limiting enabled", "trader", app.RateLimits.Trader.String(),
+			"ip", app.RateLimits.Ip.String(), "apikey", app.RateLimits.ApiKey.String())
+	}
+	app.Timeouts = loadHttpTimeouts()
+	if dsn := viper.GetString(env.LEDGER_DSN); dsn != "" {
+		pen.Ledger, err = ledger.Open(dsn)
+		if err != nil {
+			slog.Error("opening ledger: " + err.Error())
+			return
+		}
+		defer pen.Ledger.Close()
+		slog.Info("order ledger enabled")
+	}
+	watched := []string{configPath, rpcPath}
+	feePath := viper.GetString(env.FEE_CONFIG_PATH)
+	if feePath != "" {
+		if viper.GetString(env.VIP3_REDUCTION_PERC) != "" {
+			slog.Warn(env.VIP3_REDUCTION_PERC + " ignored, fee config file is used")
+		}
+		err = app.LoadFeeConfig(feePath)
+		if err != nil {
+			slog.Error("loading fee config: " + err.Error())
+			return
+		}
+		slog.Info("fee config loaded from " + feePath)
+		watched = append(watched, feePath)
+	}
+	err = app.SeedExecutors()
+	if err != nil {
+		// without the live whitelist, removed executors could be revived
+		slog.Error("executor whitelist: " + err.Error())
+		return
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	err = app.LoadPerpetuals(ctx)
+	if err != nil {
+		// orders of these chains are rejected until the perpetuals load
+		slog.Error("loading perpetuals: " + err.Error())
+	}
+	err = utils.WatchConfigFiles(ctx, watched, func() {
+		reloadBrokerConfig(app, configPath, rpcPath)
+		if feePath != "" {
+			reloadFeeConfig(app, feePath)
+		}
+	})
+	if err != nil {
+		slog.Error("watching config files: " + err.Error())
+	}
+	serveMetrics(ctx)
 	slog.Info("starting REST API server")
 	// Start the rest api
-	err = app.StartApiServer()
+	err = app.StartApiServer(ctx)
 	if err != nil {
 		slog.Error("API server: " + err.Error())
+		return
+	}
+	slog.Info("API server stopped")
+}
+
+// reloadBrokerConfig loads chain and rpc config and swaps it in the
+// signature pen. The current config is kept if the new one is invalid
+func reloadBrokerConfig(app *api.App, configPath, rpcPath string) {
+	chConf, err := utils.LoadChainConfig(configPath)
+	if err != nil {
+		slog.Error("reloading chain config, keeping current config: " + err.Error())
+		return
+	}
+	rpcConf, err := utils.LoadRpcConfig(rpcPath)
+	if err != nil {
+		slog.Error("reloading rpc config, keeping current config: " + err.Error())
+		return
+	}
+	old := app.Pen.GetChainConfigs()
+	diff, err := app.Pen.UpdateConfig(chConf, rpcConf)
+	if err != nil {
+		slog.Error("invalid config, keeping current config: " + err.Error())
+		return
+	}
+	logConfigDiff(diff)
+	app.SyncExecutors(old, chConf)
+}
+
+// reloadFeeConfig swaps the fee config. The current config is kept if the new
+// one is invalid
+func reloadFeeConfig(app *api.App, feePath string) {
+	err := app.LoadFeeConfig(feePath)
+	if err != nil {
+		slog.Error("reloading fee config, keeping current config: " + err.Error())
+		return
+	}
+	slog.Info("fee config reloaded")
+}
+
+func logConfigDiff(diff []string) {
+	if len(diff) == 0 {
+		slog.Info("config reloaded, no changes")
+		return
+	}
+	for _, d := range diff {
+		slog.Info("config reloaded: " + d)
+	}
+}
+
+// loadHttpTimeouts reads the http server timeouts from the environment
+func loadHttpTimeouts() utils.HttpTimeouts {
+	return utils.HttpTimeouts{
+		Read:     time.Duration(viper.GetInt64(env.HTTP_READ_TIMEOUT_SEC)) * time.Second,
+		Write:    time.Duration(viper.GetInt64(env.HTTP_WRITE_TIMEOUT_SEC)) * time.Second,
+		Idle:     time.Duration(viper.GetInt64(env.HTTP_IDLE_TIMEOUT_SEC)) * time.Second,
+		Shutdown: time.Duration(viper.GetInt64(env.SHUTDOWN_TIMEOUT_SEC)) * time.Second,
+	}
+}
+
+// serveMetrics serves /metrics on METRICS_ADDR until ctx is done
+func serveMetrics(ctx context.Context) {
+	addr := viper.GetString(env.METRICS_ADDR)
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	timeouts := loadHttpTimeouts()
+	slog.Info("serving metrics on " + addr + "/metrics")
+	go func() {
+		err := utils.ServeHttp(ctx, utils.NewHttpServer(addr, mux, timeouts), timeouts)
+		if err != nil {
+			slog.Error("metrics server: " + err.Error())
+		}
+	}()
+}
+
+// loadRateLimits reads the order signature rate limits from the environment
+func loadRateLimits() (api.RateLimits, error) {
+	var limits api.RateLimits
+	var err error
+	for envName, limit := range map[string]*utils.RateLimit{
+		env.RATE_LIMIT_TRADER: &limits.Trader,
+		env.RATE_LIMIT_IP:     &limits.Ip,
+		env.RATE_LIMIT_APIKEY: &limits.ApiKey,
+	} {
+		*limit, err = utils.ParseRateLimit(viper.GetString(envName))
+		if err != nil {
+			return limits, errors.New(envName + ": " + err.Error())
+		}
+	}
+	limits.TrustedProxies = viper.GetInt(env.RATE_LIMIT_TRUSTED_PROXIES)
+	if limits.TrustedProxies < 0 {
+		return limits, errors.New(env.RATE_LIMIT_TRUSTED_PROXIES + " must not be negative")
+	}
+	return limits, nil
+}
+
+// createSigners creates the broker signer for each configured chain
+// according to SIGNER_TYPE. SIGNER_URL and SIGNER_ADDR can be specified per
+// chain ("<chainId>:<value>;..."), local keys are loaded from KEYFILE_PATH
+func createSigners(chConf map[int64]utils.ChainConfig) (map[int64]utils.Signer, error) {
+	chainIds := make([]int64, 0, len(chConf))
+	for chainId := range chConf {
+		chainIds = append(chainIds, chainId)
+	}
+	signerType := viper.GetString(env.SIGNER_TYPE)
+	signers := make(map[int64]utils.Signer)
+	if signerType != utils.SIGNER_LOCAL {
+		if !viper.IsSet(env.SIGNER_URL) {
+			return nil, errors.New("required environment variable not set variable" + env.SIGNER_URL)
+		}
+		urls, defUrl, err := utils.ParseChainSpec(viper.GetString(env.SIGNER_URL))
+		if err != nil {
+			return nil, err
+		}
+		addrs, defAddr, err := utils.ParseChainSpec(viper.GetString(env.SIGNER_ADDR))
+		if err != nil {
+			return nil, err
+		}
+		// chains with the same signer url and address share the signer
+		created := make(map[string]utils.Signer)
+		for _, chainId := range chainIds {
+			url, addr := defUrl, defAddr
+			if v, exists := urls[chainId]; exists {
+				url = v
+			}
+			if v, exists := addrs[chainId]; exists {
+				addr = v
+			}
+			if url == "" {
+				return nil, fmt.Errorf("no signer url for chain %d", chainId)
+			}
+			if signer, exists := created[url+addr]; exists {
+				signers[chainId] = signer
+				continue
+			}
+			signer, err := utils.NewSigner(signerType, url, addr, viper.GetString(env.SIGNER_AUTH_TOKEN))
+			if err != nil {
+				return nil, fmt.Errorf("chain %d: %s", chainId, err.Error())
+			}
+			created[url+addr] = signer
+			signers[chainId] = signer
+		}
+	} else {
+		if !viper.IsSet(env.KEYFILE_PATH) {
+			return nil, errors.New("required environment variable not set variable" + env.KEYFILE_PATH)
+		}
+		keys, err := utils.LoadKeysFromDir(viper.GetString(env.KEYFILE_PATH), chainIds, abc)
+		if err != nil {
+			return nil, err
+		}
+		for chainId, pk := range keys {
+			signer, err := utils.NewLocalSigner(pk)
+			if err != nil {
+				return nil, fmt.Errorf("chain %d: %s", chainId, err.Error())
+			}
+			signers[chainId] = signer
+		}
+	}
+	for chainId, signer := range signers {
+		slog.Info("broker signer created", "type", signerType, "chainId", chainId, "addr", signer.Address().Hex())
+	}
+	return signers, nil
+}
+
+// loadVip3Config reads the VIP3 client settings from the environment
+func loadVip3Config() vip3.Config {
+	return vip3.Config{
+		BaseUrl:          viper.GetString(env.VIP3_API_URL),
+		Timeout:          time.Duration(viper.GetInt64(env.VIP3_TIMEOUT_SEC)) * time.Second,
+		Retries:          viper.GetInt(env.VIP3_RETRIES),
+		BreakerThreshold: viper.GetInt(env.VIP3_BREAKER_THRESHOLD),
+		BreakerCooldown:  time.Duration(viper.GetInt64(env.VIP3_BREAKER_COOLDOWN_SEC)) * time.Second,
 	}
 }
 
@@ -112,7 +394,32 @@ func loadEnv(requiredEnvs []string) error {
 	viper.SetDefault(env.API_BIND_ADDR, "")
 	viper.SetDefault(env.API_PORT, "8001")
 	viper.SetDefault(env.WS_ADDR, "executorws:8080")
+	viper.SetDefault(env.WS_SEND_BUFFER, executorws.DEFAULT_SEND_BUFFER)
+	viper.SetDefault(env.WS_SLOW_CLIENT_POLICY, executorws.POLICY_DROP_OLDEST)
+	viper.SetDefault(env.ORDER_STREAM_MAX_AGE_SEC, int64(utils.DEFAULT_ORDER_STREAM_MAX_AGE/time.Second))
+	viper.SetDefault(env.WS_INSTANCE_ID, "")
 	viper.SetDefault(env.VIP3_REDUCTION_PERC, "")
+	viper.SetDefault(env.SIGNER_TYPE, utils.SIGNER_LOCAL)
+	viper.SetDefault(env.API_AUTH_ENABLED, false)
+	viper.SetDefault(env.API_AUTH_WINDOW_SEC, api.DEFAULT_API_AUTH_WINDOW_SEC)
+	viper.SetDefault(env.RATE_LIMIT_TRADER, "")
+	viper.SetDefault(env.RATE_LIMIT_IP, "")
+	viper.SetDefault(env.RATE_LIMIT_APIKEY, "")
+	viper.SetDefault(env.RATE_LIMIT_TRUSTED_PROXIES, 0)
+	viper.SetDefault(env.HTTP_READ_TIMEOUT_SEC, 10)
+	viper.SetDefault(env.HTTP_WRITE_TIMEOUT_SEC, 120)
+	viper.SetDefault(env.HTTP_IDLE_TIMEOUT_SEC, 120)
+	viper.SetDefault(env.SHUTDOWN_TIMEOUT_SEC, 30)
+	viper.SetDefault(env.LEDGER_DSN, "")
+	viper.SetDefault(env.METRICS_ADDR, "")
+	viper.SetDefault(env.FEE_CONFIG_PATH, "")
+	viper.SetDefault(env.FEE_QUOTE_TTL_SEC, api.DEFAULT_FEE_QUOTE_TTL_SEC)
+	viper.SetDefault(env.ORDER_MAX_DEADLINE_SEC, int64(utils.DEFAULT_ORDER_MAX_DEADLINE/time.Second))
+	viper.SetDefault(env.VIP3_API_URL, vip3.DEFAULT_API_URL)
+	viper.SetDefault(env.VIP3_TIMEOUT_SEC, int64(vip3.DEFAULT_TIMEOUT/time.Second))
+	viper.SetDefault(env.VIP3_RETRIES, vip3.DEFAULT_RETRIES)
+	viper.SetDefault(env.VIP3_BREAKER_THRESHOLD, vip3.DEFAULT_BREAKER_THRESHOLD)
+	viper.SetDefault(env.VIP3_BREAKER_COOLDOWN_SEC, int64(vip3.DEFAULT_BREAKER_COOLDOWN/time.Second))
 	for _, e := range requiredEnvs {
 		if !viper.IsSet(e) {
 			return errors.New("required environment variable not set variable" + e)
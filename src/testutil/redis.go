@@ -0,0 +1,22 @@
+// Package testutil contains fixtures shared by the tests of the packages
+package testutil
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/rueidis"
+)
+
+// NewRedis starts an in-memory Redis server and returns a client connected
+// to it. Both are closed when the test ends. Client side caching is
+// disabled, miniredis does not support it
+func NewRedis(t testing.TB) (rueidis.Client, *miniredis.Miniredis) {
+	s := miniredis.RunT(t)
+	client, err := rueidis.NewClient(rueidis.ClientOption{InitAddress: []string{s.Addr()}, DisableCache: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+	return client, s
+}
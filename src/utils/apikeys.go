@@ -0,0 +1,187 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/rueidis"
+)
+
+// Redis keys for API keys: APIKEY:<id> hash with the key data,
+// APIKEYS set of all key ids, APIKEY_SIG:<signature> used request signatures
+const APIKEY_REDIS = "APIKEY"
+const APIKEYS_REDIS = "APIKEYS"
+const APIKEY_SIG_REDIS = "APIKEY_SIG"
+
+// API key scopes
+const (
+	SCOPE_ALL              = "*"
+	SCOPE_SIGN_ORDER       = "sign-order"
+	SCOPE_ORDERS_SUBMITTED = "orders-submitted"
+	SCOPE_SIGN_PAYMENT     = "sign-payment"
+	SCOPE_ORDER_STATUS     = "order-status"
+)
+
+var ApiKeyScopes = []string{SCOPE_ALL, SCOPE_SIGN_ORDER, SCOPE_ORDERS_SUBMITTED, SCOPE_SIGN_PAYMENT, SCOPE_ORDER_STATUS}
+
+type ApiKey struct {
+	Id      string   `json:"id"`
+	Secret  string   `json:"secret,omitempty"`
+	Label   string   `json:"label"`
+	Scopes  []string `json:"scopes"`
+	Created int64    `json:"created"`
+}
+
+// HasScope checks whether the key is allowed to access the scope
+func (k *ApiKey) HasScope(scope string) bool {
+	return slices.Contains(k.Scopes, SCOPE_ALL) || slices.Contains(k.Scopes, scope)
+}
+
+func apiKeyKey(id string) string {
+	return APIKEY_REDIS + ":" + id
+}
+
+// IssueApiKey creates a new API key with random id and secret
+func (r *RueidisClient) IssueApiKey(label string, scopes []string) (ApiKey, error) {
+	if len(scopes) == 0 {
+		return ApiKey{}, errors.New("at least one scope required")
+	}
+	for _, s := range scopes {
+		if !slices.Contains(ApiKeyScopes, s) {
+			return ApiKey{}, errors.New("unknown scope " + s + ", available: " + strings.Join(ApiKeyScopes, ","))
+		}
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return ApiKey{}, err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return ApiKey{}, err
+	}
+	key := ApiKey{
+		Id:      "d8x_" + id,
+		Secret:  secret,
+		Label:   label,
+		Scopes:  scopes,
+		Created: time.Now().Unix(),
+	}
+	client := *r.Client
+	for _, res := range client.DoMulti(r.Ctx,
+		client.B().Hset().Key(apiKeyKey(key.Id)).FieldValue().
+			FieldValue("Secret", key.Secret).
+			FieldValue("Label", key.Label).
+			FieldValue("Scopes", strings.Join(key.Scopes, ",")).
+			FieldValue("Created", strconv.FormatInt(key.Created, 10)).Build(),
+		client.B().Sadd().Key(APIKEYS_REDIS).Member(key.Id).Build()) {
+		if res.Error() != nil {
+			return ApiKey{}, res.Error()
+		}
+	}
+	return key, nil
+}
+
+// RevokeApiKey deletes the API key
+func (r *RueidisClient) RevokeApiKey(id string) error {
+	client := *r.Client
+	n, err := client.Do(r.Ctx, client.B().Del().Key(apiKeyKey(id)).Build()).AsInt64()
+	if err != nil {
+		return err
+	}
+	client.Do(r.Ctx, client.B().Srem().Key(APIKEYS_REDIS).Member(id).Build())
+	if n == 0 {
+		return errors.New("api key " + id + " not found")
+	}
+	return nil
+}
+
+// GetApiKey returns the API key including its secret
+func (r *RueidisClient) GetApiKey(id string) (ApiKey, error) {
+	client := *r.Client
+	hm, err := client.Do(r.Ctx, client.B().Hgetall().Key(apiKeyKey(id)).Build()).AsStrMap()
+	if err != nil {
+		return ApiKey{}, err
+	}
+	if len(hm) == 0 {
+		return ApiKey{}, errors.New("api key not found")
+	}
+	created, _ := strconv.ParseInt(hm["Created"], 10, 64)
+	return ApiKey{
+		Id:      id,
+		Secret:  hm["Secret"],
+		Label:   hm["Label"],
+		Scopes:  strings.Split(hm["Scopes"], ","),
+		Created: created,
+	}, nil
+}
+
+// ListApiKeys returns all API keys without secrets
+func (r *RueidisClient) ListApiKeys() ([]ApiKey, error) {
+	client := *r.Client
+	ids, err := client.Do(r.Ctx, client.B().Smembers().Key(APIKEYS_REDIS).Build()).AsStrSlice()
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(ids)
+	keys := make([]ApiKey, 0, len(ids))
+	for _, id := range ids {
+		k, err := r.GetApiKey(id)
+		if err != nil {
+			continue
+		}
+		k.Secret = ""
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// ClaimRequestSignature returns false if the request signature has already
+// been used within the replay window
+func (r *RueidisClient) ClaimRequestSignature(signature string, window time.Duration) (bool, error) {
+	client := *r.Client
+	err := client.Do(r.Ctx, client.B().Set().Key(APIKEY_SIG_REDIS+":"+signature).Value("1").Nx().Ex(window).Build()).Error()
+	if rueidis.IsRedisNil(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// SignApiRequest creates the HMAC-SHA256 signature of a request:
+// hex(hmac(secret, timestamp + "\n" + method + "\n" + path + "\n" + query + "\n" + hex(sha256(body))))
+// where query is the raw query in canonical form, see CanonicalQuery
+func SignApiRequest(secret string, timestamp int64, method, path, rawQuery string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	msg := strconv.FormatInt(timestamp, 10) + "\n" + strings.ToUpper(method) + "\n" + path + "\n" +
+		CanonicalQuery(rawQuery) + "\n" + hex.EncodeToString(bodyHash[:])
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(msg))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// CanonicalQuery returns the query parameters sorted by name and URL
+// encoded, an empty string if there are none. Invalid queries are returned
+// unchanged
+func CanonicalQuery(rawQuery string) string {
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return rawQuery
+	}
+	return values.Encode()
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
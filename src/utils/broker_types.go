@@ -3,9 +3,12 @@ package utils
 import (
 	"context"
 	"errors"
-	"fmt"
+	"log/slog"
+	"math/big"
 	"strconv"
+	"time"
 
+	"github.com/D8-X/d8x-broker-server/src/ledger"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/redis/rueidis"
 )
@@ -18,13 +21,24 @@ type ChainConfig struct {
 	AllowedExecutors  []common.Address
 	MultiPayCtrctAddr common.Address
 	ProxyAddr         common.Address
+	// maximal age of payment timestamps
+	PaymentMaxAgeSec int64
+	// maximal amount per executor and token per UTC day
+	PaymentDailyCaps map[common.Address]*big.Int
 }
 
 type ChainConfigFile struct {
 	ChainId          int64            `json:"chainId"`
 	Name             string           `json:"name"`
 	AllowedExecutors []common.Address `json:"allowedExecutors"`
+	// optional, defaults to DEFAULT_PAYMENT_MAX_AGE_SEC
+	PaymentMaxAgeSec int64 `json:"paymentMaxAgeSec"`
+	// optional, token address -> amount in token decimals
+	PaymentDailyCaps map[common.Address]string `json:"paymentDailyCaps"`
 }
+
+const DEFAULT_PAYMENT_MAX_AGE_SEC = 3600
+
 type RpcConfig struct {
 	ChainId int64    `json:"chainId"`
 	Rpc     []string `json:"HTTP"`
@@ -34,30 +48,13 @@ type APIBrokerOrderSignatureReq struct {
 	Order     APIOrderSig `json:"order"`
 	ChainId   int64       `json:"chainId"`
 	Signature string      `json:"signature"`
-}
-
-func (req *APIBrokerOrderSignatureReq) CheckData() error {
-	if req.ChainId == 0 {
-		return fmt.Errorf("chainId not provided")
-	}
-	if req.Order.Deadline <= 0 {
-		return fmt.Errorf("request requires order with iDeadline")
-	}
-	zeroAddr := common.Address{}.Hex()
-	if req.Order.TraderAddr == zeroAddr ||
-		len(req.Order.TraderAddr) != len(zeroAddr) {
-		return fmt.Errorf("order requires order with non-zero traderAddr")
-	}
-	if req.Order.BrokerAddr == zeroAddr ||
-		len(req.Order.BrokerAddr) != len(zeroAddr) {
-		return fmt.Errorf("order requires order with non-zero brokerAddr")
-	}
-
-	if req.Order.PerpetualId == 0 {
-		return fmt.Errorf("request requires order with iPerpetualId")
-	}
-
-	return nil
+	// optional, binds the trader to the referral code on first use
+	ReferralCode string `json:"referralCode,omitempty"`
+	// signature of REFERRAL_MESSAGE_PREFIX + referral code by the trader,
+	// required with ReferralCode
+	ReferralSignature string `json:"referralSignature,omitempty"`
+	// optional, quote token of /fee-quote. The quoted fee is signed
+	FeeQuote string `json:"feeQuote,omitempty"`
 }
 
 //	Required data for the broker-signature: \
@@ -100,8 +97,31 @@ type APIBrokerSignatureRes struct {
 	OrderId         string      `json:"orderId"`
 }
 
+// Fee tiers recorded in the ledger
+const (
+	FEE_TIER_BASE     = "base"
+	FEE_TIER_VIP3     = "vip3-"
+	FEE_TIER_REFERRAL = "ref-"
+)
+
+// FeeInfo describes how the broker fee of an order was determined
+type FeeInfo struct {
+	Tier      string
+	Vip3Level int
+	// referral code of the trader, nil if none
+	Referral *ReferralCode
+	// promotion applied to the fee, nil if none
+	Promotion *Promotion
+}
+
 type APIBrokerFeeRes struct {
 	BrokerFeeTbps uint16
+	// trailing notional volume of the trader, reported if volume tiers are
+	// configured for the chain
+	Volume *float64 `json:",omitempty"`
+	// volume and discount of the next volume tier
+	NextTierVolume       *float64 `json:",omitempty"`
+	NextTierDiscountPerc *float64 `json:",omitempty"`
 }
 
 type RueidisClient struct {
@@ -109,7 +129,10 @@ type RueidisClient struct {
 	Ctx    context.Context
 }
 
-const CHANNEL_NEW_ORDER = "new-order"
+func NewRueidisClient(client rueidis.Client) *RueidisClient {
+	return &RueidisClient{Client: &client, Ctx: context.Background()}
+}
+
 const EXPIRY_HDATA_SEC = 120
 
 // PubOrder stores the order in redis with the order id as key
@@ -131,37 +154,60 @@ func (r *RueidisClient) PubOrder(order APIOrderSig, orderId string, chainId int6
 	}
 	// set expiry of key
 	(*r.Client).Do(r.Ctx, (*r.Client).B().Expire().Key(orderId).Seconds(EXPIRY_HDATA_SEC).Build())
-	return nil
+	return r.SetOrderSigned(orderId, perpetualIdStr+":"+chainIdStr, order.Deadline, time.Now())
 }
 
-// OrderSubmission pushes the order id to the stack,
-// and publishes a message
-func (r *RueidisClient) OrderSubmission(orderIds []string) error {
+// OrderSubmission marks the orders as submitted and appends them to the
+// order stream, trimming entries older than maxAge. Closed orders are
+// skipped. Returns the orders that were published
+func (r *RueidisClient) OrderSubmission(orderIds []string, maxAge time.Duration) ([]SubmittedOrder, error) {
+	orders := make([]SubmittedOrder, 0, len(orderIds))
 	for _, orderId := range orderIds {
 		// get order from redis
 		hm, err := (*r.Client).Do(r.Ctx, (*r.Client).B().Hgetall().Key(orderId).Build()).AsStrMap()
 		if err != nil {
-			return errors.New("Could not get id " + orderId + ": " + err.Error())
+			return orders, errors.New("Could not get id " + orderId + ": " + err.Error())
 		}
 		if len(hm) == 0 {
-			return errors.New("Could not find id " + orderId + " - expired or never submitted")
+			return orders, errors.New("Could not find id " + orderId + " - expired or never submitted")
 		}
-		// add to stack
-		stackName := hm["PerpetualId"] + ":" + hm["ChainId"]
-		(*r.Client).Do(r.Ctx, (*r.Client).B().Lpush().Key(stackName).Element(orderId).Build())
-
-		// publish message
-		msg := stackName
-		err = (*r.Client).Do(r.Ctx, (*r.Client).B().Publish().Channel(CHANNEL_NEW_ORDER).Message(msg).Build()).Error()
+		// orders signed before status tracking have no status
+		_, err = r.SetOrderStatus(orderId, ledger.STATUS_SUBMITTED, time.Now())
+		if errors.Is(err, ErrOrderStatus) {
+			slog.Info("order " + orderId + " submitted after it was closed, not published")
+			continue
+		}
+		if err != nil && !errors.Is(err, ErrOrderNotFound) {
+			return orders, err
+		}
+		topic := hm["PerpetualId"] + ":" + hm["ChainId"]
+		deadline, _ := strconv.ParseUint(hm["Deadline"], 10, 32)
+		flags, _ := strconv.ParseUint(hm["Flags"], 10, 32)
+		execTs, _ := strconv.ParseUint(hm["ExecutionTimestamp"], 10, 32)
+		err = r.AddOrderToStream(topic, WSOrderResp{
+			OrderId:            orderId,
+			TraderAddr:         hm["TraderAddr"],
+			Deadline:           uint32(deadline),
+			Flags:              uint32(flags),
+			FAmount:            hm["FAmount"],
+			FLimitPrice:        hm["FLimitPrice"],
+			FTriggerPrice:      hm["FTriggerPrice"],
+			ExecutionTimestamp: uint32(execTs),
+		}, maxAge)
 		if err != nil {
-			return err
+			return orders, err
 		}
+		chainId, _ := strconv.ParseInt(hm["ChainId"], 10, 64)
+		perpetualId, _ := strconv.ParseInt(hm["PerpetualId"], 10, 64)
+		orders = append(orders, SubmittedOrder{
+			OrderId:       orderId,
+			ChainId:       chainId,
+			PerpetualId:   perpetualId,
+			TraderAddr:    hm["TraderAddr"],
+			FAmount:       hm["FAmount"],
+			FLimitPrice:   hm["FLimitPrice"],
+			FTriggerPrice: hm["FTriggerPrice"],
+		})
 	}
-	return nil
-}
-
-func (r *RueidisClient) Subscribe(channel string, fn func(msg rueidis.PubSubMessage)) error {
-	client := (*r.Client)
-	err := client.Receive(r.Ctx, client.B().Subscribe().Channel(channel).Build(), fn)
-	return err
+	return orders, nil
 }
@@ -2,10 +2,14 @@ package utils
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"log/slog"
+	"math/big"
 	"os"
+	"slices"
+	"sort"
+	"strings"
 
 	d8x_config "github.com/D8-X/d8x-futures-go-sdk/config"
 	"github.com/ethereum/go-ethereum/common"
@@ -16,15 +20,13 @@ func LoadChainConfig(configName string) (map[int64]ChainConfig, error) {
 	// Read the JSON file
 	data, err := os.ReadFile(configName)
 	if err != nil {
-		log.Fatal("Error reading JSON file:", err)
-		return nil, err
+		return nil, errors.New("reading JSON file: " + err.Error())
 	}
 	var configuration []ChainConfigFile
 	// Unmarshal the JSON data into the Configuration struct
 	err = json.Unmarshal(data, &configuration)
 	if err != nil {
-		log.Fatal("Error decoding JSON:", err)
-		return nil, err
+		return nil, errors.New("decoding JSON: " + err.Error())
 	}
 	config := make(map[int64]ChainConfig)
 	for k := range configuration {
@@ -43,12 +45,26 @@ func LoadChainConfig(configName string) (map[int64]ChainConfig, error) {
 		if sdkConf.ProxyAddr == (common.Address{}) {
 			return nil, fmt.Errorf("no proxy defined in sdk chain config for chain %d", configuration[k].ChainId)
 		}
+		caps := make(map[common.Address]*big.Int)
+		for tkn, amount := range configuration[k].PaymentDailyCaps {
+			cap, ok := new(big.Int).SetString(amount, 10)
+			if !ok || cap.Sign() < 0 {
+				return nil, fmt.Errorf("invalid payment cap %s for token %s on chain %d", amount, tkn.Hex(), configuration[k].ChainId)
+			}
+			caps[tkn] = cap
+		}
+		maxAge := configuration[k].PaymentMaxAgeSec
+		if maxAge <= 0 {
+			maxAge = DEFAULT_PAYMENT_MAX_AGE_SEC
+		}
 		config[configuration[k].ChainId] = ChainConfig{
 			ChainId:           configuration[k].ChainId,
 			Name:              configuration[k].Name,
 			AllowedExecutors:  configuration[k].AllowedExecutors,
 			MultiPayCtrctAddr: sdkConf.MultiPayAddr,
 			ProxyAddr:         sdkConf.ProxyAddr,
+			PaymentMaxAgeSec:  maxAge,
+			PaymentDailyCaps:  caps,
 		}
 	}
 	return config, nil
@@ -59,15 +75,82 @@ func LoadRpcConfig(configName string) ([]RpcConfig, error) {
 	// Read the JSON file
 	data, err := os.ReadFile(configName)
 	if err != nil {
-		log.Fatal("Error reading JSON file:", err)
-		return []RpcConfig{}, err
+		return []RpcConfig{}, errors.New("reading JSON file: " + err.Error())
 	}
 	var configuration []RpcConfig
 	// Unmarshal the JSON data into the Configuration struct
 	err = json.Unmarshal(data, &configuration)
 	if err != nil {
-		log.Fatal("Error decoding JSON:", err)
-		return []RpcConfig{}, err
+		return []RpcConfig{}, errors.New("decoding JSON: " + err.Error())
 	}
 	return configuration, nil
 }
+
+// DiffChainConfig lists the differences between two chain configs
+func DiffChainConfig(old, new map[int64]ChainConfig) []string {
+	var diff []string
+	for _, chainId := range sortedKeys(old, new) {
+		o, inOld := old[chainId]
+		n, inNew := new[chainId]
+		switch {
+		case !inOld:
+			diff = append(diff, fmt.Sprintf("chain %d added", chainId))
+		case !inNew:
+			diff = append(diff, fmt.Sprintf("chain %d removed", chainId))
+		default:
+			if o.Name != n.Name {
+				diff = append(diff, fmt.Sprintf("chain %d name %s -> %s", chainId, o.Name, n.Name))
+			}
+			for _, e := range n.AllowedExecutors {
+				if !slices.Contains(o.AllowedExecutors, e) {
+					diff = append(diff, fmt.Sprintf("chain %d executor added %s", chainId, e.Hex()))
+				}
+			}
+			for _, e := range o.AllowedExecutors {
+				if !slices.Contains(n.AllowedExecutors, e) {
+					diff = append(diff, fmt.Sprintf("chain %d executor removed %s", chainId, e.Hex()))
+				}
+			}
+			if o.PaymentMaxAgeSec != n.PaymentMaxAgeSec {
+				diff = append(diff, fmt.Sprintf("chain %d payment max age %d -> %d", chainId, o.PaymentMaxAgeSec, n.PaymentMaxAgeSec))
+			}
+			for tkn, cap := range n.PaymentDailyCaps {
+				if prev, exists := o.PaymentDailyCaps[tkn]; !exists || prev.Cmp(cap) != 0 {
+					diff = append(diff, fmt.Sprintf("chain %d payment cap %s -> %s", chainId, tkn.Hex(), cap.String()))
+				}
+			}
+			for tkn := range o.PaymentDailyCaps {
+				if _, exists := n.PaymentDailyCaps[tkn]; !exists {
+					diff = append(diff, fmt.Sprintf("chain %d payment cap %s removed", chainId, tkn.Hex()))
+				}
+			}
+		}
+	}
+	return diff
+}
+
+// DiffRpcConfig lists the differences between two rpc maps
+func DiffRpcConfig(old, new map[int64][]string) []string {
+	var diff []string
+	for _, chainId := range sortedKeys(old, new) {
+		if !slices.Equal(old[chainId], new[chainId]) {
+			diff = append(diff, fmt.Sprintf("chain %d rpc [%s] -> [%s]", chainId,
+				strings.Join(old[chainId], ","), strings.Join(new[chainId], ",")))
+		}
+	}
+	return diff
+}
+
+func sortedKeys[V any](a, b map[int64]V) []int64 {
+	var keys []int64
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, exists := a[k]; !exists {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestDiffChainConfig(t *testing.T) {
+	e1 := common.HexToAddress("0x3ef256282e578c5D97a7231C3C046F19b1E50855")
+	e2 := common.HexToAddress("0xDa47a0CAc77D50114F2725D06a2Ce887cF9f4D98")
+	old := map[int64]ChainConfig{
+		42161: {ChainId: 42161, Name: "arbitrum", AllowedExecutors: []common.Address{e1}},
+		1101:  {ChainId: 1101, Name: "zkEVM"},
+	}
+	new := map[int64]ChainConfig{
+		42161: {ChainId: 42161, Name: "arbitrum", AllowedExecutors: []common.Address{e2}},
+		8453:  {ChainId: 8453, Name: "base"},
+	}
+	diff := DiffChainConfig(old, new)
+	expected := []string{
+		"chain 1101 removed",
+		"chain 8453 added",
+		"chain 42161 executor added " + e2.Hex(),
+		"chain 42161 executor removed " + e1.Hex(),
+	}
+	if len(diff) != len(expected) {
+		t.Fatalf("unexpected diff %v", diff)
+	}
+	for k := range diff {
+		if diff[k] != expected[k] {
+			t.Errorf("diff[%d] = %s, expected %s", k, diff[k], expected[k])
+		}
+	}
+	if len(DiffChainConfig(old, old)) != 0 {
+		t.Errorf("expected no diff")
+	}
+}
+
+func TestUpdateConfigKeepsOldOnError(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	signer, _ := NewLocalSigner(common.Bytes2Hex(crypto.FromECDSA(key)))
+	chConf := map[int64]ChainConfig{42161: {ChainId: 42161}}
+	rpcConf := []RpcConfig{{ChainId: 42161, Rpc: []string{"http://a"}}}
+	pen, err := NewSignaturePenWithSigner(signer, chConf, rpcConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// new chain without broker key
+	_, err = pen.UpdateConfig(map[int64]ChainConfig{42161: {ChainId: 42161}, 8453: {ChainId: 8453}},
+		[]RpcConfig{{ChainId: 42161, Rpc: []string{"http://a"}}, {ChainId: 8453, Rpc: []string{"http://b"}}})
+	if err == nil {
+		t.Fatalf("expected error for chain without key")
+	}
+	if _, exists := pen.GetChainConfig(8453); exists {
+		t.Errorf("invalid config applied")
+	}
+	diff, err := pen.UpdateConfig(chConf, []RpcConfig{{ChainId: 42161, Rpc: []string{"http://c"}}})
+	if err != nil || len(diff) != 1 {
+		t.Fatalf("unexpected update result %v %v", diff, err)
+	}
+	if urls := pen.GetRpcUrls(42161); len(urls) != 1 || urls[0] != "http://c" {
+		t.Errorf("rpc config not swapped: %v", urls)
+	}
+}
+
+func TestWatchConfigFiles(t *testing.T) {
+	dir := t.TempDir()
+	f := filepath.Join(dir, "rpc.json")
+	os.WriteFile(f, []byte("[]"), 0644)
+	reloaded := make(chan struct{}, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := WatchConfigFiles(ctx, []string{f}, func() { reloaded <- struct{}{} })
+	if err != nil {
+		t.Fatal(err)
+	}
+	// other files in the directory are ignored
+	os.WriteFile(filepath.Join(dir, "other.json"), []byte("[]"), 0644)
+	// atomic replace
+	tmp := filepath.Join(dir, "rpc.json.tmp")
+	os.WriteFile(tmp, []byte(`[{"chainId":1,"HTTP":["x"]}]`), 0644)
+	os.Rename(tmp, f)
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no reload after file change")
+	}
+	select {
+	case <-reloaded:
+		t.Errorf("file events not debounced")
+	case <-time.After(2 * RELOAD_DEBOUNCE):
+	}
+}
+
+func TestWatchConfigMap(t *testing.T) {
+	// layout of a k8s config map volume: rpc.json -> ..data/rpc.json,
+	// ..data -> ..<version>
+	dir := t.TempDir()
+	writeVersion := func(version string) {
+		os.Mkdir(filepath.Join(dir, version), 0755)
+		os.WriteFile(filepath.Join(dir, version, "rpc.json"), []byte("[]"), 0644)
+		os.Symlink(version, filepath.Join(dir, "..data_tmp"))
+		os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data"))
+	}
+	writeVersion("..v1")
+	f := filepath.Join(dir, "rpc.json")
+	os.Symlink(filepath.Join("..data", "rpc.json"), f)
+	// the path is cleaned, the slice of the caller is not modified
+	files := []string{filepath.Join(dir, "sub", "..", "rpc.json")}
+	name := files[0]
+	reloaded := make(chan struct{}, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := WatchConfigFiles(ctx, files, func() { reloaded <- struct{}{} }); err != nil {
+		t.Fatal(err)
+	}
+	if files[0] != name {
+		t.Errorf("files of the caller modified: %v", files)
+	}
+	writeVersion("..v2")
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no reload after config map update")
+	}
+}
@@ -0,0 +1,279 @@
+package utils
+
+import (
+	"errors"
+	"math/big"
+	"strconv"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/redis/rueidis"
+)
+
+// Redis keys of the live executor whitelist:
+// EXECUTORS:<chainId> is the set of allowed executors,
+// EXECUTORS_SEEDED:<chainId> marks the set as initialized from the config file,
+// EXECUTOR_SUSP:<chainId>:<addr> stores the suspension end (unix ts) with expiry
+const EXECUTORS_REDIS = "EXECUTORS"
+const EXECUTORS_SEEDED_REDIS = "EXECUTORS_SEEDED"
+const EXECUTOR_SUSP_REDIS = "EXECUTOR_SUSP"
+
+// PAYMENT_ID:<chainId>:<executor>:<id> marks payment ids that have been signed
+const PAYMENT_ID_REDIS = "PAYMENT_ID"
+
+// PAYMENT_SPENT:<chainId>:<executor>:<token>:<yyyymmdd> is a hash of the
+// amounts per payment id the executor was paid in the token on the UTC day
+const PAYMENT_SPENT_REDIS = "PAYMENT_SPENT"
+
+type ExecutorStatus struct {
+	Address        common.Address `json:"address"`
+	SuspendedUntil int64          `json:"suspendedUntil,omitempty"`
+}
+
+func executorsKey(chainId int64) string {
+	return EXECUTORS_REDIS + ":" + strconv.FormatInt(chainId, 10)
+}
+
+func executorSuspKey(chainId int64, executor common.Address) string {
+	return EXECUTOR_SUSP_REDIS + ":" + strconv.FormatInt(chainId, 10) + ":" + executor.Hex()
+}
+
+// SeedExecutors initializes the executor set of the chain with the executors
+// from the config file, unless the set has already been seeded
+func (r *RueidisClient) SeedExecutors(chainId int64, executors []common.Address) (bool, error) {
+	client := *r.Client
+	seedKey := EXECUTORS_SEEDED_REDIS + ":" + strconv.FormatInt(chainId, 10)
+	ok, err := client.Do(r.Ctx, client.B().Setnx().Key(seedKey).Value(strconv.FormatInt(time.Now().Unix(), 10)).Build()).AsBool()
+	if err != nil || !ok {
+		return false, err
+	}
+	if len(executors) == 0 {
+		return true, nil
+	}
+	return true, r.AddExecutors(chainId, executors)
+}
+
+// AddExecutors adds executors to the whitelist of the chain
+func (r *RueidisClient) AddExecutors(chainId int64, executors []common.Address) error {
+	if len(executors) == 0 {
+		return nil
+	}
+	client := *r.Client
+	members := make([]string, len(executors))
+	for k, e := range executors {
+		members[k] = e.Hex()
+	}
+	return client.Do(r.Ctx, client.B().Sadd().Key(executorsKey(chainId)).Member(members...).Build()).Error()
+}
+
+// RemoveExecutors removes executors from the whitelist of the chain
+func (r *RueidisClient) RemoveExecutors(chainId int64, executors []common.Address) error {
+	if len(executors) == 0 {
+		return nil
+	}
+	client := *r.Client
+	members := make([]string, len(executors))
+	cmds := make(rueidis.Commands, 0, len(executors)+1)
+	for k, e := range executors {
+		members[k] = e.Hex()
+		cmds = append(cmds, client.B().Del().Key(executorSuspKey(chainId, e)).Build())
+	}
+	cmds = append(cmds, client.B().Srem().Key(executorsKey(chainId)).Member(members...).Build())
+	for _, res := range client.DoMulti(r.Ctx, cmds...) {
+		if res.Error() != nil {
+			return res.Error()
+		}
+	}
+	return nil
+}
+
+// SuspendExecutor suspends a whitelisted executor for the given duration
+func (r *RueidisClient) SuspendExecutor(chainId int64, executor common.Address, duration time.Duration) error {
+	if duration < time.Second {
+		return errors.New("suspension must be at least 1 second")
+	}
+	client := *r.Client
+	isMember, err := client.Do(r.Ctx, client.B().Sismember().Key(executorsKey(chainId)).Member(executor.Hex()).Build()).AsBool()
+	if err != nil {
+		return err
+	}
+	if !isMember {
+		return errors.New("executor not whitelisted")
+	}
+	until := time.Now().Add(duration).Unix()
+	return client.Do(r.Ctx, client.B().Set().Key(executorSuspKey(chainId, executor)).
+		Value(strconv.FormatInt(until, 10)).Ex(duration).Build()).Error()
+}
+
+// ResumeExecutor lifts the suspension of an executor
+func (r *RueidisClient) ResumeExecutor(chainId int64, executor common.Address) error {
+	client := *r.Client
+	return client.Do(r.Ctx, client.B().Del().Key(executorSuspKey(chainId, executor)).Build()).Error()
+}
+
+// GetExecutors returns all whitelisted executors of the chain including the
+// suspension status
+func (r *RueidisClient) GetExecutors(chainId int64) ([]ExecutorStatus, error) {
+	client := *r.Client
+	members, err := client.Do(r.Ctx, client.B().Smembers().Key(executorsKey(chainId)).Build()).AsStrSlice()
+	if err != nil {
+		return nil, err
+	}
+	executors := make([]ExecutorStatus, 0, len(members))
+	if len(members) == 0 {
+		return executors, nil
+	}
+	cmds := make(rueidis.Commands, len(members))
+	for k, m := range members {
+		cmds[k] = client.B().Get().Key(executorSuspKey(chainId, common.HexToAddress(m))).Build()
+	}
+	for k, res := range client.DoMulti(r.Ctx, cmds...) {
+		e := ExecutorStatus{Address: common.HexToAddress(members[k])}
+		if until, err := res.AsInt64(); err == nil {
+			e.SuspendedUntil = until
+		} else if !rueidis.IsRedisNil(err) {
+			return nil, err
+		}
+		executors = append(executors, e)
+	}
+	return executors, nil
+}
+
+// GetActiveExecutors returns the whitelisted executors of the chain that are
+// not suspended
+func (r *RueidisClient) GetActiveExecutors(chainId int64) ([]common.Address, error) {
+	executors, err := r.GetExecutors(chainId)
+	if err != nil {
+		return nil, err
+	}
+	active := make([]common.Address, 0, len(executors))
+	for _, e := range executors {
+		if e.SuspendedUntil == 0 {
+			active = append(active, e.Address)
+		}
+	}
+	return active, nil
+}
+
+// IsExecutorAllowed checks whether the executor is whitelisted on the chain
+// and not suspended
+func (r *RueidisClient) IsExecutorAllowed(chainId int64, executor common.Address) (bool, error) {
+	client := *r.Client
+	res := client.DoMulti(r.Ctx,
+		client.B().Sismember().Key(executorsKey(chainId)).Member(executor.Hex()).Build(),
+		client.B().Exists().Key(executorSuspKey(chainId, executor)).Build())
+	isMember, err := res[0].AsBool()
+	if err != nil {
+		return false, err
+	}
+	suspended, err := res[1].AsBool()
+	if err != nil {
+		return false, err
+	}
+	return isMember && !suspended, nil
+}
+
+// ClaimPayment reserves the payment id of the executor. Returns false if
+// the id was already used within ttl. A ttl of 0 claims the id permanently
+func (r *RueidisClient) ClaimPayment(chainId int64, executor common.Address, id uint32, ttl time.Duration) (bool, error) {
+	client := *r.Client
+	cmd := client.B().Set().Key(paymentKey(chainId, executor, id)).Value("1").Nx()
+	var err error
+	if ttl > 0 {
+		err = client.Do(r.Ctx, cmd.Ex(ttl).Build()).Error()
+	} else {
+		err = client.Do(r.Ctx, cmd.Build()).Error()
+	}
+	if rueidis.IsRedisNil(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ReleasePayment releases a claimed payment id if no signature was issued
+func (r *RueidisClient) ReleasePayment(chainId int64, executor common.Address, id uint32) error {
+	client := *r.Client
+	return client.Do(r.Ctx, client.B().Del().Key(paymentKey(chainId, executor, id)).Build()).Error()
+}
+
+func paymentKey(chainId int64, executor common.Address, id uint32) string {
+	return PAYMENT_ID_REDIS + ":" + strconv.FormatInt(chainId, 10) + ":" + executor.Hex() + ":" + strconv.FormatUint(uint64(id), 10)
+}
+
+// paymentCapScript adds the amount of a payment id to the daily spending
+// KEYS[1] unless the total exceeds the cap. Amounts are decimal strings
+// of arbitrary size. ARGV: id, amount, cap, expiry in unix ms.
+// Returns 1 if reserved, 0 if the cap would be exceeded
+var paymentCapScript = rueidis.NewLuaScript(`
+local function add(a, b)
+	local digits = {}
+	local carry = 0
+	local i, j = #a, #b
+	while i > 0 or j > 0 or carry > 0 do
+		local s = carry
+		if i > 0 then
+			s = s + tonumber(string.sub(a, i, i))
+			i = i - 1
+		end
+		if j > 0 then
+			s = s + tonumber(string.sub(b, j, j))
+			j = j - 1
+		end
+		table.insert(digits, 1, tostring(s % 10))
+		carry = math.floor(s / 10)
+	end
+	return table.concat(digits)
+end
+local total = ARGV[2]
+local spent = redis.call('HGETALL', KEYS[1])
+for k = 1, #spent, 2 do
+	if spent[k] ~= ARGV[1] then
+		total = add(total, spent[k + 1])
+	end
+end
+if #total > #ARGV[3] or (#total == #ARGV[3] and total > ARGV[3]) then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+redis.call('PEXPIREAT', KEYS[1], ARGV[4])
+return 1
+`)
+
+// ReservePaymentAmount adds the amount of the payment id to the spending of
+// the executor in the token on the UTC day of now. Returns false without
+// reserving if the spending would exceed the cap. The check and the
+// increment are atomic, so concurrent requests cannot exceed the cap
+func (r *RueidisClient) ReservePaymentAmount(chainId int64, executor, token common.Address, id uint32, amount, cap *big.Int, now time.Time) (bool, error) {
+	if amount.Sign() < 0 || cap.Sign() < 0 {
+		return false, errors.New("negative payment amount or cap")
+	}
+	y, m, d := now.UTC().Date()
+	// keep the spending a day longer for payments signed around midnight
+	expiry := time.Date(y, m, d+2, 0, 0, 0, 0, time.UTC)
+	client := *r.Client
+	res, err := paymentCapScript.Exec(r.Ctx, client,
+		[]string{paymentSpentKey(chainId, executor, token, now)},
+		[]string{
+			strconv.FormatUint(uint64(id), 10),
+			amount.String(),
+			cap.String(),
+			strconv.FormatInt(expiry.UnixMilli(), 10),
+		}).AsInt64()
+	if err != nil {
+		return false, err
+	}
+	return res == 1, nil
+}
+
+// ReleasePaymentAmount removes the amount reserved for the payment id if no
+// signature was issued
+func (r *RueidisClient) ReleasePaymentAmount(chainId int64, executor, token common.Address, id uint32, now time.Time) error {
+	client := *r.Client
+	key := paymentSpentKey(chainId, executor, token, now)
+	return client.Do(r.Ctx, client.B().Hdel().Key(key).Field(strconv.FormatUint(uint64(id), 10)).Build()).Error()
+}
+
+func paymentSpentKey(chainId int64, executor, token common.Address, now time.Time) string {
+	return PAYMENT_SPENT_REDIS + ":" + strconv.FormatInt(chainId, 10) + ":" + executor.Hex() + ":" +
+		token.Hex() + ":" + now.UTC().Format("20060102")
+}
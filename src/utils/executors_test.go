@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/D8-X/d8x-broker-server/src/testutil"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func newTestRedis(t *testing.T) (*RueidisClient, *miniredis.Miniredis) {
+	client, s := testutil.NewRedis(t)
+	return NewRueidisClient(client), s
+}
+
+func TestExecutorWhitelist(t *testing.T) {
+	r, s := newTestRedis(t)
+	e1 := common.HexToAddress("0x3ef256282e578c5D97a7231C3C046F19b1E50855")
+	e2 := common.HexToAddress("0xDa47a0CAc77D50114F2725D06a2Ce887cF9f4D98")
+
+	seeded, err := r.SeedExecutors(42161, []common.Address{e1})
+	if err != nil || !seeded {
+		t.Fatalf("seeding failed: %v", err)
+	}
+	// executors removed via admin stay removed after restart
+	r.RemoveExecutors(42161, []common.Address{e1})
+	seeded, _ = r.SeedExecutors(42161, []common.Address{e1})
+	if seeded {
+		t.Errorf("executors seeded twice")
+	}
+	if ok, _ := r.IsExecutorAllowed(42161, e1); ok {
+		t.Errorf("removed executor allowed")
+	}
+
+	r.AddExecutors(42161, []common.Address{e1, e2})
+	if ok, _ := r.IsExecutorAllowed(42161, e2); !ok {
+		t.Errorf("added executor not allowed")
+	}
+	if ok, _ := r.IsExecutorAllowed(1101, e2); ok {
+		t.Errorf("executor allowed on other chain")
+	}
+	if err := r.SuspendExecutor(1101, e2, time.Hour); err == nil {
+		t.Errorf("suspending executor that is not whitelisted")
+	}
+	if err := r.SuspendExecutor(42161, e2, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := r.IsExecutorAllowed(42161, e2); ok {
+		t.Errorf("suspended executor allowed")
+	}
+	executors, err := r.GetExecutors(42161)
+	if err != nil || len(executors) != 2 {
+		t.Fatalf("unexpected executors %v: %v", executors, err)
+	}
+	active, _ := r.GetActiveExecutors(42161)
+	if len(active) != 1 || active[0] != e1 {
+		t.Errorf("unexpected active executors %v", active)
+	}
+	// suspension expires
+	s.FastForward(2 * time.Minute)
+	if ok, _ := r.IsExecutorAllowed(42161, e2); !ok {
+		t.Errorf("executor still suspended")
+	}
+	r.SuspendExecutor(42161, e2, time.Minute)
+	r.ResumeExecutor(42161, e2)
+	if ok, _ := r.IsExecutorAllowed(42161, e2); !ok {
+		t.Errorf("resumed executor not allowed")
+	}
+}
+
+func TestReservePaymentAmount(t *testing.T) {
+	r, _ := newTestRedis(t)
+	executor := common.HexToAddress("0xDa47a0CAc77D50114F2725D06a2Ce887cF9f4D98")
+	token := common.HexToAddress("0x2d10075E54356E16Ebd5C6BB5194290709B69C1e")
+	// amounts beyond float precision
+	e18, _ := new(big.Int).SetString("1000000000000000000", 10)
+	cap := new(big.Int).Mul(e18, big.NewInt(10))
+	now := time.Now()
+	reserve := func(id uint32, amount *big.Int, ts time.Time) bool {
+		ok, err := r.ReservePaymentAmount(42161, executor, token, id, amount, cap, ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+	nine := new(big.Int).Sub(new(big.Int).Mul(e18, big.NewInt(9)), big.NewInt(1))
+	if !reserve(1, nine, now) {
+		t.Fatalf("payment within cap rejected")
+	}
+	if reserve(2, new(big.Int).Add(e18, big.NewInt(2)), now) {
+		t.Errorf("payment exceeding cap by 1 accepted")
+	}
+	if !reserve(2, new(big.Int).Add(e18, big.NewInt(1)), now) {
+		t.Errorf("payment up to cap rejected")
+	}
+	if reserve(3, big.NewInt(1), now) {
+		t.Errorf("payment beyond exhausted cap accepted")
+	}
+	// released amounts are available again
+	if err := r.ReleasePaymentAmount(42161, executor, token, 2, now); err != nil {
+		t.Fatal(err)
+	}
+	if !reserve(3, big.NewInt(1), now) {
+		t.Errorf("payment rejected after release")
+	}
+	// caps are per UTC day
+	if !reserve(4, cap, now.Add(24*time.Hour)) {
+		t.Errorf("payment rejected on next day")
+	}
+}
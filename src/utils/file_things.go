@@ -3,11 +3,16 @@ package utils
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 
 	"log/slog"
 )
 
+const KEYFILE_NAME = "keyfile.txt"
+const KEYFILE_CHAIN_FMT = "keyfile_%d.txt"
+
 func LoadFromFile(filePath string, key []byte) string {
 	data, err := os.ReadFile(filePath)
 	if err != nil {
@@ -33,3 +38,58 @@ func writeToFile(filePath string, txt string, key []byte) {
 		slog.Error("Error writing file:" + err.Error())
 	}
 }
+
+// LoadKeysFromDir loads the broker private key for each chain from the key
+// directory. A chain specific file keyfile_<chainId>.txt has precedence over
+// the default keyfile.txt. Plain keys (0x-prefixed) are encrypted on first
+// load. An error is returned if there is no key for one of the chains
+func LoadKeysFromDir(dir string, chainIds []int64, key []byte) (map[int64]string, error) {
+	keys := make(map[int64]string)
+	var defaultKey string
+	defaultPath := filepath.Join(dir, KEYFILE_NAME)
+	if _, err := os.Stat(defaultPath); err == nil {
+		defaultKey = LoadFromFile(defaultPath, key)
+	}
+	for _, chainId := range chainIds {
+		chainPath := filepath.Join(dir, fmt.Sprintf(KEYFILE_CHAIN_FMT, chainId))
+		if _, err := os.Stat(chainPath); err == nil {
+			pk := LoadFromFile(chainPath, key)
+			if pk == "" {
+				return nil, fmt.Errorf("could not load key file %s", chainPath)
+			}
+			keys[chainId] = pk
+			slog.Info("using chain specific broker key", "chainId", chainId)
+			continue
+		}
+		if defaultKey == "" {
+			return nil, fmt.Errorf("no broker key for chain %d: provide %s or %s", chainId,
+				fmt.Sprintf(KEYFILE_CHAIN_FMT, chainId), KEYFILE_NAME)
+		}
+		keys[chainId] = defaultKey
+	}
+	return keys, nil
+}
+
+// ParseChainSpec parses a value of the form "<chainId>:<value>;<chainId>:<value>".
+// A value without chain prefix applies to all chains and is returned as default
+func ParseChainSpec(spec string) (map[int64]string, string, error) {
+	perChain := make(map[int64]string)
+	if spec == "" {
+		return perChain, "", nil
+	}
+	var def string
+	for _, part := range strings.Split(strings.TrimSuffix(spec, ";"), ";") {
+		part = strings.TrimSpace(part)
+		chainStr, value, found := strings.Cut(part, ":")
+		chainId, err := strconv.ParseInt(chainStr, 10, 64)
+		if !found || err != nil {
+			if def != "" {
+				return nil, "", fmt.Errorf("multiple default values in %s", spec)
+			}
+			def = part
+			continue
+		}
+		perChain[chainId] = value
+	}
+	return perChain, def, nil
+}
@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestLoadKeysFromDir(t *testing.T) {
+	dir := t.TempDir()
+	encKey := make([]byte, 32)
+	rand.Read(encKey)
+	k1, _ := crypto.GenerateKey()
+	k2, _ := crypto.GenerateKey()
+	pk1 := common.Bytes2Hex(crypto.FromECDSA(k1))
+	pk2 := common.Bytes2Hex(crypto.FromECDSA(k2))
+	os.WriteFile(filepath.Join(dir, KEYFILE_NAME), []byte("0x"+pk1), 0600)
+	os.WriteFile(filepath.Join(dir, "keyfile_8453.txt"), []byte("0x"+pk2), 0600)
+
+	keys, err := LoadKeysFromDir(dir, []int64{42161, 8453}, encKey)
+	if err != nil {
+		t.Fatalf("LoadKeysFromDir: %v", err)
+	}
+	if keys[42161] != pk1 || keys[8453] != pk2 {
+		t.Errorf("wrong keys loaded")
+	}
+	// plain keys are encrypted on first load
+	data, _ := os.ReadFile(filepath.Join(dir, "keyfile_8453.txt"))
+	if strings.HasPrefix(string(data), "0x") {
+		t.Errorf("key file not encrypted")
+	}
+	keys, err = LoadKeysFromDir(dir, []int64{42161, 8453}, encKey)
+	if err != nil || keys[8453] != pk2 {
+		t.Errorf("reloading encrypted key failed: %v", err)
+	}
+
+	os.Remove(filepath.Join(dir, KEYFILE_NAME))
+	_, err = LoadKeysFromDir(dir, []int64{42161, 8453}, encKey)
+	if err == nil {
+		t.Errorf("expected error for chain without key")
+	}
+}
+
+func TestParseChainSpec(t *testing.T) {
+	perChain, def, err := ParseChainSpec("42161:http://signer-arb:8555;8453:http://signer-base:8555")
+	if err != nil || def != "" || perChain[42161] != "http://signer-arb:8555" || perChain[8453] != "http://signer-base:8555" {
+		t.Errorf("unexpected result %v %s %v", perChain, def, err)
+	}
+	perChain, def, err = ParseChainSpec("http://signer:8555")
+	if err != nil || def != "http://signer:8555" || len(perChain) != 0 {
+		t.Errorf("unexpected result %v %s %v", perChain, def, err)
+	}
+	perChain, def, err = ParseChainSpec("0x3ef256282e578c5D97a7231C3C046F19b1E50855;1101:0x5A09217F6D36E73eE5495b430e889f8c57876Ef3")
+	if err != nil || def != "0x3ef256282e578c5D97a7231C3C046F19b1E50855" || len(perChain) != 1 {
+		t.Errorf("unexpected result %v %s %v", perChain, def, err)
+	}
+}
+
+func TestBrokerAddressPerChain(t *testing.T) {
+	k1, _ := crypto.GenerateKey()
+	k2, _ := crypto.GenerateKey()
+	s1, _ := NewLocalSigner(common.Bytes2Hex(crypto.FromECDSA(k1)))
+	s2, _ := NewLocalSigner(common.Bytes2Hex(crypto.FromECDSA(k2)))
+	chConf := map[int64]ChainConfig{42161: {ChainId: 42161}, 8453: {ChainId: 8453}}
+	rpcConf := []RpcConfig{{ChainId: 42161, Rpc: []string{"a"}}, {ChainId: 8453, Rpc: []string{"b"}}}
+	_, err := NewSignaturePenWithSigners(map[int64]Signer{42161: s1}, chConf, rpcConf)
+	if err == nil {
+		t.Fatalf("expected error for chain without signer")
+	}
+	pen, err := NewSignaturePenWithSigners(map[int64]Signer{42161: s1, 8453: s2}, chConf, rpcConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := pen.BrokerAddress(8453)
+	if err != nil || addr != s2.Address() {
+		t.Errorf("wrong broker address for chain 8453")
+	}
+	_, err = pen.BrokerAddress(-1)
+	if err == nil {
+		t.Errorf("expected error for ambiguous broker address")
+	}
+}
@@ -0,0 +1,236 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/D8-X/d8x-broker-server/src/ledger"
+	"github.com/redis/rueidis"
+)
+
+// The status of a signed order is kept in the hash ORDER_STATUS:<orderId>
+// until ORDER_STATUS_EXPIRY after the deadline of open orders, at most
+// ORDER_STATUS_MAX_EXPIRY, and for ORDER_STATUS_EXPIRY after the last
+// change of closed orders. Submitted orders are indexed by deadline in the
+// sorted set ORDER_DEADLINES until they are closed (executed, cancelled or
+// expired)
+const (
+	ORDER_STATUS_REDIS      = "ORDER_STATUS:"
+	ORDER_DEADLINES_REDIS   = "ORDER_DEADLINES"
+	ORDER_STATUS_EXPIRY     = 24 * time.Hour
+	ORDER_STATUS_MAX_EXPIRY = DEFAULT_ORDER_MAX_DEADLINE + ORDER_STATUS_EXPIRY
+)
+
+var (
+	ErrOrderNotFound = errors.New("order not found")
+	// the order cannot change to the requested status
+	ErrOrderStatus = errors.New("invalid order status")
+)
+
+// statusFrom lists the statuses an order can change from
+var statusFrom = map[string][]string{
+	ledger.STATUS_SIGNED:    {ledger.STATUS_SIGNED},
+	ledger.STATUS_SUBMITTED: {ledger.STATUS_SIGNED, ledger.STATUS_SUBMITTED},
+	ledger.STATUS_EXECUTED:  {ledger.STATUS_SIGNED, ledger.STATUS_SUBMITTED},
+	ledger.STATUS_CANCELLED: {ledger.STATUS_SIGNED, ledger.STATUS_SUBMITTED},
+	ledger.STATUS_EXPIRED:   {ledger.STATUS_SIGNED, ledger.STATUS_SUBMITTED},
+}
+
+// OrderStatus is the status of a signed order
+type OrderStatus struct {
+	OrderId string `json:"orderId"`
+	Status  string `json:"status"`
+	// perpetualId:chainId
+	Topic     string `json:"topic"`
+	Deadline  uint32 `json:"iDeadline"`
+	UpdatedAt int64  `json:"updatedAt"`
+}
+
+// Closed reports whether the order was executed, cancelled or expired
+func (s OrderStatus) Closed() bool {
+	return s.Status != ledger.STATUS_SIGNED && s.Status != ledger.STATUS_SUBMITTED
+}
+
+// orderStatusScript changes the status of the order KEYS[1] if the current
+// status is one of ARGV[8:]. ARGV: status, now, expiry in ms, maximal
+// expiry in ms of open orders (0 for closed orders, which expire after
+// expiry), 1 to create the status if the order has none, topic and deadline
+// of new orders. Returns {1, previous status, deadline} if changed,
+// {0, current status} otherwise
+var orderStatusScript = rueidis.NewLuaScript(`
+local cur = redis.call('HGET', KEYS[1], 'Status')
+if cur then
+	local allowed = false
+	for i = 8, #ARGV do
+		if ARGV[i] == cur then
+			allowed = true
+		end
+	end
+	if not allowed then
+		return {0, cur}
+	end
+elseif ARGV[5] ~= '1' then
+	return {0, ''}
+end
+redis.call('HSET', KEYS[1], 'Status', ARGV[1], 'UpdatedAt', ARGV[2])
+if not cur then
+	redis.call('HSET', KEYS[1], 'Topic', ARGV[6], 'Deadline', ARGV[7])
+end
+local deadline = redis.call('HGET', KEYS[1], 'Deadline') or '0'
+local expiry = tonumber(ARGV[3])
+if tonumber(ARGV[4]) > 0 then
+	local left = (tonumber(deadline) - tonumber(ARGV[2])) * 1000
+	expiry = math.min(math.max(left, 0) + expiry, tonumber(ARGV[4]))
+end
+redis.call('PEXPIRE', KEYS[1], expiry)
+return {1, cur or '', deadline}
+`)
+
+// setOrderStatus changes the status of the order if the transition is
+// allowed. New orders are created with the topic and deadline if create is
+// set. Returns the previous status and the deadline of the order
+func (r *RueidisClient) setOrderStatus(orderId, status string, now time.Time, create bool, topic string, deadline uint32) (string, uint32, error) {
+	from, known := statusFrom[status]
+	if !known {
+		return "", 0, fmt.Errorf("%w %s", ErrOrderStatus, status)
+	}
+	return r.changeOrderStatus(orderId, status, from, now, create, topic, deadline)
+}
+
+// changeOrderStatus changes the status of the order if the current status
+// is one of from, see setOrderStatus
+func (r *RueidisClient) changeOrderStatus(orderId, status string, from []string, now time.Time, create bool, topic string, deadline uint32) (string, uint32, error) {
+	createArg := "0"
+	if create {
+		createArg = "1"
+	}
+	var maxExpiry time.Duration
+	if status == ledger.STATUS_SIGNED || status == ledger.STATUS_SUBMITTED {
+		maxExpiry = ORDER_STATUS_MAX_EXPIRY
+	}
+	args := append([]string{
+		status,
+		strconv.FormatInt(now.Unix(), 10),
+		strconv.FormatInt(ORDER_STATUS_EXPIRY.Milliseconds(), 10),
+		strconv.FormatInt(maxExpiry.Milliseconds(), 10),
+		createArg,
+		topic,
+		strconv.FormatUint(uint64(deadline), 10),
+	}, from...)
+	res, err := orderStatusScript.Exec(r.Ctx, *r.Client, []string{ORDER_STATUS_REDIS + orderId}, args).ToArray()
+	if err != nil {
+		return "", 0, err
+	}
+	if len(res) < 2 {
+		return "", 0, errors.New("unexpected order status result")
+	}
+	changed, _ := res[0].AsInt64()
+	cur, _ := res[1].ToString()
+	if changed == 1 && len(res) == 3 {
+		d, _ := res[2].ToString()
+		deadline, _ := strconv.ParseUint(d, 10, 32)
+		return cur, uint32(deadline), nil
+	}
+	if cur == "" {
+		return "", 0, ErrOrderNotFound
+	}
+	return "", 0, fmt.Errorf("%w: order %s is %s", ErrOrderStatus, orderId, cur)
+}
+
+// SetOrderSigned creates the status of a signed order
+func (r *RueidisClient) SetOrderSigned(orderId, topic string, deadline uint32, now time.Time) error {
+	_, _, err := r.setOrderStatus(orderId, ledger.STATUS_SIGNED, now, true, topic, deadline)
+	return err
+}
+
+// SetOrderStatus changes the status of the order and returns the new
+// status. Submitted orders are indexed by deadline until they are closed.
+// Returns ErrOrderNotFound for unknown orders and ErrOrderStatus if the
+// order cannot change to the status, for example because it is closed
+func (r *RueidisClient) SetOrderStatus(orderId, status string, now time.Time) (OrderStatus, error) {
+	prev, deadline, err := r.setOrderStatus(orderId, status, now, false, "", 0)
+	if err != nil {
+		return OrderStatus{}, err
+	}
+	client := *r.Client
+	indexed := status == ledger.STATUS_SUBMITTED && prev != status && deadline > 0
+	if indexed {
+		err = client.Do(r.Ctx, client.B().Zadd().Key(ORDER_DEADLINES_REDIS).ScoreMember().
+			ScoreMember(float64(deadline), orderId).Build()).Error()
+		if err != nil {
+			return OrderStatus{}, err
+		}
+	}
+	// read after indexing: an order closed meanwhile is removed here or by
+	// CloseOrder
+	st, err := r.GetOrderStatus(orderId)
+	if err != nil {
+		return OrderStatus{}, err
+	}
+	if st.Closed() {
+		err = r.RemoveOrderDeadline(orderId)
+	}
+	return st, err
+}
+
+// CloseOrder sets the final status of the order and appends the status
+// change to the order stream, trimming entries older than maxAge. Only
+// status changes of submitted orders are published, executors did not
+// receive other orders. If the status cannot be published, the previous
+// status is restored so that the order can be closed again
+func (r *RueidisClient) CloseOrder(orderId, status string, now time.Time, maxAge time.Duration) (OrderStatus, error) {
+	if status == ledger.STATUS_SIGNED || status == ledger.STATUS_SUBMITTED {
+		return OrderStatus{}, fmt.Errorf("%w %s", ErrOrderStatus, status)
+	}
+	prev, _, err := r.setOrderStatus(orderId, status, now, false, "", 0)
+	if err != nil {
+		return OrderStatus{}, err
+	}
+	st, err := r.GetOrderStatus(orderId)
+	if err == nil && prev == ledger.STATUS_SUBMITTED {
+		err = r.AddStatusToStream(st, maxAge)
+	}
+	if err != nil {
+		_, _, rerr := r.changeOrderStatus(orderId, prev, []string{status}, now, false, "", 0)
+		return OrderStatus{}, errors.Join(err, rerr)
+	}
+	return st, r.RemoveOrderDeadline(orderId)
+}
+
+// GetOrderStatus returns the status of the order, ErrOrderNotFound if the
+// order is unknown or its status expired
+func (r *RueidisClient) GetOrderStatus(orderId string) (OrderStatus, error) {
+	client := *r.Client
+	hm, err := client.Do(r.Ctx, client.B().Hgetall().Key(ORDER_STATUS_REDIS+orderId).Build()).AsStrMap()
+	if err != nil {
+		return OrderStatus{}, err
+	}
+	if len(hm) == 0 {
+		return OrderStatus{}, ErrOrderNotFound
+	}
+	deadline, _ := strconv.ParseUint(hm["Deadline"], 10, 32)
+	updatedAt, _ := strconv.ParseInt(hm["UpdatedAt"], 10, 64)
+	return OrderStatus{
+		OrderId:   orderId,
+		Status:    hm["Status"],
+		Topic:     hm["Topic"],
+		Deadline:  uint32(deadline),
+		UpdatedAt: updatedAt,
+	}, nil
+}
+
+// ExpiredOrders returns up to limit submitted orders with a deadline before
+// now
+func (r *RueidisClient) ExpiredOrders(now time.Time, limit int64) ([]string, error) {
+	client := *r.Client
+	return client.Do(r.Ctx, client.B().Zrangebyscore().Key(ORDER_DEADLINES_REDIS).
+		Min("-inf").Max("("+strconv.FormatInt(now.Unix(), 10)).Limit(0, limit).Build()).AsStrSlice()
+}
+
+// RemoveOrderDeadline removes the order from the deadline index
+func (r *RueidisClient) RemoveOrderDeadline(orderId string) error {
+	client := *r.Client
+	return client.Do(r.Ctx, client.B().Zrem().Key(ORDER_DEADLINES_REDIS).Member(orderId).Build()).Error()
+}
@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/D8-X/d8x-broker-server/src/ledger"
+)
+
+func TestOrderStatus(t *testing.T) {
+	r, _ := newTestRedis(t)
+	now := time.Now()
+	if _, err := r.SetOrderStatus("unknown", ledger.STATUS_CANCELLED, now); !errors.Is(err, ErrOrderNotFound) {
+		t.Errorf("expected order not found, got %v", err)
+	}
+	for _, id := range []string{"a", "b"} {
+		order := APIOrderSig{PerpetualId: 100001, Deadline: uint32(now.Unix()) + 60, FAmount: "1"}
+		if err := r.PubOrder(order, id, 42161); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st, err := r.GetOrderStatus("a")
+	if err != nil || st.Status != ledger.STATUS_SIGNED || st.Topic != "100001:42161" || st.Closed() {
+		t.Fatalf("unexpected status %+v, %v", st, err)
+	}
+	if _, err = r.OrderSubmission([]string{"a", "b"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	// submitted orders are indexed by deadline
+	ids, err := r.ExpiredOrders(now.Add(2*time.Minute), 10)
+	if err != nil || len(ids) != 2 {
+		t.Fatalf("expected both orders expired, got %v, %v", ids, err)
+	}
+	if ids, _ = r.ExpiredOrders(now, 10); len(ids) != 0 {
+		t.Errorf("orders expired before the deadline: %v", ids)
+	}
+
+	st, err = r.SetOrderStatus("a", ledger.STATUS_EXECUTED, now)
+	if err != nil || st.Status != ledger.STATUS_EXECUTED || !st.Closed() {
+		t.Fatalf("unexpected status %+v, %v", st, err)
+	}
+	// closed orders do not change, are not published again and not expired
+	if _, err = r.SetOrderStatus("a", ledger.STATUS_CANCELLED, now); !errors.Is(err, ErrOrderStatus) {
+		t.Errorf("executed order cancelled: %v", err)
+	}
+	if orders, err := r.OrderSubmission([]string{"a", "b"}, 0); err != nil || len(orders) != 1 || orders[0].OrderId != "b" {
+		t.Errorf("executed order submitted: %+v, %v", orders, err)
+	}
+	if ids, _ = r.ExpiredOrders(now.Add(2*time.Minute), 10); len(ids) != 1 || ids[0] != "b" {
+		t.Errorf("expected order b expired, got %v", ids)
+	}
+}
+
+func TestOrderStatusExpiry(t *testing.T) {
+	r, mr := newTestRedis(t)
+	now := time.Now()
+	deadlines := map[string]time.Duration{"day": 24 * time.Hour, "month": 30 * 24 * time.Hour, "far": 10 * 365 * 24 * time.Hour}
+	for id, d := range deadlines {
+		order := APIOrderSig{PerpetualId: 100001, Deadline: uint32(now.Add(d).Unix()), FAmount: "1"}
+		if err := r.PubOrder(order, id, 42161); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := r.OrderSubmission([]string{"day", "month", "far"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	// open orders are kept until a day after the deadline
+	for id, d := range deadlines {
+		want := min(d+ORDER_STATUS_EXPIRY, ORDER_STATUS_MAX_EXPIRY)
+		if ttl := mr.TTL(ORDER_STATUS_REDIS + id); ttl < want-time.Minute || ttl > want {
+			t.Errorf("order %s expires in %v, expected %v", id, ttl, want)
+		}
+	}
+	// closed orders are kept for a day
+	if _, err := r.SetOrderStatus("month", ledger.STATUS_CANCELLED, now); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := mr.TTL(ORDER_STATUS_REDIS + "month"); ttl != ORDER_STATUS_EXPIRY {
+		t.Errorf("closed order expires in %v", ttl)
+	}
+}
+
+func TestCloseOrder(t *testing.T) {
+	r, mr := newTestRedis(t)
+	now := time.Now()
+	for _, id := range []string{"a", "b"} {
+		order := APIOrderSig{PerpetualId: 100001, Deadline: uint32(now.Unix()) + 60, FAmount: "1"}
+		if err := r.PubOrder(order, id, 42161); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := r.OrderSubmission([]string{"a"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.CloseOrder("a", ledger.STATUS_SUBMITTED, now, 0); !errors.Is(err, ErrOrderStatus) {
+		t.Errorf("order closed as submitted: %v", err)
+	}
+
+	// the status stays unchanged if it cannot be published
+	mr.Del(ORDER_STREAM)
+	mr.Set(ORDER_STREAM, "not a stream")
+	if _, err := r.CloseOrder("a", ledger.STATUS_CANCELLED, now, 0); err == nil {
+		t.Fatal("status change not published")
+	}
+	if st, _ := r.GetOrderStatus("a"); st.Status != ledger.STATUS_SUBMITTED {
+		t.Errorf("status not restored: %+v", st)
+	}
+	mr.Del(ORDER_STREAM)
+
+	for _, id := range []string{"a", "b"} {
+		st, err := r.CloseOrder(id, ledger.STATUS_CANCELLED, now, 0)
+		if err != nil || st.Status != ledger.STATUS_CANCELLED {
+			t.Fatalf("closing %s: %+v, %v", id, st, err)
+		}
+	}
+	if ids, _ := r.ExpiredOrders(now.Add(2*time.Minute), 10); len(ids) != 0 {
+		t.Errorf("closed orders indexed: %v", ids)
+	}
+	// the order that was never submitted is not published
+	entries, err := r.OrderStreamRange("-", "+", 0)
+	if err != nil || len(entries) != 1 || entries[0].Status == nil || entries[0].Status.OrderId != "a" {
+		t.Errorf("unexpected stream entries %+v, %v", entries, err)
+	}
+}
@@ -0,0 +1,209 @@
+package utils
+
+import (
+	"cmp"
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/rueidis"
+)
+
+// Submitted orders and status changes of submitted orders are appended to
+// the stream ORDER_STREAM. Every executorws replica reads the whole stream and stores its offset under
+// ORDER_STREAM_OFFSET:<instance id>, so each replica fans out every order
+// and continues after the last order it sent when restarted
+const (
+	ORDER_STREAM        = "ORDER_STREAM"
+	ORDER_STREAM_OFFSET = "ORDER_STREAM_OFFSET:"
+	// entries older than this are trimmed from the stream
+	DEFAULT_ORDER_STREAM_MAX_AGE = 10 * time.Minute
+	// offsets of replicas that did not store it for this long are removed,
+	// replicas store their offset at least every ORDER_STREAM_OFFSET_REFRESH
+	ORDER_STREAM_OFFSET_EXPIRY  = time.Hour
+	ORDER_STREAM_OFFSET_REFRESH = time.Minute
+	// entry types
+	ORDER_STREAM_ORDER  = "order"
+	ORDER_STREAM_STATUS = "status"
+)
+
+// OrderStreamEntry is an order read from the order stream
+type OrderStreamEntry struct {
+	// stream entry id, used as offset
+	Id string
+	// perpetualId:chainId
+	Topic string
+	// new order, unset for status changes
+	Order WSOrderResp
+	// status change, nil for new orders
+	Status *OrderStatus
+}
+
+// AddOrderToStream appends the order to the order stream and trims entries
+// older than maxAge
+func (r *RueidisClient) AddOrderToStream(topic string, order WSOrderResp, maxAge time.Duration) error {
+	if maxAge <= 0 {
+		maxAge = DEFAULT_ORDER_STREAM_MAX_AGE
+	}
+	minId := strconv.FormatInt(time.Now().Add(-maxAge).UnixMilli(), 10)
+	client := *r.Client
+	return client.Do(r.Ctx, client.B().Xadd().Key(ORDER_STREAM).Minid().Almost().Threshold(minId).
+		Id("*").FieldValue().
+		FieldValue("Type", ORDER_STREAM_ORDER).
+		FieldValue("Topic", topic).
+		FieldValue("OrderId", order.OrderId).
+		FieldValue("TraderAddr", order.TraderAddr).
+		FieldValue("Deadline", strconv.FormatUint(uint64(order.Deadline), 10)).
+		FieldValue("Flags", strconv.FormatUint(uint64(order.Flags), 10)).
+		FieldValue("FAmount", order.FAmount).
+		FieldValue("FLimitPrice", order.FLimitPrice).
+		FieldValue("FTriggerPrice", order.FTriggerPrice).
+		FieldValue("ExecutionTimestamp", strconv.FormatUint(uint64(order.ExecutionTimestamp), 10)).
+		Build()).Error()
+}
+
+// AddStatusToStream appends the status change of an order to the order
+// stream and trims entries older than maxAge
+func (r *RueidisClient) AddStatusToStream(st OrderStatus, maxAge time.Duration) error {
+	if maxAge <= 0 {
+		maxAge = DEFAULT_ORDER_STREAM_MAX_AGE
+	}
+	minId := strconv.FormatInt(time.Now().Add(-maxAge).UnixMilli(), 10)
+	client := *r.Client
+	return client.Do(r.Ctx, client.B().Xadd().Key(ORDER_STREAM).Minid().Almost().Threshold(minId).
+		Id("*").FieldValue().
+		FieldValue("Type", ORDER_STREAM_STATUS).
+		FieldValue("Topic", st.Topic).
+		FieldValue("OrderId", st.OrderId).
+		FieldValue("Status", st.Status).
+		FieldValue("Deadline", strconv.FormatUint(uint64(st.Deadline), 10)).
+		FieldValue("UpdatedAt", strconv.FormatInt(st.UpdatedAt, 10)).
+		Build()).Error()
+}
+
+// ReadOrderStream returns up to count orders after the entry lastId ("0" for
+// the start of the stream), waiting up to block for new orders (not waiting
+// if block is 0). Returns no orders if none arrived in time
+func (r *RueidisClient) ReadOrderStream(ctx context.Context, lastId string, count int64, block time.Duration) ([]OrderStreamEntry, error) {
+	client := *r.Client
+	cmd := client.B().Xread().Count(count).Streams().Key(ORDER_STREAM).Id(lastId).Build()
+	if block > 0 {
+		// BLOCK 0 would wait forever
+		cmd = client.B().Xread().Count(count).Block(block.Milliseconds()).
+			Streams().Key(ORDER_STREAM).Id(lastId).Build()
+	}
+	res, err := client.Do(ctx, cmd).AsXRead()
+	if rueidis.IsRedisNil(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseOrderStreamEntries(res[ORDER_STREAM]), nil
+}
+
+// OrderStreamTail returns the id of the last entry of the order stream, "0"
+// if the stream is empty
+func (r *RueidisClient) OrderStreamTail() (string, error) {
+	client := *r.Client
+	res, err := client.Do(r.Ctx, client.B().Xrevrange().Key(ORDER_STREAM).End("+").Start("-").Count(1).Build()).AsXRange()
+	if err != nil && !rueidis.IsRedisNil(err) {
+		return "", err
+	}
+	if len(res) == 0 {
+		return "0", nil
+	}
+	return res[0].ID, nil
+}
+
+// OrderStreamRange returns at most count orders (all if 0) with entry ids
+// from start to end (XRANGE syntax: "-", "+", "(" for exclusive bounds)
+func (r *RueidisClient) OrderStreamRange(start, end string, count int64) ([]OrderStreamEntry, error) {
+	client := *r.Client
+	cmd := client.B().Xrange().Key(ORDER_STREAM).Start(start).End(end).Build()
+	if count > 0 {
+		cmd = client.B().Xrange().Key(ORDER_STREAM).Start(start).End(end).Count(count).Build()
+	}
+	res, err := client.Do(r.Ctx, cmd).AsXRange()
+	if err != nil {
+		return nil, err
+	}
+	return parseOrderStreamEntries(res), nil
+}
+
+func parseOrderStreamEntries(res []rueidis.XRangeEntry) []OrderStreamEntry {
+	entries := make([]OrderStreamEntry, 0, len(res))
+	for _, e := range res {
+		f := e.FieldValues
+		deadline, _ := strconv.ParseUint(f["Deadline"], 10, 32)
+		flags, _ := strconv.ParseUint(f["Flags"], 10, 32)
+		if f["Type"] == ORDER_STREAM_STATUS {
+			updatedAt, _ := strconv.ParseInt(f["UpdatedAt"], 10, 64)
+			entries = append(entries, OrderStreamEntry{
+				Id:    e.ID,
+				Topic: f["Topic"],
+				Status: &OrderStatus{
+					OrderId:   f["OrderId"],
+					Status:    f["Status"],
+					Topic:     f["Topic"],
+					Deadline:  uint32(deadline),
+					UpdatedAt: updatedAt,
+				},
+			})
+			continue
+		}
+		execTs, _ := strconv.ParseUint(f["ExecutionTimestamp"], 10, 32)
+		entries = append(entries, OrderStreamEntry{
+			Id:    e.ID,
+			Topic: f["Topic"],
+			Order: WSOrderResp{
+				OrderId:            f["OrderId"],
+				TraderAddr:         f["TraderAddr"],
+				Deadline:           uint32(deadline),
+				Flags:              uint32(flags),
+				FAmount:            f["FAmount"],
+				FLimitPrice:        f["FLimitPrice"],
+				FTriggerPrice:      f["FTriggerPrice"],
+				ExecutionTimestamp: uint32(execTs),
+			},
+		})
+	}
+	return entries
+}
+
+// CompareStreamIds compares the stream entry ids a and b ("<ms>-<seq>"),
+// returns -1 if a is before b, 0 if equal and 1 if a is after b
+func CompareStreamIds(a, b string) int {
+	aMs, aSeq := splitStreamId(a)
+	bMs, bSeq := splitStreamId(b)
+	if c := cmp.Compare(aMs, bMs); c != 0 {
+		return c
+	}
+	return cmp.Compare(aSeq, bSeq)
+}
+
+func splitStreamId(id string) (uint64, uint64) {
+	msStr, seqStr, _ := strings.Cut(id, "-")
+	ms, _ := strconv.ParseUint(msStr, 10, 64)
+	seq, _ := strconv.ParseUint(seqStr, 10, 64)
+	return ms, seq
+}
+
+// OrderStreamOffset returns the id of the last entry sent by the replica,
+// "" if the replica did not read the stream before
+func (r *RueidisClient) OrderStreamOffset(instanceId string) (string, error) {
+	client := *r.Client
+	id, err := client.Do(r.Ctx, client.B().Get().Key(ORDER_STREAM_OFFSET+instanceId).Build()).ToString()
+	if rueidis.IsRedisNil(err) {
+		return "", nil
+	}
+	return id, err
+}
+
+// SetOrderStreamOffset stores the id of the last entry sent by the replica
+func (r *RueidisClient) SetOrderStreamOffset(instanceId string, id string) error {
+	client := *r.Client
+	return client.Do(r.Ctx, client.B().Set().Key(ORDER_STREAM_OFFSET+instanceId).Value(id).
+		Px(ORDER_STREAM_OFFSET_EXPIRY).Build()).Error()
+}
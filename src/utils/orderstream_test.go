@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestOrderStream(t *testing.T) {
+	r, s := newTestRedis(t)
+	// entry older than the max age, trimmed by the next submission
+	_, err := s.XAdd(ORDER_STREAM, "1000-0", []string{"Topic", "100001:42161", "OrderId", "old"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := APIOrderSig{PerpetualId: 100001, TraderAddr: "0x9d5aaB428e98678d0E645ea4AeBd25f744341a05",
+		Deadline: 1900000000, Flags: 4, FAmount: "1", FLimitPrice: "2", FTriggerPrice: "0"}
+	err = r.PubOrder(order, "abc", 42161)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orders, err := r.OrderSubmission([]string{"abc"}, time.Minute)
+	if err != nil || len(orders) != 1 || orders[0].ChainId != 42161 {
+		t.Fatalf("submission %+v, %v", orders, err)
+	}
+	entries, err := r.ReadOrderStream(context.Background(), "0", 10, 0)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected the new order only, got %+v, %v", entries, err)
+	}
+	e := entries[0]
+	if e.Topic != "100001:42161" || e.Order.OrderId != "abc" || e.Order.Deadline != 1900000000 || e.Order.Flags != 4 {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	// no orders after the last entry
+	entries, err = r.ReadOrderStream(context.Background(), e.Id, 10, 10*time.Millisecond)
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("expected no orders, got %+v, %v", entries, err)
+	}
+
+	offset, err := r.OrderStreamOffset("ws-1")
+	if err != nil || offset != "" {
+		t.Fatalf("expected no offset, got %s, %v", offset, err)
+	}
+	if err = r.SetOrderStreamOffset("ws-1", e.Id); err != nil {
+		t.Fatal(err)
+	}
+	if offset, _ = r.OrderStreamOffset("ws-1"); offset != e.Id {
+		t.Errorf("offset %s, expected %s", offset, e.Id)
+	}
+}
@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/D8-X/d8x-futures-go-sdk/config"
+	"github.com/D8-X/d8x-futures-go-sdk/pkg/d8x_futures"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// PERPETUALS_CACHE_TTL is how long the perpetuals of a chain are cached
+const PERPETUALS_CACHE_TTL = 10 * time.Minute
+
+// PERPETUALS_RETRY is the minimal time between two queries of the
+// perpetuals of a chain, also if a query failed or a perpetual is unknown
+const PERPETUALS_RETRY = time.Minute
+
+// PerpetualInfo is the perpetual metadata orders are validated against
+type PerpetualInfo struct {
+	Id int32
+	// 1 / initial margin rate
+	MaxLeverage float64
+	// state of the perpetual, orders are accepted if NORMAL
+	State string
+}
+
+// PerpetualSource returns the perpetuals of a chain by id
+type PerpetualSource interface {
+	Perpetuals(ctx context.Context, chainId int64) (map[int32]PerpetualInfo, error)
+}
+
+// SdkPerpetuals queries the perpetuals on-chain with the exchange info
+// of the SDK
+type SdkPerpetuals struct {
+	// Client returns the rpc client of a chain
+	Client func(ctx context.Context, chainId int64) (*ethclient.Client, error)
+}
+
+func (s SdkPerpetuals) Perpetuals(ctx context.Context, chainId int64) (map[int32]PerpetualInfo, error) {
+	chConf, err := config.GetDefaultChainConfigFromId(chainId)
+	if err != nil {
+		return nil, err
+	}
+	pxConf, err := config.GetDefaultPriceConfig(chainId)
+	if err != nil {
+		return nil, err
+	}
+	rpc, err := s.Client(ctx, chainId)
+	if err != nil {
+		return nil, errors.New("rpc: " + err.Error())
+	}
+	conn, err := d8x_futures.CreateBlockChainConnector(pxConf, chConf, rpc)
+	if err != nil {
+		return nil, err
+	}
+	nest, err := d8x_futures.QueryNestedPerpetualInfo(conn)
+	if err != nil {
+		return nil, err
+	}
+	xInfo, err := d8x_futures.QueryExchangeStaticInfo(&conn, &chConf, &pxConf, &nest)
+	if err != nil {
+		return nil, err
+	}
+	perps := make(map[int32]PerpetualInfo, len(xInfo.Perpetuals))
+	for _, p := range xInfo.Perpetuals {
+		info := PerpetualInfo{Id: p.Id, State: p.State.String()}
+		if p.InitialMarginRate > 0 {
+			info.MaxLeverage = 1 / p.InitialMarginRate
+		}
+		perps[p.Id] = info
+	}
+	return perps, nil
+}
+
+type cachedPerpetuals struct {
+	perps map[int32]PerpetualInfo
+	// time of the last successful and of the last query
+	fetched time.Time
+	queried time.Time
+}
+
+// PerpetualCache caches the perpetuals of each chain for
+// PERPETUALS_CACHE_TTL. Unknown perpetuals trigger a new query, at most
+// every PERPETUALS_RETRY
+type PerpetualCache struct {
+	src   PerpetualSource
+	mu    sync.Mutex
+	cache map[int64]cachedPerpetuals
+}
+
+func NewPerpetualCache(src PerpetualSource) *PerpetualCache {
+	return &PerpetualCache{src: src, cache: make(map[int64]cachedPerpetuals)}
+}
+
+// Refresh queries the perpetuals of the chain. The cached perpetuals are
+// kept if the query fails
+func (c *PerpetualCache) Refresh(ctx context.Context, chainId int64) error {
+	now := time.Now()
+	perps, err := c.src.Perpetuals(ctx, chainId)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		entry := c.cache[chainId]
+		entry.queried = now
+		c.cache[chainId] = entry
+		return err
+	}
+	c.cache[chainId] = cachedPerpetuals{perps: perps, fetched: now, queried: now}
+	return nil
+}
+
+// Perpetuals returns the perpetuals of the chain. If the query fails, the
+// last known perpetuals are returned with the error, nil if there are none
+func (c *PerpetualCache) Perpetuals(ctx context.Context, chainId int64, perpetualId int32) (map[int32]PerpetualInfo, error) {
+	now := time.Now()
+	c.mu.Lock()
+	entry, exists := c.cache[chainId]
+	_, known := entry.perps[perpetualId]
+	if exists && (now.Sub(entry.queried) < PERPETUALS_RETRY ||
+		(known && now.Sub(entry.fetched) < PERPETUALS_CACHE_TTL)) {
+		c.mu.Unlock()
+		return entry.perps, nil
+	}
+	// one query per chain and retry period
+	entry.queried = now
+	c.cache[chainId] = entry
+	c.mu.Unlock()
+
+	perps, err := c.src.Perpetuals(ctx, chainId)
+	if err != nil {
+		return entry.perps, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cache[chainId] = cachedPerpetuals{perps: perps, fetched: now, queried: now}
+	return perps, nil
+}
@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/D8-X/d8x-futures-go-sdk/config"
+	"github.com/D8-X/d8x-futures-go-sdk/pkg/d8x_futures"
+	d8xUtils "github.com/D8-X/d8x-futures-go-sdk/utils"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// MARK_PRICE_CACHE_TTL is how long the mark price of a perpetual is cached
+const MARK_PRICE_CACHE_TTL = time.Minute
+
+// MarkPriceSource returns the mark price of a perpetual in quote currency
+type MarkPriceSource interface {
+	MarkPrice(ctx context.Context, chainId int64, perpetualId int32) (float64, error)
+}
+
+// OraclePrices reads the mark price on-chain: the oracle index price of the
+// perpetual times one plus its mark premium
+type OraclePrices struct {
+	// Client returns the rpc client of a chain
+	Client func(ctx context.Context, chainId int64) (*ethclient.Client, error)
+}
+
+func (s OraclePrices) MarkPrice(ctx context.Context, chainId int64, perpetualId int32) (float64, error) {
+	chConf, err := config.GetDefaultChainConfigFromId(chainId)
+	if err != nil {
+		return 0, err
+	}
+	rpc, err := s.Client(ctx, chainId)
+	if err != nil {
+		return 0, err
+	}
+	proxy, err := d8x_futures.CreatePerpetualManagerInstance(rpc, chConf.ProxyAddr)
+	if err != nil {
+		return 0, err
+	}
+	opts := &bind.CallOpts{Context: ctx}
+	perps, err := proxy.GetPerpetuals(opts, []*big.Int{big.NewInt(int64(perpetualId))})
+	if err != nil {
+		return 0, err
+	}
+	if len(perps) != 1 || perps[0].Id.Int64() != int64(perpetualId) {
+		return 0, fmt.Errorf("unknown perpetual %d on chain %d", perpetualId, chainId)
+	}
+	perp := perps[0]
+	px, _, err := proxy.GetOraclePrice(opts, [2][4]byte{perp.S2BaseCCY, perp.S2QuoteCCY})
+	if err != nil {
+		return 0, err
+	}
+	mark := d8xUtils.ABDKToFloat64(px)
+	if perp.CurrentMarkPremiumRate.FPrice != nil {
+		mark *= 1 + d8xUtils.ABDKToFloat64(perp.CurrentMarkPremiumRate.FPrice)
+	}
+	if mark <= 0 {
+		return 0, fmt.Errorf("no price for perpetual %d on chain %d", perpetualId, chainId)
+	}
+	return mark, nil
+}
+
+type cachedPrice struct {
+	price   float64
+	fetched time.Time
+}
+
+// MarkPriceCache caches the mark price of each perpetual for
+// MARK_PRICE_CACHE_TTL
+type MarkPriceCache struct {
+	src   MarkPriceSource
+	mu    sync.Mutex
+	cache map[[2]int64]cachedPrice
+}
+
+func NewMarkPriceCache(src MarkPriceSource) *MarkPriceCache {
+	return &MarkPriceCache{src: src, cache: make(map[[2]int64]cachedPrice)}
+}
+
+func (c *MarkPriceCache) MarkPrice(ctx context.Context, chainId int64, perpetualId int32) (float64, error) {
+	if c == nil {
+		return 0, errors.New("no mark price source")
+	}
+	key := [2]int64{chainId, int64(perpetualId)}
+	now := time.Now()
+	c.mu.Lock()
+	entry, exists := c.cache[key]
+	c.mu.Unlock()
+	if exists && now.Sub(entry.fetched) < MARK_PRICE_CACHE_TTL {
+		return entry.price, nil
+	}
+	px, err := c.src.MarkPrice(ctx, chainId, perpetualId)
+	if err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cache[key] = cachedPrice{price: px, fetched: now}
+	return px, nil
+}
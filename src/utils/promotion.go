@@ -0,0 +1,247 @@
+package utils
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/rueidis"
+)
+
+// Redis keys of promotions: PROMOTIONS hash of promotion id -> promotion
+// (json), PROMOTION_USAGE:<id> hash of trader -> orders signed with the
+// promotion
+const PROMOTIONS_REDIS = "PROMOTIONS"
+const PROMOTION_USAGE_REDIS = "PROMOTION_USAGE"
+
+// FEE_TIER_PROMOTION prefixes the promotion id in the fee tier
+const FEE_TIER_PROMOTION = "promo-"
+
+// PROMOTION_RETENTION is how long promotions are kept after they end,
+// like their usage counts
+const PROMOTION_RETENTION = 24 * time.Hour
+
+var promotionIdRe = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+var ErrPromotionNotFound = errors.New("promotion not found")
+
+// Promotion overrides or discounts the broker fee during a time window
+type Promotion struct {
+	// generated if empty
+	Id   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	// time window [Start, End) as unix timestamps
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	// scope, 0 or empty for all chains and perpetuals of the chains
+	ChainId      int64   `json:"chainId,omitempty"`
+	PerpetualIds []int64 `json:"perpetualIds,omitempty"`
+	// fee cap in tenth of bps (a lower fee of the trader applies), or a
+	// discount in percent on the fee of the trader
+	FeeTbps      *uint16 `json:"feeTbps,omitempty"`
+	DiscountPerc float64 `json:"discountPerc,omitempty"`
+	// orders per trader the promotion applies to, unlimited if 0
+	MaxUsesPerTrader int64 `json:"maxUsesPerTrader,omitempty"`
+}
+
+func (p Promotion) validate() error {
+	if !promotionIdRe.MatchString(p.Id) {
+		return errors.New("id must be 1-64 characters A-Z, a-z, 0-9, _ or -")
+	}
+	if p.End <= p.Start {
+		return errors.New("end must be after start")
+	}
+	if (p.FeeTbps == nil) == (p.DiscountPerc == 0) {
+		return errors.New("either feeTbps or discountPerc required")
+	}
+	if p.DiscountPerc < 0 || p.DiscountPerc > 100 {
+		return errors.New("discountPerc must be in [0, 100]")
+	}
+	if p.ChainId < 0 || p.MaxUsesPerTrader < 0 {
+		return errors.New("chainId and maxUsesPerTrader must not be negative")
+	}
+	if len(p.PerpetualIds) > 0 && p.ChainId == 0 {
+		return errors.New("perpetualIds require chainId")
+	}
+	return nil
+}
+
+// Applies returns true if the promotion is active at ts for the chain and
+// perpetual. Promotions scoped to perpetuals do not apply to perpetualId -1
+// (any perpetual)
+func (p Promotion) Applies(chainId, perpetualId int64, ts time.Time) bool {
+	now := ts.Unix()
+	if now < p.Start || now >= p.End {
+		return false
+	}
+	if p.ChainId != 0 && p.ChainId != chainId {
+		return false
+	}
+	return len(p.PerpetualIds) == 0 || slices.Contains(p.PerpetualIds, perpetualId)
+}
+
+// Fee returns the fee with the promotion applied
+func (p Promotion) Fee(fee uint16) uint16 {
+	if p.FeeTbps != nil {
+		return min(fee, *p.FeeTbps)
+	}
+	return uint16(math.Floor(float64(fee)*(100-p.DiscountPerc)/100 + 1e-9))
+}
+
+func promotionUsageKey(id string) string {
+	return PROMOTION_USAGE_REDIS + ":" + id
+}
+
+// reservePromotionScript counts an order of the trader (ARGV[1]) if the
+// usage stays within the limit (ARGV[2]) and expires the usage counts at
+// ARGV[3]. Returns 1 if the order was counted
+var reservePromotionScript = rueidis.NewLuaScript(`
+local n = redis.call('HINCRBY', KEYS[1], ARGV[1], 1)
+if n > tonumber(ARGV[2]) then
+	redis.call('HINCRBY', KEYS[1], ARGV[1], -1)
+	return 0
+end
+redis.call('EXPIREAT', KEYS[1], ARGV[3])
+return 1
+`)
+
+// CreatePromotion stores a new promotion, promotions cannot be overwritten
+func (r *RueidisClient) CreatePromotion(p Promotion) (Promotion, error) {
+	if p.Id == "" {
+		p.Id = uuid.New().String()
+	}
+	if err := p.validate(); err != nil {
+		return Promotion{}, err
+	}
+	val, err := json.Marshal(p)
+	if err != nil {
+		return Promotion{}, err
+	}
+	client := *r.Client
+	ok, err := client.Do(r.Ctx, client.B().Hsetnx().Key(PROMOTIONS_REDIS).Field(p.Id).Value(string(val)).Build()).AsBool()
+	if err != nil {
+		return Promotion{}, err
+	}
+	if !ok {
+		return Promotion{}, errors.New("promotion " + p.Id + " exists")
+	}
+	return p, nil
+}
+
+// ListPromotions returns all promotions ordered by start
+func (r *RueidisClient) ListPromotions() ([]Promotion, error) {
+	client := *r.Client
+	hm, err := client.Do(r.Ctx, client.B().Hgetall().Key(PROMOTIONS_REDIS).Build()).AsStrMap()
+	if err != nil && !rueidis.IsRedisNil(err) {
+		return nil, err
+	}
+	promos := make([]Promotion, 0, len(hm))
+	for id, val := range hm {
+		var p Promotion
+		if err := json.Unmarshal([]byte(val), &p); err != nil {
+			return nil, errors.New("invalid promotion " + id + ": " + err.Error())
+		}
+		promos = append(promos, p)
+	}
+	slices.SortFunc(promos, func(a, b Promotion) int {
+		if a.Start != b.Start {
+			return cmp.Compare(a.Start, b.Start)
+		}
+		return strings.Compare(a.Id, b.Id)
+	})
+	return promos, nil
+}
+
+// GetPromotion returns the promotion with the given id
+func (r *RueidisClient) GetPromotion(id string) (Promotion, error) {
+	client := *r.Client
+	val, err := client.Do(r.Ctx, client.B().Hget().Key(PROMOTIONS_REDIS).Field(id).Build()).ToString()
+	if rueidis.IsRedisNil(err) {
+		return Promotion{}, ErrPromotionNotFound
+	}
+	if err != nil {
+		return Promotion{}, err
+	}
+	var p Promotion
+	if err := json.Unmarshal([]byte(val), &p); err != nil {
+		return Promotion{}, errors.New("invalid promotion " + id + ": " + err.Error())
+	}
+	return p, nil
+}
+
+// PruneExpiredPromotions deletes promotions that ended more than
+// PROMOTION_RETENTION before now and returns the remaining promotions
+// ordered by start
+func (r *RueidisClient) PruneExpiredPromotions(now time.Time) ([]Promotion, error) {
+	promos, err := r.ListPromotions()
+	if err != nil {
+		return nil, err
+	}
+	cutoff := now.Add(-PROMOTION_RETENTION).Unix()
+	var expired []string
+	promos = slices.DeleteFunc(promos, func(p Promotion) bool {
+		if p.End > cutoff {
+			return false
+		}
+		expired = append(expired, p.Id)
+		return true
+	})
+	if len(expired) == 0 {
+		return promos, nil
+	}
+	client := *r.Client
+	err = client.Do(r.Ctx, client.B().Hdel().Key(PROMOTIONS_REDIS).Field(expired...).Build()).Error()
+	return promos, err
+}
+
+// DeletePromotion removes the promotion and its usage counts
+func (r *RueidisClient) DeletePromotion(id string) error {
+	client := *r.Client
+	n, err := client.Do(r.Ctx, client.B().Hdel().Key(PROMOTIONS_REDIS).Field(id).Build()).AsInt64()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrPromotionNotFound
+	}
+	return client.Do(r.Ctx, client.B().Del().Key(promotionUsageKey(id)).Build()).Error()
+}
+
+// PromotionUsage returns the number of orders of the trader signed with
+// the promotion
+func (r *RueidisClient) PromotionUsage(id, trader string) (int64, error) {
+	client := *r.Client
+	n, err := client.Do(r.Ctx, client.B().Hget().Key(promotionUsageKey(id)).Field(strings.ToLower(trader)).Build()).AsInt64()
+	if rueidis.IsRedisNil(err) {
+		return 0, nil
+	}
+	return n, err
+}
+
+// ReservePromotion counts an order of the trader signed with the
+// promotion, unless the trader used up the promotion. Returns false if
+// the order was not counted. Usage counts expire PROMOTION_RETENTION after
+// the promotion ends
+func (r *RueidisClient) ReservePromotion(p Promotion, trader string) (bool, error) {
+	client := *r.Client
+	expiry := time.Unix(p.End, 0).Add(PROMOTION_RETENTION).Unix()
+	n, err := reservePromotionScript.Exec(r.Ctx, client, []string{promotionUsageKey(p.Id)},
+		[]string{strings.ToLower(trader), strconv.FormatInt(p.MaxUsesPerTrader, 10), strconv.FormatInt(expiry, 10)}).AsInt64()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// ReleasePromotion takes back an order counted with ReservePromotion
+func (r *RueidisClient) ReleasePromotion(p Promotion, trader string) error {
+	client := *r.Client
+	return client.Do(r.Ctx, client.B().Hincrby().Key(promotionUsageKey(p.Id)).Field(strings.ToLower(trader)).Increment(-1).Build()).Error()
+}
@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPromotions(t *testing.T) {
+	r, _ := newTestRedis(t)
+	zero := uint16(0)
+	for _, p := range []Promotion{
+		{Id: "bad id", Start: 1, End: 2, FeeTbps: &zero},
+		{Id: "reversed", Start: 2, End: 1, FeeTbps: &zero},
+		{Id: "both", Start: 1, End: 2, FeeTbps: &zero, DiscountPerc: 10},
+		{Id: "none", Start: 1, End: 2},
+		{Id: "perp", Start: 1, End: 2, FeeTbps: &zero, PerpetualIds: []int64{100001}},
+	} {
+		if _, err := r.CreatePromotion(p); err == nil {
+			t.Errorf("invalid promotion %s accepted", p.Id)
+		}
+	}
+	t0 := time.Now().Unix()
+	weekend, err := r.CreatePromotion(Promotion{Id: "weekend", Start: t0 + 100, End: t0 + 200, FeeTbps: &zero})
+	if err != nil {
+		t.Fatal(err)
+	}
+	launch, err := r.CreatePromotion(Promotion{Start: t0 + 50, End: t0 + 300, ChainId: 42161,
+		PerpetualIds: []int64{100002}, DiscountPerc: 50, MaxUsesPerTrader: 2})
+	if err != nil || launch.Id == "" {
+		t.Fatal(err)
+	}
+	if _, err = r.CreatePromotion(weekend); err == nil {
+		t.Error("promotion overwritten")
+	}
+	promos, err := r.ListPromotions()
+	if err != nil || len(promos) != 2 || promos[0].Id != launch.Id || *promos[1].FeeTbps != 0 {
+		t.Fatalf("unexpected promotions %+v, %v", promos, err)
+	}
+
+	if !weekend.Applies(1, 1, time.Unix(t0+100, 0)) || weekend.Applies(1, 1, time.Unix(t0+200, 0)) {
+		t.Error("unexpected time window")
+	}
+	if !launch.Applies(42161, 100002, time.Unix(t0+100, 0)) || launch.Applies(42161, -1, time.Unix(t0+100, 0)) ||
+		launch.Applies(1, 100002, time.Unix(t0+100, 0)) {
+		t.Error("unexpected scope")
+	}
+	if weekend.Fee(60) != 0 || launch.Fee(61) != 30 {
+		t.Error("unexpected fee")
+	}
+
+	trader := "0x9d5aaB428e98678d0E645ea4AeBd25f744341a05"
+	for k := 0; k < 3; k++ {
+		ok, err := r.ReservePromotion(launch, trader)
+		if err != nil || ok != (k < 2) {
+			t.Fatalf("reservation %d: %v, %v", k, ok, err)
+		}
+	}
+	if n, err := r.PromotionUsage(launch.Id, trader); err != nil || n != 2 {
+		t.Errorf("usage %d, %v", n, err)
+	}
+	if err = r.ReleasePromotion(launch, trader); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := r.ReservePromotion(launch, trader); err != nil || !ok {
+		t.Errorf("released use not available: %v, %v", ok, err)
+	}
+	if p, err := r.GetPromotion(launch.Id); err != nil || p.MaxUsesPerTrader != 2 {
+		t.Errorf("unexpected promotion %+v, %v", p, err)
+	}
+	if err = r.DeletePromotion(launch.Id); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := r.PromotionUsage(launch.Id, trader); n != 0 {
+		t.Errorf("usage not deleted")
+	}
+	if err = r.DeletePromotion(launch.Id); err != ErrPromotionNotFound {
+		t.Errorf("expected not found, got %v", err)
+	}
+	if _, err = r.GetPromotion(launch.Id); err != ErrPromotionNotFound {
+		t.Errorf("expected not found, got %v", err)
+	}
+
+	// promotions are pruned a day after they end
+	promos, err = r.PruneExpiredPromotions(time.Unix(weekend.End, 0).Add(PROMOTION_RETENTION - time.Second))
+	if err != nil || len(promos) != 1 {
+		t.Errorf("promotion pruned early: %+v, %v", promos, err)
+	}
+	promos, err = r.PruneExpiredPromotions(time.Unix(weekend.End, 0).Add(PROMOTION_RETENTION))
+	if err != nil || len(promos) != 0 {
+		t.Errorf("promotion not pruned: %+v, %v", promos, err)
+	}
+	if promos, _ = r.ListPromotions(); len(promos) != 0 {
+		t.Errorf("pruned promotion listed: %+v", promos)
+	}
+}
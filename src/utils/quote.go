@@ -0,0 +1,96 @@
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/D8-X/d8x-futures-go-sdk/pkg/d8x_futures"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// prefix of the fee quote digest, separates quotes from other broker
+// signatures
+const FEE_QUOTE_DOMAIN = "D8X broker fee quote"
+
+var ErrFeeQuoteExpired = errors.New("fee quote expired")
+
+// FeeQuote commits the broker to a fee for the trader and perpetual until
+// Expiry (unix timestamp)
+type FeeQuote struct {
+	TraderAddr    string `json:"traderAddr"`
+	ChainId       int64  `json:"chainId"`
+	PerpetualId   int64  `json:"perpetualId"`
+	BrokerFeeTbps uint16 `json:"brokerFeeTbps"`
+	FeeTier       string `json:"feeTier"`
+	Vip3Level     int    `json:"vip3Level"`
+	Promotion     string `json:"promotion,omitempty"`
+	Expiry        int64  `json:"expiry"`
+}
+
+// APIFeeQuoteRes is the response of /fee-quote. QuoteToken is passed to
+// /sign-order as feeQuote
+type APIFeeQuoteRes struct {
+	FeeQuote
+	QuoteToken string `json:"quoteToken"`
+}
+
+func feeQuoteDigest(payload []byte) []byte {
+	return crypto.Keccak256(append([]byte(FEE_QUOTE_DOMAIN), payload...))
+}
+
+// SignFeeQuote signs the quote with the broker key of the chain. The token
+// is <base64url quote>.<hex signature>
+func (p *SignaturePen) SignFeeQuote(q FeeQuote) (string, error) {
+	signer := p.Signers[q.ChainId]
+	if signer == nil {
+		return "", fmt.Errorf("no broker key defined for chain %d", q.ChainId)
+	}
+	q.TraderAddr = strings.ToLower(q.TraderAddr)
+	payload, err := json.Marshal(q)
+	if err != nil {
+		return "", err
+	}
+	sig, err := signer.SignDigest(feeQuoteDigest(payload))
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + common.Bytes2Hex(sig), nil
+}
+
+// VerifyFeeQuote checks the signature of the quote token and that the quote
+// is not expired at now (unix timestamp)
+func (p *SignaturePen) VerifyFeeQuote(token string, now int64) (FeeQuote, error) {
+	var q FeeQuote
+	payloadStr, sigStr, found := strings.Cut(token, ".")
+	if !found {
+		return q, errors.New("invalid fee quote")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(payloadStr)
+	if err != nil {
+		return q, errors.New("invalid fee quote")
+	}
+	sig := common.FromHex(sigStr)
+	if len(sig) != crypto.SignatureLength {
+		return q, errors.New("invalid fee quote signature")
+	}
+	err = json.Unmarshal(payload, &q)
+	if err != nil {
+		return q, errors.New("invalid fee quote")
+	}
+	signer := p.Signers[q.ChainId]
+	if signer == nil {
+		return q, fmt.Errorf("no broker key defined for chain %d", q.ChainId)
+	}
+	rec, err := d8x_futures.RecoverEvmAddress(feeQuoteDigest(payload), sig)
+	if err != nil || rec != signer.Address() {
+		return q, errors.New("invalid fee quote signature")
+	}
+	if now > q.Expiry {
+		return q, ErrFeeQuoteExpired
+	}
+	return q, nil
+}
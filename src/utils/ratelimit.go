@@ -0,0 +1,177 @@
+package utils
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/rueidis"
+)
+
+// Redis keys for rate limiting: RATELIMIT:<kind>:<id> token bucket,
+// RATELIMIT_STATS hash with allowed/limited counters per kind
+const RATELIMIT_REDIS = "RATELIMIT"
+const RATELIMIT_STATS_REDIS = "RATELIMIT_STATS"
+
+// Rate limit kinds
+const (
+	RATELIMIT_TRADER = "trader"
+	RATELIMIT_IP     = "ip"
+	RATELIMIT_APIKEY = "apikey"
+)
+
+// RateLimit is a token bucket that holds up to Burst requests and is
+// refilled with Burst tokens every Period
+type RateLimit struct {
+	Burst  int64         `json:"burst"`
+	Period time.Duration `json:"-"`
+}
+
+func (l RateLimit) Enabled() bool {
+	return l.Burst > 0 && l.Period > 0
+}
+
+func (l RateLimit) String() string {
+	if !l.Enabled() {
+		return "off"
+	}
+	return strconv.FormatInt(l.Burst, 10) + "/" + strconv.FormatInt(int64(l.Period/time.Second), 10)
+}
+
+// ParseRateLimit parses "<requests>/<seconds>", for example "20/60" allows
+// bursts of 20 requests and 20 requests per minute. An empty string or "0"
+// disables the limit
+func ParseRateLimit(spec string) (RateLimit, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" || spec == "0" {
+		return RateLimit{}, nil
+	}
+	reqs, secs, found := strings.Cut(spec, "/")
+	if !found {
+		return RateLimit{}, errors.New("invalid rate limit " + spec + ", expected <requests>/<seconds>")
+	}
+	burst, err := strconv.ParseInt(strings.TrimSpace(reqs), 10, 64)
+	if err != nil || burst < 0 {
+		return RateLimit{}, errors.New("invalid number of requests in rate limit " + spec)
+	}
+	period, err := strconv.ParseInt(strings.TrimSpace(secs), 10, 64)
+	if err != nil || period <= 0 {
+		return RateLimit{}, errors.New("invalid period in rate limit " + spec)
+	}
+	return RateLimit{Burst: burst, Period: time.Duration(period) * time.Second}, nil
+}
+
+// tokenBucketScript takes one token from the bucket KEYS[1].
+// ARGV: burst, refill period in ms, now in ms.
+// Returns {1, 0} if allowed, {0, ms until the next token} otherwise
+var tokenBucketScript = rueidis.NewLuaScript(`
+local burst = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(b[1])
+local ts = tonumber(b[2])
+if tokens == nil then
+	tokens = burst
+	ts = now
+end
+if now > ts then
+	tokens = math.min(burst, tokens + (now - ts) * burst / period)
+	ts = now
+end
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) * period / burst)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', ts)
+redis.call('PEXPIRE', KEYS[1], period)
+return {allowed, wait}
+`)
+
+// TakeRateLimitToken takes a token from the bucket of the given kind and id.
+// If the limit is exceeded, it returns false and the time until the next
+// request is allowed
+func (r *RueidisClient) TakeRateLimitToken(kind, id string, limit RateLimit, now time.Time) (bool, time.Duration, error) {
+	if !limit.Enabled() {
+		return true, 0, nil
+	}
+	client := *r.Client
+	res, err := tokenBucketScript.Exec(r.Ctx, client,
+		[]string{RATELIMIT_REDIS + ":" + kind + ":" + strings.ToLower(id)},
+		[]string{
+			strconv.FormatInt(limit.Burst, 10),
+			strconv.FormatInt(limit.Period.Milliseconds(), 10),
+			strconv.FormatInt(now.UnixMilli(), 10),
+		}).AsIntSlice()
+	if err != nil {
+		return false, 0, err
+	}
+	if len(res) != 2 {
+		return false, 0, errors.New("unexpected token bucket result")
+	}
+	allowed := res[0] == 1
+	field := kind + ":allowed"
+	if !allowed {
+		field = kind + ":limited"
+	}
+	client.Do(r.Ctx, client.B().Hincrby().Key(RATELIMIT_STATS_REDIS).Field(field).Increment(1).Build())
+	return allowed, time.Duration(res[1]) * time.Millisecond, nil
+}
+
+// refundTokenScript returns a token to the bucket KEYS[1], up to the burst
+// ARGV[1]
+var refundTokenScript = rueidis.NewLuaScript(`
+local tokens = tonumber(redis.call('HGET', KEYS[1], 'tokens'))
+if tokens ~= nil then
+	redis.call('HSET', KEYS[1], 'tokens', tostring(math.min(tonumber(ARGV[1]), tokens + 1)))
+end
+return 0
+`)
+
+// RefundRateLimitToken returns a token taken for a request that was not
+// served
+func (r *RueidisClient) RefundRateLimitToken(kind, id string, limit RateLimit) error {
+	if !limit.Enabled() {
+		return nil
+	}
+	return refundTokenScript.Exec(r.Ctx, *r.Client,
+		[]string{RATELIMIT_REDIS + ":" + kind + ":" + strings.ToLower(id)},
+		[]string{strconv.FormatInt(limit.Burst, 10)}).Error()
+}
+
+// GetRateLimitStats returns the number of allowed and limited requests
+// per kind, for example {"trader": {"allowed": 10, "limited": 2}}
+func (r *RueidisClient) GetRateLimitStats() (map[string]map[string]int64, error) {
+	client := *r.Client
+	hm, err := client.Do(r.Ctx, client.B().Hgetall().Key(RATELIMIT_STATS_REDIS).Build()).AsIntMap()
+	if err != nil {
+		return nil, err
+	}
+	stats := make(map[string]map[string]int64)
+	for _, kind := range []string{RATELIMIT_TRADER, RATELIMIT_IP, RATELIMIT_APIKEY} {
+		stats[kind] = map[string]int64{"allowed": 0, "limited": 0}
+	}
+	for field, n := range hm {
+		kind, outcome, found := strings.Cut(field, ":")
+		if !found {
+			continue
+		}
+		if stats[kind] == nil {
+			stats[kind] = make(map[string]int64)
+		}
+		stats[kind][outcome] = n
+	}
+	return stats, nil
+}
+
+// RetryAfterSec rounds the wait time up to full seconds for the
+// Retry-After header
+func RetryAfterSec(wait time.Duration) int64 {
+	return int64(math.Max(1, math.Ceil(wait.Seconds())))
+}
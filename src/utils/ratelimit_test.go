@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	l, err := ParseRateLimit("20/60")
+	if err != nil || l.Burst != 20 || l.Period != time.Minute {
+		t.Errorf("unexpected limit %v %v", l, err)
+	}
+	l, err = ParseRateLimit("")
+	if err != nil || l.Enabled() {
+		t.Errorf("empty limit should be disabled")
+	}
+	for _, spec := range []string{"20", "a/60", "20/0", "-1/10"} {
+		if _, err := ParseRateLimit(spec); err == nil {
+			t.Errorf("expected error for %s", spec)
+		}
+	}
+}
+
+func TestTakeRateLimitToken(t *testing.T) {
+	r, _ := newTestRedis(t)
+	limit := RateLimit{Burst: 3, Period: 3 * time.Second}
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		allowed, _, err := r.TakeRateLimitToken(RATELIMIT_TRADER, "0xabc", limit, now)
+		if err != nil || !allowed {
+			t.Fatalf("request %d should be allowed: %v", i, err)
+		}
+	}
+	allowed, wait, err := r.TakeRateLimitToken(RATELIMIT_TRADER, "0xABC", limit, now)
+	if err != nil || allowed {
+		t.Fatalf("4th request should be limited: %v", err)
+	}
+	if wait != time.Second {
+		t.Errorf("expected wait 1s, got %v", wait)
+	}
+	// other ids have their own bucket
+	allowed, _, _ = r.TakeRateLimitToken(RATELIMIT_TRADER, "0xdef", limit, now)
+	if !allowed {
+		t.Errorf("other trader should be allowed")
+	}
+	// one token refilled per second
+	allowed, _, _ = r.TakeRateLimitToken(RATELIMIT_TRADER, "0xabc", limit, now.Add(time.Second))
+	if !allowed {
+		t.Errorf("request after refill should be allowed")
+	}
+	// refunded tokens are available again, up to the burst
+	if err = r.RefundRateLimitToken(RATELIMIT_TRADER, "0xabc", limit); err != nil {
+		t.Fatal(err)
+	}
+	allowed, _, _ = r.TakeRateLimitToken(RATELIMIT_TRADER, "0xabc", limit, now.Add(time.Second))
+	if !allowed {
+		t.Errorf("refunded token not available")
+	}
+	stats, err := r.GetRateLimitStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats[RATELIMIT_TRADER]["allowed"] != 6 || stats[RATELIMIT_TRADER]["limited"] != 1 {
+		t.Errorf("unexpected stats %v", stats)
+	}
+}
@@ -0,0 +1,211 @@
+package utils
+
+import (
+	"errors"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/D8-X/d8x-futures-go-sdk/pkg/d8x_futures"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/redis/rueidis"
+)
+
+// Redis keys of referral codes: REFERRAL_CODE:<code> hash with the code data,
+// REFERRAL_CODES set of all codes, REFERRAL_TRADER:<trader> code the trader
+// is bound to
+const REFERRAL_CODE_REDIS = "REFERRAL_CODE"
+const REFERRAL_CODES_REDIS = "REFERRAL_CODES"
+const REFERRAL_TRADER_REDIS = "REFERRAL_TRADER"
+
+// Traders prove they use a referral code by signing
+// REFERRAL_MESSAGE_PREFIX + <code> (EIP-191 personal_sign)
+const REFERRAL_MESSAGE_PREFIX = "D8X broker referral code: "
+
+var referralCodeRe = regexp.MustCompile(`^[A-Z0-9_-]{3,32}$`)
+
+var ErrReferralCodeNotFound = errors.New("referral code not found")
+
+// ReferralCode grants traders bound to the code a discount on the broker fee
+// and the referrer a share of the fee paid
+type ReferralCode struct {
+	Code     string         `json:"code"`
+	Referrer common.Address `json:"referrer"`
+	// discount on the broker fee of the trader in percent
+	DiscountPerc float64 `json:"discountPerc"`
+	// share of the (discounted) broker fee rebated to the referrer in percent
+	SharePerc float64 `json:"referrerSharePerc"`
+	Created   int64   `json:"created"`
+}
+
+// NormalizeReferralCode returns the code in upper case, codes are case
+// insensitive
+func NormalizeReferralCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func referralCodeKey(code string) string {
+	return REFERRAL_CODE_REDIS + ":" + code
+}
+
+func referralTraderKey(trader string) string {
+	return REFERRAL_TRADER_REDIS + ":" + strings.ToLower(trader)
+}
+
+// CreateReferralCode stores a new referral code, codes cannot be overwritten
+func (r *RueidisClient) CreateReferralCode(c ReferralCode) (ReferralCode, error) {
+	c.Code = NormalizeReferralCode(c.Code)
+	if !referralCodeRe.MatchString(c.Code) {
+		return ReferralCode{}, errors.New("code must be 3-32 characters A-Z, 0-9, _ or -")
+	}
+	if c.Referrer == (common.Address{}) {
+		return ReferralCode{}, errors.New("referrer required")
+	}
+	if c.DiscountPerc < 0 || c.DiscountPerc > 100 || c.SharePerc < 0 || c.SharePerc > 100 {
+		return ReferralCode{}, errors.New("discountPerc and referrerSharePerc must be in [0, 100]")
+	}
+	c.Created = time.Now().Unix()
+	client := *r.Client
+	key := referralCodeKey(c.Code)
+	ok, err := client.Do(r.Ctx, client.B().Hsetnx().Key(key).Field("Referrer").Value(c.Referrer.Hex()).Build()).AsBool()
+	if err != nil {
+		return ReferralCode{}, err
+	}
+	if !ok {
+		return ReferralCode{}, errors.New("referral code " + c.Code + " exists")
+	}
+	for _, res := range client.DoMulti(r.Ctx,
+		client.B().Hset().Key(key).FieldValue().
+			FieldValue("DiscountPerc", strconv.FormatFloat(c.DiscountPerc, 'f', -1, 64)).
+			FieldValue("SharePerc", strconv.FormatFloat(c.SharePerc, 'f', -1, 64)).
+			FieldValue("Created", strconv.FormatInt(c.Created, 10)).Build(),
+		client.B().Sadd().Key(REFERRAL_CODES_REDIS).Member(c.Code).Build()) {
+		if res.Error() != nil {
+			return ReferralCode{}, res.Error()
+		}
+	}
+	return c, nil
+}
+
+// GetReferralCode returns the referral code, ErrReferralCodeNotFound if it
+// does not exist
+func (r *RueidisClient) GetReferralCode(code string) (ReferralCode, error) {
+	code = NormalizeReferralCode(code)
+	client := *r.Client
+	hm, err := client.Do(r.Ctx, client.B().Hgetall().Key(referralCodeKey(code)).Build()).AsStrMap()
+	if err != nil {
+		return ReferralCode{}, err
+	}
+	if len(hm) == 0 || hm["Created"] == "" {
+		return ReferralCode{}, ErrReferralCodeNotFound
+	}
+	c := ReferralCode{Code: code, Referrer: common.HexToAddress(hm["Referrer"])}
+	c.DiscountPerc, _ = strconv.ParseFloat(hm["DiscountPerc"], 64)
+	c.SharePerc, _ = strconv.ParseFloat(hm["SharePerc"], 64)
+	c.Created, _ = strconv.ParseInt(hm["Created"], 10, 64)
+	return c, nil
+}
+
+// ListReferralCodes returns all referral codes
+func (r *RueidisClient) ListReferralCodes() ([]ReferralCode, error) {
+	client := *r.Client
+	codes, err := client.Do(r.Ctx, client.B().Smembers().Key(REFERRAL_CODES_REDIS).Build()).AsStrSlice()
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(codes)
+	res := make([]ReferralCode, 0, len(codes))
+	for _, code := range codes {
+		c, err := r.GetReferralCode(code)
+		if err != nil {
+			continue
+		}
+		res = append(res, c)
+	}
+	return res, nil
+}
+
+// DeleteReferralCode removes the code. Traders bound to the code keep the
+// binding but no longer get a discount
+func (r *RueidisClient) DeleteReferralCode(code string) error {
+	code = NormalizeReferralCode(code)
+	client := *r.Client
+	n, err := client.Do(r.Ctx, client.B().Del().Key(referralCodeKey(code)).Build()).AsInt64()
+	if err != nil {
+		return err
+	}
+	client.Do(r.Ctx, client.B().Srem().Key(REFERRAL_CODES_REDIS).Member(code).Build())
+	if n == 0 {
+		return ErrReferralCodeNotFound
+	}
+	return nil
+}
+
+// VerifyReferralSignature checks that the trader signed the referral
+// message of the code
+func VerifyReferralSignature(trader, code, signature string) error {
+	sig, err := d8x_futures.BytesFromHexString(signature)
+	if err != nil || len(sig) != 65 {
+		return errors.New("invalid referral signature")
+	}
+	if sig[64] < 27 {
+		sig[64] += 27
+	}
+	msg := REFERRAL_MESSAGE_PREFIX + NormalizeReferralCode(code)
+	rec, err := d8x_futures.RecoverEvmAddress([]byte(msg), sig)
+	if err != nil || !strings.EqualFold(rec.Hex(), trader) {
+		return errors.New("invalid referral signature")
+	}
+	return nil
+}
+
+// CheckTraderReferral returns the code the trader can be bound to
+func (r *RueidisClient) CheckTraderReferral(trader, code string) (ReferralCode, error) {
+	c, err := r.GetReferralCode(code)
+	if err != nil {
+		return ReferralCode{}, err
+	}
+	if strings.EqualFold(c.Referrer.Hex(), trader) {
+		return ReferralCode{}, errors.New("referrers cannot use their own referral code")
+	}
+	return c, nil
+}
+
+// BindTraderReferral binds the trader to the code. A trader is bound once,
+// the code the trader is bound to is returned
+func (r *RueidisClient) BindTraderReferral(trader, code string) (string, error) {
+	c, err := r.CheckTraderReferral(trader, code)
+	if err != nil {
+		return "", err
+	}
+	client := *r.Client
+	key := referralTraderKey(trader)
+	err = client.Do(r.Ctx, client.B().Set().Key(key).Value(c.Code).Nx().Build()).Error()
+	if err == nil {
+		return c.Code, nil
+	}
+	if !rueidis.IsRedisNil(err) {
+		return "", err
+	}
+	return client.Do(r.Ctx, client.B().Get().Key(key).Build()).ToString()
+}
+
+// TraderReferral returns the referral code the trader is bound to, false if
+// the trader is not bound or the code was deleted
+func (r *RueidisClient) TraderReferral(trader string) (ReferralCode, bool, error) {
+	client := *r.Client
+	code, err := client.Do(r.Ctx, client.B().Get().Key(referralTraderKey(trader)).Build()).ToString()
+	if rueidis.IsRedisNil(err) {
+		return ReferralCode{}, false, nil
+	}
+	if err != nil {
+		return ReferralCode{}, false, err
+	}
+	c, err := r.GetReferralCode(code)
+	if err == ErrReferralCodeNotFound {
+		return ReferralCode{}, false, nil
+	}
+	return c, err == nil, err
+}
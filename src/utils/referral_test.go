@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestReferralCodes(t *testing.T) {
+	r, _ := newTestRedis(t)
+	referrer := common.HexToAddress("0x3ef256282e578c5D97a7231C3C046F19b1E50855")
+	trader := "0x9d5aaB428e98678d0E645ea4AeBd25f744341a05"
+
+	c, err := r.CreateReferralCode(ReferralCode{Code: "alice-1", Referrer: referrer, DiscountPerc: 10, SharePerc: 20})
+	if err != nil || c.Code != "ALICE-1" {
+		t.Fatalf("creating code: %v %v", c, err)
+	}
+	for name, invalid := range map[string]ReferralCode{
+		"exists":        {Code: "Alice-1", Referrer: referrer},
+		"short code":    {Code: "ab", Referrer: referrer},
+		"no referrer":   {Code: "BOB"},
+		"discount >100": {Code: "BOB", Referrer: referrer, DiscountPerc: 110},
+	} {
+		if _, err := r.CreateReferralCode(invalid); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	if _, err = r.CreateReferralCode(ReferralCode{Code: "BOB", Referrer: referrer, DiscountPerc: 50}); err != nil {
+		t.Fatal(err)
+	}
+	codes, err := r.ListReferralCodes()
+	if err != nil || len(codes) != 2 || codes[0].Code != "ALICE-1" || codes[0].SharePerc != 20 {
+		t.Errorf("unexpected codes %v %v", codes, err)
+	}
+
+	if _, err = r.BindTraderReferral(trader, "unknown"); err != ErrReferralCodeNotFound {
+		t.Errorf("expected not found, got %v", err)
+	}
+	if _, err = r.BindTraderReferral(referrer.Hex(), "alice-1"); err == nil {
+		t.Errorf("expected error for own code")
+	}
+	if _, exists, _ := r.TraderReferral(trader); exists {
+		t.Errorf("trader should not be bound")
+	}
+	code, err := r.BindTraderReferral(trader, "alice-1")
+	if err != nil || code != "ALICE-1" {
+		t.Fatalf("binding trader: %s %v", code, err)
+	}
+	// traders are bound once
+	if code, _ = r.BindTraderReferral(trader, "BOB"); code != "ALICE-1" {
+		t.Errorf("trader rebound to %s", code)
+	}
+	ref, exists, err := r.TraderReferral("0x9D5AAB428E98678D0E645EA4AEBD25F744341A05")
+	if err != nil || !exists || ref.Code != "ALICE-1" || ref.DiscountPerc != 10 || ref.Referrer != referrer {
+		t.Errorf("unexpected trader referral %v %v %v", ref, exists, err)
+	}
+
+	if err = r.DeleteReferralCode("alice-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists, _ = r.TraderReferral(trader); exists {
+		t.Errorf("deleted code still applies")
+	}
+	if err = r.DeleteReferralCode("alice-1"); err != ErrReferralCodeNotFound {
+		t.Errorf("expected not found, got %v", err)
+	}
+}
@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// RpcClients keeps one rpc client per chain so lookups in the request path
+// do not dial a new connection. A client is dialed on first use and
+// replaced when the rpc urls of the chain change
+type RpcClients struct {
+	// RpcUrls returns the rpc urls of a chain
+	RpcUrls func(chainId int64) []string
+	mu      sync.Mutex
+	clients map[int64]rpcClient
+}
+
+type rpcClient struct {
+	client *ethclient.Client
+	// urls the client was chosen from
+	urls []string
+}
+
+func NewRpcClients(rpcUrls func(chainId int64) []string) *RpcClients {
+	return &RpcClients{RpcUrls: rpcUrls, clients: make(map[int64]rpcClient)}
+}
+
+// Client returns the rpc client of the chain
+func (c *RpcClients) Client(ctx context.Context, chainId int64) (*ethclient.Client, error) {
+	urls := c.RpcUrls(chainId)
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no rpc for chain %d", chainId)
+	}
+	c.mu.Lock()
+	cached, exists := c.clients[chainId]
+	c.mu.Unlock()
+	if exists && slices.Equal(cached.urls, urls) {
+		return cached.client, nil
+	}
+	client, err := ethclient.DialContext(ctx, urls[rand.Intn(len(urls))])
+	if err != nil {
+		return nil, errors.New("rpc: " + err.Error())
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// another request may have dialed in the meantime
+	if cur, exists := c.clients[chainId]; exists && slices.Equal(cur.urls, urls) {
+		client.Close()
+		return cur.client, nil
+	}
+	if cur, exists := c.clients[chainId]; exists {
+		cur.client.Close()
+	}
+	c.clients[chainId] = rpcClient{client: client, urls: urls}
+	return client, nil
+}
+
+// Close closes all clients
+func (c *RpcClients) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for chainId, cur := range c.clients {
+		cur.client.Close()
+		delete(c.clients, chainId)
+	}
+}
@@ -0,0 +1,27 @@
+package utils
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRpcClients(t *testing.T) {
+	urls := map[int64][]string{42161: {"http://localhost:8545"}}
+	c := NewRpcClients(func(chainId int64) []string { return urls[chainId] })
+	defer c.Close()
+	ctx := context.Background()
+	c1, err := c.Client(ctx, 42161)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c2, _ := c.Client(ctx, 42161); c2 != c1 {
+		t.Errorf("client not reused")
+	}
+	urls[42161] = []string{"http://localhost:8546"}
+	if c3, _ := c.Client(ctx, 42161); c3 == c1 {
+		t.Errorf("client not replaced after rpc change")
+	}
+	if _, err := c.Client(ctx, 1101); err == nil {
+		t.Errorf("client for chain without rpc")
+	}
+}
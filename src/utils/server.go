@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// HttpTimeouts configures the http servers. Shutdown is the time in-flight
+// requests get to complete after a termination signal
+type HttpTimeouts struct {
+	Read     time.Duration
+	Write    time.Duration
+	Idle     time.Duration
+	Shutdown time.Duration
+}
+
+const HEALTH_CHECK_TIMEOUT = 5 * time.Second
+
+// NewHttpServer creates a http server with the given timeouts
+func NewHttpServer(addr string, handler http.Handler, t HttpTimeouts) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: t.Read,
+		ReadTimeout:       t.Read,
+		WriteTimeout:      t.Write,
+		IdleTimeout:       t.Idle,
+	}
+}
+
+// ServeHttp runs the server until ctx is cancelled and then shuts it down,
+// waiting for in-flight requests to complete for at most t.Shutdown
+func ServeHttp(ctx context.Context, srv *http.Server, t HttpTimeouts) error {
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+	}
+	slog.Info("shutting down server " + srv.Addr)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), t.Shutdown)
+	defer cancel()
+	err := srv.Shutdown(shutdownCtx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errors.New("shutdown timeout, in-flight requests aborted")
+	}
+	return err
+}
+
+// Ping checks the Redis connection
+func (r *RueidisClient) Ping(ctx context.Context) error {
+	client := *r.Client
+	return client.Do(ctx, client.B().Ping().Build()).Error()
+}
+
+// CheckRpc checks that at least one of the rpc urls is reachable and
+// serves the given chain
+func CheckRpc(ctx context.Context, urls []string, chainId int64) error {
+	if len(urls) == 0 {
+		return errors.New("no rpc url")
+	}
+	var err error
+	for _, url := range urls {
+		var rpc *ethclient.Client
+		rpc, err = ethclient.DialContext(ctx, url)
+		if err != nil {
+			continue
+		}
+		id, e := rpc.ChainID(ctx)
+		rpc.Close()
+		if e != nil {
+			err = e
+			continue
+		}
+		if id.Int64() != chainId {
+			err = errors.New("rpc serves chain " + id.String())
+			continue
+		}
+		return nil
+	}
+	return err
+}
+
+// CheckRpcs checks the rpc reachability of all chains concurrently and
+// returns the error per chain (nil if reachable)
+func CheckRpcs(ctx context.Context, rpcUrls map[int64][]string) map[string]error {
+	res := make(map[string]error, len(rpcUrls))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for chainId, urls := range rpcUrls {
+		wg.Add(1)
+		go func(chainId int64, urls []string) {
+			defer wg.Done()
+			err := CheckRpc(ctx, urls, chainId)
+			mu.Lock()
+			res[strconv.FormatInt(chainId, 10)] = err
+			mu.Unlock()
+		}(chainId, urls)
+	}
+	wg.Wait()
+	return res
+}
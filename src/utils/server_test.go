@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServeHttpDrainsRequests(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("signed"))
+	})
+	timeouts := HttpTimeouts{Read: time.Second, Write: 5 * time.Second, Idle: time.Second, Shutdown: 5 * time.Second}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- ServeHttp(ctx, NewHttpServer(addr, handler, timeouts), timeouts)
+	}()
+
+	resChan := make(chan string, 1)
+	go func() {
+		var res *http.Response
+		for i := 0; i < 50; i++ {
+			res, err = http.Get("http://" + addr)
+			if err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if err != nil {
+			resChan <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		resChan <- string(body)
+	}()
+	<-started
+	cancel()
+	if res := <-resChan; res != "signed" {
+		t.Errorf("in-flight request not completed: %s", res)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("unexpected shutdown error: %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
@@ -13,7 +14,11 @@ import (
 	"math/big"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/D8-X/d8x-broker-server/src/ledger"
+	"github.com/D8-X/d8x-broker-server/src/metrics"
 	"github.com/D8-X/d8x-futures-go-sdk/config"
 	"github.com/D8-X/d8x-futures-go-sdk/pkg/contracts"
 	"github.com/D8-X/d8x-futures-go-sdk/pkg/d8x_futures"
@@ -22,27 +27,136 @@ import (
 )
 
 // SignaturePen stores the chainId <-> deployment address mappings,
-// and the wallet struct for the broker
+// and the signer for the broker. Chain and rpc config can be swapped
+// at runtime via UpdateConfig
 type SignaturePen struct {
-	ChainConfig map[int64]ChainConfig
-	RpcUrl      map[int64][]string
-	Wallets     map[int64]*d8x_futures.Wallet
+	mu          sync.RWMutex
+	chainConfig map[int64]ChainConfig
+	rpcUrl      map[int64][]string
+	Signers     map[int64]Signer
+	// optional ledger of signed orders
+	Ledger ledger.Store
+	// mark prices referral rebates are valued at, no rebates are recorded
+	// if nil
+	MarkPrices MarkPriceSource
 }
 
-func NewSignaturePen(privateKeyHex string, chConf map[int64]ChainConfig, rpcConf []RpcConfig) (SignaturePen, error) {
+// NewSignaturePen creates a signature pen that keeps the broker key in memory
+func NewSignaturePen(privateKeyHex string, chConf map[int64]ChainConfig, rpcConf []RpcConfig) (*SignaturePen, error) {
+	signer, err := NewLocalSigner(privateKeyHex)
+	if err != nil {
+		return nil, err
+	}
+	return NewSignaturePenWithSigner(signer, chConf, rpcConf)
+}
 
-	rpcMap := createRpcConfigMap(rpcConf, chConf)
+// NewSignaturePenWithSigner creates a signature pen that uses the given signer
+// for all configured chains
+func NewSignaturePenWithSigner(signer Signer, chConf map[int64]ChainConfig, rpcConf []RpcConfig) (*SignaturePen, error) {
+	signers := make(map[int64]Signer)
+	for chainId := range chConf {
+		signers[chainId] = signer
+	}
+	return NewSignaturePenWithSigners(signers, chConf, rpcConf)
+}
 
-	wallets, err := createWalletMap(chConf, privateKeyHex, rpcMap)
+// NewSignaturePenWithSigners creates a signature pen with a dedicated signer
+// per chain. Every configured chain requires a signer
+func NewSignaturePenWithSigners(signers map[int64]Signer, chConf map[int64]ChainConfig, rpcConf []RpcConfig) (*SignaturePen, error) {
+	rpcMap, err := validatePenConfig(signers, chConf, rpcConf)
 	if err != nil {
-		return SignaturePen{}, err
+		return nil, err
+	}
+	penSigners := make(map[int64]Signer)
+	for chainId := range chConf {
+		penSigners[chainId] = signers[chainId]
 	}
 	pen := SignaturePen{
-		ChainConfig: chConf,
-		RpcUrl:      rpcMap,
-		Wallets:     wallets,
+		chainConfig: chConf,
+		rpcUrl:      rpcMap,
+		Signers:     penSigners,
 	}
-	return pen, nil
+	return &pen, nil
+}
+
+// validatePenConfig ensures every configured chain has an rpc and a signer
+// and returns the rpc map
+func validatePenConfig(signers map[int64]Signer, chConf map[int64]ChainConfig, rpcConf []RpcConfig) (map[int64][]string, error) {
+	rpcMap := createRpcConfigMap(rpcConf, chConf)
+	for chainId := range chConf {
+		if len(rpcMap[chainId]) == 0 {
+			return nil, fmt.Errorf("could not find RPC url for chain ID %d", chainId)
+		}
+		if signers[chainId] == nil {
+			return nil, fmt.Errorf("no broker key defined for chain %d", chainId)
+		}
+	}
+	return rpcMap, nil
+}
+
+// UpdateConfig validates the new chain and rpc config and atomically swaps
+// it. The old config is kept on error. Returns the list of changes
+func (p *SignaturePen) UpdateConfig(chConf map[int64]ChainConfig, rpcConf []RpcConfig) ([]string, error) {
+	rpcMap, err := validatePenConfig(p.Signers, chConf, rpcConf)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	diff := DiffChainConfig(p.chainConfig, chConf)
+	diff = append(diff, DiffRpcConfig(p.rpcUrl, rpcMap)...)
+	p.chainConfig = chConf
+	p.rpcUrl = rpcMap
+	return diff, nil
+}
+
+// GetChainConfig returns the config of the given chain
+func (p *SignaturePen) GetChainConfig(chainId int64) (ChainConfig, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	c, exists := p.chainConfig[chainId]
+	return c, exists
+}
+
+// GetChainConfigs returns the configs of all chains
+func (p *SignaturePen) GetChainConfigs() []ChainConfig {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	config := make([]ChainConfig, 0, len(p.chainConfig))
+	for _, conf := range p.chainConfig {
+		config = append(config, conf)
+	}
+	return config
+}
+
+// GetRpcUrls returns the rpc urls of the given chain
+func (p *SignaturePen) GetRpcUrls(chainId int64) []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.rpcUrl[chainId]
+}
+
+// BrokerAddress returns the broker address for the given chain. If chainId is
+// -1, the broker address is returned if all chains share the same broker
+func (p *SignaturePen) BrokerAddress(chainId int64) (common.Address, error) {
+	if chainId != -1 {
+		signer := p.Signers[chainId]
+		if signer == nil {
+			return common.Address{}, fmt.Errorf("no broker defined for chain %d", chainId)
+		}
+		return signer.Address(), nil
+	}
+	var addr common.Address
+	for _, signer := range p.Signers {
+		if addr != (common.Address{}) && addr != signer.Address() {
+			return common.Address{}, errors.New("broker address differs per chain, specify chain")
+		}
+		addr = signer.Address()
+	}
+	if addr == (common.Address{}) {
+		return common.Address{}, errors.New("no broker defined")
+	}
+	return addr, nil
 }
 
 func (p *SignaturePen) RecoverPaymentSignerAddr(ps d8x_futures.BrokerPaySignatureReq) (common.Address, error) {
@@ -50,11 +164,11 @@ func (p *SignaturePen) RecoverPaymentSignerAddr(ps d8x_futures.BrokerPaySignatur
 	if err != nil {
 		return common.Address{}, err
 	}
-	c := p.ChainConfig[ps.Payment.ChainId]
+	c, _ := p.GetChainConfig(ps.Payment.ChainId)
 	if c.MultiPayCtrctAddr == (common.Address{}) {
 		return common.Address{}, fmt.Errorf("Multipay ctrct not found for chain: " + strconv.Itoa(int(ps.Payment.ChainId)))
 	}
-	ctrct := p.ChainConfig[ps.Payment.ChainId].MultiPayCtrctAddr
+	ctrct := c.MultiPayCtrctAddr
 	if !strings.EqualFold(ctrct.Hex(), ps.Payment.MultiPayCtrct.Hex()) {
 		return common.Address{}, fmt.Errorf("multipay ctrct mismatch, expected: %s got: %s on chain %d", ctrct.String(), ps.Payment.MultiPayCtrct.Hex(), ps.Payment.ChainId)
 	}
@@ -66,12 +180,7 @@ func (p *SignaturePen) RecoverPaymentSignerAddr(ps d8x_futures.BrokerPaySignatur
 }
 
 func (p *SignaturePen) GetBrokerPaymentSignatureResponse(ps d8x_futures.BrokerPaySignatureReq) ([]byte, error) {
-	ctrct := p.ChainConfig[ps.Payment.ChainId].MultiPayCtrctAddr
-	if !strings.EqualFold(ctrct.String(), ps.Payment.MultiPayCtrct.String()) {
-		return nil, fmt.Errorf("Multipay ctrct mismatch, expected: " + ctrct.String())
-	}
-	w := p.Wallets[ps.Payment.ChainId]
-	_, sig, err := d8x_futures.RawCreatePaymentBrokerSignature(&ps.Payment, w)
+	sig, err := p.SignPayment(&ps.Payment)
 	if err != nil {
 		return nil, err
 	}
@@ -88,7 +197,32 @@ func (p *SignaturePen) GetBrokerPaymentSignatureResponse(ps d8x_futures.BrokerPa
 	return jsonResponse, nil
 }
 
-func (p *SignaturePen) GetBrokerOrderSignatureResponse(order APIOrderSig, chainId int64, redis *RueidisClient) ([]byte, error) {
+// SignPayment signs the payment with the broker key and returns the
+// hex encoded signature
+func (p *SignaturePen) SignPayment(pay *d8x_futures.PaySummary) (string, error) {
+	c, _ := p.GetChainConfig(pay.ChainId)
+	ctrct := c.MultiPayCtrctAddr
+	if !strings.EqualFold(ctrct.String(), pay.MultiPayCtrct.String()) {
+		return "", fmt.Errorf("Multipay ctrct mismatch, expected: " + ctrct.String())
+	}
+	signer := p.Signers[pay.ChainId]
+	if signer == nil {
+		return "", fmt.Errorf("no broker key defined for chain %d", pay.ChainId)
+	}
+	digest, err := CreatePaymentBrokerDigest(pay)
+	if err != nil {
+		return "", err
+	}
+	sigBytes, err := signer.SignDigest(digest[:])
+	if err != nil {
+		return "", err
+	}
+	return "0x" + common.Bytes2Hex(sigBytes), nil
+}
+
+// GetBrokerOrderSignatureResponse signs the order, publishes it to Redis and
+// records it in the ledger (if configured)
+func (p *SignaturePen) GetBrokerOrderSignatureResponse(order APIOrderSig, chainId int64, redis *RueidisClient, fee FeeInfo) ([]byte, error) {
 	var perpOrder = contracts.IPerpetualOrderOrder{
 		// data for broker signature
 		BrokerFeeTbps: order.BrokerFeeTbps,
@@ -97,24 +231,26 @@ func (p *SignaturePen) GetBrokerOrderSignatureResponse(order APIOrderSig, chainI
 		IDeadline:     order.Deadline,
 		IPerpetualId:  big.NewInt(int64(order.PerpetualId)),
 	}
-	chainConfig, exists := p.ChainConfig[chainId]
+	chainConfig, exists := p.GetChainConfig(chainId)
 	if !exists {
 		return nil, fmt.Errorf("chain config not defined for chain %d", chainId)
 	}
 	if chainConfig.ProxyAddr == (common.Address{}) {
 		return nil, fmt.Errorf("proxy address not defined in chain config for chain %d", chainId)
 	}
+	start := time.Now()
 	_, sig, err := p.SignOrder(perpOrder, chainConfig.ProxyAddr, chainId)
 	if err != nil {
 		return nil, err
 	}
+	metrics.ObserveSince(metrics.SignatureLatency.WithLabelValues("order"), start)
 	sigBytes, err := d8x_futures.BytesFromHexString(sig)
 	if err != nil {
 		return []byte{}, errors.New("decoding signature: " + err.Error())
 	}
 	// order digest
 	order.BrokerSignature = sigBytes
-	order.BrokerAddr = p.Wallets[chainId].Address.String()
+	order.BrokerAddr = p.Signers[chainId].Address().String()
 	digest, orderId, err := p.createOrderDigest(order, chainId)
 	if err != nil {
 		return []byte{}, errors.New("decoding signature: " + err.Error())
@@ -128,6 +264,34 @@ func (p *SignaturePen) GetBrokerOrderSignatureResponse(order APIOrderSig, chainI
 		OrderId:         orderId,
 	}
 	redis.PubOrder(order, orderId, chainId)
+	if p.Ledger != nil {
+		err = p.Ledger.RecordOrder(context.Background(), ledger.OrderRecord{
+			OrderId:            orderId,
+			ChainId:            chainId,
+			PerpetualId:        order.PerpetualId,
+			TraderAddr:         order.TraderAddr,
+			BrokerAddr:         order.BrokerAddr,
+			BrokerFeeTbps:      order.BrokerFeeTbps,
+			FeeTier:            fee.Tier,
+			Vip3Level:          fee.Vip3Level,
+			Flags:              order.Flags,
+			Deadline:           order.Deadline,
+			FAmount:            order.FAmount,
+			FLimitPrice:        order.FLimitPrice,
+			FTriggerPrice:      order.FTriggerPrice,
+			LeverageTDR:        order.LeverageTDR,
+			ExecutionTimestamp: order.ExecutionTimestamp,
+			Digest:             digest,
+			Signature:          sig,
+			SignedAt:           time.Now().Unix(),
+		})
+		if err != nil {
+			slog.Error("ledger: recording order " + orderId + ": " + err.Error())
+		}
+		if fee.Referral != nil {
+			p.recordRebate(order, orderId, chainId, fee.Referral)
+		}
+	}
 	// Marshal the struct into JSON
 	jsonResponse, err := json.Marshal(res)
 	if err != nil {
@@ -136,6 +300,46 @@ func (p *SignaturePen) GetBrokerOrderSignatureResponse(order APIOrderSig, chainI
 	return jsonResponse, nil
 }
 
+// maximal time to read the mark price for a referral rebate
+const REBATE_PRICE_TIMEOUT = 10 * time.Second
+
+// recordRebate accrues the referrer's share of the broker fee of the order
+func (p *SignaturePen) recordRebate(order APIOrderSig, orderId string, chainId int64, ref *ReferralCode) {
+	if p.MarkPrices == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), REBATE_PRICE_TIMEOUT)
+	defer cancel()
+	px, err := p.MarkPrices.MarkPrice(ctx, chainId, order.PerpetualId)
+	if err != nil {
+		slog.Error("mark price, no referral rebate: "+err.Error(), "orderId", orderId, "code", ref.Code)
+		return
+	}
+	// valued at the mark price, the order prices are chosen by the client
+	notional, ok := SubmittedOrder{FAmount: order.FAmount}.Notional(px)
+	if !ok {
+		slog.Info("order without amount, no referral rebate", "orderId", orderId, "code", ref.Code)
+		return
+	}
+	err = p.Ledger.RecordRebate(context.Background(), ledger.RebateRecord{
+		OrderId:       orderId,
+		Code:          ref.Code,
+		Referrer:      ref.Referrer.Hex(),
+		TraderAddr:    order.TraderAddr,
+		ChainId:       chainId,
+		PerpetualId:   order.PerpetualId,
+		BrokerFeeTbps: order.BrokerFeeTbps,
+		DiscountPerc:  ref.DiscountPerc,
+		SharePerc:     ref.SharePerc,
+		Notional:      notional,
+		Rebate:        notional * float64(order.BrokerFeeTbps) / 100_000 * ref.SharePerc / 100,
+		SignedAt:      time.Now().Unix(),
+	})
+	if err != nil {
+		slog.Error("ledger: recording referral rebate of order " + orderId + ": " + err.Error())
+	}
+}
+
 func (p *SignaturePen) createOrderDigest(order APIOrderSig, chainId int64) (string, string, error) {
 	perpId := new(big.Int).SetInt64(int64(order.PerpetualId))
 
@@ -181,8 +385,8 @@ func (p *SignaturePen) createOrderDigest(order APIOrderSig, chainId int64) (stri
 }
 
 func (p *SignaturePen) SignOrder(order contracts.IPerpetualOrderOrder, proxyAddr common.Address, chainId int64) (string, string, error) {
-	wallet := p.Wallets[chainId]
-	if wallet == nil || wallet.PrivateKey == nil {
+	signer := p.Signers[chainId]
+	if signer == nil {
 		return "", "", fmt.Errorf("no broker key defined for chain %d", chainId)
 	}
 	slog.Info("data to sign",
@@ -193,10 +397,63 @@ func (p *SignaturePen) SignOrder(order contracts.IPerpetualOrderOrder, proxyAddr
 		"deadline", order.IDeadline,
 		"proxy", proxyAddr,
 	)
-	digest, sig, err := d8x_futures.RawCreateOrderBrokerSignature(
-		proxyAddr, chainId, wallet, int32(order.IPerpetualId.Int64()), uint32(order.BrokerFeeTbps),
-		order.TraderAddr.String(), order.IDeadline)
-	return digest, sig, err
+	digest, err := CreateOrderBrokerDigest(proxyAddr, chainId, int32(order.IPerpetualId.Int64()),
+		order.BrokerFeeTbps, order.TraderAddr, order.IDeadline)
+	if err != nil {
+		return "", "", err
+	}
+	sig, err := signer.SignDigest(digest[:])
+	if err != nil {
+		return "", "", err
+	}
+	return common.Bytes2Hex(digest[:]), "0x" + common.Bytes2Hex(sig), nil
+}
+
+// CreateOrderBrokerDigest creates the EIP-712 digest of the broker order data
+// the broker signs (same as the SDK's RawCreateOrderBrokerSignature)
+func CreateOrderBrokerDigest(proxyAddr common.Address, chainId int64, iPerpetualId int32, brokerFeeTbps uint16, traderAddr common.Address, iDeadline uint32) ([32]byte, error) {
+	domainHash := createDomainHash("Perpetual Trade Manager", chainId, proxyAddr)
+	typeHash := d8x_futures.Keccak256FromString("Order(uint24 iPerpetualId,uint16 brokerFeeTbps,address traderAddr,uint32 iDeadline)")
+	types := []string{"bytes32", "uint32", "uint16", "address", "uint32"}
+	values := []interface{}{typeHash, uint32(iPerpetualId), brokerFeeTbps, traderAddr, iDeadline}
+	return createTypedDataDigest(domainHash, types, values)
+}
+
+// CreatePaymentBrokerDigest creates the EIP-712 digest of the payment summary
+// the broker signs (same as the SDK's RawCreatePaymentBrokerSignature)
+func CreatePaymentBrokerDigest(ps *d8x_futures.PaySummary) ([32]byte, error) {
+	domainHash := createDomainHash("Multipay", ps.ChainId, ps.MultiPayCtrct)
+	typeHash := d8x_futures.Keccak256FromString("PaySummary(address payer,address executor,address token,uint32 timestamp,uint32 id,uint256 totalAmount)")
+	types := []string{"bytes32", "address", "address", "address", "uint32", "uint32", "uint256"}
+	values := []interface{}{typeHash, ps.Payer, ps.Executor, ps.Token, ps.Timestamp, ps.Id, ps.TotalAmount}
+	return createTypedDataDigest(domainHash, types, values)
+}
+
+func createTypedDataDigest(domainHash [32]byte, types []string, values []interface{}) ([32]byte, error) {
+	structHash, err := d8x_futures.AbiEncodeBytes32(types, values...)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	var structHash32 [32]byte
+	copy(structHash32[:], solsha3.SoliditySHA3(structHash))
+	digest0, err := d8x_futures.AbiEncodeBytes32([]string{"bytes32", "bytes32"}, domainHash, structHash32)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	var digest [32]byte
+	copy(digest[:], solsha3.SoliditySHA3(digest0))
+	return digest, nil
+}
+
+func createDomainHash(name string, chainId int64, contractAddr common.Address) [32]byte {
+	nameHash := d8x_futures.Keccak256FromString(name)
+	domainTypeHash := d8x_futures.Keccak256FromString("EIP712Domain(string name,uint256 chainId,address verifyingContract)")
+	types := []string{"bytes32", "bytes32", "uint256", "address"}
+	values := []interface{}{domainTypeHash, nameHash, big.NewInt(chainId), contractAddr}
+	domainSeparator, _ := d8x_futures.AbiEncodeBytes32(types, values...)
+	var domainHash [32]byte
+	copy(domainHash[:], solsha3.SoliditySHA3(domainSeparator))
+	return domainHash
 }
 
 func createRpcConfigMap(configList []RpcConfig, chainConfig map[int64]ChainConfig) map[int64][]string {
@@ -209,26 +466,6 @@ func createRpcConfigMap(configList []RpcConfig, chainConfig map[int64]ChainConfi
 	return config
 }
 
-func createWalletMap(chainConfig map[int64]ChainConfig, privateKeyHex string, rpcUrlMap map[int64][]string) (map[int64]*d8x_futures.Wallet, error) {
-	walletMap := make(map[int64]*d8x_futures.Wallet)
-	for chainId := range chainConfig {
-		rpcUrls := rpcUrlMap[chainId]
-		if len(rpcUrls) == 0 {
-			return nil, fmt.Errorf("createWalletMap could not find RPC url for chain ID %d", chainId)
-		}
-		client, err := CreateRpcClient(rpcUrls)
-		if err != nil {
-			return nil, fmt.Errorf("createWalletMap:" + err.Error())
-		}
-		wallet, err := d8x_futures.NewWallet(privateKeyHex, chainId, client)
-		if err != nil {
-			return nil, fmt.Errorf("error casting public key to ECDSA:" + err.Error())
-		}
-		walletMap[chainId] = wallet
-	}
-	return walletMap, nil
-}
-
 func Encrypt(plainText string, key []byte) (string, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
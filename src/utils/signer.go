@@ -0,0 +1,300 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/D8-X/d8x-futures-go-sdk/pkg/d8x_futures"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// Signer types selectable via SIGNER_TYPE
+const (
+	SIGNER_LOCAL   = "local"
+	SIGNER_REMOTE  = "remote"
+	SIGNER_JSONRPC = "jsonrpc"
+)
+
+const SIGNER_TIMEOUT = 10 * time.Second
+
+// Signer signs 32-byte digests on behalf of the broker. The signature
+// is an EVM-style (eth_sign) signature over the digest, i.e., the digest
+// is prefixed with "\x19Ethereum Signed Message:\n32" before hashing,
+// and the recovery id v is 27 or 28
+type Signer interface {
+	Address() common.Address
+	SignDigest(digest []byte) ([]byte, error)
+}
+
+// TxSigner is implemented by signers that can also sign transactions
+// (required for token approvals)
+type TxSigner interface {
+	SignTx(tx *types.Transaction, chainId *big.Int) (*types.Transaction, error)
+}
+
+// NewSigner creates a signer of the given type. For local signers,
+// target is the hex private key, for remote and jsonrpc signers it is
+// the signer url
+func NewSigner(signerType, target, addr, authToken string) (Signer, error) {
+	switch strings.ToLower(signerType) {
+	case "", SIGNER_LOCAL:
+		return NewLocalSigner(target)
+	case SIGNER_REMOTE:
+		return NewRemoteSigner(target, authToken)
+	case SIGNER_JSONRPC:
+		return NewJsonRpcSigner(target, addr)
+	}
+	return nil, fmt.Errorf("unknown signer type %s", signerType)
+}
+
+// LocalSigner keeps the private key in memory
+type LocalSigner struct {
+	key  *ecdsa.PrivateKey
+	addr common.Address
+}
+
+// NewLocalSigner creates a signer from a private key of the form "abcdef012" (0x optional)
+func NewLocalSigner(privateKeyHex string) (*LocalSigner, error) {
+	key, err := crypto.HexToECDSA(strings.TrimPrefix(strings.TrimSpace(privateKeyHex), "0x"))
+	if err != nil {
+		return nil, errors.New("invalid private key: " + err.Error())
+	}
+	return &LocalSigner{key: key, addr: crypto.PubkeyToAddress(key.PublicKey)}, nil
+}
+
+func (s *LocalSigner) Address() common.Address {
+	return s.addr
+}
+
+func (s *LocalSigner) SignDigest(digest []byte) ([]byte, error) {
+	return d8x_futures.CreateEvmSignature(digest, s.key)
+}
+
+func (s *LocalSigner) SignTx(tx *types.Transaction, chainId *big.Int) (*types.Transaction, error) {
+	return types.SignTx(tx, types.LatestSignerForChainID(chainId), s.key)
+}
+
+// RemoteSignReq is the request body of the remote signer protocol
+type RemoteSignReq struct {
+	Address string `json:"address"`
+	Digest  string `json:"digest"`
+}
+
+// RemoteSignRes is the response body of the remote signer protocol
+type RemoteSignRes struct {
+	Signature string `json:"signature"`
+	Address   string `json:"address"`
+	Error     string `json:"error,omitempty"`
+}
+
+// RemoteSigner signs via a signing service over HTTP, for example a
+// sidecar in front of an HSM/PKCS#11 token or a cloud KMS:
+//
+//	GET  <url>/address -> {"address": "0x.."}
+//	POST <url>/sign {"address": "0x..", "digest": "0x.."} -> {"signature": "0x.."}
+type RemoteSigner struct {
+	url       string
+	authToken string
+	addr      common.Address
+	client    *http.Client
+}
+
+func NewRemoteSigner(url, authToken string) (*RemoteSigner, error) {
+	s := RemoteSigner{
+		url:       strings.TrimSuffix(url, "/"),
+		authToken: authToken,
+		client:    &http.Client{Timeout: SIGNER_TIMEOUT},
+	}
+	var res RemoteSignRes
+	err := s.do(http.MethodGet, "/address", nil, &res)
+	if err != nil {
+		return nil, errors.New("querying remote signer address: " + err.Error())
+	}
+	if !common.IsHexAddress(res.Address) {
+		return nil, fmt.Errorf("remote signer returned invalid address %s", res.Address)
+	}
+	s.addr = common.HexToAddress(res.Address)
+	return &s, nil
+}
+
+func (s *RemoteSigner) Address() common.Address {
+	return s.addr
+}
+
+func (s *RemoteSigner) SignDigest(digest []byte) ([]byte, error) {
+	req := RemoteSignReq{Address: s.addr.Hex(), Digest: hexutil.Encode(digest)}
+	var res RemoteSignRes
+	err := s.do(http.MethodPost, "/sign", req, &res)
+	if err != nil {
+		return nil, errors.New("remote signer: " + err.Error())
+	}
+	sig, err := hexutil.Decode(res.Signature)
+	if err != nil {
+		return nil, errors.New("remote signer returned invalid signature: " + err.Error())
+	}
+	return checkSignature(digest, sig, s.addr)
+}
+
+func (s *RemoteSigner) do(method, path string, body any, res *RemoteSignRes) error {
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, s.url+path, rd)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.authToken)
+	}
+	response, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(data, res)
+	if err != nil {
+		return fmt.Errorf("status %d: %s", response.StatusCode, string(data))
+	}
+	if res.Error != "" {
+		return errors.New(res.Error)
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", response.StatusCode)
+	}
+	return nil
+}
+
+// JsonRpcSigner signs via an Ethereum JSON-RPC endpoint that exposes
+// eth_sign (and optionally eth_signTransaction), e.g., Clef or Web3Signer
+type JsonRpcSigner struct {
+	client *rpc.Client
+	addr   common.Address
+}
+
+// NewJsonRpcSigner connects to the JSON-RPC signer. If addr is empty, the
+// first account returned by eth_accounts is used
+func NewJsonRpcSigner(url, addr string) (*JsonRpcSigner, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), SIGNER_TIMEOUT)
+	defer cancel()
+	client, err := rpc.DialContext(ctx, url)
+	if err != nil {
+		return nil, errors.New("dialing json-rpc signer: " + err.Error())
+	}
+	s := JsonRpcSigner{client: client}
+	if addr != "" {
+		if !common.IsHexAddress(addr) {
+			return nil, fmt.Errorf("invalid signer address %s", addr)
+		}
+		s.addr = common.HexToAddress(addr)
+		return &s, nil
+	}
+	var accs []common.Address
+	err = client.CallContext(ctx, &accs, "eth_accounts")
+	if err != nil {
+		return nil, errors.New("eth_accounts: " + err.Error())
+	}
+	if len(accs) == 0 {
+		return nil, errors.New("json-rpc signer has no accounts")
+	}
+	s.addr = accs[0]
+	return &s, nil
+}
+
+func (s *JsonRpcSigner) Address() common.Address {
+	return s.addr
+}
+
+func (s *JsonRpcSigner) SignDigest(digest []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), SIGNER_TIMEOUT)
+	defer cancel()
+	var sig hexutil.Bytes
+	err := s.client.CallContext(ctx, &sig, "eth_sign", s.addr, hexutil.Bytes(digest))
+	if err != nil {
+		return nil, errors.New("eth_sign: " + err.Error())
+	}
+	return checkSignature(digest, sig, s.addr)
+}
+
+func (s *JsonRpcSigner) SignTx(tx *types.Transaction, chainId *big.Int) (*types.Transaction, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), SIGNER_TIMEOUT)
+	defer cancel()
+	args := map[string]any{
+		"from":    s.addr,
+		"to":      tx.To(),
+		"gas":     hexutil.Uint64(tx.Gas()),
+		"value":   (*hexutil.Big)(tx.Value()),
+		"nonce":   hexutil.Uint64(tx.Nonce()),
+		"data":    hexutil.Bytes(tx.Data()),
+		"chainId": (*hexutil.Big)(chainId),
+	}
+	if tx.Type() == types.LegacyTxType {
+		args["gasPrice"] = (*hexutil.Big)(tx.GasPrice())
+	} else {
+		args["maxFeePerGas"] = (*hexutil.Big)(tx.GasFeeCap())
+		args["maxPriorityFeePerGas"] = (*hexutil.Big)(tx.GasTipCap())
+	}
+	var res json.RawMessage
+	err := s.client.CallContext(ctx, &res, "eth_signTransaction", args)
+	if err != nil {
+		return nil, errors.New("eth_signTransaction: " + err.Error())
+	}
+	// geth/clef return {raw, tx}, others return the raw transaction only
+	var raw hexutil.Bytes
+	if err := json.Unmarshal(res, &raw); err != nil {
+		var obj struct {
+			Raw hexutil.Bytes `json:"raw"`
+		}
+		if err := json.Unmarshal(res, &obj); err != nil {
+			return nil, errors.New("eth_signTransaction: unexpected response " + string(res))
+		}
+		raw = obj.Raw
+	}
+	signed := new(types.Transaction)
+	err = signed.UnmarshalBinary(raw)
+	if err != nil {
+		return nil, errors.New("decoding signed transaction: " + err.Error())
+	}
+	return signed, nil
+}
+
+// checkSignature normalizes the recovery id to 27/28 and ensures the
+// signature was produced by addr
+func checkSignature(digest, sig []byte, addr common.Address) ([]byte, error) {
+	if len(sig) != crypto.SignatureLength {
+		return nil, fmt.Errorf("invalid signature length %d", len(sig))
+	}
+	if sig[64] < 27 {
+		sig[64] += 27
+	}
+	rec, err := d8x_futures.RecoverEvmAddress(digest, append([]byte{}, sig...))
+	if err != nil {
+		return nil, errors.New("recovering signer: " + err.Error())
+	}
+	if rec != addr {
+		return nil, fmt.Errorf("signature from %s, expected %s", rec.Hex(), addr.Hex())
+	}
+	return sig, nil
+}
@@ -0,0 +1,197 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/D8-X/d8x-futures-go-sdk/pkg/d8x_futures"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// MockSigner is an offline signing service holding a private key in memory.
+// It speaks both the remote signer protocol (GET /address, POST /sign) and
+// the JSON-RPC signer protocol (POST / with eth_accounts, eth_sign,
+// eth_signTransaction) so that all signer types can be tested locally
+type MockSigner struct {
+	key       *ecdsa.PrivateKey
+	addr      common.Address
+	authToken string
+}
+
+func NewMockSigner(key *ecdsa.PrivateKey, authToken string) *MockSigner {
+	return &MockSigner{
+		key:       key,
+		addr:      crypto.PubkeyToAddress(key.PublicKey),
+		authToken: authToken,
+	}
+}
+
+func (m *MockSigner) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if m.authToken != "" && r.Header.Get("Authorization") != "Bearer "+m.authToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(RemoteSignRes{Error: "unauthorized"})
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/address"):
+		json.NewEncoder(w).Encode(RemoteSignRes{Address: m.addr.Hex()})
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/sign"):
+		m.handleSign(w, r)
+	case r.Method == http.MethodPost:
+		m.handleJsonRpc(w, r)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(RemoteSignRes{Error: "not found"})
+	}
+}
+
+func (m *MockSigner) handleSign(w http.ResponseWriter, r *http.Request) {
+	var req RemoteSignReq
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(RemoteSignRes{Error: "invalid request"})
+		return
+	}
+	if !strings.EqualFold(req.Address, m.addr.Hex()) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(RemoteSignRes{Error: "unknown address"})
+		return
+	}
+	digest, err := hexutil.Decode(req.Digest)
+	if err != nil || len(digest) != 32 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(RemoteSignRes{Error: "digest must be 32 bytes hex"})
+		return
+	}
+	sig, err := d8x_futures.CreateEvmSignature(digest, m.key)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(RemoteSignRes{Error: err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(RemoteSignRes{Address: m.addr.Hex(), Signature: hexutil.Encode(sig)})
+}
+
+type jsonRpcReq struct {
+	Id     json.RawMessage   `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+type jsonRpcErr struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type jsonRpcRes struct {
+	Version string          `json:"jsonrpc"`
+	Id      json.RawMessage `json:"id"`
+	Result  any             `json:"result,omitempty"`
+	Error   *jsonRpcErr     `json:"error,omitempty"`
+}
+
+type txArgs struct {
+	To                   *common.Address `json:"to"`
+	Gas                  hexutil.Uint64  `json:"gas"`
+	GasPrice             *hexutil.Big    `json:"gasPrice"`
+	MaxFeePerGas         *hexutil.Big    `json:"maxFeePerGas"`
+	MaxPriorityFeePerGas *hexutil.Big    `json:"maxPriorityFeePerGas"`
+	Value                *hexutil.Big    `json:"value"`
+	Nonce                hexutil.Uint64  `json:"nonce"`
+	Data                 hexutil.Bytes   `json:"data"`
+	ChainId              *hexutil.Big    `json:"chainId"`
+}
+
+func (m *MockSigner) handleJsonRpc(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	var req jsonRpcReq
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		json.NewEncoder(w).Encode(jsonRpcRes{Version: "2.0", Error: &jsonRpcErr{-32700, "parse error"}})
+		return
+	}
+	res, err := m.call(req)
+	out := jsonRpcRes{Version: "2.0", Id: req.Id, Result: res}
+	if err != nil {
+		out.Result = nil
+		out.Error = &jsonRpcErr{-32000, err.Error()}
+	}
+	json.NewEncoder(w).Encode(out)
+}
+
+func (m *MockSigner) call(req jsonRpcReq) (any, error) {
+	switch req.Method {
+	case "eth_accounts":
+		return []common.Address{m.addr}, nil
+	case "eth_sign":
+		if len(req.Params) != 2 {
+			return nil, errInvalidParams
+		}
+		var addr common.Address
+		var data hexutil.Bytes
+		if json.Unmarshal(req.Params[0], &addr) != nil || json.Unmarshal(req.Params[1], &data) != nil {
+			return nil, errInvalidParams
+		}
+		if addr != m.addr {
+			return nil, errUnknownAccount
+		}
+		sig, err := d8x_futures.CreateEvmSignature(data, m.key)
+		if err != nil {
+			return nil, err
+		}
+		return hexutil.Bytes(sig), nil
+	case "eth_signTransaction":
+		if len(req.Params) != 1 {
+			return nil, errInvalidParams
+		}
+		var args txArgs
+		if json.Unmarshal(req.Params[0], &args) != nil || args.ChainId == nil {
+			return nil, errInvalidParams
+		}
+		value := new(big.Int)
+		if args.Value != nil {
+			value = args.Value.ToInt()
+		}
+		var tx *types.Transaction
+		if args.GasPrice != nil {
+			tx = types.NewTx(&types.LegacyTx{
+				Nonce: uint64(args.Nonce), GasPrice: args.GasPrice.ToInt(), Gas: uint64(args.Gas),
+				To: args.To, Value: value, Data: args.Data,
+			})
+		} else {
+			if args.MaxFeePerGas == nil || args.MaxPriorityFeePerGas == nil {
+				return nil, errInvalidParams
+			}
+			tx = types.NewTx(&types.DynamicFeeTx{
+				ChainID: args.ChainId.ToInt(), Nonce: uint64(args.Nonce), GasTipCap: args.MaxPriorityFeePerGas.ToInt(),
+				GasFeeCap: args.MaxFeePerGas.ToInt(), Gas: uint64(args.Gas), To: args.To, Value: value, Data: args.Data,
+			})
+		}
+		signed, err := types.SignTx(tx, types.LatestSignerForChainID(args.ChainId.ToInt()), m.key)
+		if err != nil {
+			return nil, err
+		}
+		raw, err := signed.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"raw": hexutil.Bytes(raw), "tx": signed}, nil
+	}
+	return nil, errUnknownMethod
+}
+
+var (
+	errInvalidParams  = errors.New("invalid params")
+	errUnknownAccount = errors.New("unknown account")
+	errUnknownMethod  = errors.New("method not supported")
+)
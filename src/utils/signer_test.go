@@ -0,0 +1,152 @@
+package utils
+
+import (
+	"math/big"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/D8-X/d8x-futures-go-sdk/pkg/contracts"
+	"github.com/D8-X/d8x-futures-go-sdk/pkg/d8x_futures"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func testPen(t *testing.T, signer Signer) *SignaturePen {
+	chConf := map[int64]ChainConfig{
+		42161: {
+			ChainId:           42161,
+			MultiPayCtrctAddr: common.HexToAddress("0xfCBE2f332b1249cDE226DFFE8b2435162426AfE5"),
+			ProxyAddr:         common.HexToAddress("0x0000000000000000000000000000000000000042"),
+		},
+	}
+	rpcConf := []RpcConfig{{ChainId: 42161, Rpc: []string{"http://localhost:8545"}}}
+	pen, err := NewSignaturePenWithSigner(signer, chConf, rpcConf)
+	if err != nil {
+		t.Fatalf("NewSignaturePenWithSigner: %v", err)
+	}
+	return pen
+}
+
+func TestLocalSignerMatchesSdk(t *testing.T) {
+	_, key, _ := generateKey()
+	signer, err := NewLocalSigner(common.Bytes2Hex(crypto.FromECDSA(key)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pen := testPen(t, signer)
+	conf, _ := pen.GetChainConfig(42161)
+	proxy := conf.ProxyAddr
+	trader := common.HexToAddress("0x9d5aaB428e98678d0E645ea4AeBd25f744341a05")
+	order := contracts.IPerpetualOrderOrder{
+		BrokerFeeTbps: 60,
+		TraderAddr:    trader,
+		IDeadline:     1742381717,
+		IPerpetualId:  big.NewInt(100001),
+	}
+	digest, sig, err := pen.SignOrder(order, proxy, 42161)
+	if err != nil {
+		t.Fatalf("SignOrder: %v", err)
+	}
+	wallet := &d8x_futures.Wallet{PrivateKey: key}
+	sdkDigest, sdkSig, err := d8x_futures.RawCreateOrderBrokerSignature(proxy, 42161, wallet, 100001, 60, trader.Hex(), 1742381717)
+	if err != nil {
+		t.Fatalf("RawCreateOrderBrokerSignature: %v", err)
+	}
+	if digest != sdkDigest || sig != sdkSig {
+		t.Errorf("order signature differs from sdk\n%s %s\n%s %s", digest, sig, sdkDigest, sdkSig)
+	}
+
+	summary := d8x_futures.PaySummary{
+		Payer:         signer.Address(),
+		Executor:      common.HexToAddress("0xDa47a0CAc77D50114F2725D06a2Ce887cF9f4D98"),
+		Token:         common.HexToAddress("0x2d10075E54356E16Ebd5C6BB5194290709B69C1e"),
+		Timestamp:     1697025629,
+		Id:            1,
+		TotalAmount:   big.NewInt(1e18),
+		ChainId:       42161,
+		MultiPayCtrct: conf.MultiPayCtrctAddr,
+	}
+	d, err := CreatePaymentBrokerDigest(&summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paySig, err := signer.SignDigest(d[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, sdkPaySig, err := d8x_futures.RawCreatePaymentBrokerSignature(&summary, wallet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if "0x"+common.Bytes2Hex(paySig) != sdkPaySig {
+		t.Errorf("payment signature differs from sdk")
+	}
+}
+
+func TestRemoteSigner(t *testing.T) {
+	_, key, _ := generateKey()
+	srv := httptest.NewServer(NewMockSigner(key, "secret"))
+	defer srv.Close()
+
+	_, err := NewRemoteSigner(srv.URL, "wrong")
+	if err == nil {
+		t.Errorf("expected unauthorized remote signer to fail")
+	}
+	signer, err := NewSigner(SIGNER_REMOTE, srv.URL, "", "secret")
+	if err != nil {
+		t.Fatalf("NewSigner: %v", err)
+	}
+	if signer.Address() != crypto.PubkeyToAddress(key.PublicKey) {
+		t.Fatalf("wrong remote signer address %s", signer.Address().Hex())
+	}
+	checkSignerRoundtrip(t, signer)
+}
+
+func TestJsonRpcSigner(t *testing.T) {
+	_, key, _ := generateKey()
+	srv := httptest.NewServer(NewMockSigner(key, ""))
+	defer srv.Close()
+
+	signer, err := NewSigner(SIGNER_JSONRPC, srv.URL, "", "")
+	if err != nil {
+		t.Fatalf("NewSigner: %v", err)
+	}
+	if signer.Address() != crypto.PubkeyToAddress(key.PublicKey) {
+		t.Fatalf("wrong json-rpc signer address %s", signer.Address().Hex())
+	}
+	checkSignerRoundtrip(t, signer)
+
+	to := common.HexToAddress("0x2d10075E54356E16Ebd5C6BB5194290709B69C1e")
+	tx := types.NewTx(&types.LegacyTx{Nonce: 3, GasPrice: big.NewInt(1e9), Gas: 50000, To: &to, Value: big.NewInt(0), Data: []byte{1, 2}})
+	chainId := big.NewInt(42161)
+	signed, err := signer.(TxSigner).SignTx(tx, chainId)
+	if err != nil {
+		t.Fatalf("SignTx: %v", err)
+	}
+	from, err := types.Sender(types.LatestSignerForChainID(chainId), signed)
+	if err != nil || from != signer.Address() {
+		t.Errorf("wrong tx sender %s: %v", from.Hex(), err)
+	}
+}
+
+func checkSignerRoundtrip(t *testing.T, signer Signer) {
+	pen := testPen(t, signer)
+	order := contracts.IPerpetualOrderOrder{
+		BrokerFeeTbps: 60,
+		TraderAddr:    common.HexToAddress("0x9d5aaB428e98678d0E645ea4AeBd25f744341a05"),
+		IDeadline:     1742381717,
+		IPerpetualId:  big.NewInt(100001),
+	}
+	conf, _ := pen.GetChainConfig(42161)
+	digest, sig, err := pen.SignOrder(order, conf.ProxyAddr, 42161)
+	if err != nil {
+		t.Fatalf("SignOrder: %v", err)
+	}
+	digestBytes, _ := d8x_futures.BytesFromHexString(digest)
+	sigBytes, _ := d8x_futures.BytesFromHexString(sig)
+	addr, err := d8x_futures.RecoverEvmAddress(digestBytes, sigBytes)
+	if err != nil || addr != signer.Address() {
+		t.Errorf("recovered %s, expected %s: %v", addr.Hex(), signer.Address().Hex(), err)
+	}
+}
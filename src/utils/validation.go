@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/D8-X/d8x-futures-go-sdk/pkg/d8x_futures"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// DEFAULT_ORDER_MAX_DEADLINE is the default of the maximal time from now
+// to the order deadline
+const DEFAULT_ORDER_MAX_DEADLINE = 365 * 24 * time.Hour
+
+// order flags the broker signs
+var knownOrderFlags = d8x_futures.MASK_CLOSE_ONLY | d8x_futures.MASK_LIMIT_ORDER |
+	d8x_futures.MASK_MARKET_ORDER | d8x_futures.MASK_STOP_ORDER | d8x_futures.MASK_KEEP_POS_LEVERAGE
+
+// smallest 64.64 fixed point number
+var min64x64 = new(big.Int).Neg(new(big.Int).Lsh(big.NewInt(1), 127))
+
+// FieldError is a validation error of a request field
+type FieldError struct {
+	Field string `json:"field"`
+	Error string `json:"error"`
+}
+
+// ValidationError lists the invalid fields of a request
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for k, f := range e.Fields {
+		msgs[k] = f.Field + ": " + f.Error
+	}
+	return "invalid order: " + strings.Join(msgs, "; ")
+}
+
+func (e *ValidationError) add(field, format string, args ...any) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Error: fmt.Sprintf(format, args...)})
+}
+
+// OrderValidation are the limits orders are validated against
+type OrderValidation struct {
+	Now time.Time
+	// maximal time from now to the order deadline
+	MaxDeadline time.Duration
+	// perpetuals of the chain, perpetual id and leverage are not checked
+	// if nil
+	Perpetuals map[int32]PerpetualInfo
+}
+
+// Validate checks the order fields of the signature request. The error is
+// a *ValidationError with all invalid fields
+func (req *APIBrokerOrderSignatureReq) Validate(v OrderValidation) error {
+	var verr ValidationError
+	o := req.Order
+	if req.ChainId <= 0 {
+		verr.add("chainId", "required")
+	}
+	checkAddress(&verr, "order.traderAddr", o.TraderAddr)
+	checkAddress(&verr, "order.brokerAddr", o.BrokerAddr)
+
+	now := v.Now.Unix()
+	switch {
+	case o.Deadline == 0:
+		verr.add("order.iDeadline", "required")
+	case int64(o.Deadline) <= now:
+		verr.add("order.iDeadline", "deadline %d has passed", o.Deadline)
+	case v.MaxDeadline > 0 && int64(o.Deadline) > v.Now.Add(v.MaxDeadline).Unix():
+		verr.add("order.iDeadline", "deadline more than %s ahead", v.MaxDeadline)
+	}
+
+	amount, ok := parse64x64(&verr, "order.fAmount", o.FAmount)
+	if ok && amount.Sign() == 0 {
+		verr.add("order.fAmount", "must not be zero")
+	}
+	// a limit price of max 64.64 is a market buy without slippage limit
+	limitPrice, ok := parse64x64(&verr, "order.fLimitPrice", o.FLimitPrice)
+	if ok && limitPrice.Sign() < 0 {
+		verr.add("order.fLimitPrice", "must not be negative")
+	}
+	triggerPrice, ok := parse64x64(&verr, "order.fTriggerPrice", o.FTriggerPrice)
+	if ok && triggerPrice.Sign() < 0 {
+		verr.add("order.fTriggerPrice", "must not be negative")
+	}
+
+	// orders without market flag are limit orders
+	isMarket := o.Flags&d8x_futures.MASK_MARKET_ORDER != 0
+	isStop := o.Flags&d8x_futures.MASK_STOP_ORDER != 0
+	switch {
+	case o.Flags&^knownOrderFlags != 0:
+		verr.add("order.flags", "unknown flags 0x%x", o.Flags&^knownOrderFlags)
+	case isMarket && o.Flags&d8x_futures.MASK_LIMIT_ORDER != 0:
+		verr.add("order.flags", "market and limit order")
+	}
+	if triggerPrice != nil {
+		if isStop && triggerPrice.Sign() == 0 {
+			verr.add("order.fTriggerPrice", "required for stop orders")
+		}
+		if !isStop && triggerPrice.Sign() != 0 {
+			verr.add("order.fTriggerPrice", "only allowed for stop orders")
+		}
+	}
+	if !isMarket && limitPrice != nil && limitPrice.Sign() == 0 {
+		verr.add("order.fLimitPrice", "required for limit orders")
+	}
+
+	if o.PerpetualId <= 0 {
+		verr.add("order.iPerpetualId", "required")
+	} else if v.Perpetuals != nil {
+		perp, exists := v.Perpetuals[o.PerpetualId]
+		switch {
+		case !exists:
+			verr.add("order.iPerpetualId", "unknown perpetual %d on chain %d", o.PerpetualId, req.ChainId)
+		case perp.State != d8x_futures.NORMAL.String():
+			verr.add("order.iPerpetualId", "perpetual %d is not trading (state %s)", o.PerpetualId, perp.State)
+		case perp.MaxLeverage > 0 && float64(o.LeverageTDR)/100 > perp.MaxLeverage:
+			verr.add("order.leverageTDR", "leverage %.2f exceeds the maximum %.2f of perpetual %d",
+				float64(o.LeverageTDR)/100, perp.MaxLeverage, o.PerpetualId)
+		}
+	}
+	if len(verr.Fields) > 0 {
+		return &verr
+	}
+	return nil
+}
+
+func checkAddress(verr *ValidationError, field, addr string) {
+	switch {
+	case addr == "":
+		verr.add(field, "required")
+	case !common.IsHexAddress(addr):
+		verr.add(field, "invalid address")
+	case common.HexToAddress(addr) == (common.Address{}):
+		verr.add(field, "must not be the zero address")
+	}
+}
+
+// parse64x64 parses a 64.64 fixed point number, nil if invalid
+func parse64x64(verr *ValidationError, field, s string) (*big.Int, bool) {
+	if s == "" {
+		verr.add(field, "required")
+		return nil, false
+	}
+	x, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		verr.add(field, "not an integer")
+		return nil, false
+	}
+	if x.Cmp(min64x64) < 0 || x.Cmp(max64x64) > 0 {
+		verr.add(field, "out of 64.64 fixed point range")
+		return nil, false
+	}
+	return x, true
+}
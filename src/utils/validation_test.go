@@ -0,0 +1,182 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/D8-X/d8x-futures-go-sdk/pkg/d8x_futures"
+	d8xUtils "github.com/D8-X/d8x-futures-go-sdk/utils"
+)
+
+func TestValidateOrder(t *testing.T) {
+	now := time.Now()
+	valid := func() APIBrokerOrderSignatureReq {
+		return APIBrokerOrderSignatureReq{
+			ChainId: 42161,
+			Order: APIOrderSig{
+				PerpetualId:   100001,
+				TraderAddr:    "0x9d5aaB428e98678d0E645ea4AeBd25f744341a05",
+				BrokerAddr:    "0x3ef256282e578c5D97a7231C3C046F19b1E50855",
+				Deadline:      uint32(now.Add(time.Hour).Unix()),
+				Flags:         d8x_futures.MASK_LIMIT_ORDER,
+				FAmount:       d8xUtils.Float64ToABDK(-2).String(),
+				FLimitPrice:   d8xUtils.Float64ToABDK(1000).String(),
+				FTriggerPrice: "0",
+				LeverageTDR:   500,
+			},
+		}
+	}
+	v := OrderValidation{
+		Now:         now,
+		MaxDeadline: 24 * time.Hour,
+		Perpetuals: map[int32]PerpetualInfo{
+			100001: {Id: 100001, MaxLeverage: 10, State: "NORMAL"},
+			100002: {Id: 100002, MaxLeverage: 10, State: "EMERGENCY"},
+		},
+	}
+	tests := []struct {
+		name   string
+		modify func(*APIBrokerOrderSignatureReq)
+		fields []string
+	}{
+		{"valid", func(*APIBrokerOrderSignatureReq) {}, nil},
+		{"market buy without slippage limit", func(r *APIBrokerOrderSignatureReq) {
+			r.Order.Flags = d8x_futures.MASK_MARKET_ORDER
+			r.Order.FLimitPrice = max64x64.String()
+		}, nil},
+		{"stop limit", func(r *APIBrokerOrderSignatureReq) {
+			r.Order.Flags = d8x_futures.MASK_STOP_ORDER | d8x_futures.MASK_LIMIT_ORDER
+			r.Order.FTriggerPrice = d8xUtils.Float64ToABDK(900).String()
+		}, nil},
+		{"addresses", func(r *APIBrokerOrderSignatureReq) {
+			r.Order.TraderAddr = "0x0000000000000000000000000000000000000000"
+			r.Order.BrokerAddr = "0x123"
+		}, []string{"order.traderAddr", "order.brokerAddr"}},
+		{"deadline passed", func(r *APIBrokerOrderSignatureReq) {
+			r.Order.Deadline = uint32(now.Unix())
+		}, []string{"order.iDeadline"}},
+		{"deadline too far", func(r *APIBrokerOrderSignatureReq) {
+			r.Order.Deadline = uint32(now.Add(25 * time.Hour).Unix())
+		}, []string{"order.iDeadline"}},
+		{"numbers", func(r *APIBrokerOrderSignatureReq) {
+			r.Order.FAmount = "0"
+			r.Order.FLimitPrice = "1.5"
+			r.Order.FTriggerPrice = "-" + max64x64.String() + "0"
+		}, []string{"order.fAmount", "order.fLimitPrice", "order.fTriggerPrice"}},
+		{"flags", func(r *APIBrokerOrderSignatureReq) {
+			r.Order.Flags = d8x_futures.MASK_MARKET_ORDER | d8x_futures.MASK_LIMIT_ORDER | 1
+		}, []string{"order.flags"}},
+		{"market and limit", func(r *APIBrokerOrderSignatureReq) {
+			r.Order.Flags = d8x_futures.MASK_MARKET_ORDER | d8x_futures.MASK_LIMIT_ORDER
+		}, []string{"order.flags"}},
+		{"stop without trigger price", func(r *APIBrokerOrderSignatureReq) {
+			r.Order.Flags = d8x_futures.MASK_STOP_ORDER | d8x_futures.MASK_MARKET_ORDER
+		}, []string{"order.fTriggerPrice"}},
+		{"limit without price", func(r *APIBrokerOrderSignatureReq) {
+			r.Order.FLimitPrice = "0"
+			r.Order.FTriggerPrice = "1"
+		}, []string{"order.fTriggerPrice", "order.fLimitPrice"}},
+		{"leverage", func(r *APIBrokerOrderSignatureReq) {
+			r.Order.LeverageTDR = 1001
+		}, []string{"order.leverageTDR"}},
+		{"unknown perpetual", func(r *APIBrokerOrderSignatureReq) {
+			r.Order.PerpetualId = 100003
+		}, []string{"order.iPerpetualId"}},
+		{"perpetual not trading", func(r *APIBrokerOrderSignatureReq) {
+			r.Order.PerpetualId = 100002
+		}, []string{"order.iPerpetualId"}},
+		{"missing", func(r *APIBrokerOrderSignatureReq) {
+			*r = APIBrokerOrderSignatureReq{}
+		}, []string{"chainId", "order.traderAddr", "order.brokerAddr", "order.iDeadline",
+			"order.fAmount", "order.fLimitPrice", "order.fTriggerPrice", "order.iPerpetualId"}},
+	}
+	for _, tc := range tests {
+		req := valid()
+		tc.modify(&req)
+		err := req.Validate(v)
+		var fields []string
+		var verr *ValidationError
+		if errors.As(err, &verr) {
+			for _, f := range verr.Fields {
+				fields = append(fields, f.Field)
+			}
+		} else if err != nil {
+			t.Fatalf("%s: unexpected error type %v", tc.name, err)
+		}
+		if len(fields) != len(tc.fields) {
+			t.Errorf("%s: expected invalid fields %v, got %v", tc.name, tc.fields, err)
+			continue
+		}
+		for k := range fields {
+			if fields[k] != tc.fields[k] {
+				t.Errorf("%s: expected invalid fields %v, got %v", tc.name, tc.fields, err)
+				break
+			}
+		}
+	}
+
+	// without perpetuals, perpetual id and leverage are not checked
+	req := valid()
+	req.Order.PerpetualId = 100003
+	req.Order.LeverageTDR = 10000
+	v.Perpetuals = nil
+	if err := req.Validate(v); err != nil {
+		t.Errorf("order rejected without perpetuals: %v", err)
+	}
+}
+
+type countingPerpetuals struct {
+	queries int
+	err     error
+}
+
+func (s *countingPerpetuals) Perpetuals(ctx context.Context, chainId int64) (map[int32]PerpetualInfo, error) {
+	s.queries++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return map[int32]PerpetualInfo{100001: {Id: 100001, MaxLeverage: 10, State: "NORMAL"}}, nil
+}
+
+func TestPerpetualCache(t *testing.T) {
+	src := &countingPerpetuals{}
+	c := NewPerpetualCache(src)
+	ctx := context.Background()
+	for k := 0; k < 2; k++ {
+		perps, err := c.Perpetuals(ctx, 42161, 100001)
+		if err != nil || perps[100001].MaxLeverage != 10 {
+			t.Fatalf("unexpected perpetuals %v, %v", perps, err)
+		}
+	}
+	// unknown perpetuals are not queried again within the retry period
+	c.Perpetuals(ctx, 42161, 100002)
+	if src.queries != 1 {
+		t.Errorf("expected 1 query, got %d", src.queries)
+	}
+	c.mu.Lock()
+	entry := c.cache[42161]
+	entry.queried = entry.queried.Add(-PERPETUALS_RETRY)
+	c.cache[42161] = entry
+	c.mu.Unlock()
+	src.err = errors.New("rpc down")
+	perps, err := c.Perpetuals(ctx, 42161, 100002)
+	if err == nil || src.queries != 2 || perps[100001].Id != 100001 {
+		t.Errorf("expected last known perpetuals with the error, got %v, %v after %d queries", perps, err, src.queries)
+	}
+	if _, err = c.Perpetuals(ctx, 42161, 100002); err != nil || src.queries != 2 {
+		t.Errorf("failed query repeated within the retry period: %v, %d queries", err, src.queries)
+	}
+	// a failed refresh keeps the cached perpetuals
+	if err = c.Refresh(ctx, 42161); err == nil || src.queries != 3 {
+		t.Errorf("expected failed refresh, got %v after %d queries", err, src.queries)
+	}
+	src.err = nil
+	if err = c.Refresh(ctx, 42161); err != nil || src.queries != 4 {
+		t.Errorf("unexpected refresh %v after %d queries", err, src.queries)
+	}
+	if perps, _ := c.Perpetuals(ctx, 42161, 100001); perps[100001].Id != 100001 || src.queries != 4 {
+		t.Errorf("refreshed perpetuals not cached: %v after %d queries", perps, src.queries)
+	}
+}
@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/rueidis"
+)
+
+// VIP3_REDIS:<trader> stores the VIP3 level of the trader
+const VIP3_REDIS = "VIP"
+
+// Vip3Level returns the cached VIP3 level of the trader and its remaining
+// time to live
+func (r *RueidisClient) Vip3Level(trader string) (int, time.Duration, bool, error) {
+	client := *r.Client
+	key := VIP3_REDIS + ":" + strings.ToLower(trader)
+	res := client.DoMulti(r.Ctx,
+		client.B().Get().Key(key).Build(),
+		client.B().Pttl().Key(key).Build())
+	lvlStr, err := res[0].ToString()
+	if rueidis.IsRedisNil(err) {
+		return 0, 0, false, nil
+	}
+	if err != nil {
+		return 0, 0, false, err
+	}
+	lvl, err := strconv.Atoi(lvlStr)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	ttl, err := res[1].AsInt64()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	return lvl, time.Duration(ttl) * time.Millisecond, true, nil
+}
+
+// SetVip3Level caches the VIP3 level of the trader for ttl
+func (r *RueidisClient) SetVip3Level(trader string, lvl int, ttl time.Duration) error {
+	client := *r.Client
+	key := VIP3_REDIS + ":" + strings.ToLower(trader)
+	return client.Do(r.Ctx, client.B().Set().Key(key).Value(strconv.Itoa(lvl)).
+		Px(ttl).Build()).Error()
+}
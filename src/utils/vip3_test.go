@@ -0,0 +1,26 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVip3LevelCache(t *testing.T) {
+	r, _ := newTestRedis(t)
+	trader := "0x9d5aaB428e98678d0E645ea4AeBd25f744341a05"
+	_, _, found, err := r.Vip3Level(trader)
+	if err != nil || found {
+		t.Fatalf("expected no level, got %v, %v", found, err)
+	}
+	err = r.SetVip3Level(trader, 3, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lvl, ttl, found, err := r.Vip3Level(trader)
+	if err != nil || !found || lvl != 3 {
+		t.Fatalf("level %d, %v, %v", lvl, found, err)
+	}
+	if ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Fatalf("unexpected ttl %s", ttl)
+	}
+}
@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	d8xUtils "github.com/D8-X/d8x-futures-go-sdk/utils"
+	"github.com/redis/rueidis"
+)
+
+// Redis keys of the trader volume:
+// VOLUME:{<chainId>:<trader>} is a hash of notional volume per UTC day
+// (days since epoch), VOLUME_SEEN:{<chainId>:<trader>}:<orderId> marks
+// orders that are counted. The hash tag keeps both in one cluster slot
+const VOLUME_REDIS = "VOLUME"
+const VOLUME_SEEN_REDIS = "VOLUME_SEEN"
+
+// VOLUME_WINDOW_DAYS is the rolling window of the trader volume
+const VOLUME_WINDOW_DAYS = 30
+
+// largest 64.64 fixed point number, used as limit price of market orders
+// without slippage protection
+var max64x64 = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 127), big.NewInt(1))
+
+// SubmittedOrder is an order reported via OrdersSubmitted
+type SubmittedOrder struct {
+	OrderId       string
+	ChainId       int64
+	PerpetualId   int64
+	TraderAddr    string
+	FAmount       string
+	FLimitPrice   string
+	FTriggerPrice string
+}
+
+// Notional returns |amount| x mark price of the order in quote currency.
+// The order prices are chosen by the client and not used. False if the
+// amount or the price is invalid
+func (o SubmittedOrder) Notional(markPrice float64) (float64, bool) {
+	amount, ok := new(big.Int).SetString(o.FAmount, 10)
+	if !ok || amount.Sign() == 0 || markPrice <= 0 {
+		return 0, false
+	}
+	return d8xUtils.ABDKToFloat64(amount.Abs(amount)) * markPrice, true
+}
+
+func volumeTag(chainId int64, trader string) string {
+	return "{" + strconv.FormatInt(chainId, 10) + ":" + strings.ToLower(trader) + "}"
+}
+
+func volumeKey(chainId int64, trader string) string {
+	return VOLUME_REDIS + ":" + volumeTag(chainId, trader)
+}
+
+func volumeDay(ts time.Time) int64 {
+	return ts.Unix() / 86400
+}
+
+// addVolumeScript counts an order once: it marks the order KEYS[1] as
+// counted and adds the notional to the day of the trader volume KEYS[2].
+// Days before the window are pruned. ARGV: day, notional, ttl in seconds,
+// first day of the window. Returns 0 if the order was already counted
+var addVolumeScript = rueidis.NewLuaScript(`
+if not redis.call('SET', KEYS[1], '1', 'NX', 'EX', ARGV[3]) then
+	return 0
+end
+redis.call('HINCRBYFLOAT', KEYS[2], ARGV[1], ARGV[2])
+redis.call('EXPIRE', KEYS[2], ARGV[3])
+local first = tonumber(ARGV[4])
+for _, d in ipairs(redis.call('HKEYS', KEYS[2])) do
+	local n = tonumber(d)
+	if n == nil or n < first then
+		redis.call('HDEL', KEYS[2], d)
+	end
+end
+return 1
+`)
+
+// AddTraderVolume adds the notional of the order to the volume of the trader
+// on the day of ts. Orders are counted once
+func (r *RueidisClient) AddTraderVolume(order SubmittedOrder, notional float64, ts time.Time) error {
+	client := *r.Client
+	day := volumeDay(ts)
+	return addVolumeScript.Exec(r.Ctx, client,
+		[]string{
+			VOLUME_SEEN_REDIS + ":" + volumeTag(order.ChainId, order.TraderAddr) + ":" + order.OrderId,
+			volumeKey(order.ChainId, order.TraderAddr),
+		},
+		[]string{
+			strconv.FormatInt(day, 10),
+			strconv.FormatFloat(notional, 'f', -1, 64),
+			strconv.FormatInt((VOLUME_WINDOW_DAYS+1)*86400, 10),
+			strconv.FormatInt(day-VOLUME_WINDOW_DAYS+1, 10),
+		}).Error()
+}
+
+// TraderVolume returns the notional volume of the trader on the chain over
+// the last VOLUME_WINDOW_DAYS days (including the current day)
+func (r *RueidisClient) TraderVolume(chainId int64, trader string, now time.Time) (float64, error) {
+	client := *r.Client
+	hm, err := client.Do(r.Ctx, client.B().Hgetall().Key(volumeKey(chainId, trader)).Build()).AsStrMap()
+	if err != nil && !rueidis.IsRedisNil(err) {
+		return 0, err
+	}
+	today := volumeDay(now)
+	var vol float64
+	for d, v := range hm {
+		day, err := strconv.ParseInt(d, 10, 64)
+		if err != nil || day <= today-VOLUME_WINDOW_DAYS || day > today {
+			continue
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, errors.New("invalid volume " + v)
+		}
+		vol += f
+	}
+	return vol, nil
+}
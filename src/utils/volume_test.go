@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	d8xUtils "github.com/D8-X/d8x-futures-go-sdk/utils"
+)
+
+func TestOrderNotional(t *testing.T) {
+	abdk := func(x float64) string { return d8xUtils.Float64ToABDK(x).String() }
+	for _, tc := range []struct {
+		o        SubmittedOrder
+		px       float64
+		notional float64
+		ok       bool
+	}{
+		// the limit price of the client is not used
+		{SubmittedOrder{FAmount: abdk(-2), FLimitPrice: abdk(1e9)}, 3000, 6000, true},
+		// market orders without slippage limit are counted
+		{SubmittedOrder{FAmount: abdk(0.5), FLimitPrice: max64x64.String(), FTriggerPrice: "0"}, 100, 50, true},
+		{SubmittedOrder{FAmount: abdk(1)}, 0, 0, false},
+		{SubmittedOrder{FAmount: "0"}, 100, 0, false},
+		{SubmittedOrder{FAmount: "x"}, 100, 0, false},
+	} {
+		n, ok := tc.o.Notional(tc.px)
+		if ok != tc.ok || math.Abs(n-tc.notional) > 1e-6 {
+			t.Errorf("%+v: got %v %v, expected %v %v", tc.o, n, ok, tc.notional, tc.ok)
+		}
+	}
+}
+
+func TestTraderVolume(t *testing.T) {
+	r, _ := newTestRedis(t)
+	trader := "0x9d5aaB428e98678d0E645ea4AeBd25f744341a05"
+	now := time.Date(2024, 6, 30, 12, 0, 0, 0, time.UTC)
+	order := func(id string, chainId int64) SubmittedOrder {
+		return SubmittedOrder{OrderId: id, ChainId: chainId, TraderAddr: trader}
+	}
+	for _, tc := range []struct {
+		o        SubmittedOrder
+		notional float64
+		ts       time.Time
+	}{
+		{order("a", 42161), 100, now.AddDate(0, 0, -40)},
+		{order("b", 42161), 200, now.AddDate(0, 0, -29)},
+		{order("c", 42161), 300, now},
+		// counted once
+		{order("c", 42161), 300, now},
+		{order("d", 1101), 1000, now},
+	} {
+		if err := r.AddTraderVolume(tc.o, tc.notional, tc.ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vol, err := r.TraderVolume(42161, trader, now)
+	if err != nil || vol != 500 {
+		t.Errorf("unexpected volume %v %v", vol, err)
+	}
+	// the window rolls
+	if vol, _ = r.TraderVolume(42161, trader, now.AddDate(0, 0, 1)); vol != 300 {
+		t.Errorf("unexpected volume next day %v", vol)
+	}
+	if vol, _ = r.TraderVolume(1101, trader, now); vol != 1000 {
+		t.Errorf("unexpected volume on chain 1101 %v", vol)
+	}
+	if vol, _ = r.TraderVolume(42161, "0x0000000000000000000000000000000000000001", now); vol != 0 {
+		t.Errorf("unexpected volume of unknown trader %v", vol)
+	}
+}
+
+type countingPrices struct {
+	queries int
+}
+
+func (s *countingPrices) MarkPrice(ctx context.Context, chainId int64, perpetualId int32) (float64, error) {
+	s.queries++
+	return 3000, nil
+}
+
+func TestMarkPriceCache(t *testing.T) {
+	src := &countingPrices{}
+	c := NewMarkPriceCache(src)
+	for k := 0; k < 2; k++ {
+		if px, err := c.MarkPrice(context.Background(), 42161, 100001); err != nil || px != 3000 {
+			t.Fatalf("unexpected price %v, %v", px, err)
+		}
+	}
+	c.MarkPrice(context.Background(), 42161, 100002)
+	if src.queries != 2 {
+		t.Errorf("expected 1 query per perpetual, got %d", src.queries)
+	}
+}
@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// time to wait for further file events before reloading
+const RELOAD_DEBOUNCE = 500 * time.Millisecond
+
+// k8s config map volumes swap the symlink ..data to the new files, the
+// files in the volume are symlinks into ..data
+const configMapDataLink = "..data"
+
+// WatchConfigFiles calls reload whenever one of the files changes or the
+// process receives SIGHUP, until ctx is done. The parent directories are
+// watched so that atomic replacements by editors and k8s config map updates
+// (swap of ..data in the directory of a file) are detected
+func WatchConfigFiles(ctx context.Context, files []string, reload func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	files = append([]string(nil), files...)
+	watched := make(map[string]bool)
+	for k, f := range files {
+		f, err = filepath.Abs(f)
+		if err != nil {
+			watcher.Close()
+			return err
+		}
+		files[k] = f
+		dir := filepath.Dir(f)
+		if watched[dir] {
+			continue
+		}
+		err = watcher.Add(dir)
+		if err != nil {
+			watcher.Close()
+			return err
+		}
+		watched[dir] = true
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer watcher.Close()
+		defer signal.Stop(hup)
+		var debounce <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				slog.Info("SIGHUP received, reloading config")
+				reload()
+			case ev, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !isWatchedFile(ev.Name, files, watched) || ev.Op == fsnotify.Chmod {
+					continue
+				}
+				debounce = time.After(RELOAD_DEBOUNCE)
+			case <-debounce:
+				slog.Info("config file changed, reloading config")
+				reload()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Error("config watcher: " + err.Error())
+			}
+		}
+	}()
+	return nil
+}
+
+// isWatchedFile reports whether the event on name concerns one of the
+// files, including a config map update in one of the watched directories
+func isWatchedFile(name string, files []string, dirs map[string]bool) bool {
+	name = filepath.Clean(name)
+	if filepath.Base(name) == configMapDataLink && dirs[filepath.Dir(name)] {
+		return true
+	}
+	for _, f := range files {
+		if name == f {
+			return true
+		}
+	}
+	return false
+}
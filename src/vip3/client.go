@@ -0,0 +1,335 @@
+package vip3
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/D8-X/d8x-broker-server/src/metrics"
+	"golang.org/x/sync/singleflight"
+)
+
+const DEFAULT_API_URL = "https://dappapi.vip3.io/api/v1/sbt/info"
+
+// Defaults of Config
+const (
+	DEFAULT_TIMEOUT           = 3 * time.Second
+	DEFAULT_RETRIES           = 2
+	DEFAULT_RETRY_BACKOFF     = 200 * time.Millisecond
+	DEFAULT_BREAKER_THRESHOLD = 5
+	DEFAULT_BREAKER_COOLDOWN  = 30 * time.Second
+	DEFAULT_EXPIRY            = 7 * 24 * time.Hour
+	DEFAULT_ZERO_EXPIRY       = time.Hour
+	DEFAULT_ERROR_EXPIRY      = time.Minute
+	DEFAULT_REFRESH_AHEAD     = 24 * time.Hour
+)
+
+// maximal size of an API response
+const maxResponseSize = 64 << 10
+
+var ErrCircuitOpen = errors.New("vip3 api circuit open")
+
+// Config of the VIP3 client. Zero values are replaced by the defaults,
+// except Retries
+type Config struct {
+	// url of the sbt info endpoint
+	BaseUrl string
+	// timeout per request
+	Timeout time.Duration
+	// retries after failed requests, with exponential backoff
+	Retries      int
+	RetryBackoff time.Duration
+	// consecutive failed lookups that open the circuit, and the time the
+	// circuit stays open before a trial request
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	// cache expiry of levels, of level 0 and of failed lookups
+	Expiry      time.Duration
+	ZeroExpiry  time.Duration
+	ErrorExpiry time.Duration
+	// cached levels expiring within RefreshAhead are refreshed in the background
+	RefreshAhead time.Duration
+}
+
+// DefaultConfig returns the default config of the VIP3 client
+func DefaultConfig() Config {
+	return Config{Retries: DEFAULT_RETRIES}.withDefaults()
+}
+
+func (c Config) withDefaults() Config {
+	if c.BaseUrl == "" {
+		c.BaseUrl = DEFAULT_API_URL
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = DEFAULT_TIMEOUT
+	}
+	if c.Retries < 0 {
+		c.Retries = 0
+	}
+	if c.RetryBackoff <= 0 {
+		c.RetryBackoff = DEFAULT_RETRY_BACKOFF
+	}
+	if c.BreakerThreshold <= 0 {
+		c.BreakerThreshold = DEFAULT_BREAKER_THRESHOLD
+	}
+	if c.BreakerCooldown <= 0 {
+		c.BreakerCooldown = DEFAULT_BREAKER_COOLDOWN
+	}
+	if c.Expiry <= 0 {
+		c.Expiry = DEFAULT_EXPIRY
+	}
+	if c.ZeroExpiry <= 0 {
+		c.ZeroExpiry = DEFAULT_ZERO_EXPIRY
+	}
+	if c.ErrorExpiry <= 0 {
+		c.ErrorExpiry = DEFAULT_ERROR_EXPIRY
+	}
+	if c.RefreshAhead <= 0 {
+		c.RefreshAhead = DEFAULT_REFRESH_AHEAD
+	}
+	return c
+}
+
+// Cache stores VIP3 levels with expiry. ttl is the remaining time to live
+// of a cached level
+type Cache interface {
+	Vip3Level(trader string) (level int, ttl time.Duration, found bool, err error)
+	SetVip3Level(trader string, level int, ttl time.Duration) error
+}
+
+type Response struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+	Data struct {
+		Level int `json:"level"`
+	} `json:"data"`
+}
+
+// Client looks up VIP3 levels of traders. Levels are cached, concurrent
+// lookups of a trader are deduplicated and the API is not queried while
+// the circuit breaker is open
+type Client struct {
+	conf  Config
+	http  *http.Client
+	cache Cache
+	group singleflight.Group
+
+	mu       sync.Mutex
+	failures int
+	openTill time.Time
+	// failed lookups, trader -> expiry
+	errs map[string]time.Time
+	// last sweep of expired errs
+	swept time.Time
+}
+
+// NewClient creates a VIP3 client. cache can be nil
+func NewClient(conf Config, cache Cache) *Client {
+	conf = conf.withDefaults()
+	return &Client{
+		conf:  conf,
+		http:  &http.Client{Timeout: conf.Timeout},
+		cache: cache,
+		errs:  make(map[string]time.Time),
+	}
+}
+
+// Level returns the VIP3 level of the trader, from cache if available
+func (c *Client) Level(ctx context.Context, trader string) (int, error) {
+	trader = strings.ToLower(trader)
+	if c.cache != nil {
+		lvl, ttl, found, err := c.cache.Vip3Level(trader)
+		if err != nil {
+			slog.Error("reading vip3 cache: " + err.Error())
+		}
+		if found {
+			metrics.Vip3Lookups.WithLabelValues(metrics.RESULT_HIT).Inc()
+			if lvl > 0 && ttl < c.conf.RefreshAhead {
+				go c.refresh(trader)
+			}
+			return lvl, nil
+		}
+	}
+	if c.failedRecently(trader) {
+		metrics.Vip3Lookups.WithLabelValues(metrics.RESULT_ERROR).Inc()
+		return 0, errors.New("vip3 lookup of " + trader + " failed recently")
+	}
+	ch := c.group.DoChan(trader, func() (any, error) {
+		// detached from the request, the result is shared and cached
+		return c.lookup(context.Background(), trader)
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			metrics.Vip3Lookups.WithLabelValues(metrics.RESULT_ERROR).Inc()
+			return 0, res.Err
+		}
+		metrics.Vip3Lookups.WithLabelValues(metrics.RESULT_MISS).Inc()
+		return res.Val.(int), nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// refresh looks up the level before the cached level expires
+func (c *Client) refresh(trader string) {
+	_, err, _ := c.group.Do(trader, func() (any, error) {
+		return c.lookup(context.Background(), trader)
+	})
+	if err != nil {
+		slog.Info("refreshing vip3 level of " + trader + ": " + err.Error())
+	}
+}
+
+// lookup queries the API and caches the result
+func (c *Client) lookup(ctx context.Context, trader string) (int, error) {
+	lvl, err := c.Fetch(ctx, trader)
+	if err != nil {
+		c.mu.Lock()
+		now := time.Now()
+		c.sweepErrs(now)
+		c.errs[trader] = now.Add(c.conf.ErrorExpiry)
+		c.mu.Unlock()
+		return 0, err
+	}
+	if c.cache != nil {
+		ttl := c.conf.Expiry
+		if lvl == 0 {
+			ttl = c.conf.ZeroExpiry
+		}
+		err = c.cache.SetVip3Level(trader, lvl, ttl)
+		if err != nil {
+			slog.Error("storing vip3 level of " + trader + ": " + err.Error())
+		}
+	}
+	return lvl, nil
+}
+
+// sweepErrs removes expired failed lookups, at most once per error expiry,
+// so traders that are not looked up again do not accumulate. Requires c.mu
+func (c *Client) sweepErrs(now time.Time) {
+	if now.Sub(c.swept) < c.conf.ErrorExpiry {
+		return
+	}
+	c.swept = now
+	for trader, expiry := range c.errs {
+		if now.After(expiry) {
+			delete(c.errs, trader)
+		}
+	}
+}
+
+func (c *Client) failedRecently(trader string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	expiry, exists := c.errs[trader]
+	if exists && now.After(expiry) {
+		delete(c.errs, trader)
+		return false
+	}
+	return exists
+}
+
+// Fetch queries the level from the API with retries, bypassing the cache
+func (c *Client) Fetch(ctx context.Context, trader string) (int, error) {
+	if !c.allow() {
+		return 0, ErrCircuitOpen
+	}
+	var lvl int
+	var err error
+	for trial := 0; trial <= c.conf.Retries; trial++ {
+		if trial > 0 {
+			select {
+			case <-time.After(c.conf.RetryBackoff << (trial - 1)):
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			}
+		}
+		var retry bool
+		lvl, retry, err = c.fetch(ctx, trader)
+		if err == nil || !retry {
+			break
+		}
+	}
+	c.record(err == nil)
+	if err != nil {
+		return 0, errors.New("vip3 api: " + err.Error())
+	}
+	return lvl, nil
+}
+
+// fetch sends one request, retry is true for errors that can be retried
+func (c *Client) fetch(ctx context.Context, trader string) (int, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.conf.BaseUrl+"?addr="+url.QueryEscape(trader), nil)
+	if err != nil {
+		return 0, false, err
+	}
+	response, err := c.http.Do(req)
+	if err != nil {
+		return 0, true, err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxResponseSize))
+	if err != nil {
+		return 0, true, err
+	}
+	if response.StatusCode != http.StatusOK {
+		retry := response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests
+		return 0, retry, fmt.Errorf("status %d", response.StatusCode)
+	}
+	var v Response
+	err = json.Unmarshal(body, &v)
+	if err != nil {
+		return 0, false, err
+	}
+	if v.Code != 0 {
+		// not a level 0, which would be cached
+		return 0, false, fmt.Errorf("code %d: %s", v.Code, v.Msg)
+	}
+	return v.Data.Level, false, nil
+}
+
+// allow checks the circuit breaker. After the cooldown, one trial request
+// is allowed until its result is recorded
+func (c *Client) allow() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failures < c.conf.BreakerThreshold {
+		return true
+	}
+	now := time.Now()
+	if now.Before(c.openTill) {
+		return false
+	}
+	// half-open: block other requests during the trial
+	c.openTill = now.Add(c.conf.Timeout * time.Duration(c.conf.Retries+1))
+	return true
+}
+
+func (c *Client) record(success bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if success {
+		if c.failures >= c.conf.BreakerThreshold {
+			slog.Info("vip3 api circuit closed")
+		}
+		c.failures = 0
+		return
+	}
+	c.failures++
+	if c.failures >= c.conf.BreakerThreshold {
+		if c.failures == c.conf.BreakerThreshold {
+			slog.Warn("vip3 api circuit open")
+		}
+		c.openTill = time.Now().Add(c.conf.BreakerCooldown)
+	}
+}
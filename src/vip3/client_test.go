@@ -0,0 +1,285 @@
+package vip3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type cacheEntry struct {
+	lvl    int
+	expiry time.Time
+}
+
+type memCache struct {
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+func newMemCache() *memCache {
+	return &memCache{entries: make(map[string]cacheEntry)}
+}
+
+func (m *memCache) Vip3Level(trader string) (int, time.Duration, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, exists := m.entries[trader]
+	if !exists || time.Now().After(e.expiry) {
+		return 0, 0, false, nil
+	}
+	return e.lvl, time.Until(e.expiry), true, nil
+}
+
+func (m *memCache) SetVip3Level(trader string, lvl int, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[trader] = cacheEntry{lvl, time.Now().Add(ttl)}
+	return nil
+}
+
+func (m *memCache) ttl(trader string) time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return time.Until(m.entries[trader].expiry)
+}
+
+// fakeApi answers with the stored status, code and level and counts
+// requests
+type fakeApi struct {
+	calls  atomic.Int64
+	status atomic.Int64
+	code   atomic.Int64
+	level  atomic.Int64
+	delay  time.Duration
+}
+
+func newFakeApi(t *testing.T, delay time.Duration) (*fakeApi, *httptest.Server) {
+	f := &fakeApi{delay: delay}
+	f.status.Store(http.StatusOK)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.calls.Add(1)
+		time.Sleep(f.delay)
+		if status := int(f.status.Load()); status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		fmt.Fprintf(w, `{"code":%d,"msg":"ok","data":{"level":%d}}`, f.code.Load(), f.level.Load())
+	}))
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func testConfig(url string) Config {
+	return Config{
+		BaseUrl:          url,
+		Timeout:          200 * time.Millisecond,
+		Retries:          1,
+		RetryBackoff:     time.Millisecond,
+		BreakerThreshold: 2,
+		BreakerCooldown:  100 * time.Millisecond,
+		ErrorExpiry:      50 * time.Millisecond,
+	}
+}
+
+const trader = "0x9d5aab428e98678d0e645ea4aebd25f744341a05"
+
+func TestClientCache(t *testing.T) {
+	f, srv := newFakeApi(t, 0)
+	f.level.Store(2)
+	cache := newMemCache()
+	c := NewClient(testConfig(srv.URL), cache)
+	for k := 0; k < 3; k++ {
+		lvl, err := c.Level(context.Background(), trader)
+		if err != nil || lvl != 2 {
+			t.Fatalf("level %d, %v", lvl, err)
+		}
+	}
+	if n := f.calls.Load(); n != 1 {
+		t.Fatalf("expected 1 api call, got %d", n)
+	}
+	if ttl := cache.ttl(trader); ttl < DEFAULT_EXPIRY-time.Minute {
+		t.Fatalf("expected expiry of a week, got %s", ttl)
+	}
+	// level 0 is cached shortly
+	f.level.Store(0)
+	other := "0x0ab6527027ecff1144dec3d78154fce309ac838c"
+	lvl, err := c.Level(context.Background(), other)
+	if err != nil || lvl != 0 {
+		t.Fatalf("level %d, %v", lvl, err)
+	}
+	if ttl := cache.ttl(other); ttl > DEFAULT_ZERO_EXPIRY {
+		t.Fatalf("expected expiry of an hour, got %s", ttl)
+	}
+}
+
+func TestClientTimeoutAndRetries(t *testing.T) {
+	f, srv := newFakeApi(t, 300*time.Millisecond)
+	c := NewClient(testConfig(srv.URL), nil)
+	t0 := time.Now()
+	_, err := c.Level(context.Background(), trader)
+	if err == nil {
+		t.Fatal("expected timeout")
+	}
+	if d := time.Since(t0); d > time.Second {
+		t.Fatalf("lookup took %s", d)
+	}
+	// the request and one retry
+	if n := f.calls.Load(); n != 2 {
+		t.Fatalf("expected 2 api calls, got %d", n)
+	}
+
+	// client errors are not retried
+	f, srv = newFakeApi(t, 0)
+	f.status.Store(http.StatusBadRequest)
+	c = NewClient(testConfig(srv.URL), nil)
+	_, err = c.Fetch(context.Background(), trader)
+	if err == nil || f.calls.Load() != 1 {
+		t.Fatalf("expected 1 failed call, got %d, %v", f.calls.Load(), err)
+	}
+}
+
+func TestClientNegativeCache(t *testing.T) {
+	f, srv := newFakeApi(t, 0)
+	f.status.Store(http.StatusInternalServerError)
+	conf := testConfig(srv.URL)
+	conf.BreakerThreshold = 100
+	c := NewClient(conf, newMemCache())
+	for k := 0; k < 5; k++ {
+		if _, err := c.Level(context.Background(), trader); err == nil {
+			t.Fatal("expected error")
+		}
+	}
+	if n := f.calls.Load(); n != 2 {
+		t.Fatalf("expected 2 api calls, got %d", n)
+	}
+	// retried after the error expiry
+	f.status.Store(http.StatusOK)
+	f.level.Store(3)
+	time.Sleep(conf.ErrorExpiry)
+	lvl, err := c.Level(context.Background(), trader)
+	if err != nil || lvl != 3 {
+		t.Fatalf("level %d, %v", lvl, err)
+	}
+}
+
+func TestClientErrorPayload(t *testing.T) {
+	f, srv := newFakeApi(t, 0)
+	f.code.Store(500)
+	cache := newMemCache()
+	c := NewClient(testConfig(srv.URL), cache)
+	// an error with status 200 is no level 0
+	if _, err := c.Level(context.Background(), trader); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, _, found, _ := cache.Vip3Level(trader); found {
+		t.Error("error payload cached as level")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.errs[trader]; !exists || c.failures != 1 {
+		t.Errorf("error payload not counted as failure: %v, %d failures", c.errs, c.failures)
+	}
+}
+
+func TestClientErrorSweep(t *testing.T) {
+	f, srv := newFakeApi(t, 0)
+	f.status.Store(http.StatusInternalServerError)
+	conf := testConfig(srv.URL)
+	conf.BreakerThreshold = 100
+	c := NewClient(conf, nil)
+	other := "0x0ab6527027ecff1144dec3d78154fce309ac838c"
+	c.Level(context.Background(), trader)
+	time.Sleep(conf.ErrorExpiry)
+	// failed lookups of traders that are not looked up again are removed
+	c.Level(context.Background(), other)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.errs[trader]; exists || len(c.errs) != 1 {
+		t.Errorf("expired failed lookups kept %v", c.errs)
+	}
+}
+
+func TestClientBreaker(t *testing.T) {
+	f, srv := newFakeApi(t, 0)
+	f.status.Store(http.StatusServiceUnavailable)
+	conf := testConfig(srv.URL)
+	conf.Retries = 0
+	c := NewClient(conf, nil)
+	for k := 0; k < conf.BreakerThreshold; k++ {
+		if _, err := c.Fetch(context.Background(), trader); err == nil {
+			t.Fatal("expected error")
+		}
+	}
+	_, err := c.Fetch(context.Background(), trader)
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected open circuit, got %v", err)
+	}
+	if n := f.calls.Load(); n != int64(conf.BreakerThreshold) {
+		t.Fatalf("expected %d api calls, got %d", conf.BreakerThreshold, n)
+	}
+	// trial request after the cooldown closes the circuit
+	f.status.Store(http.StatusOK)
+	f.level.Store(1)
+	time.Sleep(conf.BreakerCooldown)
+	lvl, err := c.Fetch(context.Background(), trader)
+	if err != nil || lvl != 1 {
+		t.Fatalf("level %d, %v", lvl, err)
+	}
+	if _, err = c.Fetch(context.Background(), trader); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientSingleFlight(t *testing.T) {
+	f, srv := newFakeApi(t, 50*time.Millisecond)
+	f.level.Store(4)
+	c := NewClient(testConfig(srv.URL), newMemCache())
+	var wg sync.WaitGroup
+	for k := 0; k < 20; k++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lvl, err := c.Level(context.Background(), trader)
+			if err != nil || lvl != 4 {
+				t.Errorf("level %d, %v", lvl, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := f.calls.Load(); n != 1 {
+		t.Fatalf("expected 1 api call, got %d", n)
+	}
+}
+
+func TestClientRefreshAhead(t *testing.T) {
+	f, srv := newFakeApi(t, 0)
+	f.level.Store(3)
+	cache := newMemCache()
+	cache.SetVip3Level(trader, 2, time.Hour)
+	c := NewClient(testConfig(srv.URL), cache)
+	// the cached level is returned and refreshed in the background
+	lvl, err := c.Level(context.Background(), trader)
+	if err != nil || lvl != 2 {
+		t.Fatalf("level %d, %v", lvl, err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		lvl, _, _, _ = cache.Vip3Level(trader)
+		if lvl == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("level not refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ttl := cache.ttl(trader); ttl < DEFAULT_EXPIRY-time.Minute {
+		t.Fatalf("expected expiry of a week, got %s", ttl)
+	}
+}